@@ -0,0 +1,439 @@
+package tuna
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nknorg/nkn/v2/common"
+)
+
+const (
+	adminUnixPrefix     = "unix:"
+	adminBalanceTimeout = 5 * time.Second
+	// AdminHeader has to be set to any value by POST requests of the admin
+	// API, so that a web page can't send them without a CORS preflight.
+	AdminHeader = "X-Tuna-Admin"
+)
+
+// ServiceBytes is the traffic of a service.
+type ServiceBytes struct {
+	EntryToExit uint64 `json:"entryToExit"`
+	ExitToEntry uint64 `json:"exitToEntry"`
+}
+
+// EntryStatus is the runtime status of an entry reported by the admin API.
+type EntryStatus struct {
+	Service          string                `json:"service"`
+	Reverse          bool                  `json:"reverse"`
+	Connected        bool                  `json:"connected"`
+	RemoteAddress    string                `json:"remoteAddress,omitempty"`
+	RemoteIP         string                `json:"remoteIP,omitempty"`
+	EntryToExitPrice string                `json:"entryToExitPrice"`
+	ExitToEntryPrice string                `json:"exitToEntryPrice"`
+	Streams          int                   `json:"streams"`
+	Bytes            ServiceBytes          `json:"bytes"`
+	NanoPaySent      string                `json:"nanoPaySent"`
+	NanoPayClaimed   string                `json:"nanoPayClaimed"`
+	Subscriptions    []*SubscriptionStatus `json:"subscriptions,omitempty"`
+}
+
+// ExitServiceStatus is the status of a service provided by an exit.
+type ExitServiceStatus struct {
+	Price string       `json:"price"`
+	Bytes ServiceBytes `json:"bytes"`
+}
+
+// ExitStatus is the runtime status of an exit reported by the admin API.
+type ExitStatus struct {
+	Reverse        bool                          `json:"reverse"`
+	RemoteAddress  string                        `json:"remoteAddress,omitempty"` // reverse entry
+	Services       map[string]*ExitServiceStatus `json:"services"`
+	Sessions       int                           `json:"sessions"`
+	Streams        int                           `json:"streams"`
+	Draining       bool                          `json:"draining"`
+	NanoPaySent    string                        `json:"nanoPaySent"`
+	NanoPayClaimed string                        `json:"nanoPayClaimed"`
+	Subscriptions  []*SubscriptionStatus         `json:"subscriptions,omitempty"`
+}
+
+// WalletStatus is the balance of a wallet used by entries or exits.
+type WalletStatus struct {
+	Address string `json:"address"`
+	Balance string `json:"balance,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AdminStatus is returned by GET /status of the admin API.
+type AdminStatus struct {
+	Wallets []*WalletStatus `json:"wallets"`
+	Entries []*EntryStatus  `json:"entries"`
+	Exits   []*ExitStatus   `json:"exits"`
+}
+
+func (c *Common) paymentTotals() (string, string) {
+	sent := common.Fixed64(atomic.LoadInt64(&c.nanoPaySent))
+	claimed := common.Fixed64(atomic.LoadInt64(&c.nanoPayClaimed))
+	return sent.String(), claimed.String()
+}
+
+// GetServiceBytes returns bytes transferred for the service of the entry.
+func (te *TunaEntry) GetServiceBytes() ServiceBytes {
+	te.paymentsLock.Lock()
+	defer te.paymentsLock.Unlock()
+	b := ServiceBytes{
+		EntryToExit: atomic.LoadUint64(&te.bytesEntryToExit) + atomic.LoadUint64(&te.reverseBytesEntryToExit),
+		ExitToEntry: atomic.LoadUint64(&te.bytesExitToEntry) + atomic.LoadUint64(&te.reverseBytesExitToEntry),
+	}
+	for p := range te.payments {
+		b.EntryToExit += atomic.LoadUint64(&p.bytesEntryToExit)
+		b.ExitToEntry += atomic.LoadUint64(&p.bytesExitToEntry)
+	}
+	return b
+}
+
+func (te *TunaEntry) Status() *EntryStatus {
+	entryToExitPrice, exitToEntryPrice := te.GetPrice()
+	s := &EntryStatus{
+		Service:          te.Service.Name,
+		Reverse:          te.Reverse,
+		Connected:        te.GetConnected(),
+		RemoteAddress:    te.GetRemoteNknAddress(),
+		EntryToExitPrice: entryToExitPrice.String(),
+		ExitToEntryPrice: exitToEntryPrice.String(),
+		Streams:          te.GetNumActiveSessions() / 2,
+		Bytes:            te.GetServiceBytes(),
+		Subscriptions:    te.Subscriptions.Status(),
+	}
+	if metadata := te.GetMetadata(); metadata != nil {
+		s.RemoteIP = metadata.Ip
+	}
+	s.NanoPaySent, s.NanoPayClaimed = te.paymentTotals()
+	return s
+}
+
+func (te *TunaExit) Status() *ExitStatus {
+	s := &ExitStatus{
+		Reverse:       te.config.Reverse,
+		Services:      make(map[string]*ExitServiceStatus, len(te.services)),
+		Sessions:      te.GetNumSessions(),
+		Streams:       te.GetNumActiveSessions() / 2,
+		Draining:      te.IsDraining(),
+		Subscriptions: te.Subscriptions.Status(),
+	}
+	if te.config.Reverse {
+		s.RemoteAddress = te.GetRemoteNknAddress()
+	}
+	bytes := te.GetServiceBytes()
+	te.servicesLock.RLock()
+	for _, service := range te.services {
+		serviceInfo, ok := te.config.Services[service.Name]
+		if !ok {
+			continue
+		}
+		s.Services[service.Name] = &ExitServiceStatus{
+			Price: serviceInfo.Price,
+			Bytes: bytes[service.Name],
+		}
+	}
+	te.servicesLock.RUnlock()
+	s.NanoPaySent, s.NanoPayClaimed = te.paymentTotals()
+	return s
+}
+
+// Reconnect measures exits again and moves new streams to the best one, which
+// can be the current exit. Existing streams are drained on the old session.
+func (te *TunaEntry) Reconnect(ctx context.Context) error {
+	if !te.canMigrate() {
+		return errors.New("entry can't switch exit")
+	}
+	return te.migrate(ctx, false, nil)
+}
+
+// SwitchNode moves new streams to the exit with NKN address addr if it passes
+// the price, NKN and IP filters of the entry.
+func (te *TunaEntry) SwitchNode(ctx context.Context, addr string) error {
+	if !te.canMigrate() {
+		return errors.New("entry can't switch exit")
+	}
+	metadata, err := te.Discovery.GetContext(ctx, te.SubscriptionPrefix+te.Service.Name, addr)
+	if err != nil {
+		return err
+	}
+	nodes, rejected, err := te.filterSubscribersWithReasons([]string{addr}, map[string]string{addr: metadata})
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		if len(rejected) > 0 {
+			return fmt.Errorf("%s is rejected: %s", addr, rejected[0].Rejected)
+		}
+		return fmt.Errorf("%s is rejected", addr)
+	}
+	return te.switchExit(ctx, nodes[0])
+}
+
+// AdminServer serves the admin API of entries and exits in the process:
+//
+//	GET  /status                                 AdminStatus
+//	POST /entries/reconnect?service=<name>       measure exits again and move to the best one
+//	POST /entries/switch?service=<name>&address=<address>
+//	POST /exits/drain?draining=<true|false>      advertise exits as draining, default true
+//
+// service selects entries of a service, or all entries if empty. Entries and
+// exits are added when created and removed when closed. Requests need a
+// localhost Host header, and POST requests need AdminHeader.
+type AdminServer struct {
+	sync.RWMutex
+	entries map[*TunaEntry]struct{}
+	exits   map[*TunaExit]struct{}
+}
+
+// DefaultAdmin is shared by all entries and exits in the process.
+var DefaultAdmin = NewAdminServer()
+
+func NewAdminServer() *AdminServer {
+	return &AdminServer{
+		entries: make(map[*TunaEntry]struct{}),
+		exits:   make(map[*TunaExit]struct{}),
+	}
+}
+
+func (a *AdminServer) AddEntry(te *TunaEntry) {
+	a.Lock()
+	defer a.Unlock()
+	a.entries[te] = struct{}{}
+}
+
+func (a *AdminServer) RemoveEntry(te *TunaEntry) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.entries, te)
+}
+
+func (a *AdminServer) AddExit(te *TunaExit) {
+	a.Lock()
+	defer a.Unlock()
+	a.exits[te] = struct{}{}
+}
+
+func (a *AdminServer) RemoveExit(te *TunaExit) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.exits, te)
+}
+
+// Entries returns entries of service, or all entries if service is empty.
+func (a *AdminServer) Entries(service string) []*TunaEntry {
+	a.RLock()
+	defer a.RUnlock()
+	entries := make([]*TunaEntry, 0, len(a.entries))
+	for te := range a.entries {
+		if len(service) == 0 || te.Service.Name == service {
+			entries = append(entries, te)
+		}
+	}
+	return entries
+}
+
+func (a *AdminServer) Exits() []*TunaExit {
+	a.RLock()
+	defer a.RUnlock()
+	exits := make([]*TunaExit, 0, len(a.exits))
+	for te := range a.exits {
+		exits = append(exits, te)
+	}
+	return exits
+}
+
+func (a *AdminServer) Status(ctx context.Context) *AdminStatus {
+	status := &AdminStatus{
+		Wallets: make([]*WalletStatus, 0),
+		Entries: make([]*EntryStatus, 0),
+		Exits:   make([]*ExitStatus, 0),
+	}
+	wallets := make(map[string]*Common)
+	for _, te := range a.Entries("") {
+		status.Entries = append(status.Entries, te.Status())
+		wallets[te.Wallet.Address()] = te.Common
+	}
+	for _, te := range a.Exits() {
+		status.Exits = append(status.Exits, te.Status())
+		wallets[te.Wallet.Address()] = te.Common
+	}
+	for addr, c := range wallets {
+		w := &WalletStatus{Address: addr}
+		ctx, cancel := context.WithTimeout(ctx, adminBalanceTimeout)
+		balance, err := c.Client.BalanceContext(ctx)
+		cancel()
+		if err != nil {
+			w.Error = err.Error()
+		} else {
+			w.Balance = balance.String()
+		}
+		status.Wallets = append(status.Wallets, w)
+	}
+	return status
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// a DNS rebinding page has its own host name
+	if !isLoopbackHost(r.Host) {
+		http.Error(w, "forbidden host", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPost && len(r.Header.Get(AdminHeader)) == 0 {
+		http.Error(w, AdminHeader+" header is required", http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/status":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, a.Status(r.Context()))
+	case "/entries/reconnect", "/entries/switch":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		address := r.URL.Query().Get("address")
+		if r.URL.Path == "/entries/switch" && len(address) == 0 {
+			http.Error(w, "address is required", http.StatusBadRequest)
+			return
+		}
+		entries := a.Entries(r.URL.Query().Get("service"))
+		if len(entries) == 0 {
+			http.Error(w, "no entry found", http.StatusNotFound)
+			return
+		}
+		errs := make([]string, 0)
+		for _, te := range entries {
+			var err error
+			if len(address) > 0 {
+				err = te.SwitchNode(r.Context(), address)
+			} else {
+				err = te.Reconnect(r.Context())
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", te.Service.Name, err))
+			}
+		}
+		if len(errs) > 0 {
+			http.Error(w, strings.Join(errs, "\n"), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, a.Status(r.Context()))
+	case "/exits/drain":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		draining := true
+		if v := r.URL.Query().Get("draining"); len(v) > 0 {
+			var err error
+			draining, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "invalid draining", http.StatusBadRequest)
+				return
+			}
+		}
+		exits := a.Exits()
+		if len(exits) == 0 {
+			http.Error(w, "no exit found", http.StatusNotFound)
+			return
+		}
+		for _, te := range exits {
+			te.SetDraining(draining)
+		}
+		writeAdminJSON(w, a.Status(r.Context()))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("Write admin response error", "error", err)
+	}
+}
+
+// isLoopbackHost returns whether host, with or without port, is localhost or
+// a loopback IP.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkAdminAddr returns an error if addr is a TCP address not on a loopback
+// interface, as the admin API has no authentication.
+func checkAdminAddr(addr string) error {
+	if strings.HasPrefix(addr, adminUnixPrefix) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("admin API should listen on localhost or a Unix socket, not %q", host)
+	}
+	return nil
+}
+
+// ServeAdmin serves DefaultAdmin at addr until it fails. addr is either a
+// TCP address on localhost, as the API has no authentication, or unix:<path>
+// of a Unix socket only accessible by its owner.
+func ServeAdmin(addr string) error {
+	err := checkAdminAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	var listener net.Listener
+	if strings.HasPrefix(addr, adminUnixPrefix) {
+		path := strings.TrimPrefix(addr, adminUnixPrefix)
+		// remove the socket left by a previous run, but never another file
+		fi, err := os.Lstat(path)
+		if err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return fmt.Errorf("%s exists and is not a socket", path)
+			}
+			err = os.Remove(path)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		listener, err = listenUnixPrivate(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Serving admin API", "addr", addr)
+	return http.Serve(listener, DefaultAdmin)
+}
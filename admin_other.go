@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package tuna
+
+import (
+	"net"
+)
+
+// listenUnixPrivate listens on a Unix socket at path. Its permissions are
+// left to the platform.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
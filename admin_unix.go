@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package tuna
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+var umaskLock sync.Mutex
+
+// listenUnixPrivate listens on a Unix socket at path that is only accessible
+// by its owner from the moment it's created.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,94 @@
+package tuna
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/nknorg/tuna/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// ProtocolVersion is advertised by exits in service metadata. Exits that
+	// don't advertise a version are treated as compatible.
+	ProtocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+var supportedEncryptionAlgos = []pb.EncryptionAlgo{
+	pb.EncryptionAlgo_ENCRYPTION_NONE,
+	pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305,
+	pb.EncryptionAlgo_ENCRYPTION_AES_GCM,
+}
+
+// EncodeMetadata returns the base64 encoded metadata. Marshaling is
+// deterministic so that unchanged metadata is not published again.
+func EncodeMetadata(metadata *pb.ServiceMetadata) (string, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// sessionLoad returns the percentage of maxSessions in use, rounded down to
+// 10% so that small changes don't need a new advertisement. It is 100 only
+// when the node is full.
+func sessionLoad(sessions, maxSessions int) uint32 {
+	if maxSessions <= 0 {
+		return 0
+	}
+	if sessions >= maxSessions {
+		return 100
+	}
+	load := sessions * 100 / maxSessions
+	return uint32(load / 10 * 10)
+}
+
+// advertisementRejection returns why a node advertising metadata can't be
+// used, or an empty string if it can.
+func (c *Common) advertisementRejection(metadata *pb.ServiceMetadata) string {
+	if metadata.Draining {
+		return "draining"
+	}
+	if metadata.MaxSessions > 0 && metadata.Load >= 100 {
+		return "full"
+	}
+	if metadata.ProtocolVersion > 0 && metadata.ProtocolVersion < minProtocolVersion {
+		return fmt.Sprintf("incompatible protocol version %d", metadata.ProtocolVersion)
+	}
+	if c.minBandwidth > 0 && metadata.MaxBandwidth > 0 && float32(metadata.MaxBandwidth) < c.minBandwidth {
+		return fmt.Sprintf("max bandwidth %d KB/s below %v KB/s", metadata.MaxBandwidth, c.minBandwidth)
+	}
+	if len(metadata.EncryptionAlgos) > 0 {
+		supported := false
+		for _, algo := range metadata.EncryptionAlgos {
+			if algo == c.encryptionAlgo {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return "encryption " + c.encryptionAlgo.String() + " not supported"
+		}
+	}
+	if len(c.ServiceInfo.Regions) > 0 {
+		inRegion := false
+		for _, region := range c.ServiceInfo.Regions {
+			if strings.EqualFold(region, metadata.Region) {
+				inRegion = true
+				break
+			}
+		}
+		if !inRegion {
+			return fmt.Sprintf("region %q not in %v", metadata.Region, c.ServiceInfo.Regions)
+		}
+	}
+	for k, v := range c.ServiceInfo.Labels {
+		if metadata.Labels[k] != v {
+			return fmt.Sprintf("label %s is not %q", k, v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nknorg/tuna"
+)
+
+type ConfigCommand struct{}
+
+type ConfigCheckCommand struct {
+	EntryConfigFile string `long:"entry" description:"Entry config file path, default is config.entry.json if exists"`
+	ExitConfigFile  string `long:"exit" description:"Exit config file path, default is config.exit.json if exists"`
+	Reverse         bool   `long:"reverse" description:"Reverse mode"`
+}
+
+var (
+	configCommand      ConfigCommand
+	configCheckCommand ConfigCheckCommand
+)
+
+// formatConfigError returns err with each config problem on its own line.
+func formatConfigError(err error) string {
+	var problems tuna.ConfigErrors
+	if !errors.As(err, &problems) {
+		return err.Error()
+	}
+	lines := make([]string, 0, len(problems)+1)
+	lines = append(lines, "Invalid config:")
+	for _, problem := range problems {
+		lines = append(lines, "  "+problem.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c *ConfigCheckCommand) Execute(args []string) error {
+	entryConfigFile, exitConfigFile := c.EntryConfigFile, c.ExitConfigFile
+	if len(entryConfigFile) == 0 && len(exitConfigFile) == 0 {
+		if _, err := os.Stat("config.entry.json"); err == nil {
+			entryConfigFile = "config.entry.json"
+		}
+		if _, err := os.Stat("config.exit.json"); err == nil {
+			exitConfigFile = "config.exit.json"
+		}
+		if len(entryConfigFile) == 0 && len(exitConfigFile) == 0 {
+			return errors.New("no config file to check, use --entry or --exit")
+		}
+	}
+
+	ok := true
+	check := func(path string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Printf("%s: %s\n", path, formatConfigError(err))
+		} else {
+			fmt.Printf("%s: OK\n", path)
+		}
+	}
+
+	if len(entryConfigFile) > 0 {
+		e := &EntryCommand{ConfigFile: entryConfigFile, Reverse: c.Reverse}
+		config, err := e.loadConfig()
+		if err == nil {
+			_, err = e.loadServices(config)
+		}
+		check(entryConfigFile, err)
+	}
+
+	if len(exitConfigFile) > 0 {
+		e := &ExitCommand{ConfigFile: exitConfigFile, Reverse: c.Reverse}
+		config, err := e.loadConfig()
+		if err == nil {
+			_, err = e.loadServices(config)
+		}
+		check(exitConfigFile, err)
+	}
+
+	if !ok {
+		return errors.New("config check failed")
+	}
+	return nil
+}
+
+func init() {
+	cmd, err := parser.AddCommand("config", "Config commands", "Commands to work with config files", &configCommand)
+	if err != nil {
+		panic(err)
+	}
+	cmd.AddCommand("check", "Check config files", "Check config and services files, and print all problems found", &configCheckCommand)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna"
+)
+
+type DiscoverCommand struct {
+	Service            string `long:"service" description:"Service name" required:"true"`
+	SubscriptionPrefix string `long:"prefix" description:"Subscription prefix" default:"tuna_v1."`
+	Address            string `long:"address" description:"Only show subscribers whose NKN address contains this string"`
+	IP                 string `long:"ip" description:"Only show subscribers with this IP"`
+	Beneficiary        string `long:"beneficiary" description:"Only show subscribers with this beneficiary address"`
+	MaxPrice           string `long:"max-price" description:"Only show subscribers with entry to exit and exit to entry price not higher than this"`
+	NoExpiry           bool   `long:"no-expiry" description:"Don't query subscription expiry heights"`
+	JSON               bool   `long:"json" description:"Print result as JSON"`
+}
+
+var discoverCommand DiscoverCommand
+
+func (d *DiscoverCommand) Execute(args []string) error {
+	seedRPCServerAddr := nkn.NewStringArray(nkn.DefaultSeedRPCServerAddr...)
+	if len(opts.SeedRPCServerAddr) > 0 {
+		seedRPCServerAddr = nkn.NewStringArrayFromString(strings.ReplaceAll(opts.SeedRPCServerAddr, ",", " "))
+	}
+	rpcConfig := &nkn.RPCConfig{SeedRPCServerAddr: seedRPCServerAddr}
+
+	var maxEntryToExitPrice, maxExitToEntryPrice common.Fixed64
+	if len(d.MaxPrice) > 0 {
+		var err error
+		maxEntryToExitPrice, maxExitToEntryPrice, err = tuna.ParsePrice(d.MaxPrice)
+		if err != nil {
+			return fmt.Errorf("parse max price error: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	topic := d.SubscriptionPrefix + d.Service
+	subscribers, err := tuna.GetServiceSubscribersContext(ctx, topic, !d.NoExpiry, rpcConfig)
+	if err != nil {
+		return err
+	}
+
+	height, err := nkn.GetHeightContext(ctx, rpcConfig)
+	if err != nil {
+		return fmt.Errorf("get block height error: %v", err)
+	}
+
+	filtered := make([]*tuna.SubscriberInfo, 0, len(subscribers))
+	for _, s := range subscribers {
+		if len(d.Address) > 0 && !strings.Contains(s.Address, d.Address) {
+			continue
+		}
+		if len(d.IP) > 0 || len(d.Beneficiary) > 0 || len(d.MaxPrice) > 0 {
+			if s.Metadata == nil {
+				continue
+			}
+			if len(d.IP) > 0 && s.Metadata.Ip != d.IP {
+				continue
+			}
+			if len(d.Beneficiary) > 0 && s.Metadata.BeneficiaryAddr != d.Beneficiary {
+				continue
+			}
+			if len(d.MaxPrice) > 0 {
+				entryToExitPrice, exitToEntryPrice, err := tuna.ParsePrice(s.Metadata.Price)
+				if err != nil || entryToExitPrice > maxEntryToExitPrice || exitToEntryPrice > maxExitToEntryPrice {
+					continue
+				}
+			}
+		}
+		filtered = append(filtered, s)
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return subscriberPrice(filtered[i]) < subscriberPrice(filtered[j])
+	})
+
+	if d.JSON {
+		b, err := json.MarshalIndent(struct {
+			Topic       string                 `json:"topic"`
+			Height      int32                  `json:"height"`
+			Subscribers []*tuna.SubscriberInfo `json:"subscribers"`
+		}{topic, height, filtered}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	fmt.Printf("Topic %s at height %d, %d of %d subscribers\n", topic, height, len(filtered), len(subscribers))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tIP\tTCP\tUDP\tSERVICE TCP\tSERVICE UDP\tPRICE\tBENEFICIARY\tEXPIRES AT")
+	for _, s := range filtered {
+		expiresAt := "-"
+		if s.InTxPool {
+			expiresAt = "txpool"
+		} else if s.ExpiresAt > 0 {
+			expiresAt = fmt.Sprintf("%d (%d left)", s.ExpiresAt, s.ExpiresAt-height)
+		}
+		if s.Metadata == nil {
+			fmt.Fprintf(w, "%s\tinvalid metadata: %s\t\t\t\t\t\t\t%s\n", s.Address, s.MetadataError, expiresAt)
+			continue
+		}
+		m := s.Metadata
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%v\t%v\t%s\t%s\t%s\n", s.Address, m.Ip, m.TcpPort, m.UdpPort, m.ServiceTcp, m.ServiceUdp, m.Price, m.BeneficiaryAddr, expiresAt)
+	}
+	return w.Flush()
+}
+
+// subscriberPrice returns the entry to exit price used to sort subscribers,
+// subscribers with invalid metadata or price are sorted last.
+func subscriberPrice(s *tuna.SubscriberInfo) common.Fixed64 {
+	if s.Metadata == nil {
+		return math.MaxInt64
+	}
+	price, _, err := tuna.ParsePrice(s.Metadata.Price)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return price
+}
+
+func init() {
+	parser.AddCommand("discover", "List service subscribers", "List subscribers of a service topic with decoded metadata and subscription expiry", &discoverCommand)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/nknorg/tuna"
@@ -10,33 +13,74 @@ import (
 )
 
 type EntryCommand struct {
-	ConfigFile string `short:"c" long:"config" description:"Config file path" default:"config.entry.json"`
+	ConfigFile string `short:"c" long:"config" description:"Config file path, can be JSON, YAML or TOML" default:"config.entry.json" env:"TUNA_CONFIG"`
 	Reverse    bool   `long:"reverse" description:"Reverse mode"`
 }
 
 var entryCommand EntryCommand
 
-func (e *EntryCommand) Execute(args []string) error {
+// loadConfig reads the config file and applies environment variables and
+// command line options, in that order.
+func (e *EntryCommand) loadConfig() (*tuna.EntryConfiguration, error) {
 	config := &tuna.EntryConfiguration{}
-	err := util.ReadJSON(e.ConfigFile, config)
+	err := util.ReadConfig(e.ConfigFile, config)
+	if err != nil {
+		return nil, fmt.Errorf("load config error: %v", err)
+	}
+
+	err = util.ApplyEnv(envPrefix, config)
 	if err != nil {
-		log.Fatalln("Load config error:", err)
+		return nil, err
 	}
 
 	if len(opts.BeneficiaryAddr) > 0 {
 		config.ReverseBeneficiaryAddr = opts.BeneficiaryAddr
 	}
 
-	if entryCommand.Reverse {
+	if e.Reverse {
 		config.Reverse = true
 	}
 
-	if len(config.ReverseBeneficiaryAddr) > 0 {
-		err = nkn.VerifyWalletAddress(config.ReverseBeneficiaryAddr)
+	return config, nil
+}
+
+// loadServices reads the services file if needed by config, and validates
+// config with it.
+func (e *EntryCommand) loadServices(config *tuna.EntryConfiguration) ([]tuna.Service, error) {
+	var services []tuna.Service
+	if !config.Reverse {
+		err := util.ReadConfig(opts.ServicesFile, &services)
 		if err != nil {
-			log.Fatalln("Invalid beneficiary address:", err)
+			return nil, fmt.Errorf("load service file error: %v", err)
+		}
+	}
+	return services, config.Validate(services)
+}
+
+// entryServices returns the service of each service name in config.
+func entryServices(config *tuna.EntryConfiguration, services []tuna.Service) map[string]tuna.Service {
+	res := make(map[string]tuna.Service, len(config.Services))
+	for _, service := range services {
+		if _, ok := config.Services[service.Name]; ok {
+			if len(service.UDP) > 0 && service.UDPBufferSize == 0 {
+				service.UDPBufferSize = tuna.DefaultUDPBufferSize
+			}
+			res[service.Name] = service
 		}
 	}
+	return res
+}
+
+func (e *EntryCommand) Execute(args []string) error {
+	config, err := e.loadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	services, err := e.loadServices(config)
+	if err != nil {
+		log.Fatalln(formatConfigError(err))
+	}
 
 	account, err := tuna.LoadOrCreateAccount(opts.WalletFile, opts.PasswordFile)
 	if err != nil {
@@ -73,46 +117,173 @@ func (e *EntryCommand) Execute(args []string) error {
 
 	log.Println("Your NKN wallet address is:", wallet.Address())
 
-	if config.Reverse {
-		err = tuna.StartReverse(config, wallet)
+	if len(config.MetricsListenAddr) > 0 {
+		go func() {
+			log.Fatalln("Serve metrics error:", tuna.ServeMetrics(config.MetricsListenAddr))
+		}()
+	}
+
+	if len(config.AdminListenAddr) > 0 {
+		go func() {
+			log.Fatalln("Serve admin API error:", tuna.ServeAdmin(config.AdminListenAddr))
+		}()
+	}
+
+	// reloadConfig loads and validates config and services again, keeping
+	// seed RPC servers found above unless set in config file.
+	reloadConfig := func() (*tuna.EntryConfiguration, []tuna.Service, error) {
+		c, err := e.loadConfig()
 		if err != nil {
-			log.Fatalln(err)
+			return nil, nil, err
+		}
+		if c.Reverse != config.Reverse {
+			return nil, nil, errors.New("reverse mode can't be changed by reload")
 		}
-	} else {
-		var services []tuna.Service
-		err = util.ReadJSON(opts.ServicesFile, &services)
+		services, err := e.loadServices(c)
 		if err != nil {
-			log.Fatalln("Load service file error:", err)
+			return nil, nil, err
 		}
+		if len(opts.SeedRPCServerAddr) > 0 || len(c.SeedRPCServerAddr) == 0 {
+			c.SeedRPCServerAddr = config.SeedRPCServerAddr
+		}
+		return c, services, nil
+	}
+
+	if config.Reverse {
+		r := startReverseEntry(config, wallet)
+		waitSignals(r.ready, func() error {
+			c, _, err := reloadConfig()
+			if err != nil {
+				return err
+			}
+			key := runnerKey(c)
+			if key == r.key {
+				return nil
+			}
+			// reverse entry ports can only be listened by one of them
+			ctx, cancel := drainContext()
+			defer cancel()
+			r.stop(ctx)
+			r = startReverseEntry(c, wallet)
+			return nil
+		})
 
-	service:
-		for serviceName, serviceInfo := range config.Services {
-			for _, service := range services {
-				if service.Name == serviceName {
-					go func(service tuna.Service, serviceInfo tuna.ServiceInfo) {
-						if len(service.UDP) > 0 && service.UDPBufferSize == 0 {
-							service.UDPBufferSize = tuna.DefaultUDPBufferSize
-						}
-						for {
-							te, err := tuna.NewTunaEntry(service, serviceInfo, wallet, nil, config)
-							if err != nil {
-								log.Fatalln(err)
-							}
-
-							err = te.Start(false)
-							if err != nil {
-								log.Println(err)
-							}
-						}
-					}(service, serviceInfo)
-					continue service
+		ctx, cancel := drainContext()
+		defer cancel()
+		r.stop(ctx)
+		return nil
+	}
+
+	runners := make(map[string]*runner, len(config.Services))
+	for serviceName, service := range entryServices(config, services) {
+		runners[serviceName] = startEntry(service, config.Services[serviceName], config, wallet)
+	}
+
+	// entries replaced on reload drain in background
+	var draining sync.WaitGroup
+	drain := func(r *runner) {
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			ctx, cancel := drainContext()
+			defer cancel()
+			r.stop(ctx)
+		}()
+	}
+
+	waitSignals(allReady(runners), func() error {
+		c, newServices, err := reloadConfig()
+		if err != nil {
+			return err
+		}
+		services := entryServices(c, newServices)
+
+		for serviceName, r := range runners {
+			if _, ok := services[serviceName]; !ok {
+				log.Println("Stop service", serviceName)
+				delete(runners, serviceName)
+				drain(r)
+			}
+		}
+		for serviceName, service := range services {
+			r, ok := runners[serviceName]
+			if ok && r.key == entryKey(service, c.Services[serviceName], c) {
+				continue
+			}
+			if ok {
+				log.Println("Restart service", serviceName)
+				// the old entry stops listening right away, while the new
+				// one listens after connecting to an exit
+				drain(r)
+			} else {
+				log.Println("Start service", serviceName)
+			}
+			runners[serviceName] = startEntry(service, c.Services[serviceName], c, wallet)
+		}
+		return nil
+	})
+
+	ctx, cancel := drainContext()
+	defer cancel()
+	stopRunners(ctx, runners)
+	draining.Wait()
+
+	return nil
+}
+
+func entryKey(service tuna.Service, serviceInfo tuna.ServiceInfo, config *tuna.EntryConfiguration) string {
+	c := *config
+	c.Services = nil
+	return runnerKey(service, serviceInfo, &c)
+}
+
+// startEntry keeps an entry of service running until the runner is stopped.
+func startEntry(service tuna.Service, serviceInfo tuna.ServiceInfo, config *tuna.EntryConfiguration, wallet *nkn.Wallet) *runner {
+	return startRunner(entryKey(service, serviceInfo, config), func(r *runner) {
+		for r.ctx.Err() == nil {
+			te, err := tuna.NewTunaEntry(service, serviceInfo, wallet, nil, config)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if !r.set(te) {
+				te.Close()
+				return
+			}
+
+			sub := te.Events.Subscribe(1, nil)
+			go func() {
+				for event := range sub.C {
+					if event.Type == tuna.EventListening {
+						r.setReady()
+					}
 				}
+			}()
+
+			err = te.StartContext(r.ctx, false)
+			if err != nil && r.ctx.Err() == nil {
+				log.Println(err)
 			}
-			log.Fatalln("Service", serviceName, "not found in service file")
 		}
-	}
+	})
+}
 
-	select {}
+// startReverseEntry serves reverse exits until the runner is stopped.
+func startReverseEntry(config *tuna.EntryConfiguration, wallet *nkn.Wallet) *runner {
+	return startRunner(runnerKey(config), func(r *runner) {
+		re, err := tuna.StartReverseContext(r.ctx, config, wallet)
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			log.Fatalln(err)
+		}
+		if !r.set(re) {
+			re.Close()
+			return
+		}
+		r.setReady()
+		<-r.ctx.Done()
+	})
 }
 
 func init() {
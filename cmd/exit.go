@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/nknorg/tuna"
@@ -10,32 +13,56 @@ import (
 )
 
 type ExitCommand struct {
-	ConfigFile string `short:"c" long:"config" description:"Config file path" default:"config.exit.json"`
+	ConfigFile string `short:"c" long:"config" description:"Config file path, can be JSON, YAML or TOML" default:"config.exit.json" env:"TUNA_CONFIG"`
 	Reverse    bool   `long:"reverse" description:"Reverse mode"`
 }
 
 var exitCommand ExitCommand
 
-func (e *ExitCommand) Execute(args []string) error {
+// loadConfig reads the config file and applies environment variables and
+// command line options, in that order.
+func (e *ExitCommand) loadConfig() (*tuna.ExitConfiguration, error) {
 	config := &tuna.ExitConfiguration{}
-	err := util.ReadJSON(e.ConfigFile, config)
+	err := util.ReadConfig(e.ConfigFile, config)
+	if err != nil {
+		return nil, fmt.Errorf("load config file error: %v", err)
+	}
+
+	err = util.ApplyEnv(envPrefix, config)
 	if err != nil {
-		log.Fatalln("Load config file error:", err)
+		return nil, err
 	}
 
 	if len(opts.BeneficiaryAddr) > 0 {
 		config.BeneficiaryAddr = opts.BeneficiaryAddr
 	}
 
-	if exitCommand.Reverse {
+	if e.Reverse {
 		config.Reverse = true
 	}
 
-	if len(config.BeneficiaryAddr) > 0 {
-		err = nkn.VerifyWalletAddress(config.BeneficiaryAddr)
-		if err != nil {
-			log.Fatalln("Invalid beneficiary address:", err)
-		}
+	return config, nil
+}
+
+// loadServices reads the services file and validates config with it.
+func (e *ExitCommand) loadServices(config *tuna.ExitConfiguration) ([]tuna.Service, error) {
+	var services []tuna.Service
+	err := util.ReadConfig(opts.ServicesFile, &services)
+	if err != nil {
+		return nil, fmt.Errorf("load service file error: %v", err)
+	}
+	return services, config.Validate(services)
+}
+
+func (e *ExitCommand) Execute(args []string) error {
+	config, err := e.loadConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	services, err := e.loadServices(config)
+	if err != nil {
+		log.Fatalln(formatConfigError(err))
 	}
 
 	account, err := tuna.LoadOrCreateAccount(opts.WalletFile, opts.PasswordFile)
@@ -70,40 +97,39 @@ func (e *ExitCommand) Execute(args []string) error {
 
 	log.Println("Your NKN wallet address is:", wallet.Address())
 
-	var services []tuna.Service
-	err = util.ReadJSON(opts.ServicesFile, &services)
-	if err != nil {
-		log.Fatalln("Load service file error:", err)
+	if len(config.MetricsListenAddr) > 0 {
+		go func() {
+			log.Fatalln("Serve metrics error:", tuna.ServeMetrics(config.MetricsListenAddr))
+		}()
 	}
 
-	if config.Reverse {
-		for _, service := range services {
-			if _, ok := config.Services[service.Name]; ok {
-				go func(service tuna.Service) {
-					for {
-						te, err := tuna.NewTunaExit([]tuna.Service{service}, wallet, nil, config)
-						if err != nil {
-							log.Fatalln(err)
-						}
-
-						go func() {
-							for range te.OnConnect.C {
-								log.Printf("Service: %s, Type: TCP, Address: %v:%v\n", service.Name, te.GetReverseIP(), te.GetReverseTCPPorts())
-								if len(service.UDP) > 0 {
-									log.Printf("Service: %s, Type: UDP, Address: %v:%v\n", service.Name, te.GetReverseIP(), te.GetReverseUDPPorts())
-								}
-							}
-						}()
-
-						err = te.StartReverse(false)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}(service)
-			}
+	if len(config.AdminListenAddr) > 0 {
+		go func() {
+			log.Fatalln("Serve admin API error:", tuna.ServeAdmin(config.AdminListenAddr))
+		}()
+	}
+
+	// reloadConfig loads and validates config and services again, keeping
+	// seed RPC servers found above unless set in config file.
+	reloadConfig := func() (*tuna.ExitConfiguration, []tuna.Service, error) {
+		c, err := e.loadConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.Reverse != config.Reverse {
+			return nil, nil, errors.New("reverse mode can't be changed by reload")
+		}
+		services, err := e.loadServices(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(opts.SeedRPCServerAddr) > 0 || len(c.SeedRPCServerAddr) == 0 {
+			c.SeedRPCServerAddr = config.SeedRPCServerAddr
 		}
-	} else {
+		return c, services, nil
+	}
+
+	if !config.Reverse {
 		te, err := tuna.NewTunaExit(services, wallet, nil, config)
 		if err != nil {
 			log.Fatalln(err)
@@ -114,10 +140,122 @@ func (e *ExitCommand) Execute(args []string) error {
 			log.Fatalln(err)
 		}
 
-		defer te.Close()
+		ready := make(chan struct{})
+		close(ready)
+		waitSignals(ready, func() error {
+			c, services, err := reloadConfig()
+			if err != nil {
+				return err
+			}
+			log.Println("Only services, prices and IP filters are reloaded, other changes need a restart")
+			return te.Reload(services, c)
+		})
+
+		ctx, cancel := drainContext()
+		defer cancel()
+		te.Shutdown(ctx)
+		return nil
+	}
+
+	runners := make(map[string]*runner)
+	for _, service := range services {
+		if _, ok := config.Services[service.Name]; ok {
+			runners[service.Name] = startReverseExit(service, config, wallet)
+		}
+	}
+
+	// exits replaced on reload drain in background
+	var draining sync.WaitGroup
+	drain := func(r *runner) {
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			ctx, cancel := drainContext()
+			defer cancel()
+			r.stop(ctx)
+		}()
 	}
 
-	select {}
+	waitSignals(allReady(runners), func() error {
+		c, services, err := reloadConfig()
+		if err != nil {
+			return err
+		}
+
+		provided := make(map[string]tuna.Service)
+		for _, service := range services {
+			if _, ok := c.Services[service.Name]; ok {
+				provided[service.Name] = service
+			}
+		}
+
+		for serviceName, r := range runners {
+			if _, ok := provided[serviceName]; !ok {
+				log.Println("Stop service", serviceName)
+				delete(runners, serviceName)
+				drain(r)
+			}
+		}
+		for serviceName, service := range provided {
+			r, ok := runners[serviceName]
+			if ok && r.key == exitKey(service, c) {
+				continue
+			}
+			if ok {
+				log.Println("Restart service", serviceName)
+				drain(r)
+			} else {
+				log.Println("Start service", serviceName)
+			}
+			runners[serviceName] = startReverseExit(service, c, wallet)
+		}
+		return nil
+	})
+
+	ctx, cancel := drainContext()
+	defer cancel()
+	stopRunners(ctx, runners)
+	draining.Wait()
+
+	return nil
+}
+
+func exitKey(service tuna.Service, config *tuna.ExitConfiguration) string {
+	c := *config
+	c.Services = map[string]tuna.ExitServiceInfo{service.Name: config.Services[service.Name]}
+	return runnerKey(service, &c)
+}
+
+// startReverseExit keeps a reverse exit of service running until the runner
+// is stopped.
+func startReverseExit(service tuna.Service, config *tuna.ExitConfiguration, wallet *nkn.Wallet) *runner {
+	return startRunner(exitKey(service, config), func(r *runner) {
+		for r.ctx.Err() == nil {
+			te, err := tuna.NewTunaExit([]tuna.Service{service}, wallet, nil, config)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if !r.set(te) {
+				te.Close()
+				return
+			}
+
+			go func() {
+				for range te.OnConnect.C {
+					r.setReady()
+					log.Printf("Service: %s, Type: TCP, Address: %v:%v\n", service.Name, te.GetReverseIP(), te.GetReverseTCPPorts())
+					if len(service.UDP) > 0 {
+						log.Printf("Service: %s, Type: UDP, Address: %v:%v\n", service.Name, te.GetReverseIP(), te.GetReverseUDPPorts())
+					}
+				}
+			}()
+
+			err = te.StartReverseContext(r.ctx, false)
+			if err != nil && r.ctx.Err() == nil {
+				log.Println(err)
+			}
+		}
+	})
 }
 
 func init() {
@@ -3,18 +3,26 @@ package main
 import (
 	"errors"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/jessevdk/go-flags"
+	"github.com/nknorg/tuna"
 )
 
+// envPrefix is the prefix of environment variables overriding config fields.
+const envPrefix = "TUNA"
+
 var opts struct {
 	BeneficiaryAddr   string `short:"b" long:"beneficiary-addr" description:"Beneficiary address (NKN wallet address to receive rewards)"`
-	ServicesFile      string `short:"s" long:"services" description:"Services file path" default:"services.json"`
-	WalletFile        string `short:"w" long:"wallet" description:"Wallet file path" default:"wallet.json"`
-	PasswordFile      string `short:"p" long:"password-file" description:"Wallet password file path" default:"wallet.pswd"`
+	ServicesFile      string `short:"s" long:"services" description:"Services file path, can be JSON or YAML" default:"services.json" env:"TUNA_SERVICE_FILE"`
+	WalletFile        string `short:"w" long:"wallet" description:"Wallet file path" default:"wallet.json" env:"TUNA_WALLET"`
+	PasswordFile      string `short:"p" long:"password-file" description:"Wallet password file path" default:"wallet.pswd" env:"TUNA_PASSWORD_FILE"`
 	SeedRPCServerAddr string `long:"rpc" description:"Seed RPC server address, separated by comma"`
 	Version           bool   `short:"v" long:"version" description:"Print version"`
+	LogLevel          string `long:"log-level" description:"Log level" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"info" env:"TUNA_LOG_LEVEL"`
+	LogFormat         string `long:"log-format" description:"Log format" choice:"text" choice:"json" default:"text" env:"TUNA_LOG_FORMAT"`
+	DrainTimeout      int    `long:"drain-timeout" description:"Seconds to wait for open streams on SIGINT, SIGTERM or reload before closing them" default:"30" env:"TUNA_DRAIN_TIMEOUT"`
 }
 
 var (
@@ -29,6 +37,18 @@ func main() {
 		}
 	}()
 
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		logger, err := tuna.NewLogger(os.Stderr, opts.LogLevel, opts.LogFormat)
+		if err != nil {
+			return err
+		}
+		slog.SetDefault(logger)
+		if command == nil {
+			return nil
+		}
+		return command.Execute(args)
+	}
+
 	_, err := parser.Parse()
 	if err != nil {
 		var e *flags.Error
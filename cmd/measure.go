@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/util"
+)
+
+type MeasureCommand struct {
+	ConfigFile       string `short:"c" long:"config" description:"Entry config file path, can be JSON, YAML or TOML" default:"config.entry.json" env:"TUNA_CONFIG"`
+	Service          string `long:"service" description:"Service name to measure" required:"true"`
+	MeasureBandwidth bool   `long:"bandwidth" description:"Measure bandwidth even if disabled in config"`
+	JSON             bool   `long:"json" description:"Print result as JSON"`
+}
+
+var measureCommand MeasureCommand
+
+func (m *MeasureCommand) Execute(args []string) error {
+	config := &tuna.EntryConfiguration{}
+	err := util.ReadConfig(m.ConfigFile, config)
+	if err != nil {
+		return fmt.Errorf("load config error: %v", err)
+	}
+
+	err = util.ApplyEnv(envPrefix, config)
+	if err != nil {
+		return err
+	}
+
+	serviceInfo, ok := config.Services[m.Service]
+	if !ok {
+		return fmt.Errorf("service %s not found in config file", m.Service)
+	}
+
+	var services []tuna.Service
+	err = util.ReadConfig(opts.ServicesFile, &services)
+	if err != nil {
+		return fmt.Errorf("load service file error: %v", err)
+	}
+
+	var service *tuna.Service
+	for i := range services {
+		if services[i].Name == m.Service {
+			service = &services[i]
+			break
+		}
+	}
+	if service == nil {
+		return fmt.Errorf("service %s not found in service file", m.Service)
+	}
+
+	account, err := tuna.LoadOrCreateAccount(opts.WalletFile, opts.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("load or create account error: %v", err)
+	}
+
+	seedRPCServerAddr := nkn.NewStringArray(nkn.DefaultSeedRPCServerAddr...)
+	if len(opts.SeedRPCServerAddr) > 0 {
+		seedRPCServerAddr = nkn.NewStringArrayFromString(strings.ReplaceAll(opts.SeedRPCServerAddr, ",", " "))
+	} else if len(config.SeedRPCServerAddr) > 0 {
+		seedRPCServerAddr = nkn.NewStringArray(config.SeedRPCServerAddr...)
+	}
+	config.SeedRPCServerAddr = seedRPCServerAddr.Elems()
+
+	wallet, err := nkn.NewWallet(&nkn.Account{Account: account}, &nkn.WalletConfig{SeedRPCServerAddr: seedRPCServerAddr})
+	if err != nil {
+		return fmt.Errorf("create wallet error: %v", err)
+	}
+
+	te, err := tuna.NewTunaEntry(*service, serviceInfo, wallet, nil, config)
+	if err != nil {
+		return err
+	}
+	defer te.Close()
+
+	reports, err := te.MeasureNodesContext(context.Background(), m.MeasureBandwidth || config.MeasureBandwidth)
+	if err != nil {
+		return err
+	}
+
+	if m.JSON {
+		b, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tIP\tCOUNTRY\tPRICE\tDELAY (ms)\tBANDWIDTH (KB/s)\tSTATUS")
+	for _, r := range reports {
+		status := "selected"
+		if !r.Selected {
+			status = "rejected: " + r.Rejected
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Address, r.IP, r.CountryCode, r.Price, formatMeasurement(r.Delay), formatMeasurement(r.Bandwidth), status)
+	}
+	return w.Flush()
+}
+
+func formatMeasurement(v float32) string {
+	if v == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", v)
+}
+
+func init() {
+	parser.AddCommand("measure", "Measure candidate exits", "Measure candidate exits of a service and show why nodes are rejected", &measureCommand)
+}
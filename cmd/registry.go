@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/nknorg/tuna"
+)
+
+type RegistryCommand struct {
+	Listen string `long:"listen" description:"Address to listen for registry requests" default:"127.0.0.1:30080"`
+	Token  string `long:"token" description:"Token exits need to publish to the registry" env:"TUNA_REGISTRY_TOKEN" required:"true"`
+}
+
+var registryCommand RegistryCommand
+
+func (r *RegistryCommand) Execute(args []string) error {
+	log.Println("Discovery registry listening on", r.Listen)
+	return http.ListenAndServe(r.Listen, tuna.NewHTTPRegistry(r.Token))
+}
+
+func init() {
+	parser.AddCommand("registry", "Run a discovery registry", "Run an in-memory HTTP registry for entries and exits using http discovery", &registryCommand)
+}
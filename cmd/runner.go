@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// runner keeps running an entry or exit, creating a new one each time the
+// previous one stops, until it's stopped. key identifies the configuration
+// it runs with, so that it's only restarted on reload if key changes.
+type runner struct {
+	key       string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	sync.Mutex
+	current shutdowner
+	stopped bool
+}
+
+// startRunner calls run in a goroutine, which should call set with each
+// entry or exit it creates, and start them with ctx of the runner.
+func startRunner(key string, run func(r *runner)) *runner {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runner{
+		key:    key,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		ready:  make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		run(r)
+	}()
+	return r
+}
+
+// setReady marks r as ready to serve, after the first entry or exit it runs
+// is listening.
+func (r *runner) setReady() {
+	r.readyOnce.Do(func() { close(r.ready) })
+}
+
+// allReady returns a channel that is closed when all runners are ready or
+// have returned.
+func allReady(runners map[string]*runner) <-chan struct{} {
+	ready := make(chan struct{})
+	waits := make([]*runner, 0, len(runners))
+	for _, r := range runners {
+		waits = append(waits, r)
+	}
+	go func() {
+		defer close(ready)
+		for _, r := range waits {
+			select {
+			case <-r.ready:
+			case <-r.done:
+			}
+		}
+	}()
+	return ready
+}
+
+// set sets the current entry or exit, and returns false if r is stopped, in
+// which case s should be closed instead of started.
+func (r *runner) set(s shutdowner) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped {
+		return false
+	}
+	r.current = s
+	return true
+}
+
+// stop shuts down the current entry or exit, waiting for open streams until
+// ctx is done, and waits for run to return.
+func (r *runner) stop(ctx context.Context) {
+	r.Lock()
+	r.stopped = true
+	current := r.current
+	r.Unlock()
+
+	if current != nil {
+		current.Shutdown(ctx)
+	}
+	r.cancel()
+	<-r.done
+}
+
+// stopRunners stops all runners concurrently.
+func stopRunners(ctx context.Context, runners map[string]*runner) {
+	var wg sync.WaitGroup
+	for _, r := range runners {
+		wg.Add(1)
+		go func(r *runner) {
+			defer wg.Done()
+			r.stop(ctx)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// runnerKey returns a fingerprint of the configuration of a runner.
+func runnerKey(v ...interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+)
+
+// sdNotify sends state to systemd when running as a Type=notify service, and
+// does nothing otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return
+	}
+	// abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Println("Notify systemd error:", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		log.Println("Notify systemd error:", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// waitSignals notifies systemd that tuna is ready when ready is closed, and
+// calls reload on each SIGHUP until SIGINT or SIGTERM is received.
+func waitSignals(ready <-chan struct{}, reload func() error) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ready:
+			sdNotify("READY=1")
+		case <-done:
+		}
+	}()
+
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, draining for at most %d seconds\n", sig, opts.DrainTimeout)
+			sdNotify("STOPPING=1")
+			return
+		}
+
+		log.Println("Reloading config")
+		sdNotify("RELOADING=1")
+		err := reload()
+		if err != nil {
+			log.Println("Reload config error:", err)
+		} else {
+			log.Println("Config reloaded")
+		}
+		select {
+		case <-ready:
+			sdNotify("READY=1")
+		default:
+		}
+	}
+}
+
+// drainContext returns a context that is done after the drain timeout, or
+// when SIGINT or SIGTERM is received again.
+func drainContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.DrainTimeout)*time.Second)
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
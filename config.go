@@ -2,6 +2,7 @@ package tuna
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"time"
 
@@ -30,12 +31,16 @@ const (
 	defaultMeasureBandwidthTimeout           = 2  // second
 	defaultMeasureBandwidthWorkersTimeout    = 8  // second
 	defaultMeasurementBytesDownLink          = 256 << 8
+	defaultMeasurementBytesUpLink            = 256 << 8
 	defaultMaxMeasureWorkerPoolSize          = 64
 	defaultReverseTestTimeout                = 3 * time.Second
 	maxMeasureBandwidthTimeout               = 30 * time.Second
 	nanoPayClaimerLinger                     = 24 * time.Hour
 	maxCheckSubscribeInterval                = time.Hour
 	defaultMinBalance                        = "0.0" // default minimum wallet balance for use tuna service
+	defaultQualityMaxFailures                = 3
+	defaultQualityAlternateInterval          = 1800 // second
+	defaultMigrationDrainTimeout             = 600  // second
 )
 
 type EntryConfiguration struct {
@@ -62,14 +67,36 @@ type EntryConfiguration struct {
 	ReverseSubscriptionReplaceTxPool bool                                                              `json:"reverseSubscriptionReplaceTxPool"`
 	GeoDBPath                        string                                                            `json:"geoDBPath"`
 	DownloadGeoDB                    bool                                                              `json:"downloadGeoDB"`
+	GeoProviders                     []geo.ProviderConfig                                              `json:"geoProviders"`
+	GeoOffline                       bool                                                              `json:"geoOffline"`
+	GeoCacheSize                     int32                                                             `json:"geoCacheSize"`
 	GetSubscribersBatchSize          int32                                                             `json:"getSubscribersBatchSize"`
 	MeasureBandwidth                 bool                                                              `json:"measureBandwidth"`
 	MeasureBandwidthTimeout          int32                                                             `json:"measureBandwidthTimeout"`
 	MeasureBandwidthWorkersTimeout   int32                                                             `json:"measureBandwidthWorkersTimeout"`
 	MeasurementBytesDownLink         int32                                                             `json:"measurementBytesDownLink"`
+	MeasurementBytesUpLink           int32                                                             `json:"measurementBytesUpLink"`
+	BandwidthDirection               string                                                            `json:"bandwidthDirection"`
+	MeasurePing                      bool                                                              `json:"measurePing"`
+	MeasurePingCount                 int32                                                             `json:"measurePingCount"`
+	MeasurementCacheTTL              int32                                                             `json:"measurementCacheTTL"`
 	MeasureStoragePath               string                                                            `json:"measureStoragePath"`
 	MaxMeasureWorkerPoolSize         int32                                                             `json:"maxMeasureWorkerPoolSize"`
 	SortMeasuredNodes                func(types.Nodes)                                                 `json:"-"`
+	Selector                         *SelectorConfig                                                   `json:"selector"`
+	NodeSelector                     Selector                                                          `json:"-"`
+	Discovery                        *DiscoveryConfig                                                  `json:"discovery"`
+	ServiceDiscovery                 Discovery                                                         `json:"-"`
+	MetricsListenAddr                string                                                            `json:"metricsListenAddr"`
+	AdminListenAddr                  string                                                            `json:"adminListenAddr"`
+	Logger                           *slog.Logger                                                      `json:"-"`
+	Events                           *Events                                                           `json:"-"`
+	QualityCheckInterval             int32                                                             `json:"qualityCheckInterval"`
+	QualityMaxDelay                  int32                                                             `json:"qualityMaxDelay"`
+	QualityMinBandwidth              float32                                                           `json:"qualityMinBandwidth"`
+	QualityMaxFailures               int32                                                             `json:"qualityMaxFailures"`
+	QualityAlternateInterval         int32                                                             `json:"qualityAlternateInterval"`
+	MigrationDrainTimeout            int32                                                             `json:"migrationDrainTimeout"`
 	TcpDialContext                   func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	HttpDialContext                  func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	WsDialContext                    func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
@@ -82,12 +109,18 @@ var defaultEntryConfiguration = EntryConfiguration{
 	MeasureBandwidthTimeout:        defaultMeasureBandwidthTimeout,
 	MeasureBandwidthWorkersTimeout: defaultMeasureBandwidthWorkersTimeout,
 	MeasurementBytesDownLink:       defaultMeasurementBytesDownLink,
+	MeasurementBytesUpLink:         defaultMeasurementBytesUpLink,
+	MeasurePingCount:               defaultMeasurePingCount,
+	MeasurementCacheTTL:            defaultMeasurementCacheTTL,
 	MaxMeasureWorkerPoolSize:       defaultMaxMeasureWorkerPoolSize,
 	ReverseSubscriptionPrefix:      DefaultSubscriptionPrefix,
 	ReverseServiceName:             DefaultReverseServiceName,
 	ReverseMinFlushAmount:          defaultNanoPayMinFlushAmount,
 	ReverseServiceListenIP:         defaultReverseServiceListenIP,
 	MinBalance:                     defaultMinBalance,
+	QualityMaxFailures:             defaultQualityMaxFailures,
+	QualityAlternateInterval:       defaultQualityAlternateInterval,
+	MigrationDrainTimeout:          defaultMigrationDrainTimeout,
 }
 
 func DefaultEntryConfig() *EntryConfiguration {
@@ -120,20 +153,39 @@ type ExitConfiguration struct {
 	ReverseEncryption              string                                                            `json:"reverseEncryption"`
 	GeoDBPath                      string                                                            `json:"geoDBPath"`
 	DownloadGeoDB                  bool                                                              `json:"downloadGeoDB"`
+	GeoProviders                   []geo.ProviderConfig                                              `json:"geoProviders"`
+	GeoOffline                     bool                                                              `json:"geoOffline"`
+	GeoCacheSize                   int32                                                             `json:"geoCacheSize"`
 	GetSubscribersBatchSize        int32                                                             `json:"getSubscribersBatchSize"`
+	IPFilter                       geo.IPFilter                                                      `json:"ipFilter"`
 	ReverseIPFilter                geo.IPFilter                                                      `json:"reverseIPFilter"`
 	ReverseNknFilter               filter.NknFilter                                                  `json:"reverseNknFilter"`
 	MeasureBandwidth               bool                                                              `json:"measureBandwidth"`
 	MeasureBandwidthTimeout        int32                                                             `json:"measureBandwidthTimeout"`
 	MeasureBandwidthWorkersTimeout int32                                                             `json:"measureBandwidthWorkersTimeout"`
 	MeasurementBytesDownLink       int32                                                             `json:"measurementBytesDownLink"`
+	MeasurementBytesUpLink         int32                                                             `json:"measurementBytesUpLink"`
+	BandwidthDirection             string                                                            `json:"bandwidthDirection"`
+	MeasurePing                    bool                                                              `json:"measurePing"`
+	MeasurePingCount               int32                                                             `json:"measurePingCount"`
+	MeasurementCacheTTL            int32                                                             `json:"measurementCacheTTL"`
 	MeasureStoragePath             string                                                            `json:"measureStoragePath"`
 	MaxMeasureWorkerPoolSize       int32                                                             `json:"maxMeasureWorkerPoolSize"`
 	SortMeasuredNodes              func(types.Nodes)                                                 `json:"-"`
+	Discovery                      *DiscoveryConfig                                                  `json:"discovery"`
+	ServiceDiscovery               Discovery                                                         `json:"-"`
+	MetricsListenAddr              string                                                            `json:"metricsListenAddr"`
+	AdminListenAddr                string                                                            `json:"adminListenAddr"`
+	Logger                         *slog.Logger                                                      `json:"-"`
+	Events                         *Events                                                           `json:"-"`
 	TcpDialContext                 func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	HttpDialContext                func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	WsDialContext                  func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
 	ReverseMinBalance              string                                                            `json:"reverseMinBalance"`
+	Region                         string                                                            `json:"region"`
+	MaxBandwidth                   int32                                                             `json:"maxBandwidth"`
+	MaxSessions                    int32                                                             `json:"maxSessions"`
+	Labels                         map[string]string                                                 `json:"labels"`
 }
 
 var defaultExitConfiguration = ExitConfiguration{
@@ -142,6 +194,9 @@ var defaultExitConfiguration = ExitConfiguration{
 	MeasureBandwidthTimeout:        defaultMeasureBandwidthTimeout,
 	MeasureBandwidthWorkersTimeout: defaultMeasureBandwidthWorkersTimeout,
 	MeasurementBytesDownLink:       defaultMeasurementBytesDownLink,
+	MeasurementBytesUpLink:         defaultMeasurementBytesUpLink,
+	MeasurePingCount:               defaultMeasurePingCount,
+	MeasurementCacheTTL:            defaultMeasurementCacheTTL,
 	MaxMeasureWorkerPoolSize:       defaultMaxMeasureWorkerPoolSize,
 	MinFlushAmount:                 defaultNanoPayMinFlushAmount,
 	ReverseSubscriptionPrefix:      DefaultSubscriptionPrefix,
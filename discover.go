@@ -0,0 +1,88 @@
+package tuna
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna/pb"
+	tunaUtil "github.com/nknorg/tuna/util"
+)
+
+const (
+	discoverPageSize          = 1000
+	discoverConcurrentWorkers = 16
+)
+
+// SubscriberInfo is a subscriber of a service topic with decoded metadata.
+type SubscriberInfo struct {
+	Address       string              `json:"address"`
+	Metadata      *pb.ServiceMetadata `json:"metadata,omitempty"`
+	MetadataError string              `json:"metadataError,omitempty"`
+	ExpiresAt     int32               `json:"expiresAt,omitempty"` // block height, 0 if unknown
+	InTxPool      bool                `json:"inTxPool,omitempty"`  // subscription is not in a block yet
+}
+
+// GetServiceSubscribersContext returns all subscribers of topic, including
+// subscriptions still in the txpool. If withExpiry is true, the expiry height
+// of each subscription is queried too, which needs one RPC call per
+// subscriber.
+func GetServiceSubscribersContext(ctx context.Context, topic string, withExpiry bool, config nkn.RPCConfigInterface) ([]*SubscriberInfo, error) {
+	subscribers := make([]*SubscriberInfo, 0)
+	seen := make(map[string]struct{})
+	add := func(address, meta string, inTxPool bool) {
+		if _, ok := seen[address]; ok {
+			return
+		}
+		seen[address] = struct{}{}
+		subscriber := &SubscriberInfo{Address: address, InTxPool: inTxPool}
+		metadata, err := ReadMetadata(meta)
+		if err != nil {
+			subscriber.MetadataError = err.Error()
+		} else {
+			subscriber.Metadata = metadata
+		}
+		subscribers = append(subscribers, subscriber)
+	}
+
+	for offset := 0; ; offset += discoverPageSize {
+		res, err := nkn.GetSubscribersContext(ctx, topic, offset, discoverPageSize, true, offset == 0, nil, config)
+		if err != nil {
+			return nil, err
+		}
+		for address, meta := range res.Subscribers.Map() {
+			add(address, meta, false)
+		}
+		if res.SubscribersInTxPool != nil {
+			for address, meta := range res.SubscribersInTxPool.Map() {
+				add(address, meta, true)
+			}
+		}
+		if res.Subscribers.Len() < discoverPageSize {
+			break
+		}
+	}
+
+	if withExpiry {
+		wg := &sync.WaitGroup{}
+		jobChan := make(chan tunaUtil.Job, 1)
+		go tunaUtil.WorkPool(discoverConcurrentWorkers, jobChan, wg)
+		for i := range subscribers {
+			subscriber := subscribers[i]
+			if subscriber.InTxPool {
+				continue
+			}
+			wg.Add(1)
+			tunaUtil.Enqueue(jobChan, func() {
+				subscription, err := nkn.GetSubscriptionContext(ctx, topic, subscriber.Address, config)
+				if err == nil {
+					subscriber.ExpiresAt = subscription.ExpiresAt
+				}
+			})
+		}
+		wg.Wait()
+		close(jobChan)
+	}
+
+	return subscribers, nil
+}
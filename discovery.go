@@ -0,0 +1,278 @@
+package tuna
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/nkn/v2/config"
+	"github.com/nknorg/nkn/v2/util/address"
+)
+
+const (
+	DiscoveryNKN  = "nkn"
+	DiscoveryFile = "file"
+	DiscoveryHTTP = "http"
+)
+
+// Discovery publishes and finds service providers. Metadata is the base64
+// encoded ServiceMetadata created by CreateRawMetadata, and topic is the
+// subscription prefix followed by the service name.
+type Discovery interface {
+	// ListContext returns up to n providers of topic, or all providers if n <= 0,
+	// as a map from NKN address to metadata.
+	ListContext(ctx context.Context, topic string, n int) (map[string]string, error)
+	// GetContext returns the metadata of the provider with NKN address addr.
+	GetContext(ctx context.Context, topic, addr string) (string, error)
+	// Publish announces this node with NKN address addr as a provider of topic
+	// in background, and keeps the announcement up to date with metadata until
+	// closeChan is closed. Backends call metadata each time they refresh the
+	// announcement, so it should be cheap. A value received from updateChan,
+	// which can be nil, makes the announcement refreshed at once if metadata
+	// has changed.
+	Publish(topic, addr string, metadata func() string, updateChan <-chan struct{}, closeChan chan struct{})
+}
+
+// waitPublish waits until next fires, or metadata is different from
+// published after a value is received from updateChan. It returns false if
+// closeChan is closed first.
+func waitPublish(next <-chan time.Time, updateChan <-chan struct{}, closeChan chan struct{}, metadata func() string, published string) bool {
+	for {
+		select {
+		case <-next:
+			return true
+		case <-updateChan:
+			if metadata() != published {
+				return true
+			}
+		case <-closeChan:
+			return false
+		}
+	}
+}
+
+// DiscoveryConfig configures a built-in discovery backend.
+type DiscoveryConfig struct {
+	Type  string `json:"type"`  // nkn (default), file or http
+	Path  string `json:"path"`  // providers file of file discovery
+	URL   string `json:"url"`   // registry URL of http discovery
+	TTL   int32  `json:"ttl"`   // seconds a provider published to http registry stays listed without refresh
+	Token string `json:"token"` // http registry token, needed to publish
+}
+
+// NewDiscovery creates a built-in discovery backend from conf. Subscription
+// manager and parameters are only used by NKN discovery to publish.
+func NewDiscovery(conf *DiscoveryConfig, client *nkn.MultiClient, subscriptions *SubscriptionManager, subscriptionDuration uint32, subscriptionFee string, subscriptionReplaceTxPool bool, logger *slog.Logger) (Discovery, error) {
+	if conf == nil {
+		conf = &DiscoveryConfig{}
+	}
+	switch conf.Type {
+	case "", DiscoveryNKN:
+		return &NknDiscovery{
+			Client:                    client,
+			Subscriptions:             subscriptions,
+			SubscriptionDuration:      subscriptionDuration,
+			SubscriptionFee:           subscriptionFee,
+			SubscriptionReplaceTxPool: subscriptionReplaceTxPool,
+			Logger:                    logger,
+		}, nil
+	case DiscoveryFile:
+		if len(conf.Path) == 0 {
+			return nil, fmt.Errorf("file discovery needs a path")
+		}
+		return &FileDiscovery{Path: conf.Path, Logger: logger}, nil
+	case DiscoveryHTTP:
+		if len(conf.URL) == 0 {
+			return nil, fmt.Errorf("http discovery needs a url")
+		}
+		return &HTTPDiscovery{URL: conf.URL, TTL: time.Duration(conf.TTL) * time.Second, Token: conf.Token, Logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery type %q", conf.Type)
+	}
+}
+
+// NknDiscovery finds providers from NKN topic subscriptions and publishes by
+// subscribing to the topic. A subscription manager of the client is created if
+// Subscriptions is nil. Logger defaults to slog.Default().
+type NknDiscovery struct {
+	Client                    *nkn.MultiClient
+	Subscriptions             *SubscriptionManager
+	SubscriptionDuration      uint32
+	SubscriptionFee           string
+	SubscriptionReplaceTxPool bool
+	Logger                    *slog.Logger
+
+	subscriptionsLock sync.Mutex
+}
+
+// ListContext returns up to n subscribers of topic. When there are more
+// subscribers, a random sample is taken using address prefixes.
+func (d *NknDiscovery) ListContext(ctx context.Context, topic string, n int) (map[string]string, error) {
+	subscribers, err := d.Client.GetSubscribersContext(ctx, topic, 0, n, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if subscribers.Subscribers.Len() == 0 {
+		return map[string]string{}, nil
+	}
+
+	var allPrefix [][]byte
+	if subscribers.Subscribers.Len() < n {
+		allPrefix = make([][]byte, 1)
+	} else {
+		allPrefix = make([][]byte, 256)
+		for i := 0; i < 256; i++ {
+			allPrefix[i] = []byte{byte(i)}
+		}
+	}
+
+	rand.Shuffle(len(allPrefix), func(i, j int) {
+		allPrefix[i], allPrefix[j] = allPrefix[j], allPrefix[i]
+	})
+
+	subscriberRaw := make(map[string]string)
+	subscriberCount := 0
+	for i := 0; i < len(allPrefix); i++ {
+		count, err := d.Client.GetSubscribersCountContext(ctx, topic, allPrefix[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if count > 0 {
+			offset := rand.Intn((count-1)/n + 1)
+			subscribers, err := d.Client.GetSubscribersContext(ctx, topic, offset*n, n, true, false, allPrefix[i])
+			if err != nil {
+				return nil, err
+			}
+
+			for subscriber, meta := range subscribers.Subscribers.Map() {
+				if _, ok := subscriberRaw[subscriber]; !ok {
+					subscriberRaw[subscriber] = meta
+					subscriberCount++
+				}
+			}
+			if subscriberCount >= n {
+				break
+			}
+		}
+
+		if i+maxRPCRequests < len(allPrefix) {
+			estimatedRemainingRequests := float64(n-subscriberCount) / (float64(subscriberCount+1) / float64(i+1))
+			if estimatedRemainingRequests > maxRPCRequests {
+				i = len(allPrefix) - 1
+				allPrefix = append(allPrefix, nil)
+			}
+		}
+	}
+
+	return subscriberRaw, nil
+}
+
+func (d *NknDiscovery) subscriptions() *SubscriptionManager {
+	d.subscriptionsLock.Lock()
+	defer d.subscriptionsLock.Unlock()
+	if d.Subscriptions == nil {
+		d.Subscriptions = NewSubscriptionManager(d.Client, d.Logger)
+	}
+	return d.Subscriptions
+}
+
+func (d *NknDiscovery) GetContext(ctx context.Context, topic, addr string) (string, error) {
+	subscription, err := d.Client.GetSubscriptionContext(ctx, topic, addr)
+	if err != nil {
+		return "", err
+	}
+	return subscription.Meta, nil
+}
+
+// Publish subscribes to topic with the client of d, and renews the
+// subscription before it expires or metadata changes. addr is ignored as the
+// subscriber is always the client.
+func (d *NknDiscovery) Publish(topic, addr string, metadata func() string, updateChan <-chan struct{}, closeChan chan struct{}) {
+	client := d.Client
+	subscriptions := d.subscriptions()
+	logger := loggerOrDefault(d.Logger).With("topic", topic)
+	identifier := ""
+	subInterval := config.ConsensusDuration
+	if d.SubscriptionDuration > 3 {
+		subInterval = time.Duration(d.SubscriptionDuration-3) * config.ConsensusDuration
+	}
+	var nextSub <-chan time.Time
+
+	go func() {
+		for {
+			nextSub = time.After(0)
+			meta := metadata()
+
+			func() {
+				sub, err := client.GetSubscription(topic, address.MakeAddressString(client.PubKey(), identifier))
+				if err != nil {
+					logger.Warn("Get existing subscription error", "error", err)
+					return
+				}
+
+				if len(sub.Meta) == 0 && sub.ExpiresAt == 0 {
+					return
+				}
+
+				if sub.Meta != meta {
+					logger.Info("Existing subscription meta need update")
+					return
+				}
+
+				height, err := client.GetHeight()
+				if err != nil {
+					logger.Warn("Get current height error", "error", err)
+					return
+				}
+
+				if sub.ExpiresAt-height < 3 {
+					logger.Info("Existing subscription is expiring")
+					return
+				}
+
+				logger.Info("Existing subscription expires later", "blocks", sub.ExpiresAt-height)
+				subscriptions.SetExpiresAt(identifier, topic, sub.ExpiresAt)
+
+				maxSubDuration := float64(sub.ExpiresAt-height) * float64(config.ConsensusDuration)
+				nextSub = time.After(time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * maxSubDuration))
+			}()
+
+			if !waitPublish(nextSub, updateChan, closeChan, metadata, meta) {
+				return
+			}
+			meta = metadata()
+
+			subFee, err := common.StringToFixed64(d.SubscriptionFee)
+			if err != nil {
+				logger.Error("Parse subscription fee error", "error", err)
+			}
+
+			if subFee > 0 {
+				balance, err := client.Balance()
+				if err != nil {
+					logger.Warn("Get balance error", "error", err)
+				} else {
+					if subFee > balance.ToFixed64() {
+						subFee = balance.ToFixed64()
+					}
+				}
+			}
+
+			subscriptions.Subscribe(identifier, topic, int(d.SubscriptionDuration), meta, &nkn.TransactionConfig{Fee: subFee.String()}, d.SubscriptionReplaceTxPool)
+
+			next := time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * float64(subInterval))
+			if next > maxCheckSubscribeInterval {
+				next = maxCheckSubscribeInterval
+			}
+			if !waitPublish(time.After(next), updateChan, closeChan, metadata, meta) {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,176 @@
+package tuna
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/util"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	fileDiscoveryRefreshInterval = 10 * time.Second
+)
+
+var fileDiscoveryMutex sync.Mutex
+
+// FileDiscovery reads providers from a JSON file that maps topic to providers,
+// and each provider NKN address to its metadata. Metadata can be either the
+// base64 encoded string or a JSON object of ServiceMetadata fields, e.g.
+//
+//	{"tuna_v1.httpproxy": {"<address>": {"ip": "1.2.3.4", "tcp_port": 30010, "udp_port": 30011, "price": "0.001"}}}
+//
+// Publish adds this node to the file, updates it when metadata changes and
+// removes it when closeChan is closed, so the file can be shared by exits and
+// entries on the same host. Logger defaults to slog.Default().
+type FileDiscovery struct {
+	Path   string
+	Logger *slog.Logger
+}
+
+func (d *FileDiscovery) read() (map[string]map[string]json.RawMessage, error) {
+	providers := make(map[string]map[string]json.RawMessage)
+	b, err := os.ReadFile(d.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return providers, nil
+		}
+		return nil, err
+	}
+	if len(b) == 0 {
+		return providers, nil
+	}
+	err = json.Unmarshal(b, &providers)
+	if err != nil {
+		return nil, fmt.Errorf("parse discovery file %s error: %v", d.Path, err)
+	}
+	return providers, nil
+}
+
+// fileMetadata returns the base64 encoded metadata of a provider in file.
+func fileMetadata(raw json.RawMessage) (string, error) {
+	var metadata string
+	if json.Unmarshal(raw, &metadata) == nil {
+		return metadata, nil
+	}
+	m := &pb.ServiceMetadata{}
+	err := json.Unmarshal(raw, m)
+	if err != nil {
+		return "", err
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (d *FileDiscovery) ListContext(ctx context.Context, topic string, n int) (map[string]string, error) {
+	providers, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+	// sort so that the same providers are listed each time if truncated
+	addrs := make([]string, 0, len(providers[topic]))
+	for addr := range providers[topic] {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	res := make(map[string]string)
+	for _, addr := range addrs {
+		if n > 0 && len(res) >= n {
+			break
+		}
+		metadata, err := fileMetadata(providers[topic][addr])
+		if err != nil {
+			loggerOrDefault(d.Logger).Warn("Invalid metadata in discovery file", "address", addr, "path", d.Path, "error", err)
+			continue
+		}
+		res[addr] = metadata
+	}
+	return res, nil
+}
+
+func (d *FileDiscovery) GetContext(ctx context.Context, topic, addr string) (string, error) {
+	providers, err := d.read()
+	if err != nil {
+		return "", err
+	}
+	raw, ok := providers[topic][addr]
+	if !ok {
+		return "", fmt.Errorf("%s is not a provider of %s", addr, topic)
+	}
+	return fileMetadata(raw)
+}
+
+func (d *FileDiscovery) Publish(topic, addr string, metadata func() string, updateChan <-chan struct{}, closeChan chan struct{}) {
+	logger := loggerOrDefault(d.Logger).With("topic", topic, "path", d.Path)
+	go func() {
+		published := ""
+		for {
+			meta := metadata()
+			if meta != published {
+				err := d.update(topic, addr, meta)
+				if err != nil {
+					logger.Warn("Publish to discovery file error", "error", err)
+				} else {
+					published = meta
+					logger.Info("Published to discovery file")
+				}
+			}
+
+			if !waitPublish(time.After(fileDiscoveryRefreshInterval), updateChan, closeChan, metadata, published) {
+				err := d.update(topic, addr, "")
+				if err != nil {
+					logger.Warn("Remove from discovery file error", "error", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// update sets the metadata of addr in topic, or removes it if metadata is
+// empty.
+func (d *FileDiscovery) update(topic, addr, metadata string) error {
+	fileDiscoveryMutex.Lock()
+	defer fileDiscoveryMutex.Unlock()
+
+	lock, err := util.LockFile(d.Path)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	providers, err := d.read()
+	if err != nil {
+		return err
+	}
+	if len(metadata) > 0 {
+		if providers[topic] == nil {
+			providers[topic] = make(map[string]json.RawMessage)
+		}
+		raw, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		providers[topic][addr] = raw
+	} else {
+		delete(providers[topic], addr)
+		if len(providers[topic]) == 0 {
+			delete(providers, topic)
+		}
+	}
+
+	return util.WriteJSON(d.Path, providers)
+}
@@ -0,0 +1,319 @@
+package tuna
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHTTPDiscoveryTTL     = 10 * time.Minute
+	maxHTTPDiscoveryTTL         = 24 * time.Hour
+	httpDiscoveryRequestTimeout = 10 * time.Second
+	maxHTTPDiscoveryRetryDelay  = time.Minute
+	maxHTTPRegistryBodySize     = 1 << 16
+)
+
+// HTTPDiscovery uses a registry server with the following API, where topic
+// and address are path escaped:
+//
+//	GET    <url>/topics/<topic>?limit=<n>  {"providers": {"<address>": "<metadata>"}}
+//	GET    <url>/topics/<topic>/<address>  {"metadata": "<metadata>"}, 404 if not found
+//	PUT    <url>/topics/<topic>/<address>  {"metadata": "<metadata>", "ttl": <seconds>}
+//	DELETE <url>/topics/<topic>/<address>
+//
+// PUT and DELETE carry the header "Authorization: Bearer <token>". HTTPRegistry
+// implements the server side. Published providers are refreshed every half
+// TTL and deleted when closeChan is closed. Logger defaults to
+// slog.Default().
+type HTTPDiscovery struct {
+	URL    string
+	TTL    time.Duration
+	Token  string // registry token, only needed to publish
+	Client *http.Client
+	Logger *slog.Logger
+}
+
+type httpDiscoveryProviders struct {
+	Providers map[string]string `json:"providers"`
+}
+
+type httpDiscoveryProvider struct {
+	Metadata string `json:"metadata"`
+	TTL      int64  `json:"ttl,omitempty"`
+}
+
+func (d *HTTPDiscovery) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	return &http.Client{Timeout: httpDiscoveryRequestTimeout}
+}
+
+func (d *HTTPDiscovery) ttl() time.Duration {
+	if d.TTL <= 0 {
+		return defaultHTTPDiscoveryTTL
+	}
+	return d.TTL
+}
+
+func (d *HTTPDiscovery) topicURL(topic string) string {
+	return strings.TrimRight(d.URL, "/") + "/topics/" + url.PathEscape(topic)
+}
+
+func (d *HTTPDiscovery) providerURL(topic, addr string) string {
+	return d.topicURL(topic) + "/" + url.PathEscape(addr)
+}
+
+// do sends a request with optional JSON body and decodes the JSON response
+// into res if res is not nil.
+func (d *HTTPDiscovery) do(ctx context.Context, method, reqURL string, body, res interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if method != http.MethodGet && len(d.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+d.Token)
+	}
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, reqURL, resp.Status)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (d *HTTPDiscovery) ListContext(ctx context.Context, topic string, n int) (map[string]string, error) {
+	reqURL := d.topicURL(topic)
+	if n > 0 {
+		reqURL += "?limit=" + strconv.Itoa(n)
+	}
+	res := &httpDiscoveryProviders{}
+	err := d.do(ctx, http.MethodGet, reqURL, nil, res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Providers == nil {
+		res.Providers = make(map[string]string)
+	}
+	return res.Providers, nil
+}
+
+func (d *HTTPDiscovery) GetContext(ctx context.Context, topic, addr string) (string, error) {
+	res := &httpDiscoveryProvider{}
+	err := d.do(ctx, http.MethodGet, d.providerURL(topic, addr), nil, res)
+	if err != nil {
+		return "", err
+	}
+	return res.Metadata, nil
+}
+
+func (d *HTTPDiscovery) Publish(topic, addr string, metadata func() string, updateChan <-chan struct{}, closeChan chan struct{}) {
+	ttl := d.ttl()
+	logger := loggerOrDefault(d.Logger).With("topic", topic, "url", d.URL)
+	go func() {
+		retryDelay := time.Second
+		for {
+			provider := &httpDiscoveryProvider{Metadata: metadata(), TTL: int64(ttl / time.Second)}
+			ctx, cancel := context.WithTimeout(context.Background(), httpDiscoveryRequestTimeout)
+			err := d.do(ctx, http.MethodPut, d.providerURL(topic, addr), provider, nil)
+			cancel()
+
+			next := ttl / 2
+			if err != nil {
+				logger.Warn("Publish to discovery registry error", "error", err, "retryIn", retryDelay)
+				next = retryDelay
+				retryDelay *= 2
+				if retryDelay > maxHTTPDiscoveryRetryDelay {
+					retryDelay = maxHTTPDiscoveryRetryDelay
+				}
+			} else {
+				retryDelay = time.Second
+			}
+
+			if !waitPublish(time.After(next), updateChan, closeChan, metadata, provider.Metadata) {
+				ctx, cancel := context.WithTimeout(context.Background(), httpDiscoveryRequestTimeout)
+				err = d.do(ctx, http.MethodDelete, d.providerURL(topic, addr), nil, nil)
+				cancel()
+				if err != nil {
+					logger.Warn("Remove from discovery registry error", "error", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+type httpRegistryProvider struct {
+	metadata  string
+	expiresAt time.Time
+}
+
+// HTTPRegistry is an in-memory registry server for HTTPDiscovery. Anyone can
+// list providers, while publishing and removing them needs Token. A registry
+// without Token is read only.
+type HTTPRegistry struct {
+	sync.Mutex
+	Token  string
+	topics map[string]map[string]*httpRegistryProvider
+}
+
+func NewHTTPRegistry(token string) *HTTPRegistry {
+	return &HTTPRegistry{Token: token, topics: make(map[string]map[string]*httpRegistryProvider)}
+}
+
+// authorized returns whether req carries the registry token.
+func (r *HTTPRegistry) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && len(r.Token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(r.Token)) == 1
+}
+
+func (r *HTTPRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.EscapedPath()
+	if !strings.HasPrefix(path, "/topics/") {
+		http.NotFound(w, req)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/topics/"), "/")
+	if len(parts) > 2 || len(parts[0]) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	topic, err := url.PathUnescape(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(parts) == 1 {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		writeRegistryJSON(w, &httpDiscoveryProviders{Providers: r.list(topic, limit)})
+		return
+	}
+
+	addr, err := url.PathUnescape(parts[1])
+	if err != nil || len(addr) == 0 {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+
+	if (req.Method == http.MethodPut || req.Method == http.MethodDelete) && !r.authorized(req) {
+		http.Error(w, "invalid registry token", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		metadata, ok := r.get(topic, addr)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		writeRegistryJSON(w, &httpDiscoveryProvider{Metadata: metadata})
+	case http.MethodPut:
+		provider := &httpDiscoveryProvider{}
+		err = json.NewDecoder(io.LimitReader(req.Body, maxHTTPRegistryBodySize)).Decode(provider)
+		if err != nil || len(provider.Metadata) == 0 {
+			http.Error(w, "invalid provider", http.StatusBadRequest)
+			return
+		}
+		ttl := time.Duration(provider.TTL) * time.Second
+		if ttl <= 0 {
+			ttl = defaultHTTPDiscoveryTTL
+		} else if ttl > maxHTTPDiscoveryTTL {
+			ttl = maxHTTPDiscoveryTTL
+		}
+		r.put(topic, addr, provider.Metadata, ttl)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		r.delete(topic, addr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeRegistryJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("Write registry response error", "error", err)
+	}
+}
+
+func (r *HTTPRegistry) list(topic string, limit int) map[string]string {
+	r.Lock()
+	defer r.Unlock()
+	providers := make(map[string]string)
+	now := time.Now()
+	for addr, p := range r.topics[topic] {
+		if now.After(p.expiresAt) {
+			delete(r.topics[topic], addr)
+			continue
+		}
+		if limit > 0 && len(providers) >= limit {
+			continue
+		}
+		providers[addr] = p.metadata
+	}
+	return providers
+}
+
+func (r *HTTPRegistry) get(topic, addr string) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	p, ok := r.topics[topic][addr]
+	if !ok || time.Now().After(p.expiresAt) {
+		return "", false
+	}
+	return p.metadata, true
+}
+
+func (r *HTTPRegistry) put(topic, addr, metadata string, ttl time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	if r.topics[topic] == nil {
+		r.topics[topic] = make(map[string]*httpRegistryProvider)
+	}
+	r.topics[topic][addr] = &httpRegistryProvider{metadata: metadata, expiresAt: time.Now().Add(ttl)}
+}
+
+func (r *HTTPRegistry) delete(topic, addr string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.topics[topic], addr)
+	if len(r.topics[topic]) == 0 {
+		delete(r.topics, topic)
+	}
+}
@@ -2,9 +2,9 @@ package tuna
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -17,17 +17,35 @@ import (
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/util"
 	"github.com/patrickmn/go-cache"
-	"github.com/rdegges/go-ipify"
 	"github.com/xtaci/smux"
 )
 
+// sessionPayment is the traffic paid by one payment loop of an entry. After
+// migrating to another exit, streams draining on the old session keep
+// counting to its payment, which is paid to the old exit until the session
+// is closed.
+type sessionPayment struct {
+	// It's important to keep these uint64 field on top to avoid panic on arm32
+	// architecture: https://github.com/golang/go/issues/23345
+	bytesEntryToExit     uint64
+	bytesEntryToExitPaid uint64
+	bytesExitToEntry     uint64
+	bytesExitToEntryPaid uint64
+
+	// set when retired by migration, guarded by sessionLock of the entry
+	retired         bool
+	paymentStream   *smux.Stream
+	paymentReceiver string
+
+	closeChan chan struct{}
+	done      chan struct{}
+}
+
 type TunaEntry struct {
 	// It's important to keep these uint64 field on top to avoid panic on arm32
 	// architecture: https://github.com/golang/go/issues/23345
-	bytesEntryToExit        uint64
-	bytesEntryToExitPaid    uint64
+	bytesEntryToExit        uint64 // of payments that have stopped
 	bytesExitToEntry        uint64
-	bytesExitToEntryPaid    uint64
 	reverseBytesEntryToExit uint64
 	reverseBytesExitToEntry uint64
 
@@ -38,8 +56,11 @@ type TunaEntry struct {
 	clientAddr         *cache.Cache
 	session            *smux.Session
 	paymentStream      *smux.Stream
+	payment            *sessionPayment
 	reverseBeneficiary common.Uint160
 	sessionLock        sync.Mutex
+	paymentsLock       sync.Mutex
+	payments           map[*sessionPayment]struct{}
 }
 
 func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet, client *nkn.MultiClient, config *EntryConfiguration) (*TunaEntry, error) {
@@ -50,11 +71,25 @@ func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet,
 	if !config.Reverse {
 		_, err = common.StringToFixed64(config.NanoPayFee)
 		if err != nil {
-			log.Fatalln("Parse NanoPayFee error:", err)
+			return nil, fmt.Errorf("%w: parse NanoPayFee %q: %v", ErrInvalidFee, config.NanoPayFee, err)
 		}
 		_, err = common.StringToFixed64(config.MinNanoPayFee)
 		if err != nil {
-			log.Fatalln("Parse MinNanoPayFee error:", err)
+			return nil, fmt.Errorf("%w: parse MinNanoPayFee %q: %v", ErrInvalidFee, config.MinNanoPayFee, err)
+		}
+	}
+
+	selector := config.NodeSelector
+	if selector == nil {
+		selectorConfig := config.Selector
+		if serviceInfo.Selector != nil {
+			selectorConfig = serviceInfo.Selector
+		}
+		if selectorConfig != nil && len(selectorConfig.Strategy) > 0 {
+			selector, err = NewSelector(selectorConfig)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -70,24 +105,46 @@ func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet,
 		config.Reverse,
 		config.GeoDBPath,
 		config.DownloadGeoDB,
+		config.GeoProviders,
+		config.GeoOffline,
+		config.GeoCacheSize,
 		config.GetSubscribersBatchSize,
 		config.MeasureBandwidth,
 		config.MeasureBandwidthTimeout,
 		config.MeasureBandwidthWorkersTimeout,
 		config.MeasurementBytesDownLink,
+		config.MeasurementBytesUpLink,
+		config.BandwidthDirection,
+		config.MeasurePing,
+		config.MeasurePingCount,
+		config.MeasurementCacheTTL,
 		config.MeasureStoragePath,
 		config.MaxMeasureWorkerPoolSize,
 		config.TcpDialContext,
 		config.HttpDialContext,
 		config.WsDialContext,
 		config.SortMeasuredNodes,
+		selector,
 		nil,
 		config.MinBalance,
+		config.Logger,
+		config.Events,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.ServiceDiscovery != nil {
+		c.Discovery = config.ServiceDiscovery
+	} else if config.Discovery != nil {
+		c.Discovery, err = NewDiscovery(config.Discovery, c.Client, c.Subscriptions, uint32(config.ReverseSubscriptionDuration), config.ReverseSubscriptionFee, config.ReverseSubscriptionReplaceTxPool, c.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.minBandwidth = max(config.QualityMinBandwidth, selectorMinBandwidth(selector))
+
 	te := &TunaEntry{
 		Common:       c,
 		config:       config,
@@ -95,29 +152,49 @@ func NewTunaEntry(service Service, serviceInfo ServiceInfo, wallet *nkn.Wallet,
 		serviceConn:  make(map[byte]*net.UDPConn),
 		clientAddr:   cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
 	}
+	te.metricsRole = metricsRoleEntry
+	te.unregisterMetrics = DefaultMetrics.register(te.collectMetrics)
+	DefaultAdmin.AddEntry(te)
 	return te, nil
 }
 
 func (te *TunaEntry) Start(shouldReconnect bool) error {
+	return te.StartContext(context.Background(), shouldReconnect)
+}
+
+// StartContext is like Start, but stops selecting, measuring and dialing
+// exits and closes the entry without waiting for streams when ctx is done.
+func (te *TunaEntry) StartContext(ctx context.Context, shouldReconnect bool) error {
 	defer te.Close()
 
+	stop := context.AfterFunc(ctx, func() { te.Shutdown(ctx) })
+	defer stop()
+
 	for {
 		if te.IsClosed() {
-			return nil
+			return ctx.Err()
 		}
 
-		err := te.CreateServerConn(true)
+		err := te.CreateServerConnContext(ctx, true)
 		if err != nil {
-			log.Println("Couldn't connect to node:", err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			te.logger.Warn("Couldn't connect to node", "error", err)
 			if errors.Is(err, nkn.ErrInsufficientBalance) {
 				return err
 			}
-			time.Sleep(1 * time.Second)
+			sleepContext(ctx, time.Second)
 			continue
 		}
+		te.sessionLock.Lock()
+		payment := te.startSessionPayment()
+		te.payment = payment
+		te.sessionLock.Unlock()
+
 		if te.udpConn != nil {
-			te.startUDPReaderWriter(te.udpConn, nil, &te.bytesExitToEntry, &te.bytesEntryToExit)
-			go sendPingMsg(te.udpConn, te.udpCloseChan)
+			te.startUDPReaderWriter(te.udpConn, nil, &payment.bytesExitToEntry, &payment.bytesEntryToExit)
+			go te.sendPingMsg(te.udpConn, te.udpCloseChan)
 		}
 		go func() {
 			for {
@@ -128,8 +205,16 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 
 				_, err = session.AcceptStream()
 				if err != nil {
-					log.Println("Close connection:", err)
+					te.logger.Info("Close connection", "remoteAddr", session.RemoteAddr(), "error", err)
 					session.Close()
+					if !te.isCurrentSession(session) {
+						// session was drained after migrating to another exit
+						continue
+					}
+					te.emitEvent(&Event{Type: EventDisconnected, RemoteNknAddress: te.GetRemoteNknAddress(), RemoteNetAddr: session.RemoteAddr().String(), Error: err.Error()})
+					if !te.IsClosed() {
+						te.recordSessionEnd("early disconnect: " + err.Error())
+					}
 					if !shouldReconnect {
 						te.Close()
 						return
@@ -138,20 +223,10 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 			}
 		}()
 
-		getPaymentStreamRecipient := func() (*smux.Stream, string, error) {
-			ps, err := te.getPaymentStream()
-			return ps, te.GetPaymentReceiver(), err
+		if te.config.QualityCheckInterval > 0 && te.canMigrate() {
+			go te.monitorQuality()
 		}
 
-		go te.startPayment(
-			&te.bytesEntryToExit, &te.bytesExitToEntry,
-			&te.bytesEntryToExitPaid, &te.bytesExitToEntryPaid,
-			te.config.NanoPayFee,
-			te.config.MinNanoPayFee,
-			te.config.NanoPayFeeRatio,
-			getPaymentStreamRecipient,
-		)
-
 		break
 	}
 
@@ -165,7 +240,7 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 		return err
 	}
 	if len(tcpPorts) > 0 {
-		log.Printf("Serving %s on localhost tcp port %v", te.Service.Name, tcpPorts)
+		te.logger.Info("Serving on localhost tcp ports", "ports", tcpPorts)
 	}
 
 	udpPorts, err := te.listenUDP(listenIP, te.Service.UDP)
@@ -173,8 +248,9 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 		return err
 	}
 	if len(udpPorts) > 0 {
-		log.Printf("Serving %s on localhost udp port %v", te.Service.Name, udpPorts)
+		te.logger.Info("Serving on localhost udp ports", "ports", udpPorts)
 	}
+	te.emitEvent(&Event{Type: EventListening})
 
 	geoCloseChan := make(chan struct{})
 	defer close(geoCloseChan)
@@ -184,12 +260,16 @@ func (te *TunaEntry) Start(shouldReconnect bool) error {
 
 	<-te.closeChan
 
-	return nil
+	return ctx.Err()
 }
 
 func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.ConnectionMetadata) error {
 	defer te.Close()
 
+	remoteAddr := te.GetTCPConn().RemoteAddr().String()
+	te.emitEvent(&Event{Type: EventConnected, RemoteNetAddr: remoteAddr})
+	defer te.emitEvent(&Event{Type: EventDisconnected, RemoteNetAddr: remoteAddr})
+
 	metadata := te.GetMetadata()
 	listenIP := net.ParseIP(te.ServiceInfo.ListenIP)
 	if listenIP == nil {
@@ -210,8 +290,12 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 			return err
 		}
 	}
+	te.emitEvent(&Event{Type: EventListening, RemoteNetAddr: remoteAddr})
 
-	serviceMetadata := CreateRawMetadata(0, tcpPorts, udpPorts, "", 0, 0, "", te.config.ReverseBeneficiaryAddr)
+	serviceMetadata, err := CreateRawMetadata(0, tcpPorts, udpPorts, "", 0, 0, "", te.config.ReverseBeneficiaryAddr)
+	if err != nil {
+		return err
+	}
 	err = WriteVarBytes(stream, serviceMetadata)
 	if err != nil {
 		return err
@@ -259,9 +343,9 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 		return cost, totalBytes
 	}
 
-	go checkNanoPayClaim(session, npc, onErr, &isClosed)
+	go te.checkNanoPayClaim(session, npc, onErr, &isClosed)
 
-	go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
+	go te.checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
 
 	for {
 		if te.IsClosed() {
@@ -269,7 +353,7 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 		}
 		stream, err := session.AcceptStream()
 		if err != nil {
-			log.Println("Couldn't accept stream:", err)
+			te.logger.Warn("Couldn't accept stream", "remoteAddr", session.RemoteAddr(), "error", err)
 			session.Close()
 			break
 		}
@@ -282,12 +366,12 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 				}
 
 				if streamMetadata.IsPayment {
-					return handlePaymentStream(stream, npc, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
+					return te.handlePaymentStream(stream, npc, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
 				}
 				return nil
 			}()
 			if err != nil {
-				log.Println(err)
+				te.logger.Warn("Handle stream error", "remoteAddr", session.RemoteAddr(), "error", err)
 				Close(stream)
 			}
 		}(stream)
@@ -296,8 +380,37 @@ func (te *TunaEntry) StartReverse(stream *smux.Stream, connMetadata *pb.Connecti
 	return nil
 }
 
+// Close stops accepting connections and closes the entry after waiting for
+// open streams according to SetLinger.
 func (te *TunaEntry) Close() {
+	te.stopAccepting()
 	te.WaitSessions()
+	te.close()
+}
+
+// Shutdown stops accepting connections and waits for open streams to finish
+// until ctx is done, then closes the entry and streams still open. It returns
+// ctx.Err() if streams had to be closed.
+func (te *TunaEntry) Shutdown(ctx context.Context) error {
+	te.stopAccepting()
+	err := te.WaitSessionsContext(ctx)
+	te.close()
+	return err
+}
+
+func (te *TunaEntry) stopAccepting() {
+	te.Common.stopAccepting()
+	te.RLock()
+	defer te.RUnlock()
+	for _, listener := range te.tcpListeners {
+		Close(listener)
+	}
+}
+
+func (te *TunaEntry) close() {
+	te.unregisterMetrics()
+	DefaultAdmin.RemoveEntry(te)
+	te.flushReputations()
 
 	te.Lock()
 	defer te.Unlock()
@@ -319,6 +432,7 @@ func (te *TunaEntry) Close() {
 		te.session.Close()
 	}
 	te.OnConnect.close()
+	te.closeEvents()
 }
 
 func (te *TunaEntry) IsClosed() bool {
@@ -347,19 +461,26 @@ func (te *TunaEntry) createSession(force bool) (*smux.Session, *smux.Stream, err
 }
 
 func (te *TunaEntry) getSession() (*smux.Session, error) {
+	session, _, err := te.getSessionPayment()
+	return session, err
+}
+
+// getSessionPayment returns the session for new streams, and the payment
+// their traffic counts to.
+func (te *TunaEntry) getSessionPayment() (*smux.Session, *sessionPayment, error) {
 	te.sessionLock.Lock()
 	defer te.sessionLock.Unlock()
 
 	if te.session == nil || te.session.IsClosed() {
 		if te.Reverse {
-			return nil, errors.New("reverse connection to exit is dead")
+			return nil, nil, errors.New("reverse connection to exit is dead")
 		}
 
 		session, paymentStream, err := te.createSession(false)
 		if err != nil {
 			session, paymentStream, err = te.createSession(true)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 		}
 
@@ -367,7 +488,61 @@ func (te *TunaEntry) getSession() (*smux.Session, error) {
 		te.paymentStream = paymentStream
 	}
 
-	return te.session, nil
+	return te.session, te.payment, nil
+}
+
+// startSessionPayment starts a payment loop paying traffic counted to the
+// returned payment, until it's retired and closeChan of it is closed. Caller
+// must hold sessionLock.
+func (te *TunaEntry) startSessionPayment() *sessionPayment {
+	p := &sessionPayment{
+		closeChan: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	te.paymentsLock.Lock()
+	if te.payments == nil {
+		te.payments = make(map[*sessionPayment]struct{})
+	}
+	te.payments[p] = struct{}{}
+	te.paymentsLock.Unlock()
+
+	go func() {
+		defer close(p.done)
+		te.startPayment(
+			&p.bytesEntryToExit, &p.bytesExitToEntry,
+			&p.bytesEntryToExitPaid, &p.bytesExitToEntryPaid,
+			te.config.NanoPayFee,
+			te.config.MinNanoPayFee,
+			te.config.NanoPayFeeRatio,
+			func() (*smux.Stream, string, error) {
+				return te.paymentStreamRecipient(p)
+			},
+			p.closeChan,
+		)
+
+		te.paymentsLock.Lock()
+		atomic.AddUint64(&te.bytesEntryToExit, atomic.LoadUint64(&p.bytesEntryToExit))
+		atomic.AddUint64(&te.bytesExitToEntry, atomic.LoadUint64(&p.bytesExitToEntry))
+		delete(te.payments, p)
+		te.paymentsLock.Unlock()
+	}()
+
+	return p
+}
+
+// paymentStreamRecipient returns the payment stream and receiver of the
+// current session, or those of the session p was retired with.
+func (te *TunaEntry) paymentStreamRecipient(p *sessionPayment) (*smux.Stream, string, error) {
+	ps, err := te.getPaymentStream()
+	receiver := te.GetPaymentReceiver()
+
+	te.sessionLock.Lock()
+	defer te.sessionLock.Unlock()
+	if p.retired {
+		return p.paymentStream, p.paymentReceiver, nil
+	}
+	return ps, receiver, err
 }
 
 func (te *TunaEntry) getPaymentStream() (*smux.Stream, error) {
@@ -382,16 +557,16 @@ func (te *TunaEntry) getPaymentStream() (*smux.Stream, error) {
 	return paymentStream, nil
 }
 
-func (te *TunaEntry) openServiceStream(portID byte) (*smux.Stream, error) {
-	session, err := te.getSession()
+func (te *TunaEntry) openServiceStream(portID byte) (*smux.Stream, *sessionPayment, error) {
+	session, payment, err := te.getSessionPayment()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	stream, err := session.OpenStream()
 	if err != nil {
 		session.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
 	streamMetadata := &pb.StreamMetadata{
@@ -403,10 +578,10 @@ func (te *TunaEntry) openServiceStream(portID byte) (*smux.Stream, error) {
 	err = writeStreamMetadata(stream, streamMetadata)
 	if err != nil {
 		stream.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	return stream, nil
+	return stream, payment, nil
 }
 
 func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
@@ -414,7 +589,7 @@ func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
 	for i, _port := range ports {
 		listener, err := net.ListenTCP(tcp4, &net.TCPAddr{IP: ip, Port: int(_port)})
 		if err != nil {
-			log.Println("Couldn't bind listener:", err)
+			te.logger.Error("Couldn't bind tcp listener", "port", _port, "error", err)
 			return nil, err
 		}
 		port := listener.Addr().(*net.TCPAddr).Port
@@ -429,19 +604,19 @@ func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
 				if c, ok := conn.(*net.TCPConn); ok {
 					err := c.SetLinger(5)
 					if err != nil {
-						log.Println("Couldn't set linger:", err)
+						te.logger.Warn("Couldn't set linger", "error", err)
 						continue
 					}
 				}
 				if err != nil {
-					if te.IsClosed() {
+					if te.IsClosed() || te.IsShuttingDown() {
 						return
 					}
 					if strings.Contains(err.Error(), "use of closed network connection") {
 						te.Close()
 						return
 					}
-					log.Println("Couldn't accept connection:", err)
+					te.logger.Warn("Couldn't accept connection", "error", err)
 					time.Sleep(time.Second)
 					continue
 				}
@@ -450,19 +625,19 @@ func (te *TunaEntry) listenTCP(ip net.IP, ports []uint32) ([]uint32, error) {
 					if te.IsClosed() {
 						return
 					}
-					stream, err := te.openServiceStream(portID)
+					stream, payment, err := te.openServiceStream(portID)
 					if err != nil {
-						log.Println("Couldn't open stream:", err)
+						te.logger.Warn("Couldn't open stream", "remoteAddr", conn.RemoteAddr(), "error", err)
 						Close(conn)
 						return
 					}
 
 					if te.config.Reverse {
-						go te.pipe(stream, conn, &te.reverseBytesEntryToExit)
-						go te.pipe(conn, stream, &te.reverseBytesExitToEntry)
+						te.pipeStream(stream, conn, "", &te.reverseBytesEntryToExit, &te.reverseBytesExitToEntry)
+					} else if payment != nil {
+						te.pipeStream(stream, conn, "", &payment.bytesEntryToExit, &payment.bytesExitToEntry)
 					} else {
-						go te.pipe(stream, conn, &te.bytesEntryToExit)
-						go te.pipe(conn, stream, &te.bytesExitToEntry)
+						te.pipeStream(stream, conn, "", &te.bytesEntryToExit, &te.bytesExitToEntry)
 					}
 				}()
 			}
@@ -486,14 +661,14 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 
 			serverReadChan, err := te.GetServerUDPReadChan(false)
 			if err != nil {
-				log.Println("Couldn't get server connection:", err)
+				te.logger.Debug("Couldn't get server connection", "error", err)
 				continue
 			}
 
 			data := <-serverReadChan
 
 			if len(data) < PrefixLen {
-				log.Println("empty udp packet received")
+				te.logger.Warn("Empty udp packet received")
 				te.Close()
 				return
 			}
@@ -504,20 +679,20 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 			var serviceConn *net.UDPConn
 			var ok bool
 			if serviceConn, ok = te.serviceConn[portID]; !ok {
-				log.Println("Couldn't get service conn for portId:", portID)
+				te.logger.Debug("Couldn't get service conn", "portId", portID)
 				continue
 			}
 
 			var x interface{}
 			if x, ok = te.clientAddr.Get(connID); !ok {
-				log.Println("Couldn't get client address for:", connID)
+				te.logger.Debug("Couldn't get client address", "connId", connID)
 				continue
 			}
 			clientAddr := x.(*net.UDPAddr)
 
 			_, _, err = serviceConn.WriteMsgUDP(data[PrefixLen:], nil, clientAddr)
 			if err != nil {
-				log.Println("Couldn't send data to client:", err)
+				te.logger.Debug("Couldn't send data to client", "remoteAddr", clientAddr, "error", err)
 			}
 		}
 	}()
@@ -525,7 +700,7 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 	for i, _port := range ports {
 		localConn, err := net.ListenUDP(udp4, &net.UDPAddr{IP: ip, Port: int(_port)})
 		if err != nil {
-			log.Println("Couldn't bind listener:", err)
+			te.logger.Error("Couldn't bind udp listener", "port", _port, "error", err)
 			return nil, err
 		}
 
@@ -551,7 +726,7 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 
 				n, addr, err := localConn.ReadFromUDP(localBuffer)
 				if err != nil {
-					log.Println("Couldn't receive data from local:", err)
+					te.logger.Warn("Couldn't receive data from local", "error", err)
 					te.Close()
 					return
 				}
@@ -561,7 +736,7 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 
 				serverWriteChan, err := te.GetServerUDPWriteChan(false)
 				if err != nil {
-					log.Println("Couldn't get remote connection:", err)
+					te.logger.Debug("Couldn't get remote connection", "error", err)
 					continue
 				}
 				connID := PortToConnID(uint16(addr.Port))
@@ -574,11 +749,65 @@ func (te *TunaEntry) listenUDP(ip net.IP, ports []uint32) ([]uint32, error) {
 	return assignedPorts, nil
 }
 
+// ReverseEntry serves reverse exits in background. It is returned by
+// StartReverseContext.
+type ReverseEntry struct {
+	entries       *sync.Map // session key to *TunaEntry
+	stopAccepting func()
+	close         func()
+	stopOnce      sync.Once
+	closeOnce     sync.Once
+}
+
+// Shutdown stops accepting reverse exits and new streams, and waits for open
+// streams to finish until ctx is done. Then it closes entries and streams
+// still open, and unsubscribes so that reverse exits stop finding this entry.
+// It returns ctx.Err() if streams had to be closed.
+func (re *ReverseEntry) Shutdown(ctx context.Context) error {
+	re.stopOnce.Do(re.stopAccepting)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var err error
+	re.entries.Range(func(_, te interface{}) bool {
+		wg.Add(1)
+		go func(te *TunaEntry) {
+			defer wg.Done()
+			if e := te.Shutdown(ctx); e != nil {
+				lock.Lock()
+				err = e
+				lock.Unlock()
+			}
+		}(te.(*TunaEntry))
+		return true
+	})
+	wg.Wait()
+
+	re.closeOnce.Do(re.close)
+	return err
+}
+
+// Close closes all entries without waiting for open streams.
+func (re *ReverseEntry) Close() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	re.Shutdown(ctx)
+}
+
 func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
+	_, err := StartReverseContext(context.Background(), config, wallet)
+	return err
+}
+
+// StartReverseContext is like StartReverse, but returns a ReverseEntry to
+// shut down gracefully, and closes it without waiting for streams when ctx is
+// done.
+func StartReverseContext(ctx context.Context, config *EntryConfiguration, wallet *nkn.Wallet) (*ReverseEntry, error) {
 	config, err := MergedEntryConfig(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	logger := loggerOrDefault(config.Logger)
 
 	var serviceListenIP string
 	if net.ParseIP(config.ReverseServiceListenIP) == nil {
@@ -587,19 +816,20 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 		serviceListenIP = config.ReverseServiceListenIP
 	}
 
-	ip, err := ipify.GetIp()
+	ip, err := getIPContext(ctx)
 	if err != nil {
-		return fmt.Errorf("couldn't get IP: %v", err)
+		return nil, fmt.Errorf("couldn't get IP: %w", err)
 	}
 
 	listener, err := net.ListenTCP(tcp4, &net.TCPAddr{Port: int(config.ReverseTCP)})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	uConn, err := net.ListenUDP(udp4, &net.UDPAddr{Port: int(config.ReverseUDP)})
 	if err != nil {
-		return err
+		listener.Close()
+		return nil, err
 	}
 	encConn := NewEncryptUDPConn(uConn)
 	var encKeys, udpEntrys, tcpEntrys, tcpReady, udpReady, addrToKey, keyToAddr sync.Map
@@ -611,13 +841,19 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 		for {
 			n, from, encrypted, err := encConn.ReadFromUDPEncrypted(buffer)
 			if err != nil {
-				log.Println("Couldn't receive exit's data:", err)
+				if encConn.IsClosed() {
+					return
+				}
+				logger.Warn("Couldn't receive exit's data", "error", err)
 				continue
 			}
 			if bytes.Equal(buffer[:PrefixLen], []byte{PrefixLen - 1: 0}) && n > PrefixLen {
 				connMetadata, err := parseUDPConnMetadata(buffer[PrefixLen:n])
 				if err != nil {
-					log.Println("Couldn't read udp metadata from client:", err)
+					logger.Debug("Couldn't read udp metadata from client", "remoteAddr", from, "error", err)
+					continue
+				}
+				if udpPings.handle(encConn, buffer[:n], connMetadata, encrypted, from, logger) {
 					continue
 				}
 				if connMetadata.IsPing || encrypted {
@@ -629,19 +865,19 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 
 				encryptKey, ok := encKeys.Load(k)
 				if !ok {
-					log.Println("no encrypt key found")
+					logger.Debug("No encrypt key found", "remoteAddr", from, "session", sessionKey(k))
 					continue
 				}
 				key := encryptKey.(*[encryptKeySize]byte)
 				err = encConn.AddCodec(from, key, connMetadata.EncryptionAlgo, false)
 				if err != nil {
-					log.Println(err)
+					logger.Error("Add udp codec error", "remoteAddr", from, "session", sessionKey(k), "error", err)
 					return
 				}
 
 				te, ok := tcpEntrys.Load(k)
 				if !ok {
-					log.Println("no encrypt key found from tcp conn")
+					logger.Debug("No entry found for session", "remoteAddr", from, "session", sessionKey(k))
 					continue
 				}
 				t := te.(*TunaEntry)
@@ -658,24 +894,24 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 				continue
 			}
 			if !encrypted {
-				log.Println("Unencrypted udp packet received")
+				logger.Debug("Unencrypted udp packet received", "remoteAddr", from)
 				continue
 			}
 			entry, ok := udpEntrys.Load(from.String())
 			if !ok {
-				log.Println("no entry found for udp data")
+				logger.Debug("No entry found for udp data", "remoteAddr", from)
 				continue
 			}
 			te := entry.(*TunaEntry)
 			udpReadchan, err := te.GetServerUDPReadChan(false)
 			if err != nil {
-				log.Println("Couldn't get udp read chan:", err)
+				logger.Debug("Couldn't get udp read chan", "remoteAddr", from, "error", err)
 				continue
 			}
 			if n > 0 {
 				k, ok := addrToKey.Load(from.String())
 				if !ok {
-					log.Println("no key found for udp data")
+					logger.Debug("No session found for udp data", "remoteAddr", from)
 					continue
 				}
 				b := make([]byte, n)
@@ -695,16 +931,49 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 	}
 	client, err := nkn.NewMultiClient(wallet.Account(), randomIdentifier(), numRPCClients, false, clientConfig)
 	if err != nil {
-		return err
+		listener.Close()
+		encConn.Close()
+		return nil, err
 	}
 
+	discovery := config.ServiceDiscovery
+	var subscriptions *SubscriptionManager
+	if discovery == nil {
+		subscriptions = NewSubscriptionManager(client, logger)
+		discovery, err = NewDiscovery(config.Discovery, client, subscriptions, uint32(config.ReverseSubscriptionDuration), config.ReverseSubscriptionFee, config.ReverseSubscriptionReplaceTxPool, logger)
+		if err != nil {
+			listener.Close()
+			encConn.Close()
+			client.Close()
+			return nil, err
+		}
+	}
+
+	publishCloseChan := make(chan struct{})
+	re := &ReverseEntry{
+		entries: &tcpEntrys,
+		stopAccepting: func() {
+			close(publishCloseChan)
+			listener.Close()
+		},
+		close: func() {
+			encConn.Close()
+			if subscriptions != nil {
+				// so that reverse exits stop finding this entry
+				subscriptions.Close(defaultUnsubscribeTimeout)
+			}
+			client.Close()
+		},
+	}
+	context.AfterFunc(ctx, re.Close)
+
 	go func() {
 		for {
 			tcpConn, err := listener.Accept()
 			if c, ok := tcpConn.(*net.TCPConn); ok {
 				err := c.SetLinger(5)
 				if err != nil {
-					log.Println("Couldn't set linger:", err)
+					logger.Warn("Couldn't set linger", "error", err)
 					continue
 				}
 			}
@@ -712,7 +981,7 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 				if strings.Contains(err.Error(), "use of closed network connection") {
 					return
 				}
-				log.Println("Couldn't accept client connection:", err)
+				logger.Warn("Couldn't accept client connection", "error", err)
 				time.Sleep(time.Second)
 				continue
 			}
@@ -730,6 +999,7 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 					}
 
 					connKey := string(append(connMetadata.PublicKey, connMetadata.Nonce...))
+					te.logger = te.logger.With("remoteAddr", tcpConn.RemoteAddr(), "session", sessionKey(connKey))
 					tcpEntrys.Store(connKey, te)
 					k, _ := te.encryptKeys.Load(connKey)
 					encKeys.Store(connKey, k)
@@ -752,13 +1022,21 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 					}()
 
 					if connMetadata.IsMeasurement {
-						err = util.BandwidthMeasurementServer(encryptedConn, int(connMetadata.MeasurementBytesDownlink), maxMeasureBandwidthTimeout)
+						err = serveMeasurement(encryptedConn, connMetadata)
 						if err != nil {
 							return fmt.Errorf("bandwidth measurement server error: %v", err)
 						}
 						return nil
 					}
 
+					if connMetadata.IsPing {
+						err = util.PingServer(encryptedConn, maxPingServerDuration)
+						if err != nil {
+							return fmt.Errorf("ping server error: %v", err)
+						}
+						return nil
+					}
+
 					te.session, err = smux.Server(encryptedConn, nil)
 					if err != nil {
 						return fmt.Errorf("create session error: %v", err)
@@ -806,12 +1084,12 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 
 							ip, portStr, err := net.SplitHostPort(clientAddr)
 							if err != nil {
-								log.Printf("parse host error: %v\n", err)
+								te.logger.Error("Parse client address error", "error", err)
 								return
 							}
 							port, err := strconv.Atoi(portStr)
 							if err != nil {
-								log.Printf("parse port error: %v\n", err)
+								te.logger.Error("Parse client port error", "error", err)
 								return
 							}
 
@@ -824,12 +1102,12 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 								case data := <-te.udpWriteChan:
 									n, _, err := encConn.WriteMsgUDP(data, nil, &udpAddr)
 									if err != nil {
-										log.Println("couldn't send udp data to server:", err)
+										te.logger.Debug("Couldn't send udp data", "error", err)
 										continue
 									}
 									key, ok := addrToKey.Load(udpAddr.String())
 									if !ok || len(data) < 2 {
-										log.Println("no key found from this udp addr:", udpAddr.String())
+										te.logger.Debug("No session found for udp address", "udpAddr", udpAddr.String())
 										continue
 									}
 									atomic.AddUint64(&te.Common.reverseBytesExitToEntry[key.(string)][data[2]], uint64(n))
@@ -850,31 +1128,20 @@ func StartReverse(config *EntryConfiguration, wallet *nkn.Wallet) error {
 				}()
 				if err != nil {
 					tcpConn.Close()
-					log.Println(err)
+					logger.Warn("Handle client connection error", "remoteAddr", tcpConn.RemoteAddr(), "error", err)
 				}
 			}()
 		}
 	}()
 
+	metadataRaw, err := CreateRawMetadata(0, nil, nil, ip, uint32(config.ReverseTCP), uint32(config.ReverseUDP), config.ReversePrice, config.ReverseBeneficiaryAddr)
+	if err != nil {
+		re.Close()
+		return nil, err
+	}
 	for _, rsn := range strings.Split(config.ReverseServiceName, ",") {
-		UpdateMetadata(
-			strings.Trim(rsn, " "),
-			0,
-			nil,
-			nil,
-			ip,
-			uint32(config.ReverseTCP),
-			uint32(config.ReverseUDP),
-			config.ReversePrice,
-			config.ReverseBeneficiaryAddr,
-			config.ReverseSubscriptionPrefix,
-			uint32(config.ReverseSubscriptionDuration),
-			config.ReverseSubscriptionFee,
-			config.ReverseSubscriptionReplaceTxPool,
-			client,
-			make(chan struct{}),
-		)
+		discovery.Publish(config.ReverseSubscriptionPrefix+strings.Trim(rsn, " "), client.Address(), func() string { return string(metadataRaw) }, nil, publishCloseChan)
 	}
 
-	return nil
+	return re, nil
 }
@@ -2,6 +2,13 @@ package tuna
 
 import "errors"
 
+// Errors returned by entries and exits can be matched with errors.Is.
 var (
-	ErrClosed = errors.New("closed")
+	ErrClosed          = errors.New("closed")
+	ErrInvalidPrice    = errors.New("invalid price")
+	ErrInvalidFee      = errors.New("invalid fee")
+	ErrInvalidMetadata = errors.New("invalid metadata")
+	ErrNoProviders     = errors.New("no service providers")
+	ErrPaymentFailed   = errors.New("payment failed")
+	ErrInvalidConfig   = errors.New("invalid config")
 )
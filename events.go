@@ -0,0 +1,179 @@
+package tuna
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of a lifecycle event.
+type EventType string
+
+const (
+	// EventConnected is emitted when an entry connects to an exit, or an exit
+	// accepts a session from an entry. RemoteNknAddress is the NKN address of
+	// the remote node if known.
+	EventConnected EventType = "connected"
+	// EventDisconnected is emitted when a connected session ends, with Error
+	// set to the reason if any.
+	EventDisconnected EventType = "disconnected"
+	// EventListening is emitted when an entry starts listening on the local
+	// ports of its service.
+	EventListening EventType = "listening"
+	// EventNodeSwitched is emitted when an entry moves new streams from
+	// PreviousNknAddress to RemoteNknAddress.
+	EventNodeSwitched EventType = "nodeSwitched"
+	// EventStreamOpened and EventStreamClosed are emitted for each service
+	// stream, with StreamID and RemoteNetAddr of the service connection.
+	EventStreamOpened EventType = "streamOpened"
+	EventStreamClosed EventType = "streamClosed"
+	// EventPaymentSent is emitted when an entry or reverse exit sends Amount
+	// in nanopay to RemoteNknAddress.
+	EventPaymentSent EventType = "paymentSent"
+	// EventPaymentClaimed is emitted when Amount of a received nanopay is
+	// claimed.
+	EventPaymentClaimed EventType = "paymentClaimed"
+	// EventInsufficientPayment is emitted when a session is closed because
+	// only Amount of Expected was paid.
+	EventInsufficientPayment EventType = "insufficientPayment"
+	// EventBalanceLow is emitted when Balance of the wallet is below
+	// MinBalance, or a payment fails due to insufficient balance.
+	EventBalanceLow EventType = "balanceLow"
+)
+
+// Event is a lifecycle event of an entry or exit. Fields that don't apply to
+// Type are empty.
+type Event struct {
+	Type               EventType `json:"type"`
+	Time               time.Time `json:"time"`
+	Role               string    `json:"role"` // entry or exit
+	Service            string    `json:"service,omitempty"`
+	RemoteNknAddress   string    `json:"remoteNknAddress,omitempty"`
+	RemoteNetAddr      string    `json:"remoteNetAddr,omitempty"` // IP and port
+	PreviousNknAddress string    `json:"previousNknAddress,omitempty"`
+	StreamID           uint32    `json:"streamId,omitempty"`
+	Amount             string    `json:"amount,omitempty"`
+	Expected           string    `json:"expected,omitempty"`
+	Balance            string    `json:"balance,omitempty"`
+	MinBalance         string    `json:"minBalance,omitempty"`
+	Error              string    `json:"error,omitempty"`
+}
+
+// EventFunc is a wrapper type for gomobile compatibility.
+type EventFunc interface{ OnEvent(*Event) }
+
+// EventSubscriber receives events on C, or by Callback if it's not nil.
+// Events are dropped when C is full so that a slow subscriber never blocks
+// traffic, and Callback should return quickly for the same reason.
+type EventSubscriber struct {
+	C        chan *Event
+	Callback EventFunc
+
+	events *Events
+}
+
+// Next waits and returns the next event, or nil if the subscriber is closed.
+func (s *EventSubscriber) Next() *Event {
+	return <-s.C
+}
+
+// Close stops receiving events and closes C.
+func (s *EventSubscriber) Close() {
+	s.events.unsubscribe(s)
+}
+
+// Events dispatches lifecycle events to subscribers. An Events can be shared
+// by multiple entries and exits through their configuration.
+type Events struct {
+	lock        sync.RWMutex
+	subscribers map[*EventSubscriber]struct{}
+	isClosed    bool
+}
+
+func NewEvents() *Events {
+	return &Events{subscribers: make(map[*EventSubscriber]struct{})}
+}
+
+// Subscribe returns a subscriber with a channel size and callback function.
+func (e *Events) Subscribe(size int, cb EventFunc) *EventSubscriber {
+	s := &EventSubscriber{
+		C:        make(chan *Event, size),
+		Callback: cb,
+		events:   e,
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.isClosed {
+		close(s.C)
+	} else {
+		e.subscribers[s] = struct{}{}
+	}
+	return s
+}
+
+func (e *Events) unsubscribe(s *EventSubscriber) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _, ok := e.subscribers[s]; ok {
+		delete(e.subscribers, s)
+		close(s.C)
+	}
+}
+
+// emit sends a copy of event to each subscriber, so that subscribers can't
+// change what the others receive.
+func (e *Events) emit(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	var callbacks []EventFunc
+	e.lock.RLock()
+	for s := range e.subscribers {
+		if s.Callback != nil {
+			callbacks = append(callbacks, s.Callback)
+			continue
+		}
+		event := *event
+		select {
+		case s.C <- &event:
+		default:
+		}
+	}
+	e.lock.RUnlock()
+
+	// callbacks are called without lock so that they can unsubscribe
+	for _, cb := range callbacks {
+		event := *event
+		cb.OnEvent(&event)
+	}
+}
+
+// close closes all subscribers. Events emitted afterwards are dropped.
+func (e *Events) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.isClosed {
+		return
+	}
+	e.isClosed = true
+	for s := range e.subscribers {
+		close(s.C)
+	}
+	e.subscribers = make(map[*EventSubscriber]struct{})
+}
+
+// closeEvents closes Events of c unless it's shared through configuration.
+func (c *Common) closeEvents() {
+	if c.ownEvents {
+		c.Events.close()
+	}
+}
+
+// emitEvent sends event to subscribers of c with role and service filled in.
+func (c *Common) emitEvent(event *Event) {
+	event.Role = c.metricsRole
+	if len(event.Service) == 0 && c.Service != nil {
+		event.Service = c.Service.Name
+	}
+	c.Events.emit(event)
+}
@@ -0,0 +1,202 @@
+package tuna
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna/filter"
+	"github.com/nknorg/tuna/geo"
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/types"
+)
+
+// startTestExit starts a forward exit of service on a random local port
+// without looking up its public IP, and returns the node to connect to it.
+func startTestExit(t *testing.T, service Service) (*TunaExit, *types.Node) {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client is only used for nanopay, which is free here
+	te, err := NewTunaExit([]Service{service}, wallet, &nkn.MultiClient{}, &ExitConfiguration{
+		BeneficiaryAddr: wallet.Address(),
+		Services:        map[string]ExitServiceInfo{service.Name: {Address: "127.0.0.1", Price: "0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = te.listenTCP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(te.Close)
+
+	node := &types.Node{
+		Address: hex.EncodeToString(wallet.PubKey()),
+		Metadata: &pb.ServiceMetadata{
+			Ip:      "127.0.0.1",
+			TcpPort: uint32(te.tcpListener.Addr().(*net.TCPAddr).Port),
+			Price:   "0",
+		},
+	}
+	return te, node
+}
+
+// waitEvent returns the next event of type typ from sub.
+func waitEvent(t *testing.T, sub *EventSubscriber, typ EventType) *Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-sub.C:
+			if event.Type == typ {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("%s event not emitted", typ)
+		}
+	}
+}
+
+func TestEventsEmitted(t *testing.T) {
+	echo, err := net.Listen(tcp4, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	service := Service{Name: "test", TCP: []uint32{uint32(echo.Addr().(*net.TCPAddr).Port)}}
+	exit, node := startTestExit(t, service)
+	exit2, node2 := startTestExit(t, service)
+	exitSub := exit.Events.Subscribe(64, nil)
+	exit2Sub := exit2.Events.Subscribe(64, nil)
+
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entry listens on another loopback address than the echo server
+	te, err := NewTunaEntry(service, ServiceInfo{ListenIP: "127.0.0.2", MaxPrice: "0", IPFilter: &geo.IPFilter{}, NknFilter: &filter.NknFilter{}}, wallet, &nkn.MultiClient{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.SetRemoteNode(node)
+	sub := te.Events.Subscribe(64, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go te.StartContext(ctx, false)
+
+	event := waitEvent(t, sub, EventConnected)
+	if event.Role != "entry" || event.Service != service.Name || event.RemoteNknAddress != node.Address || event.RemoteNetAddr != "127.0.0.1:"+strconv.Itoa(int(node.Metadata.TcpPort)) {
+		t.Fatalf("unexpected entry connected event %+v", event)
+	}
+	event = waitEvent(t, exitSub, EventConnected)
+	if event.Role != "exit" || len(event.RemoteNetAddr) == 0 {
+		t.Fatalf("unexpected exit connected event %+v", event)
+	}
+	waitEvent(t, sub, EventListening)
+
+	conn, err := net.Dial(tcp4, "127.0.0.2:"+strconv.Itoa(int(service.TCP[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entryOpened := waitEvent(t, sub, EventStreamOpened)
+	if entryOpened.Service != service.Name || entryOpened.StreamID == 0 || entryOpened.RemoteNetAddr != conn.LocalAddr().String() {
+		t.Fatalf("unexpected entry stream opened event %+v", entryOpened)
+	}
+	exitOpened := waitEvent(t, exitSub, EventStreamOpened)
+	if exitOpened.Service != service.Name || exitOpened.StreamID != entryOpened.StreamID || exitOpened.RemoteNetAddr != echo.Addr().String() {
+		t.Fatalf("unexpected exit stream opened event %+v", exitOpened)
+	}
+
+	conn.Close()
+	event = waitEvent(t, sub, EventStreamClosed)
+	if *event != (Event{Type: EventStreamClosed, Time: event.Time, Role: "entry", Service: service.Name, RemoteNetAddr: entryOpened.RemoteNetAddr, StreamID: entryOpened.StreamID}) {
+		t.Fatalf("unexpected entry stream closed event %+v", event)
+	}
+	event = waitEvent(t, exitSub, EventStreamClosed)
+	if event.StreamID != exitOpened.StreamID || event.RemoteNetAddr != exitOpened.RemoteNetAddr {
+		t.Fatalf("unexpected exit stream closed event %+v", event)
+	}
+
+	err = te.switchExit(ctx, node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event = waitEvent(t, sub, EventNodeSwitched)
+	if event.RemoteNknAddress != node2.Address || event.PreviousNknAddress != node.Address {
+		t.Fatalf("unexpected node switched event %+v", event)
+	}
+	waitEvent(t, exit2Sub, EventConnected)
+}
+
+type eventRecorder struct {
+	events []*Event
+}
+
+func (r *eventRecorder) OnEvent(event *Event) {
+	r.events = append(r.events, event)
+}
+
+func TestEventSubscribers(t *testing.T) {
+	events := NewEvents()
+
+	sub := events.Subscribe(1, nil)
+	sub.Close()
+	if event := sub.Next(); event != nil {
+		t.Fatalf("closed subscriber returned event %+v", event)
+	}
+	sub.Close()
+
+	sub = events.Subscribe(1, nil)
+	defer sub.Close()
+	recorder := &eventRecorder{}
+	cbSub := events.Subscribe(0, recorder)
+	events.emit(&Event{Type: EventConnected, RemoteNknAddress: "exit"})
+	cbSub.Close()
+	events.emit(&Event{Type: EventDisconnected})
+
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected 1 event by callback, got %+v", recorder.events)
+	}
+	// subscribers get their own copy of an event
+	recorder.events[0].RemoteNknAddress = "changed"
+	event := sub.Next()
+	if event.Type != EventConnected || event.RemoteNknAddress != "exit" || event.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
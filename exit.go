@@ -1,9 +1,9 @@
 package tuna
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -11,19 +11,23 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/rdegges/go-ipify"
-
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/geo"
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/util"
 	"github.com/patrickmn/go-cache"
 	"github.com/xtaci/smux"
 )
 
+const (
+	ipFilterCacheExpiration = 10 * time.Minute
+)
+
 type ExitServiceInfo struct {
-	Address string `json:"address"`
-	Price   string `json:"price"`
+	Address  string        `json:"address"`
+	Price    string        `json:"price"`
+	IPFilter *geo.IPFilter `json:"ipFilter"`
 }
 
 type TunaExit struct {
@@ -34,15 +38,38 @@ type TunaExit struct {
 	reverseBytesEntryToExitPaid uint64
 	reverseBytesExitToEntryPaid uint64
 
+	numSessions int32
+	draining    int32
+	load        uint32 // last advertised load
+
 	*Common
-	OnConnect   *OnConnect // override Common.OnConnect
-	config      *ExitConfiguration
-	services    []Service
-	serviceConn *cache.Cache
-	tcpListener net.Listener
-	reverseIP   net.IP
-	reverseTCP  []uint32
-	reverseUDP  []uint32
+	config        *ExitConfiguration
+	serviceConn   *cache.Cache
+	ipFilterCache *cache.Cache
+	tcpListener   net.Listener
+	reverseIP     net.IP
+	reverseTCP    []uint32
+	reverseUDP    []uint32
+
+	trafficLock    sync.Mutex
+	sessionTraffic map[*sessionTraffic]struct{}
+	closedTraffic  map[string]ServiceBytes
+
+	// services, config.Services and ipFilter can be changed by Reload
+	servicesLock       sync.RWMutex
+	services           []Service
+	ipFilter           *geo.IPFilter
+	publicIP           string
+	publishCloseChans  map[string]chan struct{}
+	publishUpdateChans map[string]chan struct{}
+	filtersCloseChan   chan struct{}
+}
+
+// sessionTraffic counts bytes of each service id in an entry session.
+type sessionTraffic struct {
+	session     *smux.Session
+	entryToExit []uint64
+	exitToEntry []uint64
 }
 
 func NewTunaExit(services []Service, wallet *nkn.Wallet, client *nkn.MultiClient, config *ExitConfiguration) (*TunaExit, error) {
@@ -82,11 +109,11 @@ func NewTunaExit(services []Service, wallet *nkn.Wallet, client *nkn.MultiClient
 		reverseMetadata.ServiceUdp = services[0].UDP
 		_, err = common.StringToFixed64(config.ReverseNanoPayFee)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: parse ReverseNanoPayFee %q: %v", ErrInvalidFee, config.ReverseNanoPayFee, err)
 		}
 		_, err = common.StringToFixed64(config.MinReverseNanoPayFee)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: parse MinReverseNanoPayFee %q: %v", ErrInvalidFee, config.MinReverseNanoPayFee, err)
 		}
 	} else {
 		subscriptionPrefix = config.SubscriptionPrefix
@@ -104,36 +131,183 @@ func NewTunaExit(services []Service, wallet *nkn.Wallet, client *nkn.MultiClient
 		!config.Reverse,
 		config.GeoDBPath,
 		config.DownloadGeoDB,
+		config.GeoProviders,
+		config.GeoOffline,
+		config.GeoCacheSize,
 		config.GetSubscribersBatchSize,
 		config.MeasureBandwidth,
 		config.MeasureBandwidthTimeout,
 		config.MeasureBandwidthWorkersTimeout,
 		config.MeasurementBytesDownLink,
+		config.MeasurementBytesUpLink,
+		config.BandwidthDirection,
+		config.MeasurePing,
+		config.MeasurePingCount,
+		config.MeasurementCacheTTL,
 		config.MeasureStoragePath,
 		config.MaxMeasureWorkerPoolSize,
 		config.TcpDialContext,
 		config.HttpDialContext,
 		config.WsDialContext,
 		config.SortMeasuredNodes,
+		nil,
 		reverseMetadata,
 		config.ReverseMinBalance,
+		config.Logger,
+		config.Events,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.ServiceDiscovery != nil {
+		c.Discovery = config.ServiceDiscovery
+	} else if config.Discovery != nil {
+		c.Discovery, err = NewDiscovery(config.Discovery, c.Client, c.Subscriptions, uint32(config.SubscriptionDuration), config.SubscriptionFee, config.SubscriptionReplaceTxPool, c.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	te := &TunaExit{
-		Common:      c,
-		OnConnect:   NewOnConnect(1, nil),
-		config:      config,
-		services:    services,
-		serviceConn: cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
+		Common:        c,
+		config:        config,
+		serviceConn:   cache.New(time.Duration(config.UDPTimeout)*time.Second, time.Second),
+		ipFilterCache: cache.New(ipFilterCacheExpiration, ipFilterCacheExpiration),
+
+		sessionTraffic: make(map[*sessionTraffic]struct{}),
+		closedTraffic:  make(map[string]ServiceBytes),
+
+		services:           services,
+		ipFilter:           &config.IPFilter,
+		publishCloseChans:  make(map[string]chan struct{}),
+		publishUpdateChans: make(map[string]chan struct{}),
+		filtersCloseChan:   make(chan struct{}),
 	}
 
+	if !config.Reverse {
+		err = te.addGeoProviders(te.ipFilters())
+		if err != nil {
+			return nil, err
+		}
+		c.allowUDPSource = te.allowIP
+	}
+
+	te.metricsRole = metricsRoleExit
+	te.unregisterMetrics = DefaultMetrics.register(te.collectMetrics)
+	DefaultAdmin.AddExit(te)
+
 	return te, nil
 }
 
+// ipFilters returns the exit IP filter followed by all service IP filters.
+// Caller must hold servicesLock once the exit is started.
+func (te *TunaExit) ipFilters() []*geo.IPFilter {
+	filters := []*geo.IPFilter{te.ipFilter}
+	for _, serviceInfo := range te.config.Services {
+		if serviceInfo.IPFilter != nil {
+			filters = append(filters, serviceInfo.IPFilter)
+		}
+	}
+	return filters
+}
+
+func (te *TunaExit) addGeoProviders(filters []*geo.IPFilter) error {
+	for _, f := range filters {
+		f.Logger = te.logger
+		if f.NeedGeoInfo() {
+			err := f.AddProviders(te.GeoProviderOptions)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startUpdateGeoData keeps geo data of filters up to date until
+// filtersCloseChan is closed. Caller must hold servicesLock.
+func (te *TunaExit) startUpdateGeoData() {
+	if te.filtersCloseChan == nil {
+		return
+	}
+	for _, f := range te.ipFilters() {
+		if len(f.GetProviders()) > 0 {
+			go f.StartUpdateDataFile(te.filtersCloseChan)
+		}
+	}
+}
+
+func (te *TunaExit) getServiceInfo(serviceName string) (ExitServiceInfo, bool) {
+	te.servicesLock.RLock()
+	defer te.servicesLock.RUnlock()
+	serviceInfo, ok := te.config.Services[serviceName]
+	return serviceInfo, ok
+}
+
+// servicePrices returns the current price of each provided service by service
+// id.
+func (te *TunaExit) servicePrices() map[byte][2]common.Fixed64 {
+	te.servicesLock.RLock()
+	defer te.servicesLock.RUnlock()
+	prices := make(map[byte][2]common.Fixed64, len(te.services))
+	for i, service := range te.services {
+		serviceInfo, ok := te.config.Services[service.Name]
+		if !ok {
+			continue
+		}
+		entryToExitPrice, exitToEntryPrice, err := ParsePrice(serviceInfo.Price)
+		if err != nil {
+			continue
+		}
+		prices[byte(i)] = [2]common.Fixed64{entryToExitPrice, exitToEntryPrice}
+	}
+	return prices
+}
+
+// allowIP checks whether a client with the given IP can use the exit and, if
+// serviceID is not negative, the service with that id. Results are cached so
+// that UDP packets don't need a geo lookup each time.
+func (te *TunaExit) allowIP(ip net.IP, serviceID int) bool {
+	if te.config.Reverse || ip == nil {
+		return true
+	}
+
+	key := ip.String() + "/" + strconv.Itoa(serviceID)
+	if allowed, ok := te.ipFilterCache.Get(key); ok {
+		return allowed.(bool)
+	}
+
+	te.servicesLock.RLock()
+	ipFilter := te.ipFilter
+	te.servicesLock.RUnlock()
+
+	allowed, err := ipFilter.AllowIP(ip.String())
+	if err != nil {
+		te.logger.Warn("IP filter error", "ip", ip, "error", err)
+	}
+
+	if allowed && serviceID >= 0 {
+		service, err := te.getService(byte(serviceID))
+		if err == nil {
+			serviceInfo, _ := te.getServiceInfo(service.Name)
+			if f := serviceInfo.IPFilter; f != nil {
+				allowed, err = f.AllowIP(ip.String())
+				if err != nil {
+					te.logger.Warn("IP filter error", "service", service.Name, "ip", ip, "error", err)
+				}
+			}
+		}
+	}
+
+	te.ipFilterCache.Set(key, allowed, cache.DefaultExpiration)
+
+	return allowed
+}
+
 func (te *TunaExit) getServiceID(serviceName string) (byte, error) {
+	te.servicesLock.RLock()
+	defer te.servicesLock.RUnlock()
 	for i, service := range te.services {
 		if service.Name == serviceName {
 			return byte(i), nil
@@ -143,7 +317,7 @@ func (te *TunaExit) getServiceID(serviceName string) (byte, error) {
 	return 0, errors.New("Service " + serviceName + " not found")
 }
 
-func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.ConnectionMetadata) {
+func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.ConnectionMetadata) error {
 	bytesEntryToExit := make([]uint64, 256)
 	bytesExitToEntry := make([]uint64, 256)
 	var k string
@@ -155,13 +329,36 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 	onErr := nkn.NewOnError(1, nil)
 	lastPaymentTime := time.Now()
 	isClosed := false
+	remoteIP := addrIP(session.RemoteAddr())
+	logger := te.logger.With("remoteAddr", session.RemoteAddr())
+	te.addSessions(1)
+	defer te.addSessions(-1)
+	if !te.config.Reverse {
+		traffic := &sessionTraffic{session: session, entryToExit: bytesEntryToExit, exitToEntry: bytesExitToEntry}
+		te.addSessionTraffic(traffic)
+		defer te.removeSessionTraffic(traffic)
+	}
+	remoteAddress := ""
+	if te.config.Reverse {
+		remoteAddress = te.GetRemoteNknAddress()
+	}
+	te.emitEvent(&Event{Type: EventConnected, RemoteNknAddress: remoteAddress, RemoteNetAddr: session.RemoteAddr().String()})
+	defer te.emitEvent(&Event{Type: EventDisconnected, RemoteNknAddress: remoteAddress, RemoteNetAddr: session.RemoteAddr().String()})
 	if connMetadata != nil {
 		k = string(append(connMetadata.PublicKey, connMetadata.Nonce...))
+		logger = logger.With("session", sessionKey(k))
 		te.Common.reverseBytesEntryToExit[k] = bytesEntryToExit
 		te.Common.reverseBytesExitToEntry[k] = bytesExitToEntry
 	}
 
+	// entries pay the price they saw when connecting, so prices changed by
+	// Reload only apply to new sessions, and services added by Reload are
+	// priced when the session first uses them
+	var pricesLock sync.Mutex
+	prices := te.servicePrices()
 	getTotalCost := func() (common.Fixed64, common.Fixed64) {
+		pricesLock.Lock()
+		defer pricesLock.Unlock()
 		cost, totalBytes := common.Fixed64(0), common.Fixed64(0)
 		for i := range bytesEntryToExit {
 			entryToExit := common.Fixed64(atomic.LoadUint64(&bytesEntryToExit[i]))
@@ -169,16 +366,15 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 			if entryToExit == 0 && exitToEntry == 0 {
 				continue
 			}
-			service, err := te.getService(byte(i))
-			if err != nil {
-				continue
-			}
-			serviceInfo := te.config.Services[service.Name]
-			entryToExitPrice, exitToEntryPrice, err := ParsePrice(serviceInfo.Price)
-			if err != nil {
-				continue
+			price, ok := prices[byte(i)]
+			if !ok {
+				price, ok = te.servicePrices()[byte(i)]
+				if !ok {
+					continue
+				}
+				prices[byte(i)] = price
 			}
-			cost += entryToExitPrice*entryToExit/TrafficUnit + exitToEntryPrice*exitToEntry/TrafficUnit
+			cost += price[0]*entryToExit/TrafficUnit + price[1]*exitToEntry/TrafficUnit
 			totalBytes += entryToExit + exitToEntry
 		}
 		return cost, totalBytes
@@ -187,20 +383,21 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 	if !te.config.Reverse {
 		npc, err = te.Client.NewNanoPayClaimer(te.config.BeneficiaryAddr, int32(claimInterval/time.Millisecond), int32(nanoPayClaimerLinger/time.Millisecond), te.config.MinFlushAmount, onErr)
 		if err != nil {
-			log.Fatalln(err)
+			Close(session)
+			return fmt.Errorf("%w: create nanopay claimer: %w", ErrPaymentFailed, err)
 		}
 
 		defer npc.Close()
 
-		go checkNanoPayClaim(session, npc, onErr, &isClosed)
+		go te.checkNanoPayClaim(session, npc, onErr, &isClosed)
 
-		go checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
+		go te.checkPayment(session, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, &isClosed, getTotalCost)
 	}
 
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
-			log.Println("Couldn't accept stream:", err)
+			logger.Info("Couldn't accept stream", "error", err)
 			session.Close()
 			break
 		}
@@ -213,7 +410,15 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 				}
 
 				if streamMetadata.IsPayment {
-					return handlePaymentStream(stream, npc, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
+					return te.handlePaymentStream(stream, npc, &lastPaymentTime, &lastPaymentAmount, &bytesPaid, getTotalCost)
+				}
+
+				if streamMetadata.IsPing {
+					return handlePingStream(stream)
+				}
+
+				if te.IsShuttingDown() {
+					return errors.New("exit is shutting down")
 				}
 
 				serviceID := byte(streamMetadata.ServiceId)
@@ -223,6 +428,9 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 				if err != nil {
 					return err
 				}
+				if !te.allowIP(remoteIP, int(serviceID)) {
+					return fmt.Errorf("service %s is not allowed for %s", service.Name, remoteIP)
+				}
 				tcpPortsCount := len(service.TCP)
 				udpPortsCount := len(service.UDP)
 				var protocol string
@@ -238,7 +446,10 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 					return fmt.Errorf("invalid portId: %d", portID)
 				}
 
-				serviceInfo := te.config.Services[service.Name]
+				serviceInfo, ok := te.getServiceInfo(service.Name)
+				if !ok {
+					return fmt.Errorf("service %s is not provided", service.Name)
+				}
 				host := serviceInfo.Address + ":" + strconv.Itoa(port)
 
 				conn, err := net.DialTimeout(protocol, host, time.Duration(te.config.DialTimeout)*time.Second)
@@ -247,17 +458,15 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 				}
 
 				if te.config.Reverse {
-					go te.pipe(conn, stream, &te.reverseBytesEntryToExit)
-					go te.pipe(stream, conn, &te.reverseBytesExitToEntry)
+					te.pipeStream(stream, conn, service.Name, &te.reverseBytesExitToEntry, &te.reverseBytesEntryToExit)
 				} else {
-					go te.pipe(conn, stream, &te.Common.reverseBytesEntryToExit[k][serviceID])
-					go te.pipe(stream, conn, &te.Common.reverseBytesExitToEntry[k][serviceID])
+					te.pipeStream(stream, conn, service.Name, &te.Common.reverseBytesExitToEntry[k][serviceID], &te.Common.reverseBytesEntryToExit[k][serviceID])
 				}
 
 				return nil
 			}()
 			if err != nil {
-				log.Println(err)
+				logger.Warn("Handle stream error", "error", err)
 				Close(stream)
 			}
 		}()
@@ -265,12 +474,14 @@ func (te *TunaExit) handleSession(session *smux.Session, connMetadata *pb.Connec
 
 	Close(session)
 	isClosed = true
+
+	return nil
 }
 
 func (te *TunaExit) listenTCP(port int) error {
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
 	if err != nil {
-		log.Println("Couldn't bind listener:", err)
+		te.logger.Error("Couldn't bind tcp listener", "port", port, "error", err)
 		return err
 	}
 	te.tcpListener = listener
@@ -282,11 +493,14 @@ func (te *TunaExit) listenTCP(port int) error {
 				return
 			}
 			if err != nil {
+				if te.IsShuttingDown() {
+					return
+				}
 				if strings.Contains(err.Error(), "use of closed network connection") {
 					te.Close()
 					return
 				}
-				log.Println("Couldn't accept client connection:", err)
+				te.logger.Warn("Couldn't accept client connection", "error", err)
 				time.Sleep(time.Second)
 				continue
 			}
@@ -295,6 +509,10 @@ func (te *TunaExit) listenTCP(port int) error {
 				err := func() error {
 					defer Close(conn)
 
+					if ip := addrIP(conn.RemoteAddr()); !te.allowIP(ip, -1) {
+						return fmt.Errorf("client connection from %s is not allowed by IP filter", ip)
+					}
+
 					encryptedConn, connMetadata, err := te.wrapConn(conn, nil, nil)
 					if err != nil {
 						return fmt.Errorf("wrap conn error: %v", err)
@@ -303,24 +521,30 @@ func (te *TunaExit) listenTCP(port int) error {
 					defer Close(encryptedConn)
 
 					if connMetadata.IsMeasurement {
-						err = util.BandwidthMeasurementServer(encryptedConn, int(connMetadata.MeasurementBytesDownlink), maxMeasureBandwidthTimeout)
+						err = serveMeasurement(encryptedConn, connMetadata)
 						if err != nil {
 							return fmt.Errorf("bandwidth measurement server error: %v", err)
 						}
 						return nil
 					}
 
+					if connMetadata.IsPing {
+						err = util.PingServer(encryptedConn, maxPingServerDuration)
+						if err != nil {
+							return fmt.Errorf("ping server error: %v", err)
+						}
+						return nil
+					}
+
 					session, err := smux.Server(encryptedConn, nil)
 					if err != nil {
 						return fmt.Errorf("create session error: %v", err)
 					}
 
-					te.handleSession(session, connMetadata)
-
-					return nil
+					return te.handleSession(session, connMetadata)
 				}()
 				if err != nil {
-					log.Println(err)
+					te.logger.Warn("Handle client connection error", "remoteAddr", conn.RemoteAddr(), "error", err)
 				}
 			}()
 		}
@@ -330,6 +554,8 @@ func (te *TunaExit) listenTCP(port int) error {
 }
 
 func (te *TunaExit) getService(serviceID byte) (*Service, error) {
+	te.servicesLock.RLock()
+	defer te.servicesLock.RUnlock()
 	if int(serviceID) >= len(te.services) {
 		return nil, errors.New("Wrong serviceId: " + strconv.Itoa(int(serviceID)))
 	}
@@ -344,7 +570,7 @@ func (te *TunaExit) getServiceConn(connID []byte, serviceID byte, portID byte) (
 	if x, ok = te.serviceConn.Get(connKey); !ok {
 		service, err := te.getService(serviceID)
 		if err != nil {
-			log.Println(err)
+			te.logger.Debug("Get service error", "serviceId", serviceID, "error", err)
 			return nil, err
 		}
 		if int(portID) >= len(service.UDP) {
@@ -353,7 +579,7 @@ func (te *TunaExit) getServiceConn(connID []byte, serviceID byte, portID byte) (
 		port := service.UDP[portID]
 		conn, err = net.DialUDP(udp4, nil, &net.UDPAddr{Port: int(port)})
 		if err != nil {
-			log.Println("Couldn't connect to local UDP port", port, "with error:", err)
+			te.logger.Warn("Couldn't connect to local UDP port", "service", service.Name, "port", port, "error", err)
 			return nil, err
 		}
 
@@ -376,7 +602,7 @@ func (te *TunaExit) getServiceConn(connID []byte, serviceID byte, portID byte) (
 			for {
 				n, _, err := conn.ReadFromUDP(serviceBuffer)
 				if err != nil {
-					log.Println("Couldn't receive data from service:", err)
+					te.logger.Debug("Couldn't receive data from service", "error", err)
 					Close(conn)
 					break
 				}
@@ -394,13 +620,13 @@ func (te *TunaExit) getServiceConn(connID []byte, serviceID byte, portID byte) (
 func (te *TunaExit) listenUDP(port int) error {
 	conn, err := net.ListenUDP(udp4, &net.UDPAddr{Port: port})
 	if err != nil {
-		log.Println("Couldn't bind listener:", err)
+		te.logger.Error("Couldn't bind udp listener", "port", port, "error", err)
 		return err
 	}
 	encConn := NewEncryptUDPConn(conn)
 	udpConn, err := te.wrapUDPConn(encConn, nil, nil, nil)
 	if err != nil {
-		log.Println("wrap udp conn err:", err)
+		te.logger.Error("Wrap udp conn error", "error", err)
 		return err
 	}
 	te.startUDPReaderWriter(udpConn, nil, nil, nil)
@@ -417,60 +643,328 @@ func (te *TunaExit) readUDP() {
 			}
 			serverReadChan, err := te.GetServerUDPReadChan(false)
 			if err != nil {
-				log.Println("Couldn't get server connection:", err)
+				te.logger.Debug("Couldn't get server connection", "error", err)
 				continue
 			}
 			data := <-serverReadChan
 			if len(data) < PrefixLen {
-				log.Println("empty udp packet received")
+				te.logger.Warn("Empty udp packet received")
 				te.Close()
 				return
 			}
 
 			serviceConn, err := te.getServiceConn(data[0:2], data[2], data[3])
 			if err != nil {
-				log.Println("get service conn error:", err)
+				te.logger.Debug("Get service conn error", "error", err)
 				continue
 			}
 			_, _, err = serviceConn.WriteMsgUDP(data[PrefixLen:], nil, nil)
 			if err != nil {
-				log.Println("Couldn't send data to service:", err)
+				te.logger.Debug("Couldn't send data to service", "error", err)
 			}
 		}
 	}()
 }
 
-func (te *TunaExit) updateAllMetadata(ip string, tcpPort, udpPort uint32) error {
-	for serviceName, serviceInfo := range te.config.Services {
-		serviceID, err := te.getServiceID(serviceName)
+func (te *TunaExit) updateAllMetadata(ip string) error {
+	te.servicesLock.Lock()
+	defer te.servicesLock.Unlock()
+	if te.publishCloseChans == nil {
+		return ErrClosed
+	}
+	te.publicIP = ip
+	for serviceName := range te.config.Services {
+		err := te.publishService(serviceName)
 		if err != nil {
 			return err
 		}
-		UpdateMetadata(
-			serviceName,
-			serviceID,
-			nil,
-			nil,
-			ip,
-			tcpPort,
-			udpPort,
-			serviceInfo.Price,
-			te.config.BeneficiaryAddr,
-			te.config.SubscriptionPrefix,
-			uint32(te.config.SubscriptionDuration),
-			te.config.SubscriptionFee,
-			te.config.SubscriptionReplaceTxPool,
-			te.Client,
-			te.closeChan,
-		)
 	}
 	return nil
 }
 
+// publishService publishes serviceName until it's removed or the exit is
+// closed. Caller must hold servicesLock, and the exit must not be closed.
+func (te *TunaExit) publishService(serviceName string) error {
+	serviceID := -1
+	for i, service := range te.services {
+		if service.Name == serviceName {
+			serviceID = i
+			break
+		}
+	}
+	if serviceID < 0 {
+		return fmt.Errorf("service %s not found", serviceName)
+	}
+	closeChan := make(chan struct{})
+	updateChan := make(chan struct{}, 1)
+	te.publishCloseChans[serviceName] = closeChan
+	te.publishUpdateChans[serviceName] = updateChan
+	te.Discovery.Publish(te.config.SubscriptionPrefix+serviceName, te.Client.Address(), func() string {
+		return te.advertisedMetadata(serviceName, uint32(serviceID))
+	}, updateChan, closeChan)
+	return nil
+}
+
+// republish makes published services advertise their current metadata
+// without waiting for the next refresh.
+func (te *TunaExit) republish() {
+	te.servicesLock.RLock()
+	defer te.servicesLock.RUnlock()
+	te.notifyPublish()
+}
+
+// notifyPublish is republish with servicesLock held.
+func (te *TunaExit) notifyPublish() {
+	for _, updateChan := range te.publishUpdateChans {
+		select {
+		case updateChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advertisedMetadata returns metadata of a service with current price, load
+// and draining state.
+func (te *TunaExit) advertisedMetadata(serviceName string, serviceID uint32) string {
+	te.servicesLock.RLock()
+	metadata := &pb.ServiceMetadata{
+		Ip:              te.publicIP,
+		TcpPort:         uint32(te.config.ListenTCP),
+		UdpPort:         uint32(te.config.ListenUDP),
+		ServiceId:       serviceID,
+		Price:           te.config.Services[serviceName].Price,
+		BeneficiaryAddr: te.config.BeneficiaryAddr,
+		ProtocolVersion: ProtocolVersion,
+		EncryptionAlgos: supportedEncryptionAlgos,
+		Region:          te.config.Region,
+		MaxBandwidth:    uint32(te.config.MaxBandwidth),
+		MaxSessions:     uint32(te.config.MaxSessions),
+		Labels:          te.config.Labels,
+		Load:            atomic.LoadUint32(&te.load),
+		Draining:        te.IsDraining(),
+	}
+	te.servicesLock.RUnlock()
+	s, err := EncodeMetadata(metadata)
+	if err != nil {
+		te.logger.Error("Encode metadata error", "error", err)
+	}
+	return s
+}
+
+// Reload replaces the services provided and their prices and IP filters, as
+// well as the exit IP filter, without dropping sessions. Streams of removed
+// services are kept until they end, and new streams of them are rejected.
+// Sessions keep paying the prices they started with. Added services are
+// published, removed ones are unpublished and new prices are republished at
+// once if the exit is started. Nothing is changed if Validate of config
+// returns an error, and other fields of config are ignored. Reverse exits
+// can't be reloaded.
+func (te *TunaExit) Reload(services []Service, config *ExitConfiguration) error {
+	if te.config.Reverse {
+		return errors.New("reverse exit can't be reloaded")
+	}
+
+	err := config.Validate(services)
+	if err != nil {
+		return err
+	}
+
+	config, err = MergedExitConfig(config)
+	if err != nil {
+		return err
+	}
+
+	ipFilter := config.IPFilter
+	filters := []*geo.IPFilter{&ipFilter}
+	for _, serviceInfo := range config.Services {
+		if serviceInfo.IPFilter != nil {
+			filters = append(filters, serviceInfo.IPFilter)
+		}
+	}
+	err = te.addGeoProviders(filters)
+	if err != nil {
+		return err
+	}
+
+	te.servicesLock.Lock()
+	defer te.servicesLock.Unlock()
+
+	// service id is the index in services, so existing services keep theirs
+	// for sessions and entries using them
+	newServices := make([]Service, len(te.services))
+	copy(newServices, te.services)
+	for _, service := range services {
+		i := 0
+		for ; i < len(newServices); i++ {
+			if newServices[i].Name == service.Name {
+				break
+			}
+		}
+		if i < len(newServices) {
+			newServices[i] = service
+		} else {
+			newServices = append(newServices, service)
+		}
+	}
+	if len(newServices) > 256 {
+		return errors.New("too many services")
+	}
+
+	oldServices := te.config.Services
+	te.services = newServices
+	te.config.Services = config.Services
+	te.ipFilter = &ipFilter
+	te.ipFilterCache.Flush()
+
+	if te.filtersCloseChan == nil {
+		return nil
+	}
+	close(te.filtersCloseChan)
+	te.filtersCloseChan = make(chan struct{})
+	te.startUpdateGeoData()
+
+	// not started yet
+	if len(te.publicIP) == 0 {
+		return nil
+	}
+
+	for serviceName := range oldServices {
+		if _, ok := config.Services[serviceName]; ok {
+			continue
+		}
+		if closeChan, ok := te.publishCloseChans[serviceName]; ok {
+			close(closeChan)
+			delete(te.publishCloseChans, serviceName)
+			delete(te.publishUpdateChans, serviceName)
+		}
+		topic := te.config.SubscriptionPrefix + serviceName
+		go func() {
+			err := te.Subscriptions.Unsubscribe("", topic, defaultUnsubscribeTimeout)
+			if err != nil {
+				te.logger.Error("Unsubscribe from topic error", "topic", topic, "error", err)
+			}
+		}()
+	}
+	for serviceName := range config.Services {
+		if _, ok := oldServices[serviceName]; ok {
+			continue
+		}
+		err = te.publishService(serviceName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// so that entries see new prices at once
+	te.notifyPublish()
+
+	return nil
+}
+
+func (te *TunaExit) addSessionTraffic(traffic *sessionTraffic) {
+	te.trafficLock.Lock()
+	defer te.trafficLock.Unlock()
+	te.sessionTraffic[traffic] = struct{}{}
+}
+
+// removeSessionTraffic keeps bytes of an ended session in service totals.
+func (te *TunaExit) removeSessionTraffic(traffic *sessionTraffic) {
+	te.trafficLock.Lock()
+	defer te.trafficLock.Unlock()
+	delete(te.sessionTraffic, traffic)
+	te.addTraffic(te.closedTraffic, traffic)
+}
+
+// addTraffic adds bytes counted in traffic to totals by service name.
+func (te *TunaExit) addTraffic(totals map[string]ServiceBytes, traffic *sessionTraffic) {
+	for i := range traffic.entryToExit {
+		entryToExit := atomic.LoadUint64(&traffic.entryToExit[i])
+		exitToEntry := atomic.LoadUint64(&traffic.exitToEntry[i])
+		if entryToExit == 0 && exitToEntry == 0 {
+			continue
+		}
+		service, err := te.getService(byte(i))
+		if err != nil {
+			continue
+		}
+		b := totals[service.Name]
+		b.EntryToExit += entryToExit
+		b.ExitToEntry += exitToEntry
+		totals[service.Name] = b
+	}
+}
+
+// GetServiceBytes returns bytes transferred for each service since the exit
+// was created.
+func (te *TunaExit) GetServiceBytes() map[string]ServiceBytes {
+	totals := make(map[string]ServiceBytes)
+	if te.config.Reverse {
+		if len(te.services) > 0 {
+			totals[te.services[0].Name] = ServiceBytes{
+				EntryToExit: atomic.LoadUint64(&te.reverseBytesEntryToExit),
+				ExitToEntry: atomic.LoadUint64(&te.reverseBytesExitToEntry),
+			}
+		}
+		return totals
+	}
+
+	te.trafficLock.Lock()
+	defer te.trafficLock.Unlock()
+	for name, b := range te.closedTraffic {
+		totals[name] = b
+	}
+	for traffic := range te.sessionTraffic {
+		te.addTraffic(totals, traffic)
+	}
+	return totals
+}
+
+// GetNumSessions returns the number of connected entries.
+func (te *TunaExit) GetNumSessions() int {
+	return int(atomic.LoadInt32(&te.numSessions))
+}
+
+// addSessions changes the number of connected entries by delta, and
+// republishes services when the load crosses a 10% step.
+func (te *TunaExit) addSessions(delta int32) {
+	sessions := atomic.AddInt32(&te.numSessions, delta)
+	if te.config.MaxSessions <= 0 {
+		return
+	}
+	load := sessionLoad(int(sessions), int(te.config.MaxSessions))
+	if atomic.SwapUint32(&te.load, load) != load {
+		te.republish()
+	}
+}
+
+// SetDraining sets whether the exit advertises that it is draining, so that
+// entries stop choosing it. Published services are republished at once.
+func (te *TunaExit) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	if atomic.SwapInt32(&te.draining, v) != v {
+		te.republish()
+	}
+}
+
+func (te *TunaExit) IsDraining() bool {
+	return atomic.LoadInt32(&te.draining) == 1
+}
+
 func (te *TunaExit) Start() error {
-	ip, err := ipify.GetIp()
+	return te.StartContext(context.Background())
+}
+
+// StartContext is like Start, but closes the exit without waiting for streams
+// when ctx is done, also after StartContext returns.
+func (te *TunaExit) StartContext(ctx context.Context) error {
+	context.AfterFunc(ctx, func() { te.Shutdown(ctx) })
+
+	ip, err := getIPContext(ctx)
 	if err != nil {
-		return fmt.Errorf("couldn't get IP: %v", err)
+		return fmt.Errorf("couldn't get IP: %w", err)
 	}
 
 	err = te.listenTCP(int(te.config.ListenTCP))
@@ -483,12 +977,26 @@ func (te *TunaExit) Start() error {
 		return err
 	}
 
-	return te.updateAllMetadata(ip, uint32(te.config.ListenTCP), uint32(te.config.ListenUDP))
+	te.servicesLock.RLock()
+	te.startUpdateGeoData()
+	te.servicesLock.RUnlock()
+
+	return te.updateAllMetadata(ip)
 }
 
 func (te *TunaExit) StartReverse(shouldReconnect bool) error {
+	return te.StartReverseContext(context.Background(), shouldReconnect)
+}
+
+// StartReverseContext is like StartReverse, but stops selecting, measuring
+// and dialing reverse entries and closes the exit without waiting for streams
+// when ctx is done.
+func (te *TunaExit) StartReverseContext(ctx context.Context, shouldReconnect bool) error {
 	defer te.Close()
 
+	stop := context.AfterFunc(ctx, func() { te.Shutdown(ctx) })
+	defer stop()
+
 	geoCloseChan := make(chan struct{})
 	defer close(geoCloseChan)
 	if len(te.ServiceInfo.IPFilter.GetProviders()) > 0 {
@@ -510,16 +1018,16 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 	var tcpConn net.Conn
 	var payOnce sync.Once
 	for {
-		err = te.Common.CreateServerConn(true)
+		err = te.Common.CreateServerConnContext(ctx, true)
 		if err != nil {
-			if errors.Is(err, ErrClosed) {
-				return nil
+			if errors.Is(err, ErrClosed) || ctx.Err() != nil {
+				return ctx.Err()
 			}
-			log.Println("Couldn't connect to reverse entry:", err)
+			te.logger.Warn("Couldn't connect to reverse entry", "error", err)
 			if errors.Is(err, nkn.ErrInsufficientBalance) {
 				return err
 			}
-			time.Sleep(1 * time.Second)
+			sleepContext(ctx, time.Second)
 			continue
 		}
 		if te.udpConn != nil {
@@ -530,11 +1038,11 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 		if len(service.UDP) > 0 {
 			udpConn, err = te.Common.GetServerUDPConn(false)
 			if err != nil {
-				log.Println(err)
+				te.logger.Warn("Get reverse entry udp conn error", "error", err)
 				time.Sleep(1 * time.Second)
 				continue
 			}
-			go sendPingMsg(udpConn, te.udpCloseChan)
+			go te.sendPingMsg(udpConn, te.udpCloseChan)
 		}
 
 		var tcpPorts []uint32
@@ -547,7 +1055,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			udpPorts = service.UDP
 		}
 
-		serviceMetadata := CreateRawMetadata(
+		serviceMetadata, err := CreateRawMetadata(
 			serviceID,
 			tcpPorts,
 			udpPorts,
@@ -557,45 +1065,48 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 			"",
 			te.config.BeneficiaryAddr,
 		)
+		if err != nil {
+			return err
+		}
 
 		tcpConn, err = te.Common.GetServerTCPConn(false)
 		if err != nil {
-			log.Println(err)
+			te.logger.Warn("Get reverse entry tcp conn error", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		session, err := smux.Client(tcpConn, nil)
 		if err != nil {
-			log.Println(err)
+			te.logger.Warn("Create session error", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		stream, err := session.OpenStream()
 		if err != nil {
-			log.Println("Couldn't open stream to reverse entry:", err)
+			te.logger.Warn("Couldn't open stream to reverse entry", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		err = WriteVarBytes(stream, serviceMetadata)
 		if err != nil {
-			log.Println("Couldn't send metadata to reverse entry:", err)
+			te.logger.Warn("Couldn't send metadata to reverse entry", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		buf, err := ReadVarBytes(stream, maxServiceMetadataSize)
 		if err != nil {
-			log.Println("Couldn't read reverse metadata:", err)
+			te.logger.Warn("Couldn't read reverse metadata", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		reverseMetadata, err := ReadMetadata(string(buf))
 		if err != nil {
-			log.Println("Couldn't unmarshal metadata:", err)
+			te.logger.Warn("Couldn't unmarshal reverse metadata", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
@@ -615,7 +1126,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 
 			stream, err := session.AcceptStream()
 			if err != nil {
-				log.Println("Couldn't accept stream test conn from reverse entry:", err)
+				te.logger.Warn("Couldn't accept stream test conn from reverse entry", "error", err)
 				time.Sleep(1 * time.Second)
 				continue
 			}
@@ -627,7 +1138,7 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 
 		ps, err := openPaymentStream(session)
 		if err != nil {
-			log.Println("Couldn't open payment stream:", err)
+			te.logger.Warn("Couldn't open payment stream", "error", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
@@ -657,10 +1168,14 @@ func (te *TunaExit) StartReverse(shouldReconnect bool) error {
 				te.config.MinReverseNanoPayFee,
 				te.config.ReverseNanoPayFeeRatio,
 				getPaymentStreamRecipient,
+				nil,
 			)
 		})
 
-		te.handleSession(session, nil)
+		err = te.handleSession(session, nil)
+		if err != nil {
+			te.logger.Warn("Handle reverse entry session error", "error", err)
+		}
 
 		Close(tcpConn)
 		Close(udpConn)
@@ -694,13 +1209,38 @@ func (te *TunaExit) GetReverseUDPPorts() []uint32 {
 	return te.reverseUDP
 }
 
+// Close stops accepting connections and streams, and closes the exit after
+// waiting for open streams according to SetLinger.
 func (te *TunaExit) Close() {
+	te.stopAccepting()
 	te.WaitSessions()
+	te.close()
+}
 
-	te.Lock()
-	defer te.Unlock()
+// Shutdown republishes the exit as draining at once so that entries stop
+// choosing it, stops accepting connections and streams, and waits for open
+// streams to finish until ctx is done. Then it closes the exit and streams
+// still open, and unsubscribes. It returns ctx.Err() if streams had to be
+// closed.
+func (te *TunaExit) Shutdown(ctx context.Context) error {
+	te.SetDraining(true)
+	te.stopAccepting()
+	err := te.WaitSessionsContext(ctx)
+	te.close()
+	return err
+}
+
+func (te *TunaExit) stopAccepting() {
+	te.Common.stopAccepting()
+	te.RLock()
+	defer te.RUnlock()
+	Close(te.tcpListener)
+}
 
+func (te *TunaExit) close() {
+	te.Lock()
 	if te.isClosed {
+		te.Unlock()
 		return
 	}
 
@@ -713,6 +1253,31 @@ func (te *TunaExit) Close() {
 
 	te.CloseUDPConn()
 	te.OnConnect.close()
+	te.closeEvents()
+	te.Unlock()
+
+	te.trafficLock.Lock()
+	for traffic := range te.sessionTraffic {
+		Close(traffic.session)
+	}
+	te.trafficLock.Unlock()
+
+	te.servicesLock.Lock()
+	close(te.filtersCloseChan)
+	te.filtersCloseChan = nil
+	for _, closeChan := range te.publishCloseChans {
+		close(closeChan)
+	}
+	te.publishCloseChans = nil
+	te.publishUpdateChans = nil
+	te.publicIP = ""
+	te.servicesLock.Unlock()
+
+	te.unregisterMetrics()
+	DefaultAdmin.RemoveExit(te)
+
+	// so that entries stop finding this exit
+	te.Subscriptions.Close(defaultUnsubscribeTimeout)
 }
 
 func (te *TunaExit) CloseUDPConn() {
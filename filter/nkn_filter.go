@@ -1,7 +1,7 @@
 package filter
 
 import (
-	"log"
+	"log/slog"
 )
 
 type NknClient struct {
@@ -31,6 +31,8 @@ func (c *NknClient) Match(nknClient *NknClient) bool {
 type NknFilter struct {
 	Allow    []NknClient `json:"allow"`
 	Disallow []NknClient `json:"disallow"`
+	// Logger logs filtered clients, the default logger is used if nil.
+	Logger *slog.Logger `json:"-"`
 }
 
 func (f *NknFilter) Empty() bool {
@@ -58,9 +60,14 @@ func (f *NknFilter) IsAllow(nknClient *NknClient) bool {
 		return true
 	}
 
+	logger := f.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	for _, d := range f.Disallow {
 		if d.Match(nknClient) {
-			log.Printf("%s dropped", nknClient.Address)
+			logger.Debug("NKN client dropped", "address", nknClient.Address)
 			return false
 		}
 	}
@@ -68,7 +75,7 @@ func (f *NknFilter) IsAllow(nknClient *NknClient) bool {
 	empty := true
 	for _, a := range f.Allow {
 		if a.Match(nknClient) {
-			log.Printf("%s passed", nknClient.Address)
+			logger.Debug("NKN client passed", "address", nknClient.Address)
 			return true
 		}
 		if !a.Empty() {
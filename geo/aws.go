@@ -2,11 +2,9 @@ package geo
 
 import (
 	"context"
-	"io/ioutil"
-	"log"
+	"errors"
+	"log/slog"
 	"net"
-	"os"
-	"path"
 	"path/filepath"
 	"time"
 
@@ -20,11 +18,14 @@ const (
 )
 
 type AWSProvider struct {
-	Info     *AWSGeoInfo
-	fileName string
-	url      string
-	expire   time.Duration
-	ready    bool
+	Info      *AWSGeoInfo
+	fileName  string
+	url       string
+	expire    time.Duration
+	offline   bool
+	ready     bool
+	integrity *Integrity
+	logger    *slog.Logger
 }
 
 type AWSGeoInfo struct {
@@ -65,11 +66,37 @@ var AWSRegionMapping = map[string]string{
 	"sa-east-1":      "BR",
 }
 
+// AWSRegionCityMapping maps AWS regions to the city of their data centers.
+var AWSRegionCityMapping = map[string]string{
+	"us-east-1":      "Ashburn",
+	"us-east-2":      "Columbus",
+	"us-west-1":      "San Jose",
+	"us-west-2":      "Boardman",
+	"af-south-1":     "Cape Town",
+	"ap-east-1":      "Hong Kong",
+	"ap-south-1":     "Mumbai",
+	"ap-northeast-1": "Tokyo",
+	"ap-northeast-2": "Seoul",
+	"ap-northeast-3": "Osaka",
+	"ap-southeast-1": "Singapore",
+	"ap-southeast-2": "Sydney",
+	"ca-central-1":   "Montreal",
+	"eu-central-1":   "Frankfurt",
+	"eu-west-1":      "Dublin",
+	"eu-west-2":      "London",
+	"eu-west-3":      "Paris",
+	"eu-south-1":     "Milan",
+	"eu-north-1":     "Stockholm",
+	"me-south-1":     "Manama",
+	"sa-east-1":      "São Paulo",
+}
+
 func NewAWSProvider(path string) *AWSProvider {
 	return &AWSProvider{
 		url:      AWSGeoUrl,
 		fileName: filepath.Join(path, AWSFile),
 		expire:   AWSExpired,
+		logger:   slog.Default(),
 	}
 }
 
@@ -84,46 +111,48 @@ func (p *AWSProvider) MaybeUpdateContext(ctx context.Context) error {
 		return nil
 	}
 	if p.NeedUpdate() {
-		log.Println("Updating AWS geo db")
-		tmpFile, err := ioutil.TempFile(path.Dir(p.fileName), path.Base(p.fileName)+"-*")
-		if err != nil {
-			return err
-		}
-		defer os.Remove(tmpFile.Name())
-		defer tmpFile.Close()
-		err = util.DownloadJsonFile(ctx, p.url, tmpFile.Name())
-		if err != nil {
-			return err
-		}
-		err = util.CopyFile(tmpFile.Name(), p.fileName)
+		p.logger.Info("Updating AWS geo db")
+		err := downloadDataFile(ctx, p.logger, p.url, p.fileName, p.integrity, validateJSON, shouldKeepLastGood(p.fileName, p.ready))
 		if err != nil {
 			return err
 		}
 	}
-	err := util.ReadJSON(p.fileName, &p.Info)
+	err := loadDataFile(p.logger, p.fileName, !p.offline, p.load)
 	if err != nil {
 		return err
 	}
+	p.ready = true
+	return nil
+}
 
-	for idx := range p.Info.Prefixes {
-		if len(p.Info.Prefixes[idx].IPPrefix) == 0 {
+func (p *AWSProvider) load(fileName string) error {
+	var info *AWSGeoInfo
+	err := util.ReadJSON(fileName, &info)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return errors.New("empty AWS geo db")
+	}
+	for idx := range info.Prefixes {
+		if len(info.Prefixes[idx].IPPrefix) == 0 {
 			continue
 		}
-		_, subnet, err := net.ParseCIDR(p.Info.Prefixes[idx].IPPrefix)
+		_, subnet, err := net.ParseCIDR(info.Prefixes[idx].IPPrefix)
 		if err != nil {
-			log.Print(err)
+			p.logger.Warn("Invalid prefix in AWS geo db", "prefix", info.Prefixes[idx].IPPrefix, "error", err)
 			continue
 		}
-		p.Info.Prefixes[idx].Subnet = subnet
+		info.Prefixes[idx].Subnet = subnet
 	}
-	p.ready = true
+	p.Info = info
 	return nil
 }
 
 func (p *AWSProvider) GetLocation(ip string) (*Location, error) {
 	loc, err := p.getLocationFromAWS(ip)
 	if err != nil {
-		return &emptyLocation, err
+		return &Location{}, err
 	}
 	return loc, nil
 }
@@ -143,7 +172,9 @@ func parseAWS(ip string, info *AWSGeoInfo) *Location {
 		if p.Subnet.Contains(parsed) {
 			if code, ok := AWSRegionMapping[p.Region]; ok {
 				loc.CountryCode = code
+				loc.City = AWSRegionCityMapping[p.Region]
 				loc.IP = ip
+				fillCountryInfo(&loc)
 				break
 			}
 		}
@@ -168,10 +199,15 @@ func (p *AWSProvider) DownloadUrl() string {
 }
 
 func (p *AWSProvider) LastUpdate() time.Time {
-	return getModTime(p.fileName)
+	return getModTime(p.logger, p.fileName)
 }
 
+// NeedUpdate returns true if the file should be downloaded. Offline
+// providers only read the local file once.
 func (p *AWSProvider) NeedUpdate() bool {
+	if p.offline {
+		return false
+	}
 	return time.Since(p.LastUpdate()) > p.expire
 }
 
@@ -0,0 +1,97 @@
+package geo
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLocationCacheSize = 4096
+	DefaultLocationCacheTTL  = time.Hour
+	// Lookups that no provider knows the answer of, e.g. because an online
+	// provider is down, are cached for a short time only.
+	DefaultLocationCacheFailureTTL = time.Minute
+)
+
+type locationCacheItem struct {
+	ip        string
+	loc       Location
+	expiresAt time.Time
+}
+
+// locationCache is a LRU cache of IP lookup results with expiration.
+type locationCache struct {
+	sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List
+}
+
+func newLocationCache(size int) *locationCache {
+	return &locationCache{
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+func (c *locationCache) Get(ip string) (*Location, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.items[ip]
+	if !ok {
+		return nil, false
+	}
+
+	item := e.Value.(*locationCacheItem)
+	if time.Now().After(item.expiresAt) {
+		c.order.Remove(e)
+		delete(c.items, ip)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	loc := item.loc
+	return &loc, true
+}
+
+// Add caches loc of ip for ttl.
+func (c *locationCache) Add(ip string, loc *Location, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.items[ip]; ok {
+		item := e.Value.(*locationCacheItem)
+		item.loc = *loc
+		item.expiresAt = time.Now().Add(ttl)
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[ip] = c.order.PushFront(&locationCacheItem{
+		ip:        ip,
+		loc:       *loc,
+		expiresAt: time.Now().Add(ttl),
+	})
+
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*locationCacheItem).ip)
+	}
+}
+
+func (c *locationCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+func (c *locationCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+	c.items = make(map[string]*list.Element, c.size)
+	c.order.Init()
+}
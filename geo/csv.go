@@ -0,0 +1,199 @@
+package geo
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CSVExpired = 7 * 24 * time.Hour
+	CSVFile    = "geo-ip.csv"
+)
+
+type csvEntry struct {
+	subnet *net.IPNet
+	loc    Location
+}
+
+// CSVProvider looks up locations from a CSV file with columns
+//
+//	network,countryCode,country,city,continent,asn
+//
+// where network is an IP or CIDR and all columns after countryCode are
+// optional. Empty lines and lines starting with # are ignored.
+type CSVProvider struct {
+	entries   []csvEntry
+	fileName  string
+	url       string
+	expire    time.Duration
+	offline   bool
+	ready     bool
+	integrity *Integrity
+	logger    *slog.Logger
+}
+
+func NewCSVProvider(path string) *CSVProvider {
+	return &CSVProvider{
+		fileName: filepath.Join(path, CSVFile),
+		expire:   CSVExpired,
+		logger:   slog.Default(),
+	}
+}
+
+func (p *CSVProvider) MaybeUpdate() error {
+	return p.MaybeUpdateContext(context.Background())
+}
+
+func (p *CSVProvider) MaybeUpdateContext(ctx context.Context) error {
+	geoLock.Lock()
+	defer geoLock.Unlock()
+	if !p.NeedUpdate() && p.entries != nil {
+		return nil
+	}
+	if p.NeedUpdate() {
+		p.logger.Info("Updating CSV geo db")
+		err := downloadDataFile(ctx, p.logger, p.url, p.fileName, p.integrity, nil, shouldKeepLastGood(p.fileName, p.ready))
+		if err != nil {
+			return err
+		}
+	}
+
+	var entries []csvEntry
+	err := loadDataFile(p.logger, p.fileName, !p.offline && len(p.url) > 0, func(fileName string) (err error) {
+		entries, err = readCSVFile(p.logger, fileName)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	p.entries = entries
+	p.ready = true
+	return nil
+}
+
+func readCSVFile(logger *slog.Logger, fileName string) ([]csvEntry, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	entries := make([]csvEntry, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			continue
+		}
+
+		network := strings.TrimSpace(record[0])
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, subnet, err := net.ParseCIDR(network)
+		if err != nil {
+			// header or malformed line
+			continue
+		}
+
+		loc := Location{CountryCode: strings.TrimSpace(record[1])}
+		if len(record) > 2 {
+			loc.Country = strings.TrimSpace(record[2])
+		}
+		if len(record) > 3 {
+			loc.City = strings.TrimSpace(record[3])
+		}
+		if len(record) > 4 {
+			loc.Continent = strings.TrimSpace(record[4])
+		}
+		if len(record) > 5 && len(strings.TrimSpace(record[5])) > 0 {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(record[5])), "AS"), 10, 32)
+			if err != nil {
+				logger.Warn("Invalid ASN in geo csv", "asn", record[5], "file", fileName)
+			} else {
+				loc.ASN = uint(asn)
+			}
+		}
+		fillCountryInfo(&loc)
+
+		entries = append(entries, csvEntry{subnet: subnet, loc: loc})
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("no valid entry in geo csv file " + fileName)
+	}
+
+	return entries, nil
+}
+
+func (p *CSVProvider) GetLocation(ip string) (*Location, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return &Location{}, errors.New("invalid ip " + ip)
+	}
+	for _, e := range p.entries {
+		if e.subnet.Contains(parsed) {
+			loc := e.loc
+			loc.IP = ip
+			return &loc, nil
+		}
+	}
+	return &Location{}, nil
+}
+
+func (p *CSVProvider) SetReady(ready bool) {
+	p.ready = ready
+}
+
+func (p *CSVProvider) Ready() bool {
+	return p.ready
+}
+
+func (p *CSVProvider) FileName() string {
+	return p.fileName
+}
+
+func (p *CSVProvider) DownloadUrl() string {
+	return p.url
+}
+
+func (p *CSVProvider) LastUpdate() time.Time {
+	return getModTime(p.logger, p.fileName)
+}
+
+// NeedUpdate returns true if the file should be downloaded. A CSV provider
+// without download url only reads the local file.
+func (p *CSVProvider) NeedUpdate() bool {
+	if p.offline || len(p.url) == 0 {
+		return false
+	}
+	return time.Since(p.LastUpdate()) > p.expire
+}
+
+func (p *CSVProvider) SetFileName(name string) {
+	p.fileName = name
+}
@@ -2,11 +2,9 @@ package geo
 
 import (
 	"context"
-	"io/ioutil"
-	"log"
+	"errors"
+	"log/slog"
 	"net"
-	"os"
-	"path"
 	"path/filepath"
 	"time"
 
@@ -20,11 +18,14 @@ const (
 )
 
 type GCPProvider struct {
-	Info     *GCPGeoInfo
-	fileName string
-	url      string
-	expire   time.Duration
-	ready    bool
+	Info      *GCPGeoInfo
+	fileName  string
+	url       string
+	expire    time.Duration
+	offline   bool
+	ready     bool
+	integrity *Integrity
+	logger    *slog.Logger
 }
 
 type GCPGeoInfo struct {
@@ -67,11 +68,40 @@ var GCPScopeMapping = map[string]string{
 	"us-west4":                "US",
 }
 
+// GCPScopeCityMapping maps GCP regions to the city of their data centers.
+var GCPScopeCityMapping = map[string]string{
+	"asia-east1":              "Changhua",
+	"asia-east2":              "Hong Kong",
+	"asia-northeast1":         "Tokyo",
+	"asia-northeast2":         "Osaka",
+	"asia-northeast3":         "Seoul",
+	"asia-south1":             "Mumbai",
+	"asia-southeast1":         "Singapore",
+	"asia-southeast2":         "Jakarta",
+	"australia-southeast1":    "Sydney",
+	"europe-north1":           "Hamina",
+	"europe-west1":            "St. Ghislain",
+	"europe-west2":            "London",
+	"europe-west3":            "Frankfurt",
+	"europe-west4":            "Eemshaven",
+	"europe-west6":            "Zurich",
+	"northamerica-northeast1": "Montreal",
+	"southamerica-east1":      "São Paulo",
+	"us-central1":             "Council Bluffs",
+	"us-east1":                "Moncks Corner",
+	"us-east4":                "Ashburn",
+	"us-west1":                "The Dalles",
+	"us-west2":                "Los Angeles",
+	"us-west3":                "Salt Lake City",
+	"us-west4":                "Las Vegas",
+}
+
 func NewGCPProvider(path string) *GCPProvider {
 	return &GCPProvider{
 		url:      GCPGeoUrl,
 		fileName: filepath.Join(path, GCPFile),
 		expire:   GCPExpired,
+		logger:   slog.Default(),
 	}
 }
 
@@ -86,45 +116,48 @@ func (p *GCPProvider) MaybeUpdateContext(ctx context.Context) error {
 		return nil
 	}
 	if p.NeedUpdate() {
-		log.Println("Updating GCP geo db")
-		tmpFile, err := ioutil.TempFile(path.Dir(p.fileName), path.Base(p.fileName)+"-*")
-		if err != nil {
-			return err
-		}
-		defer os.Remove(tmpFile.Name())
-		defer tmpFile.Close()
-		err = util.DownloadJsonFile(ctx, p.url, tmpFile.Name())
-		if err != nil {
-			return err
-		}
-		err = util.CopyFile(tmpFile.Name(), p.fileName)
+		p.logger.Info("Updating GCP geo db")
+		err := downloadDataFile(ctx, p.logger, p.url, p.fileName, p.integrity, validateJSON, shouldKeepLastGood(p.fileName, p.ready))
 		if err != nil {
 			return err
 		}
 	}
-	err := util.ReadJSON(p.fileName, &p.Info)
+	err := loadDataFile(p.logger, p.fileName, !p.offline, p.load)
+	if err != nil {
+		return err
+	}
+	p.ready = true
+	return nil
+}
+
+func (p *GCPProvider) load(fileName string) error {
+	var info *GCPGeoInfo
+	err := util.ReadJSON(fileName, &info)
 	if err != nil {
 		return err
 	}
-	for idx := range p.Info.Prefixes {
-		if len(p.Info.Prefixes[idx].Ipv4Prefix) == 0 {
+	if info == nil {
+		return errors.New("empty GCP geo db")
+	}
+	for idx := range info.Prefixes {
+		if len(info.Prefixes[idx].Ipv4Prefix) == 0 {
 			continue
 		}
-		_, subnet, err := net.ParseCIDR(p.Info.Prefixes[idx].Ipv4Prefix)
+		_, subnet, err := net.ParseCIDR(info.Prefixes[idx].Ipv4Prefix)
 		if err != nil {
-			log.Print(err)
+			p.logger.Warn("Invalid prefix in GCP geo db", "prefix", info.Prefixes[idx].Ipv4Prefix, "error", err)
 			continue
 		}
-		p.Info.Prefixes[idx].Subnet = subnet
+		info.Prefixes[idx].Subnet = subnet
 	}
-	p.ready = true
+	p.Info = info
 	return nil
 }
 
 func (p *GCPProvider) GetLocation(ip string) (*Location, error) {
 	loc, err := p.getLocationFromGCP(ip)
 	if err != nil {
-		return &emptyLocation, err
+		return &Location{}, err
 	}
 	return loc, nil
 }
@@ -144,7 +177,9 @@ func parseGCP(ip string, info *GCPGeoInfo) *Location {
 		if p.Subnet.Contains(parsed) {
 			if code, ok := GCPScopeMapping[p.Scope]; ok {
 				loc.CountryCode = code
+				loc.City = GCPScopeCityMapping[p.Scope]
 				loc.IP = ip
+				fillCountryInfo(&loc)
 				break
 			}
 		}
@@ -169,10 +204,15 @@ func (p *GCPProvider) DownloadUrl() string {
 }
 
 func (p *GCPProvider) LastUpdate() time.Time {
-	return getModTime(p.fileName)
+	return getModTime(p.logger, p.fileName)
 }
 
+// NeedUpdate returns true if the file should be downloaded. Offline
+// providers only read the local file once.
 func (p *GCPProvider) NeedUpdate() bool {
+	if p.offline {
+		return false
+	}
 	return time.Since(p.LastUpdate()) > p.expire
 }
 
@@ -2,7 +2,7 @@ package geo
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"regexp"
@@ -29,9 +29,14 @@ type Location struct {
 	CountryCode string `json:"countryCode"`
 	Country     string `json:"country"`
 	City        string `json:"city"`
+	Continent   string `json:"continent"`
+	ASN         uint   `json:"asn"`
 	cidr        *net.IPNet
 }
 
+// unknownCountryCode is the country code of an IP no provider knows.
+const unknownCountryCode = "UNKNOWN"
+
 var emptyLocation = Location{}
 var geoLock sync.Mutex
 
@@ -42,12 +47,20 @@ func (l *Location) Empty() bool {
 	return *l == emptyLocation
 }
 
+// Match returns true if the given location is in the IP range of l if it's
+// set, and otherwise if all non-empty fields of l match the location. Country
+// name and continent of the location are derived from its country code when
+// they are missing.
 func (l *Location) Match(location *Location) bool {
+	if l.Empty() {
+		return false
+	}
+
 	if len(l.IP) > 0 {
 		if l.cidr == nil {
 			matched, err := regexp.MatchString(`/\d{1,2}`, l.IP)
 			if err != nil {
-				log.Println(err)
+				slog.Warn("Match geo location error", "ip", l.IP, "error", err)
 				return false
 			}
 			if !matched {
@@ -55,30 +68,89 @@ func (l *Location) Match(location *Location) bool {
 			}
 			_, subnet, err := net.ParseCIDR(l.IP)
 			if err != nil {
-				log.Println(err)
+				slog.Warn("Invalid ip in geo location", "ip", l.IP, "error", err)
 				return false
 			}
 			l.cidr = subnet
 		}
 
-		if l.cidr.Contains(net.ParseIP(location.IP)) {
-			return true
+		return l.cidr.Contains(net.ParseIP(location.IP))
+	}
+
+	if len(l.CountryCode) > 0 && !strings.EqualFold(location.CountryCode, l.CountryCode) {
+		return false
+	}
+
+	info := Countries[strings.ToUpper(location.CountryCode)]
+
+	if len(l.Country) > 0 {
+		country := location.Country
+		if len(country) == 0 {
+			country = info.Name
+		}
+		if !strings.EqualFold(country, l.Country) {
+			return false
 		}
+	}
+
+	if len(l.City) > 0 && !strings.EqualFold(location.City, l.City) {
 		return false
 	}
 
-	if len(l.CountryCode) > 0 && strings.ToLower(location.CountryCode) == strings.ToLower(l.CountryCode) {
-		return true
+	if len(l.Continent) > 0 {
+		continent := location.Continent
+		if len(continent) == 0 {
+			continent = info.Continent
+		}
+		if !strings.EqualFold(continent, l.Continent) && !strings.EqualFold(ContinentNames[strings.ToUpper(continent)], l.Continent) {
+			return false
+		}
 	}
-	return false
+
+	if l.ASN > 0 && location.ASN != l.ASN {
+		return false
+	}
+
+	return true
+}
+
+// merge fills empty fields of l with values from location.
+func (l *Location) merge(location *Location) {
+	if len(l.IP) == 0 {
+		l.IP = location.IP
+	}
+	if len(l.CountryCode) == 0 {
+		l.CountryCode = location.CountryCode
+	}
+	if len(l.Country) == 0 {
+		l.Country = location.Country
+	}
+	if len(l.City) == 0 {
+		l.City = location.City
+	}
+	if len(l.Continent) == 0 {
+		l.Continent = location.Continent
+	}
+	if l.ASN == 0 {
+		l.ASN = location.ASN
+	}
+}
+
+// complete returns true if all geo fields of l are known.
+func (l *Location) complete() bool {
+	return len(l.CountryCode) > 0 && len(l.Country) > 0 && len(l.City) > 0 && len(l.Continent) > 0 && l.ASN > 0
 }
 
 type IPFilter struct {
-	Allow      []Location `json:"allow"`
-	Disallow   []Location `json:"disallow"`
+	Allow    []Location `json:"allow"`
+	Disallow []Location `json:"disallow"`
+	// Logger logs filtered IPs and provider errors, the default logger is
+	// used if nil. AddProviders sets it from ProviderOptions.
+	Logger     *slog.Logger `json:"-"`
 	providers  []GeoProvider
 	dbPath     string
 	downloadDB bool
+	cache      *locationCache
 }
 
 func (f *IPFilter) Empty() bool {
@@ -103,18 +175,22 @@ func (f *IPFilter) NeedGeoInfo() bool {
 		return false
 	}
 	for _, loc := range f.Allow {
-		if len(loc.CountryCode) > 0 || len(loc.Country) > 0 || len(loc.City) > 0 {
+		if loc.needGeoInfo() {
 			return true
 		}
 	}
 	for _, loc := range f.Disallow {
-		if len(loc.CountryCode) > 0 || len(loc.Country) > 0 || len(loc.City) > 0 {
+		if loc.needGeoInfo() {
 			return true
 		}
 	}
 	return false
 }
 
+func (l *Location) needGeoInfo() bool {
+	return len(l.CountryCode) > 0 || len(l.Country) > 0 || len(l.City) > 0 || len(l.Continent) > 0 || l.ASN > 0
+}
+
 func (f *IPFilter) AllowIP(ip string) (bool, error) {
 	if f.Empty() {
 		return true, nil
@@ -130,16 +206,52 @@ func (f *IPFilter) AllowIP(ip string) (bool, error) {
 	return f.AllowLocation(loc), nil
 }
 
+// GetLocation merges results of ready providers in order until the location
+// is complete. Online providers are only queried if no local provider knows
+// the IP.
 func (f *IPFilter) GetLocation(ip string) *Location {
+	if f.cache != nil {
+		if loc, ok := f.cache.Get(ip); ok {
+			return loc
+		}
+	}
+
+	loc := f.getLocationFromProviders(ip)
+
+	if f.cache != nil {
+		ttl := DefaultLocationCacheTTL
+		if loc.CountryCode == unknownCountryCode {
+			ttl = DefaultLocationCacheFailureTTL
+		}
+		f.cache.Add(ip, loc, ttl)
+	}
+
+	return loc
+}
+
+func (f *IPFilter) getLocationFromProviders(ip string) *Location {
+	loc := &Location{}
 	for _, p := range f.providers {
-		if p.Ready() {
-			loc := getLocationFromProvider(ip, p)
-			if !loc.Empty() {
-				return &loc
-			}
+		if !p.Ready() {
+			continue
+		}
+		if !loc.Empty() && len(p.FileName()) == 0 {
+			break
+		}
+		l := getLocationFromProvider(loggerOrDefault(f.Logger), ip, p)
+		if l.Empty() {
+			continue
+		}
+		loc.merge(&l)
+		fillCountryInfo(loc)
+		if loc.complete() {
+			break
 		}
 	}
-	return &Location{CountryCode: "UNKNOWN", IP: ip}
+	if loc.Empty() {
+		return &Location{CountryCode: unknownCountryCode, IP: ip}
+	}
+	return loc
 }
 
 func (f *IPFilter) AllowLocation(loc *Location) bool {
@@ -149,7 +261,7 @@ func (f *IPFilter) AllowLocation(loc *Location) bool {
 
 	for _, l := range f.Disallow {
 		if l.Match(loc) {
-			log.Printf("%s from %s dropped", loc.IP, loc.CountryCode)
+			loggerOrDefault(f.Logger).Debug("IP dropped", "ip", loc.IP, "countryCode", loc.CountryCode)
 			return false
 		}
 	}
@@ -157,7 +269,7 @@ func (f *IPFilter) AllowLocation(loc *Location) bool {
 	empty := true
 	for _, l := range f.Allow {
 		if l.Match(loc) {
-			log.Printf("%s from %s passed", loc.IP, loc.CountryCode)
+			loggerOrDefault(f.Logger).Debug("IP passed", "ip", loc.IP, "countryCode", loc.CountryCode)
 			return true
 		}
 		if !l.Empty() {
@@ -168,21 +280,57 @@ func (f *IPFilter) AllowLocation(loc *Location) bool {
 	return empty
 }
 
+// AddProvider adds the default providers. It's the same as AddProviders with
+// only path and download options.
 func (f *IPFilter) AddProvider(download bool, path string) {
-	f.downloadDB = download
-	f.dbPath = path
-	if f.downloadDB {
-		aws := NewAWSProvider(f.dbPath)
-		gcp := NewGCPProvider(f.dbPath)
-		mm := NewMaxMindProvider(f.dbPath)
-		f.providers = []GeoProvider{aws, gcp, mm}
+	err := f.AddProviders(&ProviderOptions{Path: path, Download: download})
+	if err != nil {
+		loggerOrDefault(f.Logger).Warn("Add geo providers error", "error", err)
 	}
+}
 
-	ip2c := NewIP2CProvider()
-	f.providers = append(f.providers, ip2c)
+// AddProviders replaces providers of the filter with the ones configured in
+// opts, or the default providers if opts has none.
+func (f *IPFilter) AddProviders(opts *ProviderOptions) error {
+	confs := opts.Providers
+	if len(confs) == 0 {
+		confs = opts.defaultProviderConfigs()
+	}
+
+	providers := make([]GeoProvider, 0, len(confs))
+	for i := range confs {
+		p, err := NewProvider(&confs[i], opts)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			providers = append(providers, p)
+		}
+	}
+
+	if opts.Logger != nil {
+		f.Logger = opts.Logger
+	}
+	f.downloadDB = opts.canDownload()
+	f.dbPath = opts.Path
+	f.providers = providers
+
+	switch {
+	case opts.CacheSize < 0:
+		f.cache = nil
+	case opts.CacheSize == 0:
+		f.cache = newLocationCache(DefaultLocationCacheSize)
+	default:
+		f.cache = newLocationCache(opts.CacheSize)
+	}
+
+	return nil
 }
 
 func (f *IPFilter) GetProviders() []GeoProvider {
+	if f == nil {
+		return nil
+	}
 	return f.providers
 }
 
@@ -191,15 +339,23 @@ func (f *IPFilter) UpdateDataFile() {
 }
 
 func (f *IPFilter) UpdateDataFileContext(ctx context.Context) {
+	updated := false
 	for _, p := range f.providers {
 		if len(p.FileName()) == 0 {
 			continue
 		}
+		lastUpdate, ready := p.LastUpdate(), p.Ready()
 		err := p.MaybeUpdateContext(ctx)
 		if err != nil {
-			log.Print(err)
+			loggerOrDefault(f.Logger).Warn("Update geo db error", "file", p.FileName(), "error", err)
 			continue
 		}
+		if p.Ready() != ready || !p.LastUpdate().Equal(lastUpdate) {
+			updated = true
+		}
+	}
+	if updated && f.cache != nil {
+		f.cache.Purge()
 	}
 }
 
@@ -217,21 +373,32 @@ func (f *IPFilter) StartUpdateDataFile(c chan struct{}) {
 	}
 }
 
-func getLocationFromProvider(ip string, p GeoProvider) Location {
+func getLocationFromProvider(logger *slog.Logger, ip string, p GeoProvider) Location {
 	loc, err := p.GetLocation(ip)
 	if err != nil {
-		log.Println(err)
+		logger.Debug("Geo lookup error", "ip", ip, "error", err)
+	}
+	if loc == nil {
+		return emptyLocation
 	}
 	return *loc
 }
 
-func getModTime(fileName string) time.Time {
+func getModTime(logger *slog.Logger, fileName string) time.Time {
 	fs, err := os.Stat(fileName)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Print(err)
+			logger.Warn("Stat geo db error", "file", fileName, "error", err)
 		}
 		return time.Time{}
 	}
 	return fs.ModTime()
 }
+
+// loggerOrDefault returns logger, or the default logger if it's nil.
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
@@ -2,14 +2,12 @@ package geo
 
 import (
 	"context"
-	"io"
-	"io/ioutil"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
-	"net/http"
-	"os"
-	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/nknorg/tuna/util"
@@ -21,29 +19,41 @@ const (
 	Geolite2Url    = "https://githubusercontent.nkn.org/leo108/geolite2-db/master/Country.mmdb"
 	MaxMindExpired = 30 * 24 * time.Hour
 	MaxMindFile    = "geolite2-country.mmdb"
+	MaxMindASNFile = "geolite2-asn.mmdb" // optional, used for ASN lookup if present
 )
 
 type MaxMindProvider struct {
-	DB       *geoip2.Reader
-	fileName string
-	url      string
-	expire   time.Duration
-	ready    bool
+	DB          *geoip2.Reader
+	ASNDB       *geoip2.Reader
+	fileName    string
+	asnFileName string
+	url         string
+	expire      time.Duration
+	offline     bool
+	ready       bool
+	integrity   *Integrity
+	// the ASN db is downloaded from asnURL if set, and verified with
+	// asnIntegrity either way
+	asnURL       string
+	asnIntegrity *Integrity
+	logger       *slog.Logger
 }
 
 func (p *MaxMindProvider) GetLocation(ip string) (*Location, error) {
 	loc, err := p.getLocationFromMM(ip)
 	if err != nil {
-		return &emptyLocation, err
+		return &Location{}, err
 	}
 	return loc, nil
 }
 
 func NewMaxMindProvider(path string) *MaxMindProvider {
 	return &MaxMindProvider{
-		url:      MaxMindFile,
-		fileName: filepath.Join(path, MaxMindFile),
-		expire:   MaxMindExpired,
+		url:         Geolite2Url,
+		fileName:    filepath.Join(path, MaxMindFile),
+		asnFileName: filepath.Join(path, MaxMindASNFile),
+		expire:      MaxMindExpired,
+		logger:      slog.Default(),
 	}
 }
 
@@ -58,55 +68,123 @@ func (p *MaxMindProvider) MaybeUpdateContext(ctx context.Context) error {
 		return nil
 	}
 	if p.NeedUpdate() {
-		log.Println("Updating geolite db")
-		tmpFile, err := ioutil.TempFile(path.Dir(p.fileName), path.Base(p.fileName)+"-*")
+		p.logger.Info("Updating geolite db")
+		err := downloadDataFile(ctx, p.logger, p.url, p.fileName, p.integrity, validateMMDB, shouldKeepLastGood(p.fileName, p.ready))
 		if err != nil {
 			return err
 		}
-		defer os.Remove(tmpFile.Name())
-		defer tmpFile.Close()
+	}
 
-		req, err := http.NewRequestWithContext(ctx, "GET", Geolite2Url, nil)
-		if err != nil {
-			return err
-		}
-		client := http.Client{
-			Timeout: 300 * time.Second,
-		}
-		resp, err := client.Do(req)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
+	err := loadDataFile(p.logger, p.fileName, !p.offline, p.load)
+	if err != nil {
+		return err
+	}
+
+	p.maybeUpdateASN(ctx)
 
-		_, err = io.Copy(tmpFile, resp.Body)
+	p.ready = true
+	return nil
+}
+
+// maybeUpdateASN downloads the optional ASN db if it's expired, and opens it
+// if not opened yet. Errors are logged as ASN lookup is optional.
+func (p *MaxMindProvider) maybeUpdateASN(ctx context.Context) {
+	updated := false
+	if len(p.asnURL) > 0 && !p.offline && time.Since(getModTime(p.logger, p.asnFileName)) > p.expire {
+		p.logger.Info("Updating ASN db")
+		err := downloadDataFile(ctx, p.logger, p.asnURL, p.asnFileName, p.asnIntegrity, validateASNMMDB, shouldKeepLastGood(p.asnFileName, p.ASNDB != nil))
 		if err != nil {
-			return err
+			p.logger.Warn("Update ASN db error", "error", err)
+		} else {
+			updated = true
 		}
-		err = util.CopyFile(tmpFile.Name(), p.fileName)
+	}
+
+	if (p.ASNDB != nil && !updated) || !util.Exists(p.asnFileName) {
+		return
+	}
+	// a downloaded file is verified before it's written
+	if !updated {
+		err := verifyDataFile(ctx, p.asnFileName, p.asnIntegrity)
 		if err != nil {
-			return err
+			p.logger.Warn("Verify ASN db error", "error", err)
+			return
 		}
 	}
+	err := loadDataFile(p.logger, p.asnFileName, false, p.loadASN)
+	if err != nil {
+		p.logger.Warn("Open ASN db error", "error", err)
+	}
+}
 
-	db, err := geoip2.Open(p.fileName)
+func (p *MaxMindProvider) loadASN(fileName string) error {
+	db, err := geoip2.Open(fileName)
 	if err != nil {
-		os.Remove(p.fileName)
 		return err
 	}
+	if !strings.Contains(db.Metadata().DatabaseType, "ASN") {
+		db.Close()
+		return fmt.Errorf("%s is not an ASN db", fileName)
+	}
+	if p.ASNDB != nil {
+		p.ASNDB.Close()
+	}
+	p.ASNDB = db
+	return nil
+}
 
+func (p *MaxMindProvider) load(fileName string) error {
+	db, err := geoip2.Open(fileName)
+	if err != nil {
+		return err
+	}
 	p.DB = db
-	p.ready = true
+	return nil
+}
+
+func validateMMDB(b []byte) error {
+	db, err := geoip2.FromBytes(b)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func validateASNMMDB(b []byte) error {
+	db, err := geoip2.FromBytes(b)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !strings.Contains(db.Metadata().DatabaseType, "ASN") {
+		return errors.New("not an ASN db")
+	}
 	return nil
 }
 
 func (p *MaxMindProvider) getLocationFromMM(ip string) (*Location, error) {
 	parsed := net.ParseIP(ip)
-	record, err := p.DB.Country(parsed)
+	// City lookup also works on country databases, with empty city
+	record, err := p.DB.City(parsed)
 	if err != nil {
 		return nil, err
 	}
-	return &Location{CountryCode: record.Country.IsoCode, IP: ip}, nil
+	loc := &Location{
+		IP:          ip,
+		CountryCode: record.Country.IsoCode,
+		Country:     record.Country.Names["en"],
+		City:        record.City.Names["en"],
+		Continent:   record.Continent.Code,
+	}
+	if p.ASNDB != nil {
+		asn, err := p.ASNDB.ASN(parsed)
+		if err != nil {
+			p.logger.Debug("ASN lookup error", "ip", ip, "error", err)
+		} else {
+			loc.ASN = asn.AutonomousSystemNumber
+		}
+	}
+	return loc, nil
 }
 
 func (p *MaxMindProvider) FileName() string {
@@ -118,10 +196,15 @@ func (p *MaxMindProvider) DownloadUrl() string {
 }
 
 func (p *MaxMindProvider) LastUpdate() time.Time {
-	return getModTime(p.fileName)
+	return getModTime(p.logger, p.fileName)
 }
 
+// NeedUpdate returns true if the file should be downloaded. Offline
+// providers only read the local file once.
 func (p *MaxMindProvider) NeedUpdate() bool {
+	if p.offline {
+		return false
+	}
 	return time.Since(p.LastUpdate()) > p.expire
 }
 
@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
@@ -16,10 +16,15 @@ const (
 )
 
 type IP2CProvider struct {
+	url    string
+	logger *slog.Logger
 }
 
 func NewIP2CProvider() *IP2CProvider {
-	return new(IP2CProvider)
+	return &IP2CProvider{
+		url:    IP2CUrl,
+		logger: slog.Default(),
+	}
 }
 
 func (p *IP2CProvider) MaybeUpdate() error {
@@ -33,13 +38,13 @@ func (p *IP2CProvider) MaybeUpdateContext(ctx context.Context) error {
 func (p *IP2CProvider) GetLocation(ip string) (*Location, error) {
 	loc, err := p.getLocationFromIP2C(ip, GeoIPRetry)
 	if err != nil {
-		return &emptyLocation, err
+		return &Location{}, err
 	}
 	return loc, nil
 }
 
 func (p *IP2CProvider) getLocationFromIP2C(ip string, retry int) (*Location, error) {
-	queryURL := IP2CUrl + ip
+	queryURL := p.url + ip
 	client := http.Client{
 		Timeout: 10 * time.Second,
 	}
@@ -50,7 +55,7 @@ func (p *IP2CProvider) getLocationFromIP2C(ip string, retry int) (*Location, err
 	for ; i < retry; i++ {
 		resp, err = client.Get(queryURL)
 		if err != nil {
-			log.Println(err)
+			p.logger.Debug("Query ip2c error", "ip", ip, "error", err)
 			continue
 		}
 		break
@@ -90,6 +95,7 @@ func parseIP2C(ip, body string) (*Location, error) {
 
 	l := &Location{}
 	l.CountryCode = res[1]
+	l.Country = strings.TrimSpace(res[3])
 	l.IP = ip
 	return l, nil
 }
@@ -99,7 +105,7 @@ func (p *IP2CProvider) FileName() string {
 }
 
 func (p *IP2CProvider) DownloadUrl() string {
-	return ""
+	return p.url
 }
 
 func (p *IP2CProvider) LastUpdate() time.Time {
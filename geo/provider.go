@@ -0,0 +1,188 @@
+package geo
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	ProviderAWS     = "aws"
+	ProviderGCP     = "gcp"
+	ProviderMaxMind = "maxmind"
+	ProviderCSV     = "csv"
+	ProviderIP2C    = "ip2c"
+)
+
+// ProviderConfig configures one geo provider.
+type ProviderConfig struct {
+	Type    string `json:"type"`    // aws, gcp, maxmind, csv, ip2c or a registered type
+	File    string `json:"file"`    // data file, relative to geo db path if not absolute
+	ASNFile string `json:"asnFile"` // maxmind only, optional ASN database
+	URL     string `json:"url"`     // download (or query for ip2c) url, default is used if empty
+	Integrity
+	ASNURL       string    `json:"asnUrl"`       // maxmind only, download url of the ASN database
+	ASNIntegrity Integrity `json:"asnIntegrity"` // maxmind only, verifies the ASN database
+}
+
+// ProviderOptions configures the providers of an IPFilter.
+type ProviderOptions struct {
+	Path      string           // directory of data files
+	Download  bool             // download and update data files
+	Offline   bool             // disable download and all online lookups
+	CacheSize int              // size of location cache, 0 for default, negative to disable
+	Providers []ProviderConfig // providers in lookup order, defaults are used if empty
+	Logger    *slog.Logger     // logger of the filter and providers, default logger if nil
+}
+
+// ProviderFactory creates a provider from its config. It can return a nil
+// provider if the provider should not be used with the given options, e.g.
+// an online provider in offline mode.
+type ProviderFactory func(conf *ProviderConfig, opts *ProviderOptions) (GeoProvider, error)
+
+var (
+	providerFactoriesLock sync.RWMutex
+	providerFactories     = map[string]ProviderFactory{
+		ProviderAWS:     newAWSProviderFromConfig,
+		ProviderGCP:     newGCPProviderFromConfig,
+		ProviderMaxMind: newMaxMindProviderFromConfig,
+		ProviderCSV:     newCSVProviderFromConfig,
+		ProviderIP2C:    newIP2CProviderFromConfig,
+	}
+)
+
+// RegisterProvider registers a provider type that can be used in
+// ProviderConfig. Registering an existing type replaces it.
+func RegisterProvider(providerType string, factory ProviderFactory) {
+	providerFactoriesLock.Lock()
+	defer providerFactoriesLock.Unlock()
+	providerFactories[strings.ToLower(providerType)] = factory
+}
+
+// IsProviderRegistered returns whether providerType can be used in
+// ProviderConfig.
+func IsProviderRegistered(providerType string) bool {
+	providerFactoriesLock.RLock()
+	defer providerFactoriesLock.RUnlock()
+	_, ok := providerFactories[strings.ToLower(providerType)]
+	return ok
+}
+
+// NewProvider creates a provider from its config using registered factories.
+func NewProvider(conf *ProviderConfig, opts *ProviderOptions) (GeoProvider, error) {
+	providerFactoriesLock.RLock()
+	factory, ok := providerFactories[strings.ToLower(conf.Type)]
+	providerFactoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown geo provider type %q", conf.Type)
+	}
+	return factory(conf, opts)
+}
+
+// defaultProviderConfigs returns the providers used when none is configured.
+// File based providers are used if they can be downloaded, or in offline mode
+// where they read existing files in path.
+func (opts *ProviderOptions) defaultProviderConfigs() []ProviderConfig {
+	var confs []ProviderConfig
+	if opts.Download || opts.Offline {
+		confs = append(confs, ProviderConfig{Type: ProviderAWS}, ProviderConfig{Type: ProviderGCP}, ProviderConfig{Type: ProviderMaxMind})
+	}
+	if !opts.Offline {
+		confs = append(confs, ProviderConfig{Type: ProviderIP2C})
+	}
+	return confs
+}
+
+// logger returns the logger of opts, or the default logger if it's nil.
+func (opts *ProviderOptions) logger() *slog.Logger {
+	return loggerOrDefault(opts.Logger)
+}
+
+// canDownload returns whether data files can be downloaded with opts.
+func (opts *ProviderOptions) canDownload() bool {
+	return opts.Download && !opts.Offline
+}
+
+func (conf *ProviderConfig) integrity() *Integrity {
+	if conf.Integrity.Empty() {
+		return nil
+	}
+	integrity := conf.Integrity
+	return &integrity
+}
+
+func resolveFileName(path, fileName, defaultFileName string) string {
+	if len(fileName) == 0 {
+		return filepath.Join(path, defaultFileName)
+	}
+	if filepath.IsAbs(fileName) {
+		return fileName
+	}
+	return filepath.Join(path, fileName)
+}
+
+func newAWSProviderFromConfig(conf *ProviderConfig, opts *ProviderOptions) (GeoProvider, error) {
+	p := NewAWSProvider(opts.Path)
+	p.fileName = resolveFileName(opts.Path, conf.File, AWSFile)
+	if len(conf.URL) > 0 {
+		p.url = conf.URL
+	}
+	p.integrity = conf.integrity()
+	p.offline = !opts.canDownload()
+	p.logger = opts.logger()
+	return p, nil
+}
+
+func newGCPProviderFromConfig(conf *ProviderConfig, opts *ProviderOptions) (GeoProvider, error) {
+	p := NewGCPProvider(opts.Path)
+	p.fileName = resolveFileName(opts.Path, conf.File, GCPFile)
+	if len(conf.URL) > 0 {
+		p.url = conf.URL
+	}
+	p.integrity = conf.integrity()
+	p.offline = !opts.canDownload()
+	p.logger = opts.logger()
+	return p, nil
+}
+
+func newMaxMindProviderFromConfig(conf *ProviderConfig, opts *ProviderOptions) (GeoProvider, error) {
+	p := NewMaxMindProvider(opts.Path)
+	p.fileName = resolveFileName(opts.Path, conf.File, MaxMindFile)
+	p.asnFileName = resolveFileName(opts.Path, conf.ASNFile, MaxMindASNFile)
+	if len(conf.URL) > 0 {
+		p.url = conf.URL
+	}
+	p.integrity = conf.integrity()
+	p.asnURL = conf.ASNURL
+	if !conf.ASNIntegrity.Empty() {
+		asnIntegrity := conf.ASNIntegrity
+		p.asnIntegrity = &asnIntegrity
+	}
+	p.offline = !opts.canDownload()
+	p.logger = opts.logger()
+	return p, nil
+}
+
+func newCSVProviderFromConfig(conf *ProviderConfig, opts *ProviderOptions) (GeoProvider, error) {
+	p := NewCSVProvider(opts.Path)
+	p.fileName = resolveFileName(opts.Path, conf.File, CSVFile)
+	p.url = conf.URL
+	p.integrity = conf.integrity()
+	p.offline = !opts.canDownload()
+	p.logger = opts.logger()
+	return p, nil
+}
+
+func newIP2CProviderFromConfig(conf *ProviderConfig, opts *ProviderOptions) (GeoProvider, error) {
+	if opts.Offline {
+		return nil, nil
+	}
+	p := NewIP2CProvider()
+	if len(conf.URL) > 0 {
+		p.url = conf.URL
+	}
+	p.logger = opts.logger()
+	return p, nil
+}
@@ -0,0 +1,232 @@
+package geo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nknorg/tuna/util"
+)
+
+const (
+	LastGoodSuffix      = ".last"
+	dataDownloadTimeout = 300 * time.Second
+)
+
+// Integrity configures how a downloaded data file is verified before it
+// replaces the current one. All configured checks must pass.
+type Integrity struct {
+	SHA256       string `json:"sha256"`       // expected hex sha256 digest of the file
+	ChecksumURL  string `json:"checksumUrl"`  // url of a sha256sum style digest file
+	PublicKey    string `json:"publicKey"`    // hex ed25519 public key used with signatureUrl
+	SignatureURL string `json:"signatureUrl"` // url of a detached ed25519 signature, hex, base64 or raw
+}
+
+// Empty returns whether no check is configured. A public key without
+// signature url is a check that always fails.
+func (v *Integrity) Empty() bool {
+	return v == nil || (len(v.SHA256) == 0 && len(v.ChecksumURL) == 0 && len(v.SignatureURL) == 0 && len(v.PublicKey) == 0)
+}
+
+// Verify checks data against the configured digest and signature. fileName is
+// used to find the digest in a checksum file with multiple entries.
+func (v *Integrity) Verify(ctx context.Context, data []byte, fileName string) error {
+	if v.Empty() {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+
+	if len(v.SHA256) > 0 && !strings.EqualFold(strings.TrimSpace(v.SHA256), hex.EncodeToString(sum[:])) {
+		return fmt.Errorf("sha256 mismatch for %s", fileName)
+	}
+
+	if len(v.ChecksumURL) > 0 {
+		b, err := util.Download(ctx, v.ChecksumURL, dataDownloadTimeout)
+		if err != nil {
+			return fmt.Errorf("download checksum error: %v", err)
+		}
+		digest, err := parseChecksumFile(b, fileName)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(digest, hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("sha256 mismatch with checksum file for %s", fileName)
+		}
+	}
+
+	if len(v.SignatureURL) > 0 || len(v.PublicKey) > 0 {
+		if len(v.SignatureURL) == 0 {
+			return errors.New("geo data publicKey requires signatureUrl")
+		}
+		pubKey, err := hex.DecodeString(strings.TrimSpace(v.PublicKey))
+		if err != nil || len(pubKey) != ed25519.PublicKeySize {
+			return errors.New("invalid geo data public key")
+		}
+		b, err := util.Download(ctx, v.SignatureURL, dataDownloadTimeout)
+		if err != nil {
+			return fmt.Errorf("download signature error: %v", err)
+		}
+		if !ed25519.Verify(pubKey, data, decodeSignature(b)) {
+			return fmt.Errorf("invalid signature for %s", fileName)
+		}
+	}
+
+	return nil
+}
+
+// parseChecksumFile returns the digest of fileName in a sha256sum style file,
+// or the first digest if no line has a matching name.
+func parseChecksumFile(b []byte, fileName string) (string, error) {
+	var first string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields[0]) != 2*sha256.Size {
+			continue
+		}
+		if len(first) == 0 {
+			first = fields[0]
+		}
+		if len(fields) > 1 && path.Base(strings.TrimPrefix(fields[1], "*")) == fileName {
+			return fields[0], nil
+		}
+	}
+	if len(first) == 0 {
+		return "", errors.New("no sha256 digest in checksum file")
+	}
+	return first, nil
+}
+
+func decodeSignature(b []byte) []byte {
+	s := string(bytes.TrimSpace(b))
+	if sig, err := hex.DecodeString(s); err == nil && len(sig) == ed25519.SignatureSize {
+		return sig
+	}
+	if sig, err := base64.StdEncoding.DecodeString(s); err == nil && len(sig) == ed25519.SignatureSize {
+		return sig
+	}
+	return b
+}
+
+func validateJSON(b []byte) error {
+	if !json.Valid(b) {
+		return errors.New("invalid json")
+	}
+	return nil
+}
+
+// urlFileName returns the last element of the path of rawURL, without query
+// or fragment.
+func urlFileName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return path.Base(rawURL)
+	}
+	return path.Base(u.Path)
+}
+
+// saveLastGood copies fileName to its last good copy, as a hard link if
+// possible, replacing the previous copy atomically.
+func saveLastGood(fileName string) error {
+	lastGood := fileName + LastGoodSuffix
+	tmpName := lastGood + ".tmp"
+	os.Remove(tmpName)
+	if err := os.Link(fileName, tmpName); err == nil {
+		return os.Rename(tmpName, lastGood)
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(lastGood, b, 0644)
+}
+
+// downloadDataFile downloads fileURL, validates and verifies it, and
+// atomically replaces fileName, which always exists as either the old or the
+// new file. If keepLastGood is true, the current file is kept as the last
+// good copy to roll back to.
+func downloadDataFile(ctx context.Context, logger *slog.Logger, fileURL, fileName string, integrity *Integrity, validate func([]byte) error, keepLastGood bool) error {
+	b, err := util.Download(ctx, fileURL, dataDownloadTimeout)
+	if err != nil {
+		return err
+	}
+	if validate != nil {
+		err = validate(b)
+		if err != nil {
+			return fmt.Errorf("validate %s error: %v", fileURL, err)
+		}
+	}
+	err = integrity.Verify(ctx, b, urlFileName(fileURL))
+	if err != nil {
+		return err
+	}
+
+	if keepLastGood && util.Exists(fileName) {
+		err = saveLastGood(fileName)
+		if err != nil {
+			logger.Warn("Keep last good geo db error", "file", fileName, "error", err)
+		}
+	}
+
+	return util.WriteFileAtomic(fileName, b, 0644)
+}
+
+// verifyDataFile verifies an existing fileName that is not downloaded.
+func verifyDataFile(ctx context.Context, fileName string, integrity *Integrity) error {
+	if integrity.Empty() {
+		return nil
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return integrity.Verify(ctx, b, filepath.Base(fileName))
+}
+
+// loadDataFile loads fileName. If it fails, the last good copy is restored
+// and loaded instead. If there is no last good copy and removeOnFail is true,
+// the file is removed so it will be downloaded again.
+func loadDataFile(logger *slog.Logger, fileName string, removeOnFail bool, load func(fileName string) error) error {
+	err := load(fileName)
+	if err == nil {
+		return nil
+	}
+
+	lastGood := fileName + LastGoodSuffix
+	if !util.Exists(lastGood) {
+		if removeOnFail {
+			os.Remove(fileName)
+		}
+		return err
+	}
+
+	logger.Warn("Load geo db error, rolling back to last good copy", "file", fileName, "error", err)
+	if renameErr := os.Rename(lastGood, fileName); renameErr != nil {
+		return fmt.Errorf("%v, roll back error: %v", err, renameErr)
+	}
+
+	return load(fileName)
+}
+
+// shouldKeepLastGood returns whether the current data file should replace the
+// last good copy before an update. A file that has not been loaded yet only
+// becomes the last good copy if there is none.
+func shouldKeepLastGood(fileName string, loaded bool) bool {
+	return loaded || !util.Exists(fileName+LastGoodSuffix)
+}
@@ -1,8 +1,9 @@
 module github.com/nknorg/tuna
 
-go 1.20
+go 1.21
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/imdario/mergo v0.3.13
 	github.com/jessevdk/go-flags v1.5.0
 	github.com/nknorg/encrypted-stream v1.0.2-0.20230320101720-9891f770de86
@@ -14,7 +15,9 @@ require (
 	github.com/xtaci/smux v2.0.1+incompatible
 	golang.org/x/crypto v0.7.0
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c
+	golang.org/x/sys v0.6.0
 	google.golang.org/protobuf v1.29.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -29,5 +32,4 @@ require (
 	github.com/oschwald/maxminddb-golang v1.6.0 // indirect
 	github.com/pbnjay/memory v0.0.0-20210728143218-7b4eea64cf58 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 )
@@ -0,0 +1,212 @@
+package tuna
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nknorg/tuna/geo"
+	"github.com/nknorg/tuna/types"
+)
+
+// NodeReport is what the entry sees about one subscriber during selection.
+type NodeReport struct {
+	Address         string           `json:"address"`
+	IP              string           `json:"ip"`
+	CountryCode     string           `json:"countryCode,omitempty"`
+	Region          string           `json:"region,omitempty"` // advertised by the node
+	Price           string           `json:"price"`
+	Delay           float32          `json:"delay,omitempty"`           // ms
+	Bandwidth       float32          `json:"bandwidth,omitempty"`       // KB/s
+	UplinkBandwidth float32          `json:"uplinkBandwidth,omitempty"` // KB/s
+	Ping            *types.PingStats `json:"ping,omitempty"`
+	Selected        bool             `json:"selected"`
+	Rejected        string           `json:"rejected,omitempty"` // why the node was filtered out
+}
+
+func newNodeReport(node *types.Node) *NodeReport {
+	return &NodeReport{
+		Address:         node.Address,
+		IP:              node.Metadata.Ip,
+		Region:          node.Metadata.Region,
+		Price:           node.Metadata.Price,
+		Delay:           node.Delay,
+		Bandwidth:       node.DownlinkBandwidth / 1024,
+		UplinkBandwidth: node.UplinkBandwidth / 1024,
+		Ping:            node.Ping(),
+	}
+}
+
+// measureRound is the result of one round of filtering, measurement and
+// selection.
+type measureRound struct {
+	nodes    types.Nodes   // nodes in order of preference
+	measured int           // number of measured nodes passed to the selector
+	rejected []*NodeReport // rejected nodes with reasons, if recorded
+}
+
+// measureNodes runs one round of filtering, measurement and selection shared
+// by GetTopPerformanceNodesContext and MeasureNodesContext. Bandwidth is
+// measured until n nodes succeed, or of all nodes if n <= 0. If
+// recordRejected is true, the reason of each rejected node is recorded.
+func (c *Common) measureNodes(ctx context.Context, measureBandwidth bool, n int, recordRejected bool) (*measureRound, error) {
+	if len(c.ServiceInfo.IPFilter.GetProviders()) > 0 {
+		c.ServiceInfo.IPFilter.UpdateDataFileContext(ctx)
+	}
+
+	if c.measureStorage != nil {
+		mutex := c.measureStorageMutex()
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		err := c.measureStorage.Load()
+		if err != nil {
+			return nil, err
+		}
+		defer c.flushReputations()
+	}
+
+	allSubscribers, subscriberRaw, err := c.nknFilterContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filterSubs, rejected, err := c.filterSubscribersWithReasons(allSubscribers, subscriberRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	round := &measureRound{}
+	reject := func(all, kept types.Nodes, reason func(*types.Node) string) {
+		if recordRejected {
+			rejected = append(rejected, notIn(all, kept, reason)...)
+		}
+	}
+
+	candidateSubs := filterSubs
+	if len(filterSubs) > 1 {
+		// with a selector, all reachable nodes are ranked by it (e.g. by
+		// price) before keeping the top ones, instead of by delay only
+		numDelayResults := measureDelayTopDelayCount
+		if c.selector != nil {
+			numDelayResults = len(filterSubs)
+		}
+		candidateSubs = c.measureDelay(ctx, filterSubs, c.measureDelayConcurrentWorkers, numDelayResults, defaultMeasureDelayTimeout)
+		reject(filterSubs, candidateSubs, func(node *types.Node) string {
+			if node.Delay == 0 {
+				return "unreachable"
+			}
+			return fmt.Sprintf("not in top %d by delay", measureDelayTopDelayCount)
+		})
+
+		if c.selector != nil && len(candidateSubs) > 0 {
+			round.measured = len(candidateSubs)
+			rankedSubs := c.selectNodes(candidateSubs)
+			topSubs := rankedSubs
+			if len(topSubs) > measureDelayTopDelayCount {
+				topSubs = topSubs[:measureDelayTopDelayCount]
+			}
+			ranked := make(map[*types.Node]struct{}, len(rankedSubs))
+			for _, node := range rankedSubs {
+				ranked[node] = struct{}{}
+			}
+			reject(candidateSubs, topSubs, func(node *types.Node) string {
+				if _, ok := ranked[node]; ok {
+					return fmt.Sprintf("not in top %d by selector", measureDelayTopDelayCount)
+				}
+				return "rejected by selector"
+			})
+			candidateSubs = topSubs
+		}
+
+		if c.MeasurePing {
+			candidateSubs = c.measurePing(ctx, candidateSubs)
+		}
+
+		if measureBandwidth {
+			delayMeasuredSubs := candidateSubs
+			if n <= 0 {
+				n = len(delayMeasuredSubs)
+			}
+			candidateSubs = c.measureBandwidth(ctx, delayMeasuredSubs, n, c.MeasureBandwidthWorkersTimeout, c.MeasurementCacheTTL)
+			reject(delayMeasuredSubs, candidateSubs, func(*types.Node) string {
+				return "bandwidth measurement failed"
+			})
+		}
+	}
+
+	round.measured = max(round.measured, len(candidateSubs))
+	if c.selector != nil && len(candidateSubs) > 0 {
+		selectedSubs := c.selectNodes(candidateSubs)
+		reject(candidateSubs, selectedSubs, func(*types.Node) string {
+			return "rejected by selector"
+		})
+		candidateSubs = selectedSubs
+	}
+
+	round.nodes = candidateSubs
+	if recordRejected {
+		round.rejected = rejected
+	}
+	return round, nil
+}
+
+// MeasureNodesContext runs the same filtering and measurement as
+// GetTopPerformanceNodesContext, but returns a report of every subscriber
+// instead of the best nodes. Selected nodes come first in order of
+// preference, followed by rejected nodes with the reason they were rejected.
+func (c *Common) MeasureNodesContext(ctx context.Context, measureBandwidth bool) ([]*NodeReport, error) {
+	round, err := c.measureNodes(ctx, measureBandwidth, 0, true)
+	if err != nil {
+		return nil, err
+	}
+
+	candidateSubs := round.nodes
+	if c.sortMeasuredNodes != nil {
+		c.sortMeasuredNodes(candidateSubs)
+	}
+
+	reports := make([]*NodeReport, 0, len(candidateSubs)+len(round.rejected))
+	for _, node := range candidateSubs {
+		report := newNodeReport(node)
+		report.Selected = true
+		reports = append(reports, report)
+	}
+	reports = append(reports, round.rejected...)
+
+	// countries are always reported, but looked up by a separate filter if
+	// the entry doesn't need geo info itself, so that its own filtering is
+	// not changed
+	locations := c.ServiceInfo.IPFilter
+	if len(locations.GetProviders()) == 0 {
+		locations = &geo.IPFilter{}
+		err = locations.AddProviders(c.GeoProviderOptions)
+		if err != nil {
+			return nil, err
+		}
+		locations.UpdateDataFileContext(ctx)
+	}
+	for _, report := range reports {
+		if len(report.IP) > 0 {
+			report.CountryCode = locations.GetLocation(report.IP).CountryCode
+		}
+	}
+
+	return reports, nil
+}
+
+// notIn returns reports of nodes in all but not in kept.
+func notIn(all, kept types.Nodes, reason func(*types.Node) string) []*NodeReport {
+	keptNodes := make(map[*types.Node]struct{}, len(kept))
+	for _, node := range kept {
+		keptNodes[node] = struct{}{}
+	}
+	reports := make([]*NodeReport, 0)
+	for _, node := range all {
+		if _, ok := keptNodes[node]; !ok {
+			report := newNodeReport(node)
+			report.Rejected = reason(node)
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
@@ -0,0 +1,133 @@
+package tuna
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMeasurementCacheTTL = 300 // second
+	maxMeasurementCacheSize    = 4096
+	// failed measurements are only reused for a short time, so an exit that
+	// was briefly unreachable is measured again at the next selection
+	measurementErrorCacheTTL = 10 * time.Second
+)
+
+var (
+	// measurementCache is shared by all entries and exits in the process, so
+	// an exit serving several services is only measured once per TTL.
+	measurementCache = newMeasureCache()
+
+	// Measurement of the same service with the same storage runs one at a time
+	// so that later measurement can take use of the previous measurement results.
+	measureStorageMutexes sync.Map
+)
+
+type cachedMeasurement struct {
+	done       chan struct{}
+	measuredAt time.Time
+	value      interface{}
+	err        error
+	canceled   bool // measurement was canceled by its caller and is not cached
+}
+
+// fresh returns whether the finished measurement can be reused within ttl.
+// Errors are reused for at most measurementErrorCacheTTL.
+func (r *cachedMeasurement) fresh(ttl time.Duration) bool {
+	if r.err != nil && ttl > measurementErrorCacheTTL {
+		ttl = measurementErrorCacheTTL
+	}
+	return time.Since(r.measuredAt) < ttl
+}
+
+// measureCache caches measurement results keyed by measurement kind and exit
+// address. Concurrent measurements of the same key wait for the first one
+// instead of measuring again.
+type measureCache struct {
+	sync.Mutex
+	results map[string]*cachedMeasurement
+}
+
+func newMeasureCache() *measureCache {
+	return &measureCache{results: make(map[string]*cachedMeasurement)}
+}
+
+// do returns the result of key measured within ttl, or calls measure and
+// caches its result. Errors are cached for at most measurementErrorCacheTTL,
+// and not at all if ctx is done when measure returns. Nothing is cached if
+// ttl <= 0.
+func (mc *measureCache) do(ctx context.Context, key string, ttl time.Duration, measure func() (interface{}, error)) (interface{}, error) {
+	if ttl <= 0 {
+		return measure()
+	}
+
+	for {
+		mc.Lock()
+		r, ok := mc.results[key]
+		if ok {
+			select {
+			case <-r.done:
+				if r.fresh(ttl) {
+					mc.Unlock()
+					return r.value, r.err
+				}
+			default:
+				mc.Unlock()
+				select {
+				case <-r.done:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				if r.canceled {
+					continue
+				}
+				return r.value, r.err
+			}
+		}
+
+		r = &cachedMeasurement{done: make(chan struct{})}
+		mc.results[key] = r
+		if len(mc.results) > maxMeasurementCacheSize {
+			mc.clearExpired(ttl)
+		}
+		mc.Unlock()
+
+		value, err := measure()
+
+		mc.Lock()
+		r.value, r.err, r.measuredAt = value, err, time.Now()
+		if err != nil && ctx.Err() != nil {
+			r.canceled = true
+			if mc.results[key] == r {
+				delete(mc.results, key)
+			}
+		}
+		close(r.done)
+		mc.Unlock()
+
+		return value, err
+	}
+}
+
+// clearExpired removes finished results that can't be reused within ttl.
+// Caller must hold the lock.
+func (mc *measureCache) clearExpired(ttl time.Duration) {
+	for k, r := range mc.results {
+		select {
+		case <-r.done:
+			if !r.fresh(ttl) {
+				delete(mc.results, k)
+			}
+		default:
+		}
+	}
+}
+
+// measureStorageMutex returns the lock of the measurement storage of c.
+func (c *Common) measureStorageMutex() *sync.Mutex {
+	key := filepath.Join(c.MeasureStoragePath, c.SubscriptionPrefix+c.Service.Name)
+	m, _ := measureStorageMutexes.LoadOrStore(key, &sync.Mutex{})
+	return m.(*sync.Mutex)
+}
@@ -0,0 +1,248 @@
+package tuna
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsRoleEntry = "entry"
+	metricsRoleExit  = "exit"
+
+	directionEntryToExit = "entry_to_exit"
+	directionExitToEntry = "exit_to_entry"
+)
+
+type metricInfo struct {
+	typ  string
+	help string
+}
+
+var metricInfos = map[string]metricInfo{
+	"tuna_bytes_total":                  {"counter", "Service traffic in bytes."},
+	"tuna_sessions":                     {"gauge", "Connected sessions, to the exit for entries and from entries for exits."},
+	"tuna_streams":                      {"gauge", "Open service streams."},
+	"tuna_handshake_failures_total":     {"counter", "Connections that failed the tuna handshake."},
+	"tuna_measurement_duration_seconds": {"summary", "Duration of measurement rounds of candidate nodes."},
+	"tuna_nanopay_sent_total":           {"counter", "NKN sent in nanopay transactions."},
+	"tuna_nanopay_claimed_total":        {"counter", "NKN claimed from nanopay transactions."},
+	"tuna_subscription_expires_at":      {"gauge", "Block height at which the subscription to a topic expires."},
+	"tuna_subscription_failures":        {"gauge", "Failed subscribe attempts to a topic since the last success."},
+	"tuna_subscription_pending":         {"gauge", "Whether a subscription update of a topic is waiting to be sent."},
+}
+
+// emitFunc reports one sample of a metric with label name value pairs.
+type emitFunc func(name string, value float64, labels ...string)
+
+// Metrics keeps counters updated by entries and exits, and collects current
+// values from them when scraped. It serves Prometheus text format over HTTP.
+type Metrics struct {
+	sync.Mutex
+	values     map[string]map[string]float64 // metric name to rendered labels to value
+	collectors map[int]func(emitFunc)
+	nextID     int
+}
+
+// DefaultMetrics is shared by all entries and exits in the process.
+var DefaultMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		values:     make(map[string]map[string]float64),
+		collectors: make(map[int]func(emitFunc)),
+	}
+}
+
+// ServeMetrics serves DefaultMetrics at /metrics of addr until it fails.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", DefaultMetrics)
+	slog.Info("Serving metrics", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// add adds value to a counter. Caller must hold the lock.
+func (m *Metrics) add(name string, value float64, labels ...string) {
+	samples, ok := m.values[name]
+	if !ok {
+		samples = make(map[string]float64)
+		m.values[name] = samples
+	}
+	samples[renderLabels(labels)] += value
+}
+
+// Add adds value to the counter name.
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.add(name, value, labels...)
+}
+
+// ObserveDuration records d in the summary name.
+func (m *Metrics) ObserveDuration(name string, d time.Duration, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.add(name+"_sum", d.Seconds(), labels...)
+	m.add(name+"_count", 1, labels...)
+}
+
+// register adds a collector called on each scrape, and returns a function
+// that removes it. Counters reported by the collector at removal are kept so
+// that totals don't go down.
+func (m *Metrics) register(collect func(emitFunc)) func() {
+	m.Lock()
+	id := m.nextID
+	m.nextID++
+	m.collectors[id] = collect
+	m.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			var counters []func()
+			collect(func(name string, value float64, labels ...string) {
+				if metricInfos[name].typ == "counter" {
+					counters = append(counters, func() { m.add(name, value, labels...) })
+				}
+			})
+			m.Lock()
+			defer m.Unlock()
+			delete(m.collectors, id)
+			for _, add := range counters {
+				add()
+			}
+		})
+	}
+}
+
+// familyName returns the metric name samples of name belong to.
+func familyName(name string) string {
+	for _, suffix := range []string{"_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base != name && metricInfos[base].typ == "summary" {
+			return base
+		}
+	}
+	return name
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	samples := make(map[string]map[string]float64, len(m.values))
+	for name, values := range m.values {
+		samples[name] = make(map[string]float64, len(values))
+		for labels, v := range values {
+			samples[name][labels] = v
+		}
+	}
+	collectors := make([]func(emitFunc), 0, len(m.collectors))
+	for _, collect := range m.collectors {
+		collectors = append(collectors, collect)
+	}
+	m.Unlock()
+
+	// collectors take locks of entries and exits, which may add to counters
+	// while holding them
+	for _, collect := range collectors {
+		collect(func(name string, value float64, labels ...string) {
+			if samples[name] == nil {
+				samples[name] = make(map[string]float64)
+			}
+			samples[name][renderLabels(labels)] += value
+		})
+	}
+
+	families := make(map[string][]string)
+	for name := range samples {
+		family := familyName(name)
+		families[family] = append(families[family], name)
+	}
+	familyNames := make([]string, 0, len(families))
+	for family := range families {
+		familyNames = append(familyNames, family)
+	}
+	sort.Strings(familyNames)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, family := range familyNames {
+		info, ok := metricInfos[family]
+		if !ok {
+			info = metricInfo{typ: "untyped"}
+		}
+		if len(info.help) > 0 {
+			fmt.Fprintf(w, "# HELP %s %s\n", family, info.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", family, info.typ)
+		names := families[family]
+		sort.Strings(names)
+		for _, name := range names {
+			labels := make([]string, 0, len(samples[name]))
+			for l := range samples[name] {
+				labels = append(labels, l)
+			}
+			sort.Strings(labels)
+			for _, l := range labels {
+				fmt.Fprintf(w, "%s%s %s\n", name, l, strconv.FormatFloat(samples[name][l], 'g', -1, 64))
+			}
+		}
+	}
+}
+
+// collectSubscriptions reports status of subscriptions managed by s.
+func collectSubscriptions(s *SubscriptionManager, emit emitFunc) {
+	for _, status := range s.Status() {
+		pending := 0.0
+		if status.Pending {
+			pending = 1
+		}
+		emit("tuna_subscription_expires_at", float64(status.ExpiresAt), "topic", status.Topic)
+		emit("tuna_subscription_failures", float64(status.Attempts), "topic", status.Topic)
+		emit("tuna_subscription_pending", pending, "topic", status.Topic)
+	}
+}
+
+func observeMeasurement(kind string, d time.Duration) {
+	DefaultMetrics.ObserveDuration("tuna_measurement_duration_seconds", d, "kind", kind)
+}
+
+func (te *TunaEntry) collectMetrics(emit emitFunc) {
+	service := te.Service.Name
+	b := te.GetServiceBytes()
+	emit("tuna_bytes_total", float64(b.EntryToExit), "role", metricsRoleEntry, "service", service, "direction", directionEntryToExit)
+	emit("tuna_bytes_total", float64(b.ExitToEntry), "role", metricsRoleEntry, "service", service, "direction", directionExitToEntry)
+
+	sessions := 0.0
+	if te.GetConnected() {
+		sessions = 1
+	}
+	emit("tuna_sessions", sessions, "role", metricsRoleEntry, "service", service)
+	emit("tuna_streams", float64(te.GetNumActiveSessions()/2), "role", metricsRoleEntry, "service", service)
+	collectSubscriptions(te.Subscriptions, emit)
+}
+
+func (te *TunaExit) collectMetrics(emit emitFunc) {
+	for service, b := range te.GetServiceBytes() {
+		emit("tuna_bytes_total", float64(b.EntryToExit), "role", metricsRoleExit, "service", service, "direction", directionEntryToExit)
+		emit("tuna_bytes_total", float64(b.ExitToEntry), "role", metricsRoleExit, "service", service, "direction", directionExitToEntry)
+	}
+	emit("tuna_sessions", float64(te.GetNumSessions()), "role", metricsRoleExit)
+	emit("tuna_streams", float64(te.GetNumActiveSessions()/2), "role", metricsRoleExit)
+	collectSubscriptions(te.Subscriptions, emit)
+}
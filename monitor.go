@@ -0,0 +1,395 @@
+package tuna
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/storage"
+	"github.com/nknorg/tuna/types"
+	tunaUtil "github.com/nknorg/tuna/util"
+	"github.com/xtaci/smux"
+)
+
+const (
+	pingStreamTimeout = 5 * time.Second
+	pingPayloadSize   = 8
+	maxPingPayload    = 1024
+	// Old exits reject ping streams as an invalid port, so they close the
+	// stream instead of dialing a service.
+	pingStreamPortID = math.MaxUint16
+	// an alternate exit needs this much less delay than the current one to
+	// be migrated to while the current one is not degraded
+	alternateMinImprovement = 0.3
+)
+
+var errNoBetterExit = errors.New("no better exit found")
+
+// QualitySample is one measurement of the active exit.
+type QualitySample struct {
+	Delay     float32 // ms
+	Bandwidth float32 // KB/s, 0 if not measured
+}
+
+// handlePingStream echoes a ping payload back and closes the stream.
+func handlePingStream(stream *smux.Stream) error {
+	defer stream.Close()
+	err := stream.SetDeadline(time.Now().Add(pingStreamTimeout))
+	if err != nil {
+		return err
+	}
+	b, err := ReadVarBytes(stream, maxPingPayload)
+	if err != nil {
+		return err
+	}
+	return WriteVarBytes(stream, b)
+}
+
+// pingSession returns the round trip time of a ping stream through session.
+func pingSession(session *smux.Session, serviceID uint32) (time.Duration, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	err = stream.SetDeadline(time.Now().Add(pingStreamTimeout))
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeStreamMetadata(stream, &pb.StreamMetadata{
+		ServiceId: serviceID,
+		PortId:    pingStreamPortID,
+		IsPing:    true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	payload := make([]byte, pingPayloadSize)
+	binary.LittleEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+
+	timeStart := time.Now()
+	err = WriteVarBytes(stream, payload)
+	if err != nil {
+		return 0, err
+	}
+	b, err := ReadVarBytes(stream, maxPingPayload)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, errors.New("exit does not support ping stream")
+		}
+		return 0, err
+	}
+	rtt := time.Since(timeStart)
+
+	if string(b) != string(payload) {
+		return 0, errors.New("ping payload mismatch")
+	}
+
+	return rtt, nil
+}
+
+// sampleQuality measures delay of the active session, and bandwidth of the
+// current exit if a minimum bandwidth is configured. Delay falls back to TCP
+// connect time if the exit does not support ping streams.
+func (te *TunaEntry) sampleQuality(ctx context.Context) (*QualitySample, error) {
+	session, err := te.getSession()
+	if err != nil {
+		return nil, err
+	}
+	metadata := te.GetMetadata()
+	if metadata == nil {
+		return nil, errors.New("not connected")
+	}
+
+	sample := &QualitySample{}
+
+	rtt, err := pingSession(session, metadata.ServiceId)
+	if err != nil {
+		te.logger.Debug("Ping session error", "error", err)
+		addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.TcpPort))
+		rtt, err = tunaUtil.DelayMeasurementContext(ctx, tcp4, addr, defaultMeasureDelayTimeout, te.TcpDialContext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sample.Delay = float32(rtt) / float32(time.Millisecond)
+
+	if te.config.QualityMinBandwidth > 0 {
+		node := &types.Node{
+			Address:  te.GetRemoteNknAddress(),
+			Metadata: metadata,
+			Delay:    sample.Delay,
+		}
+		// samples are never cached so that a degraded exit is noticed
+		nodes := te.measureBandwidth(ctx, types.Nodes{node}, 1, te.MeasureBandwidthWorkersTimeout, 0)
+		if len(nodes) > 0 {
+			sample.Bandwidth = nodes[0].Bandwidth / 1024
+		}
+	}
+
+	return sample, nil
+}
+
+// isDegraded returns whether a sample is below configured thresholds.
+func (te *TunaEntry) isDegraded(sample *QualitySample) bool {
+	if te.config.QualityMaxDelay > 0 && sample.Delay > float32(te.config.QualityMaxDelay) {
+		return true
+	}
+	if te.config.QualityMinBandwidth > 0 && sample.Bandwidth < te.config.QualityMinBandwidth {
+		return true
+	}
+	return false
+}
+
+// canMigrate returns whether the entry can move to another exit. UDP has no
+// streams to drain, so services with UDP ports are never migrated, and a
+// preset node should never be replaced.
+func (te *TunaEntry) canMigrate() bool {
+	return !te.Reverse && te.presetNode == nil && len(te.Service.UDP) == 0
+}
+
+// isBetter returns whether node improves on sample of the current exit by at
+// least alternateMinImprovement of its delay, without less bandwidth.
+func isBetter(node *types.Node, sample *QualitySample) bool {
+	if node.Delay > sample.Delay*(1-alternateMinImprovement) {
+		return false
+	}
+	if sample.Bandwidth > 0 && node.Bandwidth > 0 && node.Bandwidth/1024 < sample.Bandwidth {
+		return false
+	}
+	return true
+}
+
+// monitorQuality periodically samples the active exit and migrates to a
+// better exit after QualityMaxFailures consecutive degraded samples. Every
+// QualityAlternateInterval alternate exits are measured as well, and new
+// streams move to one that is clearly better than the last sample.
+func (te *TunaEntry) monitorQuality() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-te.closeChan
+		cancel()
+	}()
+
+	interval := time.Duration(te.config.QualityCheckInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var alternateChan <-chan time.Time
+	if te.config.QualityAlternateInterval > 0 {
+		alternateTicker := time.NewTicker(time.Duration(te.config.QualityAlternateInterval) * time.Second)
+		defer alternateTicker.Stop()
+		alternateChan = alternateTicker.C
+	}
+
+	failures := 0
+	var lastSample *QualitySample
+	for {
+		select {
+		case <-te.closeChan:
+			return
+		case <-alternateChan:
+			if lastSample == nil {
+				continue
+			}
+			err := te.migrate(ctx, true, lastSample)
+			if err == nil {
+				lastSample = nil
+				failures = 0
+			} else if !errors.Is(err, errNoBetterExit) {
+				te.logger.Warn("Measure alternate exits error", "error", err)
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		sampleCtx, sampleCancel := context.WithTimeout(ctx, interval)
+		sample, err := te.sampleQuality(sampleCtx)
+		sampleCancel()
+		if err != nil {
+			te.logger.Warn("Sample exit quality error", "error", err)
+		} else {
+			te.logger.Debug("Sampled exit quality", "address", te.GetRemoteNknAddress(), "delayMs", sample.Delay, "bandwidthKBps", sample.Bandwidth)
+		}
+
+		if err == nil && !te.isDegraded(sample) {
+			lastSample = sample
+			failures = 0
+			continue
+		}
+		lastSample = nil
+
+		failures++
+		if failures < int(te.config.QualityMaxFailures) {
+			continue
+		}
+
+		if metadata := te.GetMetadata(); metadata != nil {
+			te.recordReputation(metadata.Ip, te.GetRemoteNknAddress(), &storage.ReputationEvent{Reason: "degraded quality"})
+		}
+
+		err = te.migrate(ctx, true, nil)
+		if err != nil {
+			te.logger.Warn("Migrate to a better exit error", "error", err)
+			continue
+		}
+		failures = 0
+	}
+}
+
+// migrate measures exits and switches new streams to the best one that meets
+// quality thresholds, skipping the current exit if skipCurrent is true. If
+// baseline is not nil, the exit also needs to be better than it.
+func (te *TunaEntry) migrate(ctx context.Context, skipCurrent bool, baseline *QualitySample) error {
+	nodes, err := te.GetTopPerformanceNodesContext(ctx, te.MeasureBandwidth, measureBandwidthTopCount)
+	if err != nil {
+		return err
+	}
+
+	current := te.GetRemoteNknAddress()
+	for _, node := range nodes {
+		if skipCurrent && node.Address == current {
+			continue
+		}
+		if te.config.QualityMaxDelay > 0 && node.Delay > float32(te.config.QualityMaxDelay) {
+			continue
+		}
+		if te.config.QualityMinBandwidth > 0 && node.Bandwidth > 0 && node.Bandwidth/1024 < te.config.QualityMinBandwidth {
+			continue
+		}
+		if baseline != nil && !isBetter(node, baseline) {
+			continue
+		}
+		err = te.switchExit(ctx, node)
+		if err != nil {
+			te.logger.Warn("Switch exit error", "error", err)
+			continue
+		}
+		return nil
+	}
+
+	return errNoBetterExit
+}
+
+// switchExit connects to node and uses it for new streams. The old session
+// is kept until its streams finish or MigrationDrainTimeout is reached, and
+// their traffic is paid to the old exit until then.
+func (te *TunaEntry) switchExit(ctx context.Context, node *types.Node) error {
+	metadata := te.latestMetadata(ctx, node)
+	entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
+	if err != nil {
+		return err
+	}
+	paymentReceiver, err := paymentReceiverOf(metadata, node.Address)
+	if err != nil {
+		return err
+	}
+	remotePublicKey, err := nkn.ClientAddrToPubKey(node.Address)
+	if err != nil {
+		return err
+	}
+
+	// new streams keep using the old session while connecting
+	addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.TcpPort))
+	conn, _, err := te.dialServerTCP(ctx, addr, remotePublicKey)
+	if err != nil {
+		te.recordReputation(metadata.Ip, node.Address, &storage.ReputationEvent{Reason: "connect error: " + err.Error()})
+		return err
+	}
+
+	session, err := smux.Client(conn, nil)
+	if err != nil {
+		Close(conn)
+		return err
+	}
+
+	paymentStream, err := openPaymentStream(session)
+	if err != nil {
+		session.Close()
+		return err
+	}
+
+	te.sessionLock.Lock()
+	oldSession, oldPayment := te.session, te.payment
+	oldConn := te.GetTCPConn()
+	oldRemoteNknAddress := te.GetRemoteNknAddress()
+	if oldPayment != nil {
+		oldPayment.retired = true
+		oldPayment.paymentStream = te.paymentStream
+		oldPayment.paymentReceiver = te.GetPaymentReceiver()
+	}
+
+	te.SetMetadata(metadata)
+	te.SetServerTCPConn(conn)
+	te.Lock()
+	te.remoteNknAddress = node.Address
+	te.paymentReceiver = paymentReceiver
+	te.entryToExitPrice, te.exitToEntryPrice = entryToExitPrice, exitToEntryPrice
+	te.connectedAt = time.Now()
+	te.Unlock()
+
+	te.session = session
+	te.paymentStream = paymentStream
+	te.payment = te.startSessionPayment()
+	te.sessionLock.Unlock()
+
+	te.logger.Info("Migrated new streams", "from", oldRemoteNknAddress, "to", node.Address, "remoteAddr", addr)
+	te.emitEvent(&Event{Type: EventNodeSwitched, RemoteNknAddress: node.Address, PreviousNknAddress: oldRemoteNknAddress})
+
+	if oldSession == nil {
+		Close(oldConn)
+	}
+	go te.drainSession(oldSession, oldPayment)
+
+	return nil
+}
+
+// drainSession closes session after all streams except the payment stream
+// are closed, or after MigrationDrainTimeout. Traffic of the session is paid
+// by payment until then.
+func (te *TunaEntry) drainSession(session *smux.Session, payment *sessionPayment) {
+	if session != nil {
+		deadline := time.Now().Add(time.Duration(te.config.MigrationDrainTimeout) * time.Second)
+		numPaymentStreams := 0
+		if payment != nil && payment.paymentStream != nil {
+			numPaymentStreams = 1
+		}
+		for !session.IsClosed() && session.NumStreams() > numPaymentStreams && time.Now().Before(deadline) {
+			select {
+			case <-te.closeChan:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		te.logger.Info("Closing drained session", "streams", session.NumStreams()-numPaymentStreams)
+	}
+
+	if payment != nil {
+		close(payment.closeChan)
+		select {
+		case <-payment.done:
+		case <-te.closeChan:
+		}
+	}
+
+	if session != nil {
+		session.Close()
+	}
+}
+
+// isCurrentSession returns whether session is used for new streams.
+func (te *TunaEntry) isCurrentSession(session *smux.Session) bool {
+	te.sessionLock.Lock()
+	defer te.sessionLock.Unlock()
+	return te.session == session
+}
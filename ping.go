@@ -0,0 +1,375 @@
+package tuna
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/types"
+	tunaUtil "github.com/nknorg/tuna/util"
+)
+
+const (
+	defaultMeasurePingCount = 10
+	pingInterval            = 20 * time.Millisecond
+	pingTimeout             = time.Second
+	maxPingServerDuration   = 30 * time.Second
+)
+
+const (
+	udpPingCookieSize   = 8
+	udpPingCookiePeriod = time.Minute
+	udpPingRate         = 100 // replies per second per source IP
+	udpPingBurst        = 2 * tunaUtil.MaxPingCount
+	maxUDPPingSources   = 4096
+)
+
+// udpPings answers UDP pings of all entries and exits in the process.
+var udpPings = newUDPPingResponder()
+
+type udpPingSource struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// udpPingResponder echoes UDP pings only to clients that have proved they
+// receive packets at their source address, by returning a stateless cookie
+// sent to that address. Requests without a valid cookie get the cookie, which
+// is smaller than the request, so a spoofed source gets no more traffic than
+// the spoofer sends. Replies to each source IP are rate limited as well.
+type udpPingResponder struct {
+	secret [32]byte
+
+	lock    sync.Mutex
+	sources map[string]*udpPingSource
+}
+
+func newUDPPingResponder() *udpPingResponder {
+	r := &udpPingResponder{sources: make(map[string]*udpPingSource)}
+	if _, err := rand.Read(r.secret[:]); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// cookie returns the cookie of addr in the period of t.
+func (r *udpPingResponder) cookie(addr *net.UDPAddr, t time.Time) []byte {
+	mac := hmac.New(sha256.New, r.secret[:])
+	mac.Write(addr.IP.To16())
+	binary.Write(mac, binary.LittleEndian, uint16(addr.Port))
+	binary.Write(mac, binary.LittleEndian, t.Unix()/int64(udpPingCookiePeriod/time.Second))
+	return mac.Sum(nil)[:udpPingCookieSize]
+}
+
+// validCookie returns whether cookie of addr is from this or the last period.
+func (r *udpPingResponder) validCookie(addr *net.UDPAddr, cookie []byte) bool {
+	now := time.Now()
+	return hmac.Equal(cookie, r.cookie(addr, now)) || hmac.Equal(cookie, r.cookie(addr, now.Add(-udpPingCookiePeriod)))
+}
+
+// allow takes a token of the rate limit of ip.
+func (r *udpPingResponder) allow(ip net.IP) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if len(r.sources) >= maxUDPPingSources {
+		for k, s := range r.sources {
+			if now.Sub(s.updatedAt) > time.Second*udpPingBurst/udpPingRate {
+				delete(r.sources, k)
+			}
+		}
+		if len(r.sources) >= maxUDPPingSources {
+			return false
+		}
+	}
+
+	s, ok := r.sources[string(ip.To16())]
+	if !ok {
+		s = &udpPingSource{tokens: udpPingBurst, updatedAt: now}
+		r.sources[string(ip.To16())] = s
+	}
+	s.tokens = math.Min(udpPingBurst, s.tokens+now.Sub(s.updatedAt).Seconds()*udpPingRate)
+	s.updatedAt = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// handle answers the UDP ping packet from addr with connMetadata, and returns
+// whether it is a ping request. Heartbeat pings have no nonce and are not
+// answered.
+func (r *udpPingResponder) handle(conn UDPConn, packet []byte, connMetadata *pb.ConnectionMetadata, encrypted bool, addr *net.UDPAddr, logger *slog.Logger) bool {
+	if !connMetadata.IsPing || encrypted {
+		return false
+	}
+	nonce := connMetadata.Nonce
+	if len(nonce) != tunaUtil.PingFrameSize && len(nonce) != tunaUtil.PingFrameSize+udpPingCookieSize {
+		return false
+	}
+	if !r.allow(addr.IP) {
+		return true
+	}
+
+	var err error
+	if len(nonce) > tunaUtil.PingFrameSize && r.validCookie(addr, nonce[tunaUtil.PingFrameSize:]) {
+		_, _, err = conn.WriteMsgUDP(packet, nil, addr)
+	} else {
+		err = writeUDPConnMetadata(conn, addr, &pb.ConnectionMetadata{IsPing: true, Nonce: r.cookie(addr, time.Now())})
+	}
+	if err != nil {
+		logger.Debug("Couldn't answer udp ping", "remoteAddr", addr, "error", err)
+	}
+	return true
+}
+
+// pingUDP gets a cookie from addr, then sends count UDP pings with it every
+// interval and returns round trip times of replies in the order pings were
+// sent. Pings are sent without cookie to exits that echo the cookie request,
+// or if no reply is received within timeout.
+func pingUDP(ctx context.Context, addr string, count int, interval, timeout time.Duration) ([]time.Duration, int, error) {
+	udpAddr, err := net.ResolveUDPAddr(udp4, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.DialUDP(udp4, nil, udpAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	var lock sync.Mutex
+	sendTime := make([]time.Time, count)
+	rtts := make([]time.Duration, count)
+	var cookie []byte
+	var cookieOnce sync.Once
+	cookieChan := make(chan struct{})
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		buffer := make([]byte, MaxUDPBufferSize)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			if n <= PrefixLen {
+				continue
+			}
+			connMetadata, err := parseUDPConnMetadata(buffer[PrefixLen:n])
+			if err != nil || !connMetadata.IsPing {
+				continue
+			}
+			if len(connMetadata.Nonce) == udpPingCookieSize {
+				cookieOnce.Do(func() {
+					lock.Lock()
+					cookie = connMetadata.Nonce
+					lock.Unlock()
+					close(cookieChan)
+				})
+				continue
+			}
+			if len(connMetadata.Nonce) < tunaUtil.PingFrameSize {
+				continue
+			}
+			seq, err := tunaUtil.PingFrameSeq(connMetadata.Nonce[:tunaUtil.PingFrameSize])
+			if err == nil && seq == uint64(count) {
+				cookieOnce.Do(func() { close(cookieChan) })
+				continue
+			}
+			if err != nil || seq > uint64(count) {
+				continue
+			}
+			lock.Lock()
+			if rtts[seq] == 0 && !sendTime[seq].IsZero() {
+				rtts[seq] = time.Since(sendTime[seq])
+			}
+			lock.Unlock()
+		}
+	}()
+
+	// exits without cookie support echo the request instead, which has a
+	// sequence number out of range
+	err = writeUDPConnMetadata(conn, nil, &pb.ConnectionMetadata{
+		IsPing: true,
+		Nonce:  tunaUtil.NewPingFrame(uint64(count)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		return nil, 0, ctx.Err()
+	case <-cookieChan:
+	case <-time.After(timeout):
+	}
+
+	sent := 0
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return nil, sent, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		lock.Lock()
+		sendTime[seq] = time.Now()
+		nonce := append(tunaUtil.NewPingFrame(uint64(seq)), cookie...)
+		lock.Unlock()
+		err = writeUDPConnMetadata(conn, nil, &pb.ConnectionMetadata{
+			IsPing: true,
+			Nonce:  nonce,
+		})
+		if err != nil {
+			return nil, sent, err
+		}
+		sent++
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	}
+	conn.Close()
+	<-readDone
+
+	received := make([]time.Duration, 0, count)
+	for _, rtt := range rtts {
+		if rtt > 0 {
+			received = append(received, rtt)
+		}
+	}
+
+	return received, sent, nil
+}
+
+// pingTCP pings node over a new tuna connection and returns round trip times.
+func (c *Common) pingTCP(ctx context.Context, node *types.Node, count int) ([]time.Duration, int, error) {
+	remotePublicKey, err := nkn.ClientAddrToPubKey(node.Address)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addr := node.Metadata.Ip + ":" + strconv.Itoa(int(node.Metadata.TcpPort))
+	d := net.Dialer{Timeout: defaultMeasureDelayTimeout}
+	dialContext := d.DialContext
+	if c.TcpDialContext != nil {
+		dialContext = c.TcpDialContext
+	}
+	conn, err := dialContext(ctx, tcp4, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	encryptedConn, _, err := c.wrapConn(conn, remotePublicKey, &pb.ConnectionMetadata{
+		IsPing: true,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer encryptedConn.Close()
+
+	return tunaUtil.PingClientContext(ctx, encryptedConn, count, pingInterval, pingTimeout)
+}
+
+// pingMeasurement is the TCP and UDP ping stats of a node, nil if not
+// measured.
+type pingMeasurement struct {
+	tcp, udp *types.PingStats
+}
+
+// pingNode pings node over TCP, and over UDP if udpPort is not 0.
+func (c *Common) pingNode(ctx context.Context, node *types.Node, udpPort uint32, count int) *pingMeasurement {
+	res := &pingMeasurement{}
+	rtts, sent, err := c.pingTCP(ctx, node, count)
+	if err == nil || len(rtts) > 0 {
+		res.tcp = types.NewPingStats(sent, rtts)
+	} else {
+		var e net.Error
+		if !errors.As(err, &e) {
+			c.logger.Warn("TCP ping error", "ip", node.Metadata.Ip, "error", err)
+		}
+	}
+
+	if udpPort > 0 {
+		addr := node.Metadata.Ip + ":" + strconv.Itoa(int(udpPort))
+		rtts, sent, err := pingUDP(ctx, addr, count, pingInterval, pingTimeout)
+		if err != nil {
+			c.logger.Warn("UDP ping error", "remoteAddr", addr, "error", err)
+		} else if res.tcp != nil || len(rtts) > 0 {
+			// no reply from an exit without ping support is not loss
+			res.udp = types.NewPingStats(sent, rtts)
+		}
+	}
+
+	return res
+}
+
+// measurePing measures TCP, and UDP if the service uses UDP, ping stats of
+// nodes and sorts them by ping quality. Delay of a node is replaced by its
+// median ping RTT. Nodes that don't support ping keep their connect delay.
+func (c *Common) measurePing(ctx context.Context, nodes types.Nodes) types.Nodes {
+	timeStart := time.Now()
+	count := int(c.MeasurePingCount)
+	if count <= 0 {
+		count = defaultMeasurePingCount
+	}
+	measureUDP := len(c.Service.UDP) > 0
+
+	wg := &sync.WaitGroup{}
+	var measurementPingJobChan = make(chan tunaUtil.Job, 1)
+	go tunaUtil.WorkPool(c.measureDelayConcurrentWorkers, measurementPingJobChan, wg)
+	for i := range nodes {
+		wg.Add(1)
+		node := nodes[i]
+		tunaUtil.Enqueue(measurementPingJobChan, func() {
+			udpPort := uint32(0)
+			if measureUDP {
+				udpPort = node.Metadata.UdpPort
+			}
+			key := fmt.Sprintf("ping %s:%d %d %d", node.Metadata.Ip, node.Metadata.TcpPort, udpPort, count)
+			v, _ := measurementCache.do(ctx, key, c.MeasurementCacheTTL, func() (interface{}, error) {
+				// pings cut short by ctx are used but not cached
+				return c.pingNode(ctx, node, udpPort, count), ctx.Err()
+			})
+			if v == nil {
+				return
+			}
+			res := v.(*pingMeasurement)
+			node.TCPPing, node.UDPPing = res.tcp, res.udp
+			if node.TCPPing != nil && node.TCPPing.Received > 0 {
+				node.Delay = node.TCPPing.Median
+			}
+		})
+	}
+	wg.Wait()
+	close(measurementPingJobChan)
+
+	measurePingTime := time.Since(timeStart)
+	observeMeasurement("ping", measurePingTime)
+	c.logger.Info("Measured ping", "nodes", len(nodes), "duration", measurePingTime)
+
+	sort.Stable(types.SortByPing{Nodes: nodes})
+
+	return nodes
+}
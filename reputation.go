@@ -0,0 +1,71 @@
+package tuna
+
+import (
+	"time"
+
+	"github.com/nknorg/tuna/storage"
+)
+
+const (
+	// Sessions closed by the exit within earlyDisconnectDuration count as failures.
+	earlyDisconnectDuration = time.Minute
+	// Reputation events outside of a selection round are saved at most once
+	// per reputationFlushInterval.
+	reputationFlushInterval = time.Minute
+)
+
+// recordReputation adds event to the reputation of node ip if measure storage
+// is enabled. Events are kept in memory and saved at the end of the selection
+// round, or by a timer started by the first unsaved event.
+func (c *Common) recordReputation(ip, address string, event *storage.ReputationEvent) {
+	if c.measureStorage == nil || len(ip) == 0 {
+		return
+	}
+	c.measureStorage.AddReputationEvent(ip, address, event)
+
+	c.reputationFlushLock.Lock()
+	defer c.reputationFlushLock.Unlock()
+	if c.reputationFlushTimer == nil {
+		c.reputationFlushTimer = time.AfterFunc(reputationFlushInterval, c.flushReputations)
+	}
+}
+
+// flushReputations saves reputation events recorded since the last save.
+func (c *Common) flushReputations() {
+	if c.measureStorage == nil {
+		return
+	}
+
+	c.reputationFlushLock.Lock()
+	if c.reputationFlushTimer != nil {
+		c.reputationFlushTimer.Stop()
+		c.reputationFlushTimer = nil
+	}
+	c.reputationFlushLock.Unlock()
+
+	err := c.measureStorage.FlushReputations()
+	if err != nil {
+		c.logger.Warn("Save reputations error", "error", err)
+	}
+}
+
+// recordSessionEnd records the end of the session with the current remote
+// node. reason is used if the session ended too early.
+func (c *Common) recordSessionEnd(reason string) {
+	metadata := c.GetMetadata()
+	if metadata == nil {
+		return
+	}
+	c.RLock()
+	connectedAt := c.connectedAt
+	c.RUnlock()
+	if connectedAt.IsZero() {
+		return
+	}
+	uptime := time.Since(connectedAt)
+	c.recordReputation(metadata.Ip, c.GetRemoteNknAddress(), &storage.ReputationEvent{
+		Success: uptime >= earlyDisconnectDuration,
+		Uptime:  uptime,
+		Reason:  reason,
+	})
+}
@@ -0,0 +1,277 @@
+package tuna
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/storage"
+	"github.com/nknorg/tuna/types"
+)
+
+const (
+	SelectorFastest  = "fastest"
+	SelectorCheapest = "cheapest"
+	SelectorWeighted = "weighted"
+
+	unknownBandwidthPenalty = 1e9
+	neutralScore            = 0.5
+)
+
+// Candidate is a measured node together with everything a Selector can use
+// to rank it.
+type Candidate struct {
+	Node             *types.Node
+	EntryToExitPrice common.Fixed64
+	ExitToEntryPrice common.Fixed64
+	Favorite         *storage.FavoriteNode // nil if the node is not a favorite node
+	Avoided          bool                  // the node has been recorded as an avoid node
+	Reputation       *storage.Reputation   // nil if the node has no history
+	Direction        string                // bandwidth direction used for history bandwidth
+}
+
+// Price returns the sum of both direction prices.
+func (c *Candidate) Price() common.Fixed64 {
+	return c.EntryToExitPrice + c.ExitToEntryPrice
+}
+
+// KnownBandwidth returns the bandwidth in KB/s measured this time, or the
+// one recorded in history in Direction, or 0 if unknown.
+func (c *Candidate) KnownBandwidth() float32 {
+	if c.Node.Bandwidth > 0 {
+		return c.Node.Bandwidth / 1024
+	}
+	if c.Favorite != nil {
+		return directionBandwidth(c.Direction, c.Favorite.MinBandwidth, c.Favorite.MinUplinkBandwidth)
+	}
+	return 0
+}
+
+// Selector ranks candidate nodes. It returns the candidates to use in order
+// of preference, candidates not returned will not be used.
+type Selector interface {
+	Select(candidates []*Candidate) []*Candidate
+}
+
+// Scorer scores a single candidate, higher is better. Candidates with ok ==
+// false are excluded.
+type Scorer interface {
+	Score(candidate *Candidate) (score float64, ok bool)
+}
+
+// ScoreSelector is a Selector that sorts candidates by the score of Scorer.
+type ScoreSelector struct {
+	Scorer Scorer
+}
+
+func (s *ScoreSelector) Select(candidates []*Candidate) []*Candidate {
+	scores := make(map[*Candidate]float64, len(candidates))
+	selected := make([]*Candidate, 0, len(candidates))
+	for _, c := range candidates {
+		score, ok := s.Scorer.Score(c)
+		if !ok {
+			continue
+		}
+		scores[c] = score
+		selected = append(selected, c)
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return scores[selected[i]] > scores[selected[j]]
+	})
+	return selected
+}
+
+// FastestScorer prefers the highest bandwidth, and the lowest delay among
+// nodes without bandwidth measurement.
+type FastestScorer struct{}
+
+func (s *FastestScorer) Score(c *Candidate) (float64, bool) {
+	if c.Node.Bandwidth > 0 {
+		return float64(c.Node.Bandwidth), true
+	}
+	return -float64(c.Node.Delay), true
+}
+
+// CheapestScorer prefers the lowest price among nodes meeting MinBandwidth
+// (KB/s). Nodes whose bandwidth is unknown are ranked after nodes known to
+// meet it.
+type CheapestScorer struct {
+	MinBandwidth float32
+}
+
+func (s *CheapestScorer) Score(c *Candidate) (float64, bool) {
+	score := -float64(c.Price())
+	if s.MinBandwidth > 0 {
+		bandwidth := c.KnownBandwidth()
+		if bandwidth == 0 {
+			score -= unknownBandwidthPenalty * common.StorageFactor
+		} else if bandwidth < s.MinBandwidth {
+			return 0, false
+		}
+	}
+	return score, true
+}
+
+// WeightedSelector ranks candidates by the weighted sum of their delay,
+// bandwidth, price, history, ping jitter and ping loss, each normalized to
+// [0, 1] among candidates. Candidates without ping stats get a neutral
+// jitter and loss score.
+type WeightedSelector struct {
+	DelayWeight     float64
+	BandwidthWeight float64
+	PriceWeight     float64
+	HistoryWeight   float64
+	JitterWeight    float64
+	LossWeight      float64
+}
+
+func (s *WeightedSelector) Select(candidates []*Candidate) []*Candidate {
+	delay := newRange()
+	bandwidth := newRange()
+	price := newRange()
+	jitter := newRange()
+	loss := newRange()
+	for _, c := range candidates {
+		delay.add(float64(c.Node.Delay))
+		bandwidth.add(float64(c.KnownBandwidth()))
+		price.add(float64(c.Price()))
+		if ping := c.Node.Ping(); ping != nil {
+			jitter.add(float64(ping.Jitter))
+			loss.add(float64(ping.Loss()))
+		}
+	}
+
+	scores := make(map[*Candidate]float64, len(candidates))
+	for _, c := range candidates {
+		history := neutralScore
+		if c.Avoided {
+			history = 0
+		} else if c.Reputation != nil {
+			history = c.Reputation.Score()
+		} else if c.Favorite != nil {
+			history = 1
+		}
+		jitterScore, lossScore := neutralScore, neutralScore
+		if ping := c.Node.Ping(); ping != nil {
+			jitterScore = 1 - jitter.normalize(float64(ping.Jitter))
+			lossScore = 1 - loss.normalize(float64(ping.Loss()))
+		}
+		scores[c] = s.DelayWeight*(1-delay.normalize(float64(c.Node.Delay))) +
+			s.BandwidthWeight*bandwidth.normalize(float64(c.KnownBandwidth())) +
+			s.PriceWeight*(1-price.normalize(float64(c.Price()))) +
+			s.HistoryWeight*history +
+			s.JitterWeight*jitterScore +
+			s.LossWeight*lossScore
+	}
+
+	selected := make([]*Candidate, len(candidates))
+	copy(selected, candidates)
+	sort.SliceStable(selected, func(i, j int) bool {
+		return scores[selected[i]] > scores[selected[j]]
+	})
+	return selected
+}
+
+type valueRange struct {
+	min, max float64
+}
+
+func newRange() *valueRange {
+	return &valueRange{min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (r *valueRange) add(v float64) {
+	r.min = math.Min(r.min, v)
+	r.max = math.Max(r.max, v)
+}
+
+func (r *valueRange) normalize(v float64) float64 {
+	if r.max <= r.min {
+		return 0
+	}
+	return (v - r.min) / (r.max - r.min)
+}
+
+// selectorMinBandwidth returns the bandwidth in KB/s that nodes need to be
+// selected by s, or 0 if it has no such requirement.
+func selectorMinBandwidth(s Selector) float32 {
+	if s, ok := s.(*ScoreSelector); ok {
+		if scorer, ok := s.Scorer.(*CheapestScorer); ok {
+			return scorer.MinBandwidth
+		}
+	}
+	return 0
+}
+
+// SelectorConfig configures a built-in selector.
+type SelectorConfig struct {
+	Strategy        string  `json:"strategy"`        // fastest, cheapest or weighted
+	MinBandwidth    float32 `json:"minBandwidth"`    // cheapest only, KB/s
+	DelayWeight     float64 `json:"delayWeight"`     // weighted only
+	BandwidthWeight float64 `json:"bandwidthWeight"` // weighted only
+	PriceWeight     float64 `json:"priceWeight"`     // weighted only
+	HistoryWeight   float64 `json:"historyWeight"`   // weighted only
+	JitterWeight    float64 `json:"jitterWeight"`    // weighted only, needs measurePing
+	LossWeight      float64 `json:"lossWeight"`      // weighted only, needs measurePing
+}
+
+// NewSelector creates a built-in selector from config. A weighted selector
+// without any weight uses equal weights.
+func NewSelector(conf *SelectorConfig) (Selector, error) {
+	switch strings.ToLower(conf.Strategy) {
+	case SelectorFastest:
+		return &ScoreSelector{Scorer: &FastestScorer{}}, nil
+	case SelectorCheapest:
+		return &ScoreSelector{Scorer: &CheapestScorer{MinBandwidth: conf.MinBandwidth}}, nil
+	case SelectorWeighted:
+		s := &WeightedSelector{
+			DelayWeight:     conf.DelayWeight,
+			BandwidthWeight: conf.BandwidthWeight,
+			PriceWeight:     conf.PriceWeight,
+			HistoryWeight:   conf.HistoryWeight,
+			JitterWeight:    conf.JitterWeight,
+			LossWeight:      conf.LossWeight,
+		}
+		if s.DelayWeight == 0 && s.BandwidthWeight == 0 && s.PriceWeight == 0 && s.HistoryWeight == 0 && s.JitterWeight == 0 && s.LossWeight == 0 {
+			s.DelayWeight, s.BandwidthWeight, s.PriceWeight, s.HistoryWeight = 1, 1, 1, 1
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown selector strategy %q", conf.Strategy)
+	}
+}
+
+// newCandidates collects price and history information of nodes.
+func (c *Common) newCandidates(nodes types.Nodes) []*Candidate {
+	candidates := make([]*Candidate, 0, len(nodes))
+	for _, node := range nodes {
+		candidate := &Candidate{Node: node, Direction: c.BandwidthDirection}
+		if node.Metadata != nil {
+			entryToExitPrice, exitToEntryPrice, err := ParsePrice(node.Metadata.Price)
+			if err != nil {
+				continue
+			}
+			candidate.EntryToExitPrice = entryToExitPrice
+			candidate.ExitToEntryPrice = exitToEntryPrice
+			if c.measureStorage != nil {
+				candidate.Favorite = c.measureStorage.GetFavoriteNode(node.Metadata.Ip)
+				candidate.Avoided = c.measureStorage.IsAvoidNode(node.Metadata.Ip)
+				candidate.Reputation = c.measureStorage.GetReputation(node.Metadata.Ip)
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+// selectNodes ranks nodes with selector.
+func (c *Common) selectNodes(nodes types.Nodes) types.Nodes {
+	candidates := c.selector.Select(c.newCandidates(nodes))
+	selected := make(types.Nodes, 0, len(candidates))
+	for _, candidate := range candidates {
+		selected = append(selected, candidate.Node)
+	}
+	return selected
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"log/slog"
+
+	"github.com/nknorg/tuna/util"
+)
+
+// readJSONFile reads fileName into value if it exists. A corrupt file is
+// ignored and will be replaced at the next save.
+func readJSONFile(logger *slog.Logger, fileName string, value interface{}) {
+	if !util.Exists(fileName) {
+		return
+	}
+	err := util.ReadJSON(fileName, value)
+	if err != nil {
+		logger.Warn("Ignore corrupt file", "file", fileName, "error", err)
+	}
+}
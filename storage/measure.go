@@ -2,7 +2,7 @@ package storage
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"net"
 	"path/filepath"
@@ -25,6 +25,8 @@ const (
 
 var (
 	// file lock is global variable so it's shared among multiple tuna instance
+	// in a process, files are also locked with advisory file locks so they can
+	// be shared with other processes
 	avoidNodeFileMutex    sync.RWMutex
 	favoriteNodeFileMutex sync.RWMutex
 )
@@ -37,6 +39,9 @@ type FavoriteNode struct {
 	MinBandwidth float32 `json:"minBandwidth"`
 	MaxBandwidth float32 `json:"maxBandwidth"`
 	ExpiresAt    int64   `json:"expiredAt"`
+	// uplink bandwidth is 0 if not measured
+	MinUplinkBandwidth float32 `json:"minUplinkBandwidth,omitempty"`
+	MaxUplinkBandwidth float32 `json:"maxUplinkBandwidth,omitempty"`
 }
 
 type AvoidNodes = map[string]*AvoidNode
@@ -49,22 +54,39 @@ type AvoidNode struct {
 }
 
 type MeasureStorage struct {
-	path             string
-	favoriteFilePath string
-	avoidFilePath    string
+	path               string
+	favoriteFilePath   string
+	avoidFilePath      string
+	reputationFilePath string
 
 	FavoriteNodes *Storage
 
 	avoidNodeMutex sync.RWMutex
 	AvoidNodes     map[string]AvoidNodes
+
+	reputationMutex sync.RWMutex
+	Reputations     map[string]*Reputation
+	reputationDirty bool // events added since the last save
+
+	// Logger is used for errors that don't fail an operation, the default
+	// logger is used if nil.
+	Logger *slog.Logger
 }
 
 func NewMeasureStorage(path, filenamePrefix string) *MeasureStorage {
 	return &MeasureStorage{
-		path:             path,
-		favoriteFilePath: filepath.Join(path, filenamePrefix+FavoriteFileSuffix),
-		avoidFilePath:    filepath.Join(path, filenamePrefix+AvoidFileSuffix),
+		path:               path,
+		favoriteFilePath:   filepath.Join(path, filenamePrefix+FavoriteFileSuffix),
+		avoidFilePath:      filepath.Join(path, filenamePrefix+AvoidFileSuffix),
+		reputationFilePath: filepath.Join(path, filenamePrefix+ReputationFileSuffix),
+	}
+}
+
+func (s *MeasureStorage) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
 	}
+	return slog.Default()
 }
 
 // Load must be called before all other methods
@@ -79,6 +101,11 @@ func (s *MeasureStorage) Load() error {
 		return err
 	}
 
+	err = s.loadReputationData()
+	if err != nil {
+		return err
+	}
+
 	err = s.ClearFavoriteExpired()
 	if err != nil {
 		return err
@@ -89,6 +116,11 @@ func (s *MeasureStorage) Load() error {
 		return err
 	}
 
+	err = s.ClearReputationExpired()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -97,15 +129,7 @@ func (s *MeasureStorage) loadFavoriteData() error {
 	defer favoriteNodeFileMutex.Unlock()
 
 	favoriteData := make(map[string]*FavoriteNode)
-	if util.Exists(s.favoriteFilePath) {
-		err := util.ReadJSON(s.favoriteFilePath, &favoriteData)
-		if err != nil {
-			err = util.WriteJSON(s.favoriteFilePath, favoriteData)
-			if err != nil {
-				return err
-			}
-		}
-	}
+	readJSONFile(s.logger(), s.favoriteFilePath, &favoriteData)
 
 	s.FavoriteNodes = NewStorage()
 	for k, v := range favoriteData {
@@ -120,17 +144,11 @@ func (s *MeasureStorage) loadAvoidData() error {
 	defer avoidNodeFileMutex.Unlock()
 
 	avoidData := make(map[string]AvoidNodes)
-	if util.Exists(s.avoidFilePath) {
-		err := util.ReadJSON(s.avoidFilePath, &avoidData)
-		if err != nil {
-			err = util.WriteJSON(s.avoidFilePath, avoidData)
-			if err != nil {
-				return err
-			}
-		}
-	}
+	readJSONFile(s.logger(), s.avoidFilePath, &avoidData)
 
+	s.avoidNodeMutex.Lock()
 	s.AvoidNodes = avoidData
+	s.avoidNodeMutex.Unlock()
 
 	return nil
 }
@@ -161,26 +179,88 @@ func (s *MeasureStorage) ClearAvoidExpired() error {
 	return s.SaveAvoidNodes()
 }
 
+// SaveFavoriteNodes merges favorite nodes with the ones saved by other
+// processes and saves the result. For the same node, the most recently added
+// one is kept.
 func (s *MeasureStorage) SaveFavoriteNodes() error {
 	favoriteNodeFileMutex.Lock()
 	defer favoriteNodeFileMutex.Unlock()
-	err := util.WriteJSON(s.favoriteFilePath, s.FavoriteNodes.GetData())
+
+	lock, err := util.LockFile(s.favoriteFilePath)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer lock.Unlock()
+
+	onDisk := make(map[string]*FavoriteNode)
+	readJSONFile(s.logger(), s.favoriteFilePath, &onDisk)
+
+	now := time.Now().Unix()
+	merged := make(map[string]interface{}, len(onDisk))
+	for k, v := range onDisk {
+		if now <= v.ExpiresAt {
+			merged[k] = v
+		}
+	}
+	for k, v := range s.FavoriteNodes.GetData() {
+		if old, ok := merged[k]; !ok || v.(*FavoriteNode).ExpiresAt >= old.(*FavoriteNode).ExpiresAt {
+			merged[k] = v
+		}
+	}
+	for len(merged) > maxFavoriteLength {
+		deleteKey := ""
+		minExpire := int64(math.MaxInt64)
+		for k, v := range merged {
+			if v.(*FavoriteNode).ExpiresAt < minExpire {
+				minExpire = v.(*FavoriteNode).ExpiresAt
+				deleteKey = k
+			}
+		}
+		delete(merged, deleteKey)
+	}
+	s.FavoriteNodes.SetData(merged)
+
+	return util.WriteJSON(s.favoriteFilePath, merged)
 }
 
+// SaveAvoidNodes merges avoid nodes with the ones saved by other processes and
+// saves the result. For the same node, the one expiring later is kept.
 func (s *MeasureStorage) SaveAvoidNodes() error {
-	s.avoidNodeMutex.RLock()
-	defer s.avoidNodeMutex.RUnlock()
 	avoidNodeFileMutex.Lock()
 	defer avoidNodeFileMutex.Unlock()
-	err := util.WriteJSON(s.avoidFilePath, s.AvoidNodes)
+
+	lock, err := util.LockFile(s.avoidFilePath)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer lock.Unlock()
+
+	onDisk := make(map[string]AvoidNodes)
+	readJSONFile(s.logger(), s.avoidFilePath, &onDisk)
+
+	s.avoidNodeMutex.Lock()
+	defer s.avoidNodeMutex.Unlock()
+
+	now := time.Now().Unix()
+	merged := make(map[string]AvoidNodes, len(onDisk))
+	for _, nodes := range []map[string]AvoidNodes{onDisk, s.AvoidNodes} {
+		for subnet, v := range nodes {
+			for ip, node := range v {
+				if now > node.ExpiresAt {
+					continue
+				}
+				if _, ok := merged[subnet]; !ok {
+					merged[subnet] = make(AvoidNodes)
+				}
+				if old, ok := merged[subnet][ip]; !ok || node.ExpiresAt >= old.ExpiresAt {
+					merged[subnet][ip] = node
+				}
+			}
+		}
+	}
+	s.AvoidNodes = merged
+
+	return util.WriteJSON(s.avoidFilePath, merged)
 }
 
 func (s *MeasureStorage) AddFavoriteNode(key string, val *FavoriteNode) bool {
@@ -228,7 +308,7 @@ func (s *MeasureStorage) AddAvoidNode(key string, val *AvoidNode) {
 
 	_, subnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", key, val.MaskSize))
 	if err != nil {
-		log.Println(err)
+		s.logger().Warn("Invalid avoid node", "ip", key, "error", err)
 		return
 	}
 
@@ -244,6 +324,30 @@ func (s *MeasureStorage) AddAvoidNode(key string, val *AvoidNode) {
 	}
 }
 
+// GetFavoriteNode returns the favorite node with ip, or nil if there is none.
+func (s *MeasureStorage) GetFavoriteNode(ip string) *FavoriteNode {
+	if s.FavoriteNodes == nil {
+		return nil
+	}
+	v, ok := s.FavoriteNodes.Get(ip)
+	if !ok {
+		return nil
+	}
+	return v.(*FavoriteNode)
+}
+
+// IsAvoidNode returns whether ip has been added as an avoid node.
+func (s *MeasureStorage) IsAvoidNode(ip string) bool {
+	s.avoidNodeMutex.RLock()
+	defer s.avoidNodeMutex.RUnlock()
+	for _, nodes := range s.AvoidNodes {
+		if _, ok := nodes[ip]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *MeasureStorage) GetAvoidCIDR() []*net.IPNet {
 	s.avoidNodeMutex.RLock()
 	defer s.avoidNodeMutex.RUnlock()
@@ -252,7 +356,7 @@ func (s *MeasureStorage) GetAvoidCIDR() []*net.IPNet {
 		if len(v) > avoidCIDRMinIP {
 			_, subnet, err := net.ParseCIDR(k)
 			if err != nil {
-				log.Printf("parseCIDR error: %s", k)
+				s.logger().Warn("Invalid avoid subnet", "subnet", k, "error", err)
 				continue
 			}
 			results = append(results, subnet)
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nknorg/tuna/util"
+)
+
+const (
+	ReputationFileSuffix = ".reputation.json"
+
+	// Weight of past events halves every reputationHalfLife.
+	reputationHalfLife = 3 * 24 * time.Hour
+	reputationExpired  = 30 * 24 * time.Hour
+	maxReputationCount = 1024
+	// Reputation score of a node without history.
+	neutralReputation = 0.5
+)
+
+var reputationFileMutex sync.RWMutex
+
+// ReputationEvent is the outcome of one measurement or live session.
+type ReputationEvent struct {
+	Success    bool
+	Throughput float32       // KB/s, 0 if unknown
+	Uptime     time.Duration // session duration, 0 if not a session
+	Reason     string        // failure reason
+}
+
+// Reputation is the exponentially decayed history of a node.
+type Reputation struct {
+	IP                string  `json:"ip"`
+	Address           string  `json:"address"`
+	SuccessRate       float64 `json:"successRate"`
+	Samples           float64 `json:"samples"`    // decayed number of events
+	Throughput        float64 `json:"throughput"` // KB/s
+	ThroughputSamples float64 `json:"throughputSamples"`
+	Uptime            float64 `json:"uptime"` // average session duration in seconds
+	UptimeSamples     float64 `json:"uptimeSamples"`
+	Failures          int64   `json:"failures"` // total number of failures, not decayed
+	LastFailure       string  `json:"lastFailure,omitempty"`
+	UpdatedAt         int64   `json:"updatedAt"`
+}
+
+// decay returns the weight factor of history updated at updatedAt.
+func decay(updatedAt int64, now time.Time) float64 {
+	elapsed := now.Sub(time.Unix(updatedAt, 0))
+	if elapsed <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(elapsed)/float64(reputationHalfLife))
+}
+
+func decayedAverage(avg, samples, value float64) (float64, float64) {
+	samples++
+	return avg + (value-avg)/samples, samples
+}
+
+func (r *Reputation) update(event *ReputationEvent, now time.Time) {
+	f := decay(r.UpdatedAt, now)
+	r.Samples *= f
+	r.ThroughputSamples *= f
+	r.UptimeSamples *= f
+
+	success := 0.0
+	if event.Success {
+		success = 1
+	} else {
+		r.Failures++
+		r.LastFailure = event.Reason
+	}
+	r.SuccessRate, r.Samples = decayedAverage(r.SuccessRate, r.Samples, success)
+	if event.Throughput > 0 {
+		r.Throughput, r.ThroughputSamples = decayedAverage(r.Throughput, r.ThroughputSamples, float64(event.Throughput))
+	}
+	if event.Uptime > 0 {
+		r.Uptime, r.UptimeSamples = decayedAverage(r.Uptime, r.UptimeSamples, event.Uptime.Seconds())
+	}
+	r.UpdatedAt = now.Unix()
+}
+
+// Score returns the success rate in [0, 1], pulled towards a neutral score
+// when there are only a few recent events.
+func (r *Reputation) Score() float64 {
+	samples := r.Samples * decay(r.UpdatedAt, time.Now())
+	return (r.SuccessRate*samples + neutralReputation) / (samples + 1)
+}
+
+func (s *MeasureStorage) loadReputationData() error {
+	reputationFileMutex.Lock()
+	defer reputationFileMutex.Unlock()
+
+	reputationData := make(map[string]*Reputation)
+	readJSONFile(s.logger(), s.reputationFilePath, &reputationData)
+
+	s.reputationMutex.Lock()
+	// keep events that have not been saved yet
+	if s.reputationDirty {
+		mergeReputations(reputationData, s.Reputations)
+	}
+	s.Reputations = reputationData
+	s.reputationMutex.Unlock()
+
+	return nil
+}
+
+// ClearReputationExpired removes nodes without events for a long time, and
+// the least recently updated nodes if there are too many.
+func (s *MeasureStorage) ClearReputationExpired() error {
+	s.reputationMutex.Lock()
+	s.Reputations = clearReputationExpired(s.Reputations)
+	// Unlock must be called before save to avoid deadlock
+	s.reputationMutex.Unlock()
+	return s.SaveReputations()
+}
+
+func clearReputationExpired(reputations map[string]*Reputation) map[string]*Reputation {
+	expiredAt := time.Now().Add(-reputationExpired).Unix()
+	for k, v := range reputations {
+		if v.UpdatedAt < expiredAt {
+			delete(reputations, k)
+		}
+	}
+	for len(reputations) > maxReputationCount {
+		oldestKey, oldest := "", int64(math.MaxInt64)
+		for k, v := range reputations {
+			if v.UpdatedAt < oldest {
+				oldestKey, oldest = k, v.UpdatedAt
+			}
+		}
+		delete(reputations, oldestKey)
+	}
+	return reputations
+}
+
+// SaveReputations merges reputations with the ones saved by other processes
+// and saves the result. For the same node, the most recently updated one is
+// kept.
+func (s *MeasureStorage) SaveReputations() error {
+	reputationFileMutex.Lock()
+	defer reputationFileMutex.Unlock()
+
+	lock, err := util.LockFile(s.reputationFilePath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	onDisk := make(map[string]*Reputation)
+	readJSONFile(s.logger(), s.reputationFilePath, &onDisk)
+
+	s.reputationMutex.Lock()
+	defer s.reputationMutex.Unlock()
+
+	mergeReputations(onDisk, s.Reputations)
+	s.Reputations = clearReputationExpired(onDisk)
+
+	err = util.WriteJSON(s.reputationFilePath, s.Reputations)
+	if err != nil {
+		return err
+	}
+	s.reputationDirty = false
+	return nil
+}
+
+// FlushReputations saves reputations if events were added since the last
+// save.
+func (s *MeasureStorage) FlushReputations() error {
+	s.reputationMutex.RLock()
+	dirty := s.reputationDirty
+	s.reputationMutex.RUnlock()
+	if !dirty {
+		return nil
+	}
+	return s.SaveReputations()
+}
+
+// mergeReputations adds reputations of src to dst. For the same node, the
+// most recently updated one is kept.
+func mergeReputations(dst, src map[string]*Reputation) {
+	for k, v := range src {
+		if old, ok := dst[k]; !ok || v.UpdatedAt >= old.UpdatedAt {
+			dst[k] = v
+		}
+	}
+}
+
+// AddReputationEvent updates the reputation of node ip with event in memory,
+// SaveReputations or FlushReputations saves it. Events are ignored if the
+// storage has not been loaded.
+func (s *MeasureStorage) AddReputationEvent(ip, address string, event *ReputationEvent) {
+	s.reputationMutex.Lock()
+	defer s.reputationMutex.Unlock()
+
+	if s.Reputations == nil {
+		return
+	}
+	r, ok := s.Reputations[ip]
+	if !ok {
+		r = &Reputation{IP: ip}
+		s.Reputations[ip] = r
+	}
+	if len(address) > 0 {
+		r.Address = address
+	}
+	r.update(event, time.Now())
+	s.reputationDirty = true
+}
+
+// GetReputation returns a copy of the reputation of node ip, or nil if there
+// is no history.
+func (s *MeasureStorage) GetReputation(ip string) *Reputation {
+	s.reputationMutex.RLock()
+	defer s.reputationMutex.RUnlock()
+	r, ok := s.Reputations[ip]
+	if !ok {
+		return nil
+	}
+	reputation := *r
+	return &reputation
+}
@@ -41,6 +41,13 @@ func (s *Storage) Delete(key string) {
 	delete(s.data, key)
 }
 
+// SetData replaces all data.
+func (s *Storage) SetData(data map[string]interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	s.data = util.DeepCopyMap(data)
+}
+
 func (s *Storage) Len() int {
 	s.RLock()
 	defer s.RUnlock()
@@ -0,0 +1,411 @@
+package tuna
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/config"
+)
+
+// SubscriptionClient is the part of an NKN client used by SubscriptionManager
+// to send transactions. *nkn.MultiClient implements it.
+type SubscriptionClient interface {
+	Subscribe(identifier, topic string, duration int, meta string, config *nkn.TransactionConfig) (string, error)
+	UnsubscribeContext(ctx context.Context, identifier, topic string, config *nkn.TransactionConfig) (string, error)
+	GetNonce(txPool bool) (int64, error)
+	GetHeight() (int32, error)
+}
+
+const (
+	minSubscribeRetryDelay    = time.Second
+	maxSubscribeRetryDelay    = 10 * time.Minute
+	defaultUnsubscribeTimeout = 30 * time.Second
+)
+
+type subscribeData struct {
+	identifier    string
+	topic         string
+	duration      int
+	meta          string
+	config        *nkn.TransactionConfig
+	replaceTxPool bool
+	generation    uint64 // of the topic when queued
+}
+
+// SubscriptionStatus is the state of a topic subscription of a
+// SubscriptionManager.
+type SubscriptionStatus struct {
+	Topic       string    `json:"topic"`
+	Identifier  string    `json:"identifier,omitempty"`
+	TxnHash     string    `json:"txnHash,omitempty"`   // last successful subscribe transaction
+	ExpiresAt   int32     `json:"expiresAt,omitempty"` // block height, 0 if unknown
+	LastError   string    `json:"lastError,omitempty"`
+	Attempts    int       `json:"attempts"` // failed attempts since last success
+	Pending     bool      `json:"pending"`  // an update is waiting to be sent
+	UpdatedAt   time.Time `json:"updatedAt"`
+	fee         string
+	unsubscribe bool
+}
+
+// SubscriptionManager sends subscribe transactions of one client one at a
+// time, retrying failures with exponential backoff. Only the latest update of
+// each topic is kept while waiting, and Close unsubscribes from all topics.
+type SubscriptionManager struct {
+	// MinRetryDelay and MaxRetryDelay bound the backoff of a failed update, and
+	// Interval is the wait after each update for it to be packed. They should
+	// not be changed after the first Subscribe.
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+	Interval      time.Duration
+
+	client SubscriptionClient
+	logger *slog.Logger
+
+	// sendLock makes transactions of the client use consecutive nonces
+	sendLock sync.Mutex
+
+	sync.Mutex
+	pending     map[string]*subscribeData
+	order       []string
+	status      map[string]*SubscriptionStatus
+	generations map[string]uint64 // incremented when a topic is unsubscribed
+	wakeChan    chan struct{}
+	closeChan   chan struct{}
+	started     bool
+	isClosed    bool
+}
+
+func NewSubscriptionManager(client SubscriptionClient, logger *slog.Logger) *SubscriptionManager {
+	return &SubscriptionManager{
+		MinRetryDelay: minSubscribeRetryDelay,
+		MaxRetryDelay: maxSubscribeRetryDelay,
+		Interval:      config.ConsensusTimeout,
+		client:        client,
+		logger:        loggerOrDefault(logger),
+		pending:       make(map[string]*subscribeData),
+		status:        make(map[string]*SubscriptionStatus),
+		generations:   make(map[string]uint64),
+		wakeChan:      make(chan struct{}, 1),
+		closeChan:     make(chan struct{}),
+	}
+}
+
+func subscriptionKey(identifier, topic string) string {
+	return identifier + "." + topic
+}
+
+// Subscribe queues a subscription update of topic, replacing the queued one
+// of the same topic if any.
+func (m *SubscriptionManager) Subscribe(identifier, topic string, duration int, meta string, config *nkn.TransactionConfig, replaceTxPool bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.isClosed {
+		return
+	}
+
+	key := subscriptionKey(identifier, topic)
+	if _, ok := m.pending[key]; !ok {
+		m.order = append(m.order, key)
+	}
+	m.pending[key] = &subscribeData{
+		identifier:    identifier,
+		topic:         topic,
+		duration:      duration,
+		meta:          meta,
+		config:        config,
+		replaceTxPool: replaceTxPool,
+		generation:    m.generations[key],
+	}
+
+	m.getStatus(identifier, topic).Pending = true
+
+	if !m.started {
+		m.started = true
+		go m.run()
+	}
+	select {
+	case m.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// getStatus returns the status of topic, creating it if not exists. Caller
+// must hold the lock.
+func (m *SubscriptionManager) getStatus(identifier, topic string) *SubscriptionStatus {
+	key := subscriptionKey(identifier, topic)
+	s, ok := m.status[key]
+	if !ok {
+		s = &SubscriptionStatus{Topic: topic, Identifier: identifier}
+		m.status[key] = s
+	}
+	return s
+}
+
+// Status returns the status of all topics.
+func (m *SubscriptionManager) Status() []*SubscriptionStatus {
+	m.Lock()
+	defer m.Unlock()
+	res := make([]*SubscriptionStatus, 0, len(m.status))
+	for _, s := range m.status {
+		status := *s
+		res = append(res, &status)
+	}
+	return res
+}
+
+// SetExpiresAt records an existing subscription of topic, e.g. made before a
+// restart, which is unsubscribed on Close as well.
+func (m *SubscriptionManager) SetExpiresAt(identifier, topic string, expiresAt int32) {
+	m.Lock()
+	defer m.Unlock()
+	s := m.getStatus(identifier, topic)
+	s.ExpiresAt = expiresAt
+	s.unsubscribe = true
+}
+
+// next returns the next queued update, or nil if there is none.
+func (m *SubscriptionManager) next() *subscribeData {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.order) == 0 {
+		return nil
+	}
+	key := m.order[0]
+	m.order = m.order[1:]
+	subData := m.pending[key]
+	delete(m.pending, key)
+	return subData
+}
+
+// superseded returns whether a newer update of subData is queued, or its
+// topic has been unsubscribed since it was queued.
+func (m *SubscriptionManager) superseded(subData *subscribeData) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.pending[subscriptionKey(subData.identifier, subData.topic)]
+	return ok || m.removed(subData)
+}
+
+// removed returns whether the topic of subData has been unsubscribed, or m
+// closed, since subData was queued. Caller must hold the lock.
+func (m *SubscriptionManager) removed(subData *subscribeData) bool {
+	return m.isClosed || m.generations[subscriptionKey(subData.identifier, subData.topic)] != subData.generation
+}
+
+func (m *SubscriptionManager) run() {
+	for {
+		subData := m.next()
+		if subData == nil {
+			select {
+			case <-m.wakeChan:
+				continue
+			case <-m.closeChan:
+				return
+			}
+		}
+
+		retryDelay := m.MinRetryDelay
+		for {
+			err := m.subscribe(subData)
+			if err == nil {
+				break
+			}
+			m.logger.Warn("Subscribe to topic error", "topic", subData.topic, "error", err, "retryIn", retryDelay)
+			select {
+			case <-time.After(retryDelay):
+			case <-m.closeChan:
+				return
+			}
+			if m.superseded(subData) {
+				break
+			}
+			retryDelay *= 2
+			if retryDelay > m.MaxRetryDelay {
+				retryDelay = m.MaxRetryDelay
+			}
+		}
+
+		select {
+		case <-time.After(m.Interval):
+		case <-m.closeChan:
+			return
+		}
+	}
+}
+
+func (m *SubscriptionManager) subscribe(subData *subscribeData) error {
+	m.sendLock.Lock()
+	defer m.sendLock.Unlock()
+
+	// Unsubscribe and Close may have run since run took subData from the
+	// queue, and their transactions must not be followed by this one
+	m.Lock()
+	removed := m.removed(subData)
+	m.Unlock()
+	if removed {
+		return nil
+	}
+
+	txnConfig := *subData.config
+	if subData.replaceTxPool {
+		nonce, err := m.client.GetNonce(false)
+		if err != nil {
+			m.setResult(subData, "", err)
+			return err
+		}
+		txnConfig.Nonce = nonce
+		txnConfig.FixNonce = true
+	}
+
+	txnHash, err := m.client.Subscribe(subData.identifier, subData.topic, subData.duration, subData.meta, &txnConfig)
+	m.setResult(subData, txnHash, err)
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info("Subscribed to topic", "topic", subData.topic, "txnHash", txnHash)
+	return nil
+}
+
+func (m *SubscriptionManager) setResult(subData *subscribeData, txnHash string, err error) {
+	var height int32
+	if err == nil {
+		height, _ = m.client.GetHeight()
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	s := m.getStatus(subData.identifier, subData.topic)
+	s.UpdatedAt = time.Now()
+	if err != nil {
+		s.LastError = err.Error()
+		s.Attempts++
+		return
+	}
+	_, s.Pending = m.pending[subscriptionKey(subData.identifier, subData.topic)]
+	s.TxnHash = txnHash
+	s.LastError = ""
+	s.Attempts = 0
+	s.fee = subData.config.Fee
+	s.unsubscribe = true
+	if height > 0 {
+		s.ExpiresAt = height + int32(subData.duration)
+	}
+}
+
+// Close stops sending queued updates and unsubscribes from all topics
+// subscribed by m, waiting at most timeout for the transactions to be sent.
+func (m *SubscriptionManager) Close(timeout time.Duration) {
+	m.Lock()
+	if m.isClosed {
+		m.Unlock()
+		return
+	}
+	m.isClosed = true
+	close(m.closeChan)
+	m.pending = make(map[string]*subscribeData)
+	m.order = nil
+	unsubscribe := make([]*SubscriptionStatus, 0)
+	for _, s := range m.status {
+		s.Pending = false
+		if s.unsubscribe {
+			unsubscribe = append(unsubscribe, s)
+		}
+	}
+	m.Unlock()
+
+	if len(unsubscribe) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	m.sendLock.Lock()
+	defer m.sendLock.Unlock()
+
+	nonce, err := m.client.GetNonce(true)
+	if err != nil {
+		m.logger.Error("Unsubscribe get nonce error", "error", err)
+		return
+	}
+	for _, s := range unsubscribe {
+		txnHash, err := m.client.UnsubscribeContext(ctx, s.Identifier, s.Topic, &nkn.TransactionConfig{Fee: s.fee, Nonce: nonce, FixNonce: true})
+		m.Lock()
+		s.UpdatedAt = time.Now()
+		if err != nil {
+			s.LastError = err.Error()
+		} else {
+			s.TxnHash = txnHash
+			s.ExpiresAt = 0
+			s.unsubscribe = false
+		}
+		m.Unlock()
+		if err != nil {
+			m.logger.Error("Unsubscribe from topic error", "topic", s.Topic, "error", err)
+			continue
+		}
+		m.logger.Info("Unsubscribed from topic", "topic", s.Topic, "txnHash", txnHash)
+		nonce++
+	}
+}
+
+// Unsubscribe drops the queued update of topic and unsubscribes from it if
+// subscribed by m, waiting at most timeout for the transaction to be sent.
+// Updates of topic queued before are not sent, also if being retried.
+func (m *SubscriptionManager) Unsubscribe(identifier, topic string, timeout time.Duration) error {
+	key := subscriptionKey(identifier, topic)
+	m.Lock()
+	if m.isClosed {
+		m.Unlock()
+		return nil
+	}
+	m.generations[key]++
+	if _, ok := m.pending[key]; ok {
+		delete(m.pending, key)
+		for i, k := range m.order {
+			if k == key {
+				m.order = append(m.order[:i], m.order[i+1:]...)
+				break
+			}
+		}
+	}
+	m.Unlock()
+
+	// wait for an update being sent by run, so that it is unsubscribed as well
+	// and the nonce after it is used
+	m.sendLock.Lock()
+	defer m.sendLock.Unlock()
+
+	m.Lock()
+	s, ok := m.status[key]
+	if !ok || !s.unsubscribe {
+		delete(m.status, key)
+		m.Unlock()
+		return nil
+	}
+	fee := s.fee
+	m.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	nonce, err := m.client.GetNonce(true)
+	if err != nil {
+		return err
+	}
+	txnHash, err := m.client.UnsubscribeContext(ctx, identifier, topic, &nkn.TransactionConfig{Fee: fee, Nonce: nonce, FixNonce: true})
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	delete(m.status, key)
+	m.Unlock()
+	m.logger.Info("Unsubscribed from topic", "topic", topic, "txnHash", txnHash)
+	return nil
+}
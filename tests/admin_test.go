@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nknorg/tuna"
+)
+
+func TestAdminServer(t *testing.T) {
+	server := httptest.NewServer(tuna.NewAdminServer())
+	defer server.Close()
+	client := server.Client()
+
+	resp, err := client.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := &tuna.AdminStatus{}
+	err = json.NewDecoder(resp.Body).Decode(status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Entries == nil || status.Exits == nil || status.Wallets == nil {
+		t.Fatalf("status should have empty lists, got %+v", status)
+	}
+	if len(status.Entries) != 0 || len(status.Exits) != 0 || len(status.Wallets) != 0 {
+		t.Fatalf("status should be empty, got %+v", status)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		host   string
+		header bool
+	}{
+		{method: http.MethodPost, path: "/entries/reconnect", code: http.StatusForbidden, header: false},
+		{method: http.MethodGet, path: "/status", code: http.StatusForbidden, host: "attacker.example:9091"},
+		{method: http.MethodGet, path: "/status", code: http.StatusOK, host: "localhost:9091"},
+		{method: http.MethodPost, path: "/status", code: http.StatusMethodNotAllowed, header: true},
+		{method: http.MethodGet, path: "/entries/reconnect", code: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, path: "/entries/reconnect", code: http.StatusNotFound, header: true},
+		{method: http.MethodPost, path: "/entries/switch", code: http.StatusBadRequest, header: true},
+		{method: http.MethodPost, path: "/entries/switch?address=abc", code: http.StatusNotFound, header: true},
+		{method: http.MethodPost, path: "/exits/drain?draining=maybe", code: http.StatusBadRequest, header: true},
+		{method: http.MethodPost, path: "/exits/drain", code: http.StatusNotFound, header: true},
+		{method: http.MethodGet, path: "/unknown", code: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.host) > 0 {
+			req.Host = test.host
+		}
+		if test.header {
+			req.Header.Set(tuna.AdminHeader, "1")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s %s returned %d, expected %d", test.method, test.path, resp.StatusCode, test.code)
+		}
+	}
+}
+
+func TestServeAdminAddr(t *testing.T) {
+	err := tuna.ServeAdmin("0.0.0.0:0")
+	if err == nil {
+		t.Fatal("admin API should not listen on all interfaces")
+	}
+
+	// a file that is not a socket is never removed
+	path := filepath.Join(t.TempDir(), "tuna.sock")
+	err = os.WriteFile(path, []byte("data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tuna.ServeAdmin("unix:" + path)
+	if err == nil {
+		t.Fatal("admin API should not replace a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file was removed: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/util"
+)
+
+const yamlExitConfig = `
+# comments are allowed
+beneficiaryAddr: ""
+listenTCP: 30010
+subscriptionFee: 0.00001
+seedRPCServerAddr:
+  - http://127.0.0.1:30003
+services:
+  httpproxy:
+    address: 127.0.0.1
+    price: 0.0002
+`
+
+const tomlExitConfig = `
+# comments are allowed
+beneficiaryAddr = ""
+listenTCP = 30010
+subscriptionFee = 0.00001
+seedRPCServerAddr = ["http://127.0.0.1:30003"]
+
+[services.httpproxy]
+address = "127.0.0.1"
+price = 0.0002
+`
+
+func TestReadConfig(t *testing.T) {
+	jsonConfig := &tuna.ExitConfiguration{}
+	err := util.ReadConfig("../config.exit.json.example", jsonConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var configs []*tuna.ExitConfiguration
+	for name, content := range map[string]string{"config.yaml": yamlExitConfig, "config.toml": tomlExitConfig} {
+		path := filepath.Join(t.TempDir(), name)
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &tuna.ExitConfiguration{}
+		err = util.ReadConfig(path, config)
+		if err != nil {
+			t.Fatalf("read %s error: %v", name, err)
+		}
+		if config.ListenTCP != 30010 || config.Services["httpproxy"].Price != "0.0002" || config.SubscriptionFee != "0.00001" || len(config.SeedRPCServerAddr) != 1 {
+			t.Errorf("%s is not read correctly: %+v", name, config)
+		}
+		configs = append(configs, config)
+	}
+	if !reflect.DeepEqual(configs[0], configs[1]) {
+		t.Errorf("YAML and TOML configs should be equal, got %+v and %+v", configs[0], configs[1])
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	if name := util.EnvName("TUNA", "seedRPCServerAddr"); name != "TUNA_SEED_RPC_SERVER_ADDR" {
+		t.Errorf("EnvName returned %s, expected TUNA_SEED_RPC_SERVER_ADDR", name)
+	}
+
+	t.Setenv("TUNA_BENEFICIARY_ADDR", "NKNaddr")
+	t.Setenv("TUNA_SEED_RPC_SERVER_ADDR", "http://a:30003, http://b:30003")
+	t.Setenv("TUNA_LISTEN_TCP", "30020")
+	t.Setenv("TUNA_REVERSE", "true")
+	t.Setenv("TUNA_SERVICES_HTTPPROXY_PRICE", "0.001")
+	t.Setenv("TUNA_LABELS", `{"tier": "gold"}`)
+	t.Setenv("TUNA_DISCOVERY_TYPE", "http")
+
+	config := &tuna.ExitConfiguration{
+		ListenTCP: 30010,
+		Services:  map[string]tuna.ExitServiceInfo{"httpproxy": {Address: "127.0.0.1", Price: "0.0002"}},
+	}
+	err := util.ApplyEnv("TUNA", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BeneficiaryAddr != "NKNaddr" || config.ListenTCP != 30020 || !config.Reverse {
+		t.Errorf("scalar fields are not set from env: %+v", config)
+	}
+	if !reflect.DeepEqual(config.SeedRPCServerAddr, []string{"http://a:30003", "http://b:30003"}) {
+		t.Errorf("seedRPCServerAddr is %v", config.SeedRPCServerAddr)
+	}
+	if s := config.Services["httpproxy"]; s.Price != "0.001" || s.Address != "127.0.0.1" {
+		t.Errorf("service is %+v", s)
+	}
+	if config.Labels["tier"] != "gold" {
+		t.Errorf("labels are %v", config.Labels)
+	}
+	if config.Discovery == nil || config.Discovery.Type != "http" {
+		t.Errorf("discovery is %+v", config.Discovery)
+	}
+
+	t.Setenv("TUNA_LISTEN_TCP", "abc")
+	err = util.ApplyEnv("TUNA", config)
+	if err == nil {
+		t.Error("ApplyEnv should fail with invalid number")
+	}
+}
@@ -0,0 +1,319 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/pb"
+	"github.com/nknorg/tuna/util"
+)
+
+const testTopic = "tuna_v1.test"
+
+// testPublish publishes to d and checks it can be listed and read back, and
+// is removed after close.
+func testPublish(t *testing.T, d tuna.Discovery) {
+	ctx := context.Background()
+	metadataRaw, err := tuna.CreateRawMetadata(1, nil, nil, "127.0.0.1", 30010, 30011, "0.001", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := string(metadataRaw)
+	closeChan := make(chan struct{})
+	d.Publish(testTopic, "exit", func() string { return metadata }, nil, closeChan)
+
+	var providers map[string]string
+	for i := 0; i < 50; i++ {
+		providers, err = d.ListContext(ctx, testTopic, 0)
+		if err == nil && len(providers) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if providers["exit"] != metadata {
+		t.Fatalf("unexpected providers %v", providers)
+	}
+
+	meta, err := d.GetContext(ctx, testTopic, "exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := tuna.ReadMetadata(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Ip != "127.0.0.1" || m.TcpPort != 30010 || m.ServiceId != 1 {
+		t.Fatalf("unexpected metadata %v", m)
+	}
+
+	close(closeChan)
+	for i := 0; i < 50; i++ {
+		providers, err = d.ListContext(ctx, testTopic, 0)
+		if err == nil && len(providers) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(providers) != 0 {
+		t.Fatalf("expected no provider after close, got %v", providers)
+	}
+	if _, err = d.GetContext(ctx, testTopic, "exit"); err == nil {
+		t.Fatal("expected error getting closed provider")
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	testPublish(t, &tuna.FileDiscovery{Path: path})
+
+	err := os.WriteFile(path, []byte(`{"tuna_v1.test": {"static": {"ip": "10.0.0.1", "tcp_port": 30020, "price": "0"}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := tuna.NewDiscovery(&tuna.DiscoveryConfig{Type: tuna.DiscoveryFile, Path: path}, nil, nil, 0, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers, err := d.ListContext(context.Background(), testTopic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := tuna.ReadMetadata(providers["static"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Ip != "10.0.0.1" || m.TcpPort != 30020 {
+		t.Fatalf("unexpected metadata %v", m)
+	}
+
+	// a limited list is the first providers by address
+	err = os.WriteFile(path, []byte(`{"tuna_v1.test": {"c": "x", "a": "x", "d": "x", "b": "x"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		providers, err = d.ListContext(context.Background(), testTopic, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := providers["a"]; len(providers) != 2 || !ok || len(providers["b"]) == 0 {
+			t.Fatalf("unexpected providers %v", providers)
+		}
+	}
+}
+
+func TestHTTPDiscovery(t *testing.T) {
+	server := httptest.NewServer(tuna.NewHTTPRegistry("secret"))
+	defer server.Close()
+
+	d, err := tuna.NewDiscovery(&tuna.DiscoveryConfig{Type: tuna.DiscoveryHTTP, URL: server.URL, TTL: 60, Token: "secret"}, nil, nil, 0, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPublish(t, d)
+
+	// publishing needs the registry token
+	for _, token := range []string{"", "wrong"} {
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/topics/test/addr", strings.NewReader(`{"metadata": "abc"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("PUT with token %q returned %s, expected 401", token, resp.Status)
+		}
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	metadata := &pb.ServiceMetadata{
+		Ip:              "127.0.0.1",
+		TcpPort:         30010,
+		ProtocolVersion: tuna.ProtocolVersion,
+		Region:          "eu-west",
+		MaxSessions:     10,
+		Load:            50,
+		Draining:        true,
+		Labels:          map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"},
+	}
+	s, err := tuna.EncodeMetadata(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		s2, err := tuna.EncodeMetadata(metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s2 != s {
+			t.Fatal("metadata encoding is not deterministic")
+		}
+	}
+
+	m, err := tuna.ReadMetadata(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Region != "eu-west" || m.Load != 50 || !m.Draining || m.Labels["c"] != "3" {
+		t.Fatalf("unexpected metadata %v", m)
+	}
+}
+
+func TestPublishUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	d := &tuna.FileDiscovery{Path: path}
+
+	var lock sync.Mutex
+	metadata := "a"
+	getMetadata := func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		return metadata
+	}
+	updateChan := make(chan struct{}, 1)
+	closeChan := make(chan struct{})
+	d.Publish(testTopic, "exit", getMetadata, updateChan, closeChan)
+
+	waitMetadata := func(expected string) {
+		for i := 0; i < 100; i++ {
+			meta, err := d.GetContext(context.Background(), testTopic, "exit")
+			if err == nil && meta == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("metadata %q is not published", expected)
+	}
+	waitMetadata("a")
+
+	// published at once instead of at the next refresh
+	lock.Lock()
+	metadata = "b"
+	lock.Unlock()
+	updateChan <- struct{}{}
+	waitMetadata("b")
+
+	// wait for removal before the temp dir is removed
+	close(closeChan)
+	for i := 0; i < 100; i++ {
+		if _, err := d.GetContext(context.Background(), testTopic, "exit"); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdvertisementRejection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := tuna.Service{Name: "test", TCP: []uint32{30080}, Encryption: "aes-gcm"}
+	serviceInfo := tuna.ServiceInfo{
+		MaxPrice: "0.01",
+		Regions:  []string{"eu-west"},
+		Labels:   map[string]string{"tier": "gold"},
+		Selector: &tuna.SelectorConfig{Strategy: tuna.SelectorCheapest, MinBandwidth: 1024},
+	}
+	// the client is not used with file discovery
+	te, err := tuna.NewTunaEntry(service, serviceInfo, wallet, &nkn.MultiClient{}, &tuna.EntryConfiguration{
+		SubscriptionPrefix:  "tuna_v1.",
+		Discovery:           &tuna.DiscoveryConfig{Type: tuna.DiscoveryFile, Path: path},
+		GeoOffline:          true,
+		QualityMinBandwidth: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newMetadata := func(update func(*pb.ServiceMetadata)) *pb.ServiceMetadata {
+		metadata := &pb.ServiceMetadata{
+			Ip:              "10.0.0.1",
+			TcpPort:         30010,
+			Price:           "0.001",
+			ProtocolVersion: tuna.ProtocolVersion,
+			EncryptionAlgos: []pb.EncryptionAlgo{pb.EncryptionAlgo_ENCRYPTION_NONE, pb.EncryptionAlgo_ENCRYPTION_AES_GCM},
+			Region:          "EU-West",
+			Labels:          map[string]string{"tier": "gold", "other": "1"},
+		}
+		update(metadata)
+		return metadata
+	}
+
+	tests := []struct {
+		name     string
+		update   func(*pb.ServiceMetadata)
+		rejected string
+	}{
+		{"accepted", func(m *pb.ServiceMetadata) {}, ""},
+		{"draining", func(m *pb.ServiceMetadata) { m.Draining = true }, "draining"},
+		{"full", func(m *pb.ServiceMetadata) { m.MaxSessions, m.Load = 10, 100 }, "full"},
+		{"not full", func(m *pb.ServiceMetadata) { m.MaxSessions, m.Load = 10, 90 }, ""},
+		{"no version", func(m *pb.ServiceMetadata) { m.ProtocolVersion = 0 }, ""},
+		{"newer version", func(m *pb.ServiceMetadata) { m.ProtocolVersion = tuna.ProtocolVersion + 1 }, ""},
+		{"no ciphers", func(m *pb.ServiceMetadata) { m.EncryptionAlgos = nil }, ""},
+		{"bandwidth", func(m *pb.ServiceMetadata) { m.MaxBandwidth = 768 }, "max bandwidth 768 KB/s below 1024 KB/s"},
+		{"enough bandwidth", func(m *pb.ServiceMetadata) { m.MaxBandwidth = 1024 }, ""},
+		{"cipher", func(m *pb.ServiceMetadata) {
+			m.EncryptionAlgos = []pb.EncryptionAlgo{pb.EncryptionAlgo_ENCRYPTION_XSALSA20_POLY1305}
+		}, "encryption ENCRYPTION_AES_GCM not supported"},
+		{"region", func(m *pb.ServiceMetadata) { m.Region = "us-east" }, `region "us-east" not in [eu-west]`},
+		{"no region", func(m *pb.ServiceMetadata) { m.Region = "" }, `region "" not in [eu-west]`},
+		{"label", func(m *pb.ServiceMetadata) { m.Labels["tier"] = "silver" }, `label tier is not "gold"`},
+		{"no labels", func(m *pb.ServiceMetadata) { m.Labels = nil }, `label tier is not "gold"`},
+		{"price", func(m *pb.ServiceMetadata) { m.Price = "0.1" }, "price higher than max price 0.01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := tuna.EncodeMetadata(newMetadata(tt.update))
+			if err != nil {
+				t.Fatal(err)
+			}
+			providers := map[string]map[string]string{"tuna_v1.test": {"exit": meta}}
+			err = util.WriteJSON(path, providers)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reports, err := te.MeasureNodesContext(context.Background(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reports) != 1 {
+				t.Fatalf("expected 1 report, got %d", len(reports))
+			}
+			if reports[0].Rejected != tt.rejected || reports[0].Selected != (len(tt.rejected) == 0) {
+				t.Fatalf("expected rejection %q, got %+v", tt.rejected, reports[0])
+			}
+		})
+	}
+
+	// reports look up countries without adding geo lookups to the entry
+	if te.ServiceInfo.IPFilter != nil {
+		t.Fatalf("MeasureNodesContext changed the IP filter to %+v", te.ServiceInfo.IPFilter)
+	}
+}
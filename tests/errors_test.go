@@ -0,0 +1,25 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nknorg/tuna"
+)
+
+func TestTypedErrors(t *testing.T) {
+	_, _, err := tuna.ParsePrice("0.001,abc")
+	if !errors.Is(err, tuna.ErrInvalidPrice) {
+		t.Errorf("ParsePrice returned %v, expected %v", err, tuna.ErrInvalidPrice)
+	}
+
+	_, err = tuna.NewTunaEntry(tuna.Service{}, tuna.ServiceInfo{}, nil, nil, &tuna.EntryConfiguration{NanoPayFee: "abc"})
+	if !errors.Is(err, tuna.ErrInvalidFee) {
+		t.Errorf("NewTunaEntry returned %v, expected %v", err, tuna.ErrInvalidFee)
+	}
+
+	_, err = tuna.CreateRawMetadata(0, nil, nil, "127.0.0.1", 30010, 30011, "0.001", "")
+	if err != nil {
+		t.Errorf("CreateRawMetadata returned %v", err)
+	}
+}
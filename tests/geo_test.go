@@ -1,7 +1,16 @@
 package tests
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nknorg/tuna/geo"
 )
@@ -200,6 +209,62 @@ var testData = []testCase{
 		location: geo.Location{CountryCode: "US"},
 		result:   true,
 	},
+	{
+		f: geo.IPFilter{
+			Allow: []geo.Location{{Country: "germany"}},
+		},
+		location: geo.Location{CountryCode: "DE"},
+		result:   true,
+	},
+	{
+		f: geo.IPFilter{
+			Allow: []geo.Location{{Country: "Germany"}},
+		},
+		location: geo.Location{CountryCode: "FR", Country: "France"},
+		result:   false,
+	},
+	{
+		f: geo.IPFilter{
+			Disallow: []geo.Location{{City: "Frankfurt"}},
+		},
+		location: geo.Location{CountryCode: "DE", City: "Frankfurt"},
+		result:   false,
+	},
+	{
+		f: geo.IPFilter{
+			Allow: []geo.Location{{Continent: "EU"}},
+		},
+		location: geo.Location{CountryCode: "FR"},
+		result:   true,
+	},
+	{
+		f: geo.IPFilter{
+			Allow: []geo.Location{{Continent: "Europe"}},
+		},
+		location: geo.Location{CountryCode: "US", Continent: "NA"},
+		result:   false,
+	},
+	{
+		f: geo.IPFilter{
+			Disallow: []geo.Location{{ASN: 16509}},
+		},
+		location: geo.Location{IP: IP1, ASN: 16509},
+		result:   false,
+	},
+	{
+		f: geo.IPFilter{
+			Allow: []geo.Location{{ASN: 16509}},
+		},
+		location: geo.Location{IP: IP1, ASN: 15169},
+		result:   false,
+	},
+	{
+		f: geo.IPFilter{
+			Allow: []geo.Location{{IP: "1.0.0.0/8", CountryCode: "US"}},
+		},
+		location: geo.Location{IP: IP1, CountryCode: "CA"},
+		result:   true,
+	},
 	{
 		f: geo.IPFilter{
 			Allow:    []geo.Location{},
@@ -271,3 +336,138 @@ func TestGetLocations(t *testing.T) {
 	}
 	close(c)
 }
+
+func TestOfflineCSVProvider(t *testing.T) {
+	dir := t.TempDir()
+	csv := "# network,countryCode,country,city,continent,asn\n" +
+		"10.1.0.0/16,DE,Germany,Frankfurt,EU,AS64500\n" +
+		"10.2.0.0/16,US,,,,64501\n"
+	err := os.WriteFile(filepath.Join(dir, "ranges.csv"), []byte(csv), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := &geo.IPFilter{
+		Allow: []geo.Location{{Continent: "Europe"}},
+	}
+	err = filter.AddProviders(&geo.ProviderOptions{
+		Path:      dir,
+		Download:  true,
+		Offline:   true,
+		Providers: []geo.ProviderConfig{{Type: geo.ProviderCSV, File: "ranges.csv"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filter.GetProviders()) != 1 {
+		t.Fatal("expected only the csv provider")
+	}
+	filter.UpdateDataFile()
+
+	loc := filter.GetLocation("10.1.2.3")
+	if loc.CountryCode != "DE" || loc.City != "Frankfurt" || loc.ASN != 64500 {
+		t.Fatal(loc)
+	}
+	loc = filter.GetLocation("10.2.2.3")
+	if loc.CountryCode != "US" || loc.Country != "United States" || loc.Continent != geo.ContinentNorthAmerica {
+		t.Fatal(loc)
+	}
+
+	for ip, allowed := range map[string]bool{"10.1.2.3": true, "10.2.2.3": false, "10.3.2.3": false} {
+		res, err := filter.AllowIP(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != allowed {
+			t.Fatalf("AllowIP(%s) = %v, expected %v", ip, res, allowed)
+		}
+	}
+
+	err = filter.AddProviders(&geo.ProviderOptions{Offline: true, Providers: []geo.ProviderConfig{{Type: "unknown"}}})
+	if err == nil {
+		t.Fatal("expected error for unknown provider")
+	}
+}
+
+func TestGeoDownloadIntegrity(t *testing.T) {
+	good := []byte("10.1.0.0/16,DE\n")
+	bad := []byte("not,a,network\n")
+	data := good
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ranges.csv":
+			w.Write(data)
+		case "/ranges.csv.sha256":
+			sum := sha256.Sum256(data)
+			fmt.Fprintf(w, "%x  ranges.csv\n", sum)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "ranges.csv")
+	newFilter := func(integrity geo.Integrity) *geo.IPFilter {
+		filter := &geo.IPFilter{}
+		err := filter.AddProviders(&geo.ProviderOptions{
+			Path:      dir,
+			Download:  true,
+			CacheSize: -1,
+			Providers: []geo.ProviderConfig{{Type: geo.ProviderCSV, File: "ranges.csv", URL: server.URL + "/ranges.csv?v=1", Integrity: integrity}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter
+	}
+
+	wrongSum := sha256.Sum256([]byte("tampered"))
+	filter := newFilter(geo.Integrity{SHA256: hex.EncodeToString(wrongSum[:])})
+	filter.UpdateDataFile()
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatal("file with wrong digest should not be written")
+	}
+
+	filter = newFilter(geo.Integrity{PublicKey: strings.Repeat("00", 32)})
+	filter.UpdateDataFile()
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatal("public key without signature url should not pass")
+	}
+
+	// the checksum file is matched by the url path, not the query
+	filter = newFilter(geo.Integrity{ChecksumURL: server.URL + "/ranges.csv.sha256"})
+	filter.UpdateDataFile()
+	if loc := filter.GetLocation("10.1.2.3"); loc.CountryCode != "DE" {
+		t.Fatal(loc)
+	}
+
+	// an update keeps a copy of the current file, which stays in place
+	expired := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(fileName, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	filter.UpdateDataFile()
+	for _, name := range []string{fileName, fileName + geo.LastGoodSuffix} {
+		if b, err := os.ReadFile(name); err != nil || string(b) != string(good) {
+			t.Fatal(name, string(b), err)
+		}
+	}
+
+	// a verified update that fails to parse rolls back to the last good copy
+	data = bad
+	if err := os.Chtimes(fileName, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	filter.UpdateDataFile()
+	if loc := filter.GetLocation("10.1.2.3"); loc.CountryCode != "DE" {
+		t.Fatal(loc)
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(good) {
+		t.Fatal("data file was not rolled back")
+	}
+}
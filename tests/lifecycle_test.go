@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+)
+
+func TestStartReverseContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tuna.StartReverseContext(ctx, &tuna.EntryConfiguration{}, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("StartReverseContext returned %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartReverseContext didn't return after ctx was canceled")
+	}
+}
+
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+	GetSessionsWaitGroup() *sync.WaitGroup
+	IsClosed() bool
+}
+
+// testShutdown checks that Shutdown waits for an open stream, which is
+// simulated by the sessions wait group, and closes at the deadline.
+func testShutdown(t *testing.T, newTuna func() shutdowner) {
+	te := newTuna()
+	wg := te.GetSessionsWaitGroup()
+	wg.Add(1)
+	done := make(chan error, 1)
+	go func() {
+		done <- te.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with an open stream", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if te.IsClosed() {
+		t.Fatal("closed with an open stream")
+	}
+	wg.Done()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't return after the stream ended")
+	}
+	if !te.IsClosed() {
+		t.Fatal("not closed after Shutdown")
+	}
+
+	te = newTuna()
+	te.GetSessionsWaitGroup().Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := te.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Shutdown returned after %v, expected at the deadline", elapsed)
+	}
+	if !te.IsClosed() {
+		t.Fatal("not closed at the deadline")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet, err := nkn.NewWallet(account, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("entry", func(t *testing.T) {
+		testShutdown(t, func() shutdowner {
+			// the client is not used before start
+			te, err := tuna.NewTunaEntry(tuna.Service{Name: "test"}, tuna.ServiceInfo{}, wallet, &nkn.MultiClient{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return te
+		})
+	})
+
+	t.Run("exit", func(t *testing.T) {
+		var te *tuna.TunaExit
+		testShutdown(t, func() shutdowner {
+			services := []tuna.Service{{Name: "test", TCP: []uint32{30080}}}
+			te, err = tuna.NewTunaExit(services, wallet, &nkn.MultiClient{}, &tuna.ExitConfiguration{
+				Services: map[string]tuna.ExitServiceInfo{"test": {Address: "127.0.0.1", Price: "0"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return te
+		})
+		if !te.IsDraining() {
+			t.Fatal("exit is not draining after Shutdown")
+		}
+	})
+}
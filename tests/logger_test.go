@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/filter"
+	"github.com/nknorg/tuna/geo"
+)
+
+func TestNewLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := tuna.NewLogger(buf, "warn", tuna.LogFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "service", "httpproxy")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %q", buf.String())
+	}
+	record := make(map[string]interface{})
+	err = json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "shown" || record["level"] != "WARN" || record["service"] != "httpproxy" {
+		t.Fatalf("unexpected record %v", record)
+	}
+
+	if _, err = tuna.NewLogger(buf, "verbose", tuna.LogFormatText); err == nil {
+		t.Fatal("invalid level should be rejected")
+	}
+	if _, err = tuna.NewLogger(buf, "info", "xml"); err == nil {
+		t.Fatal("invalid format should be rejected")
+	}
+}
+
+func TestFilterLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := tuna.NewLogger(buf, "info", tuna.LogFormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipFilter := &geo.IPFilter{Disallow: []geo.Location{{IP: "10.0.0.0/8"}}, Logger: logger}
+	if allowed, _ := ipFilter.AllowIP("10.1.2.3"); allowed {
+		t.Fatal("ip should be dropped")
+	}
+	nknFilter := &filter.NknFilter{Disallow: []filter.NknClient{{Address: "abc"}}, Logger: logger}
+	if nknFilter.IsAllow(&filter.NknClient{Address: "abc"}) {
+		t.Fatal("client should be dropped")
+	}
+	// per connection filter results are only logged at debug level
+	if buf.Len() > 0 {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+
+	ipFilter.Logger, _ = tuna.NewLogger(buf, "debug", tuna.LogFormatText)
+	ipFilter.AllowIP("10.1.2.3")
+	if !strings.Contains(buf.String(), "IP dropped") || !strings.Contains(buf.String(), "ip=10.1.2.3") {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+}
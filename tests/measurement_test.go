@@ -1,11 +1,15 @@
 package tests
 
 import (
+	"context"
+	"io"
 	"log"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/nknorg/tuna/types"
 	"github.com/nknorg/tuna/util"
 )
 
@@ -30,3 +34,96 @@ func TestDelayMeasurement(t *testing.T) {
 	wg.Wait()
 	return
 }
+
+func TestPingMeasurement(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func(server net.Conn) {
+		defer server.Close()
+		util.PingServer(server, 10*time.Second)
+	}(server)
+
+	rtts, sent, err := util.PingClientContext(context.Background(), client, 5, time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := types.NewPingStats(sent, rtts)
+	if stats.Sent != 5 || stats.Received != 5 || stats.Loss() != 0 {
+		t.Fatalf("unexpected ping stats %+v", stats)
+	}
+
+	// a missing reply is lost, and later pings are still sent
+	client, server = net.Pipe()
+	defer client.Close()
+	go func(server net.Conn) {
+		defer server.Close()
+		b := make([]byte, util.PingFrameSize)
+		for {
+			if _, err := io.ReadFull(server, b); err != nil {
+				return
+			}
+			if seq, _ := util.PingFrameSeq(b); seq == 1 {
+				continue
+			}
+			if _, err := server.Write(b); err != nil {
+				return
+			}
+		}
+	}(server)
+	start := time.Now()
+	rtts, sent, err = util.PingClientContext(context.Background(), client, 5, time.Millisecond, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = types.NewPingStats(sent, rtts)
+	if stats.Sent != 5 || stats.Received != 4 {
+		t.Fatalf("unexpected ping stats %+v", stats)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("ping took %v", elapsed)
+	}
+
+	// pinging stops when ctx is done
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, sent, err = util.PingClientContext(ctx, client, 100, 10*time.Millisecond, time.Second)
+	if err != context.DeadlineExceeded || sent >= 100 || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected ping to stop at ctx deadline, got %v after %d pings", err, sent)
+	}
+
+	stats = types.NewPingStats(4, []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond})
+	if stats.Loss() != 0.25 || stats.Min != 10 || stats.Max != 30 || stats.Median != 20 || stats.Mean != 20 || stats.Jitter != 15 {
+		t.Fatalf("unexpected ping stats %+v", stats)
+	}
+}
+
+func TestUplinkMeasurement(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		util.BandwidthUplinkServerContext(context.Background(), server, 64<<10, 10*time.Second)
+	}()
+
+	min, max, err := util.BandwidthUplinkClientContext(context.Background(), client, 64<<10, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if min <= 0 || max < min {
+		t.Fatalf("unexpected uplink bandwidth %f - %f", min, max)
+	}
+
+	// a server without uplink support closes the conn after downlink
+	client, server = net.Pipe()
+	defer client.Close()
+	server.Close()
+	_, _, err = util.BandwidthUplinkClientContext(context.Background(), client, 64<<10, 0)
+	if err != util.ErrUplinkNotSupported {
+		t.Fatalf("expected %v, got %v", util.ErrUplinkNotSupported, err)
+	}
+}
@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna"
+)
+
+func TestMetrics(t *testing.T) {
+	m := tuna.NewMetrics()
+	m.Add("tuna_bytes_total", 100, "role", "exit", "service", "httpproxy", "direction", "entry_to_exit")
+	m.Add("tuna_bytes_total", 50, "role", "exit", "service", "httpproxy", "direction", "entry_to_exit")
+	m.Add("tuna_handshake_failures_total", 1, "role", "entry")
+	m.ObserveDuration("tuna_measurement_duration_seconds", 1500*time.Millisecond, "kind", "delay")
+	m.ObserveDuration("tuna_measurement_duration_seconds", 500*time.Millisecond, "kind", "delay")
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	for _, line := range []string{
+		"# TYPE tuna_bytes_total counter",
+		`tuna_bytes_total{role="exit",service="httpproxy",direction="entry_to_exit"} 150`,
+		`tuna_handshake_failures_total{role="entry"} 1`,
+		"# TYPE tuna_measurement_duration_seconds summary",
+		`tuna_measurement_duration_seconds_sum{kind="delay"} 2`,
+		`tuna_measurement_duration_seconds_count{kind="delay"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics should contain %q, got:\n%s", line, body)
+		}
+	}
+	if strings.Count(body, "# TYPE tuna_measurement_duration_seconds") != 1 {
+		t.Errorf("summary type should be written once, got:\n%s", body)
+	}
+}
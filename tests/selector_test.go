@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/storage"
+	"github.com/nknorg/tuna/types"
+)
+
+func newTestCandidate(address string, delay, bandwidth float32, price common.Fixed64) *tuna.Candidate {
+	return &tuna.Candidate{
+		Node:             &types.Node{Address: address, Delay: delay, Bandwidth: bandwidth},
+		EntryToExitPrice: price,
+		ExitToEntryPrice: price,
+	}
+}
+
+func selectedAddresses(candidates []*tuna.Candidate) []string {
+	addrs := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		addrs = append(addrs, c.Node.Address)
+	}
+	return addrs
+}
+
+func checkSelected(t *testing.T, strategy string, candidates []*tuna.Candidate, expected ...string) {
+	t.Helper()
+	if len(candidates) != len(expected) {
+		t.Fatalf("%s selected %v, expected %v", strategy, selectedAddresses(candidates), expected)
+	}
+	for i := range expected {
+		if candidates[i].Node.Address != expected[i] {
+			t.Fatalf("%s selected %v, expected %v", strategy, selectedAddresses(candidates), expected)
+		}
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	// fast but expensive, slow and cheap, unknown bandwidth and cheapest
+	fast := newTestCandidate("fast", 10, 4096*1024, 300)
+	cheap := newTestCandidate("cheap", 80, 512*1024, 100)
+	unknown := newTestCandidate("unknown", 20, 0, 50)
+	candidates := []*tuna.Candidate{cheap, unknown, fast}
+
+	selector, err := tuna.NewSelector(&tuna.SelectorConfig{Strategy: tuna.SelectorFastest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelected(t, tuna.SelectorFastest, selector.Select(candidates), "fast", "cheap", "unknown")
+
+	selector, err = tuna.NewSelector(&tuna.SelectorConfig{Strategy: tuna.SelectorCheapest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelected(t, tuna.SelectorCheapest, selector.Select(candidates), "unknown", "cheap", "fast")
+
+	selector, err = tuna.NewSelector(&tuna.SelectorConfig{Strategy: tuna.SelectorCheapest, MinBandwidth: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelected(t, tuna.SelectorCheapest, selector.Select(candidates), "fast", "unknown")
+
+	// bandwidth from history counts for the minimum bandwidth
+	unknown.Favorite = &storage.FavoriteNode{MinBandwidth: 2048}
+	checkSelected(t, tuna.SelectorCheapest, selector.Select(candidates), "unknown", "fast")
+	unknown.Favorite = nil
+
+	selector, err = tuna.NewSelector(&tuna.SelectorConfig{Strategy: tuna.SelectorWeighted, PriceWeight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelected(t, tuna.SelectorWeighted, selector.Select(candidates), "unknown", "cheap", "fast")
+
+	selector, err = tuna.NewSelector(&tuna.SelectorConfig{Strategy: tuna.SelectorWeighted, DelayWeight: 1, BandwidthWeight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSelected(t, tuna.SelectorWeighted, selector.Select(candidates), "fast", "unknown", "cheap")
+
+	_, err = tuna.NewSelector(&tuna.SelectorConfig{Strategy: "random"})
+	if err == nil {
+		t.Fatal("expected error for unknown strategy")
+	}
+}
@@ -2,7 +2,9 @@ package tests
 
 import (
 	"log"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/nknorg/tuna/storage"
 )
@@ -14,3 +16,104 @@ func TestMeasureStorage(t *testing.T) {
 		log.Println(err)
 	}
 }
+
+func TestReputation(t *testing.T) {
+	dir := t.TempDir()
+	measureStorage := storage.NewMeasureStorage(dir, "test")
+	err := measureStorage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	measureStorage.AddReputationEvent("1.1.1.1", "good", &storage.ReputationEvent{Success: true, Throughput: 100})
+	measureStorage.AddReputationEvent("1.1.1.1", "good", &storage.ReputationEvent{Success: true, Throughput: 300, Uptime: time.Hour})
+	measureStorage.AddReputationEvent("2.2.2.2", "bad", &storage.ReputationEvent{Reason: "connect error"})
+	err = measureStorage.SaveReputations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	measureStorage = storage.NewMeasureStorage(dir, "test")
+	err = measureStorage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := measureStorage.GetReputation("1.1.1.1")
+	if good == nil || math.Abs(good.Throughput-200) > 0.01 || good.Uptime != 3600 || good.SuccessRate != 1 {
+		t.Fatalf("unexpected reputation %+v", good)
+	}
+	bad := measureStorage.GetReputation("2.2.2.2")
+	if bad == nil || bad.Failures != 1 || bad.LastFailure != "connect error" {
+		t.Fatalf("unexpected reputation %+v", bad)
+	}
+	if good.Score() <= 0.5 || bad.Score() >= 0.5 {
+		t.Fatalf("unexpected scores %f, %f", good.Score(), bad.Score())
+	}
+	if measureStorage.GetReputation("3.3.3.3") != nil {
+		t.Fatal("expected no reputation for unknown node")
+	}
+
+	// unsaved events survive a reload and are saved by a flush
+	measureStorage.AddReputationEvent("3.3.3.3", "new", &storage.ReputationEvent{Success: true})
+	err = measureStorage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measureStorage.GetReputation("3.3.3.3") == nil {
+		t.Fatal("unsaved reputation was lost by reload")
+	}
+	measureStorage.AddReputationEvent("4.4.4.4", "new", &storage.ReputationEvent{Success: true})
+	err = measureStorage.FlushReputations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	measureStorage = storage.NewMeasureStorage(dir, "test")
+	err = measureStorage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measureStorage.GetReputation("4.4.4.4") == nil {
+		t.Fatal("flushed reputation was not saved")
+	}
+}
+
+func TestMeasureStorageMerge(t *testing.T) {
+	dir := t.TempDir()
+	s1 := storage.NewMeasureStorage(dir, "test")
+	s2 := storage.NewMeasureStorage(dir, "test")
+	for _, s := range []*storage.MeasureStorage{s1, s2} {
+		err := s.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both instances save without seeing each other's nodes
+	s1.AddFavoriteNode("1.1.1.1", &storage.FavoriteNode{IP: "1.1.1.1", MinBandwidth: 100})
+	s1.AddAvoidNode("3.3.3.3", &storage.AvoidNode{IP: "3.3.3.3"})
+	s2.AddFavoriteNode("2.2.2.2", &storage.FavoriteNode{IP: "2.2.2.2", MinBandwidth: 200})
+	s2.AddAvoidNode("4.4.4.4", &storage.AvoidNode{IP: "4.4.4.4"})
+	for _, s := range []*storage.MeasureStorage{s1, s2} {
+		err := s.SaveFavoriteNodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SaveAvoidNodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := storage.NewMeasureStorage(dir, "test")
+	err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetFavoriteNode("1.1.1.1") == nil || s.GetFavoriteNode("2.2.2.2") == nil {
+		t.Fatalf("favorite nodes not merged: %v", s.FavoriteNodes.GetData())
+	}
+	if !s.IsAvoidNode("3.3.3.3") || !s.IsAvoidNode("4.4.4.4") {
+		t.Fatalf("avoid nodes not merged: %v", s.AvoidNodes)
+	}
+}
@@ -0,0 +1,295 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/tuna"
+)
+
+type fakeTxn struct {
+	unsubscribe bool
+	topic       string
+	meta        string
+	nonce       int64
+	fixNonce    bool
+	time        time.Time
+}
+
+// fakeSubscriptionClient records transactions. Subscribe fails while failures
+// is positive, and blocks while block is not nil. Unsubscribe blocks while
+// unsubscribeBlock is not nil.
+type fakeSubscriptionClient struct {
+	sync.Mutex
+	txns             []fakeTxn
+	failures         int
+	block            chan struct{}
+	unsubscribeBlock chan struct{}
+	nonce            int64
+}
+
+func (c *fakeSubscriptionClient) Subscribe(identifier, topic string, duration int, meta string, config *nkn.TransactionConfig) (string, error) {
+	c.Lock()
+	block := c.block
+	c.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return "", errors.New("subscribe failed")
+	}
+	c.txns = append(c.txns, fakeTxn{topic: topic, meta: meta, nonce: config.Nonce, fixNonce: config.FixNonce, time: time.Now()})
+	c.nonce++
+	return "hash", nil
+}
+
+func (c *fakeSubscriptionClient) UnsubscribeContext(ctx context.Context, identifier, topic string, config *nkn.TransactionConfig) (string, error) {
+	c.Lock()
+	block := c.unsubscribeBlock
+	c.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.txns = append(c.txns, fakeTxn{unsubscribe: true, topic: topic, nonce: config.Nonce, fixNonce: config.FixNonce, time: time.Now()})
+	c.nonce++
+	return "hash", nil
+}
+
+func (c *fakeSubscriptionClient) GetNonce(txPool bool) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.nonce, nil
+}
+
+func (c *fakeSubscriptionClient) GetHeight() (int32, error) {
+	return 100, nil
+}
+
+func (c *fakeSubscriptionClient) getTxns() []fakeTxn {
+	c.Lock()
+	defer c.Unlock()
+	return append([]fakeTxn(nil), c.txns...)
+}
+
+func newTestSubscriptionManager(client tuna.SubscriptionClient) *tuna.SubscriptionManager {
+	m := tuna.NewSubscriptionManager(client, nil)
+	m.MinRetryDelay = 20 * time.Millisecond
+	m.MaxRetryDelay = 40 * time.Millisecond
+	m.Interval = time.Millisecond
+	return m
+}
+
+// waitTxns waits until client has recorded n transactions.
+func waitTxns(t *testing.T, client *fakeSubscriptionClient, n int) []fakeTxn {
+	for i := 0; i < 200; i++ {
+		if txns := client.getTxns(); len(txns) >= n {
+			return txns
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d transactions, got %v", n, client.getTxns())
+	return nil
+}
+
+func TestSubscriptionBackoff(t *testing.T) {
+	client := &fakeSubscriptionClient{failures: 3}
+	m := newTestSubscriptionManager(client)
+	defer m.Close(time.Second)
+
+	start := time.Now()
+	m.Subscribe("", "topic", 100, "meta", &nkn.TransactionConfig{}, false)
+	txns := waitTxns(t, client, 1)
+
+	// retries after 20ms, 40ms and 40ms
+	if elapsed := txns[0].time.Sub(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected backoff of at least 100ms, got %v", elapsed)
+	}
+	status := m.Status()
+	if len(status) != 1 || status[0].Attempts != 0 || status[0].LastError != "" || status[0].ExpiresAt != 200 || status[0].Pending {
+		t.Fatalf("unexpected status %+v", status[0])
+	}
+}
+
+func TestSubscriptionSupersede(t *testing.T) {
+	client := &fakeSubscriptionClient{block: make(chan struct{})}
+	m := newTestSubscriptionManager(client)
+	defer m.Close(time.Second)
+
+	m.Subscribe("", "topic", 100, "v1", &nkn.TransactionConfig{}, false)
+	time.Sleep(20 * time.Millisecond)
+	// v1 is being sent, v2 is replaced by v3 while queued
+	m.Subscribe("", "topic", 100, "v2", &nkn.TransactionConfig{}, false)
+	m.Subscribe("", "topic", 100, "v3", &nkn.TransactionConfig{}, false)
+	if status := m.Status(); !status[0].Pending {
+		t.Fatal("expected pending update")
+	}
+
+	client.Lock()
+	close(client.block)
+	client.block = nil
+	client.Unlock()
+
+	waitTxns(t, client, 2)
+	time.Sleep(20 * time.Millisecond)
+	txns := client.getTxns()
+	if len(txns) != 2 || txns[0].meta != "v1" || txns[1].meta != "v3" {
+		t.Fatalf("expected v1 and v3 to be sent, got %v", txns)
+	}
+
+	// a failed update is not retried after a newer one is queued
+	client.Lock()
+	client.failures = 1
+	client.block = make(chan struct{})
+	client.Unlock()
+	m.Subscribe("", "topic", 100, "v4", &nkn.TransactionConfig{}, false)
+	time.Sleep(10 * time.Millisecond)
+	m.Subscribe("", "topic", 100, "v5", &nkn.TransactionConfig{}, false)
+	client.Lock()
+	close(client.block)
+	client.block = nil
+	client.Unlock()
+
+	waitTxns(t, client, 3)
+	time.Sleep(50 * time.Millisecond)
+	txns = client.getTxns()
+	if len(txns) != 3 || txns[2].meta != "v5" {
+		t.Fatalf("expected v5 to be sent instead of retrying v4, got %v", txns)
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	client := &fakeSubscriptionClient{nonce: 10}
+	m := newTestSubscriptionManager(client)
+
+	m.Subscribe("", "a", 100, "meta", &nkn.TransactionConfig{}, false)
+	m.Subscribe("", "b", 100, "meta", &nkn.TransactionConfig{}, false)
+	m.SetExpiresAt("", "c", 150)
+	waitTxns(t, client, 2)
+
+	m.Close(time.Second)
+	txns := client.getTxns()
+	if len(txns) != 5 {
+		t.Fatalf("expected 3 unsubscribe transactions, got %v", txns[2:])
+	}
+	topics := make(map[string]bool)
+	for i, txn := range txns[2:] {
+		if !txn.unsubscribe || !txn.fixNonce || txn.nonce != int64(12+i) {
+			t.Fatalf("unexpected unsubscribe transaction %+v", txn)
+		}
+		topics[txn.topic] = true
+	}
+	if !topics["a"] || !topics["b"] || !topics["c"] {
+		t.Fatalf("expected all topics to be unsubscribed, got %v", topics)
+	}
+
+	// nothing is sent after close
+	m.Subscribe("", "a", 100, "meta", &nkn.TransactionConfig{}, false)
+	time.Sleep(20 * time.Millisecond)
+	if len(client.getTxns()) != 5 {
+		t.Fatal("expected no transaction after close")
+	}
+}
+
+func TestSubscriptionUnsubscribe(t *testing.T) {
+	client := &fakeSubscriptionClient{block: make(chan struct{})}
+	m := newTestSubscriptionManager(client)
+	defer m.Close(time.Second)
+
+	m.Subscribe("", "topic", 100, "meta", &nkn.TransactionConfig{}, false)
+	time.Sleep(20 * time.Millisecond)
+
+	// Unsubscribe waits for the subscribe being sent
+	done := make(chan error)
+	go func() {
+		done <- m.Unsubscribe("", "topic", time.Second)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Unsubscribe returned while subscribe is being sent")
+	case <-time.After(20 * time.Millisecond):
+	}
+	client.Lock()
+	close(client.block)
+	client.block = nil
+	client.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	txns := client.getTxns()
+	if len(txns) != 2 || txns[0].unsubscribe || !txns[1].unsubscribe || !txns[1].fixNonce || txns[1].nonce != 1 {
+		t.Fatalf("expected subscribe followed by unsubscribe with next nonce, got %v", txns)
+	}
+	if len(m.Status()) != 0 {
+		t.Fatalf("expected no status after unsubscribe, got %v", m.Status())
+	}
+}
+
+func TestSubscriptionUnsubscribeQueued(t *testing.T) {
+	client := &fakeSubscriptionClient{failures: 1}
+	m := newTestSubscriptionManager(client)
+	defer m.Close(time.Second)
+
+	// an update backing off after a failure is not retried
+	m.Subscribe("", "retried", 100, "meta", &nkn.TransactionConfig{}, false)
+	time.Sleep(10 * time.Millisecond)
+	if status := m.Status(); len(status) != 1 || status[0].Attempts != 1 {
+		t.Fatalf("expected a failed attempt, got %v", status)
+	}
+	if err := m.Unsubscribe("", "retried", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if txns := client.getTxns(); len(txns) != 0 {
+		t.Fatalf("expected no transaction, got %v", txns)
+	}
+
+	m.Subscribe("", "a", 100, "meta", &nkn.TransactionConfig{}, false)
+	waitTxns(t, client, 1)
+
+	// an update taken from the queue while another transaction is being sent
+	// is not sent after its topic is unsubscribed
+	client.Lock()
+	client.unsubscribeBlock = make(chan struct{})
+	client.Unlock()
+	done := make(chan error, 2)
+	go func() {
+		done <- m.Unsubscribe("", "a", time.Second)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.Subscribe("", "b", 100, "meta", &nkn.TransactionConfig{}, false)
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		done <- m.Unsubscribe("", "b", time.Second)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client.Lock()
+	close(client.unsubscribeBlock)
+	client.unsubscribeBlock = nil
+	client.Unlock()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	txns := client.getTxns()
+	if len(txns) != 2 || txns[0].topic != "a" || txns[0].unsubscribe || txns[1].topic != "a" || !txns[1].unsubscribe {
+		t.Fatalf("expected only a to be subscribed and unsubscribed, got %v", txns)
+	}
+	if status := m.Status(); len(status) != 0 {
+		t.Fatalf("expected no status after unsubscribe, got %v", status)
+	}
+}
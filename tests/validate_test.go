@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/util"
+)
+
+func TestValidateExampleConfig(t *testing.T) {
+	var services []tuna.Service
+	err := util.ReadJSON("../services.json.example", &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entryConfig := &tuna.EntryConfiguration{}
+	err = util.ReadJSON("../config.entry.json.example", entryConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entryConfig.Validate(services)
+	if err != nil {
+		t.Errorf("entry config example should be valid, got %v", err)
+	}
+
+	exitConfig := &tuna.ExitConfiguration{}
+	err = util.ReadJSON("../config.exit.json.example", exitConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exitConfig.Validate(services)
+	if err != nil {
+		t.Errorf("exit config example should be valid, got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	services := []tuna.Service{
+		{Name: "a", TCP: []uint32{30080}},
+		{Name: "b", TCP: []uint32{30080}, Encryption: "abc"},
+	}
+	config := &tuna.EntryConfiguration{
+		Services: map[string]tuna.ServiceInfo{
+			"a":       {MaxPrice: "0.001,abc"},
+			"b":       {},
+			"missing": {},
+		},
+		MinNanoPayFee:     "abc",
+		MetricsListenAddr: "127.0.0.1:30080",
+		AdminListenAddr:   "0.0.0.0:30081",
+		// negative disables the cache
+		MeasurementCacheTTL:  -1,
+		QualityCheckInterval: -1,
+	}
+	err := config.Validate(services)
+	if !errors.Is(err, tuna.ErrInvalidConfig) {
+		t.Fatalf("Validate returned %v, expected %v", err, tuna.ErrInvalidConfig)
+	}
+	if !errors.Is(err, tuna.ErrInvalidPrice) || !errors.Is(err, tuna.ErrInvalidFee) {
+		t.Errorf("Validate returned %v, expected to match %v and %v", err, tuna.ErrInvalidPrice, tuna.ErrInvalidFee)
+	}
+
+	var problems tuna.ConfigErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("Validate returned %T, expected tuna.ConfigErrors", err)
+	}
+	paths := make(map[string]bool)
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+	for _, path := range []string{"services.a.maxPrice", "services.b.encryption", "services.b.tcp", "services.missing", "minNanoPayFee", "metricsListenAddr", "adminListenAddr", "qualityCheckInterval"} {
+		if !paths[path] {
+			t.Errorf("Validate should report %s, got %v", path, err)
+		}
+	}
+	if paths["measurementCacheTTL"] {
+		t.Errorf("Validate should accept negative measurementCacheTTL, got %v", err)
+	}
+}
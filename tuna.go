@@ -8,8 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net"
 	"os"
 	"reflect"
@@ -22,11 +21,9 @@ import (
 
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/nknorg/nkn/v2/common"
-	"github.com/nknorg/nkn/v2/config"
 	"github.com/nknorg/nkn/v2/crypto/ed25519"
 	"github.com/nknorg/nkn/v2/transaction"
 	"github.com/nknorg/nkn/v2/util"
-	"github.com/nknorg/nkn/v2/util/address"
 	"github.com/nknorg/nkn/v2/vault"
 	"github.com/nknorg/tuna/filter"
 	"github.com/nknorg/tuna/geo"
@@ -46,6 +43,12 @@ import (
 const (
 	TrafficUnit = 1024 * 1024
 
+	// Bandwidth directions used to rank measured nodes. Downlink is from the
+	// measured node to us, uplink is from us to the measured node.
+	BandwidthDownlink = "downlink"
+	BandwidthUplink   = "uplink"
+	BandwidthBoth     = "both"
+
 	tcp4                          = "tcp"
 	udp4                          = "udp"
 	trafficPaymentThreshold       = 32
@@ -65,18 +68,14 @@ const (
 	maxRPCRequests                = 8
 )
 
-var (
-	// This lock makes sure that only one measurement can run at the same time if
-	// measurement storage is set so that later measurement can take use of the
-	// previous measurement results.
-	measureStorageMutex sync.Mutex
-)
-
 type ServiceInfo struct {
 	MaxPrice  string            `json:"maxPrice"`
 	ListenIP  string            `json:"listenIP"`
 	IPFilter  *geo.IPFilter     `json:"ipFilter"`
 	NknFilter *filter.NknFilter `json:"nknFilter"`
+	Selector  *SelectorConfig   `json:"selector"`
+	Regions   []string          `json:"regions"` // only use exits advertising one of these regions
+	Labels    map[string]string `json:"labels"`  // only use exits advertising all these labels
 }
 
 type Service struct {
@@ -88,23 +87,37 @@ type Service struct {
 }
 
 type Common struct {
+	// It's important to keep these int64 field on top to avoid panic on arm32
+	// architecture: https://github.com/golang/go/issues/23345
+	nanoPaySent    int64
+	nanoPayClaimed int64
+
 	Service                        *Service
 	ServiceInfo                    *ServiceInfo
 	Wallet                         *nkn.Wallet
 	Client                         *nkn.MultiClient
+	Discovery                      Discovery
+	Subscriptions                  *SubscriptionManager
 	DialTimeout                    int32
 	SubscriptionPrefix             string
 	Reverse                        bool
 	ReverseMetadata                *pb.ServiceMetadata
 	OnConnect                      *OnConnect
+	Events                         *Events
 	IsServer                       bool
 	GeoDBPath                      string
 	DownloadGeoDB                  bool
+	GeoProviderOptions             *geo.ProviderOptions
 	GetSubscribersBatchSize        int
 	MeasureBandwidth               bool
 	MeasureBandwidthTimeout        time.Duration
 	MeasureBandwidthWorkersTimeout time.Duration
 	MeasurementBytesDownLink       int32
+	MeasurementBytesUpLink         int32
+	BandwidthDirection             string
+	MeasurePing                    bool
+	MeasurePingCount               int32
+	MeasurementCacheTTL            time.Duration
 	MeasureStoragePath             string
 	MaxPoolSize                    int32
 	TcpDialContext                 func(ctx context.Context, network, addr string) (net.Conn, error)
@@ -120,9 +133,11 @@ type Common struct {
 	closeChan                         chan struct{}
 	measureStorage                    *storage.MeasureStorage
 	sortMeasuredNodes                 func(types.Nodes)
+	selector                          Selector
 	measureDelayConcurrentWorkers     int
 	measureBandwidthConcurrentWorkers int
 	sessionsWaitGroup                 *sync.WaitGroup
+	allowUDPSource                    func(ip net.IP, serviceID int) bool
 
 	sync.RWMutex
 	udpReadWriteChanLock sync.RWMutex
@@ -134,6 +149,7 @@ type Common struct {
 	tcpConn              net.Conn
 	udpConn              *EncryptUDPConn
 	isClosed             bool
+	isShuttingDown       bool
 	sharedKeys           map[string]*[sharedKeySize]byte
 	encryptKeys          sync.Map
 	remoteNknAddress     string
@@ -141,11 +157,19 @@ type Common struct {
 	linger               time.Duration
 	presetNode           *types.Node
 	connReadyChan        sync.Map
+	connectedAt          time.Time
+	reputationFlushLock  sync.Mutex
+	reputationFlushTimer *time.Timer
+	metricsRole          string
+	logger               *slog.Logger
+	unregisterMetrics    func()
+	ownEvents            bool
 
 	reverseBytesExitToEntry map[string][]uint64
 	reverseBytesEntryToExit map[string][]uint64
 
-	minBalance common.Fixed64 // minimum wallet balance requirement for connecting
+	minBalance   common.Fixed64 // minimum wallet balance requirement for connecting
+	minBandwidth float32        // KB/s, exits advertising less max bandwidth are skipped
 }
 
 func NewCommon(
@@ -159,19 +183,30 @@ func NewCommon(
 	reverse, isServer bool,
 	geoDBPath string,
 	downloadGeoDB bool,
+	geoProviders []geo.ProviderConfig,
+	geoOffline bool,
+	geoCacheSize int32,
 	getSubscribersBatchSize int32,
 	measureBandwidth bool,
 	measureBandwidthTimeout int32,
 	measureBandwidthWorkersTimeout int32,
 	measurementBytes int32,
+	measurementBytesUpLink int32,
+	bandwidthDirection string,
+	measurePing bool,
+	measurePingCount int32,
+	measurementCacheTTL int32,
 	measureStoragePath string,
 	maxPoolSize int32,
 	tcpDialContext func(ctx context.Context, network, addr string) (net.Conn, error),
 	httpDialContext func(ctx context.Context, network, addr string) (net.Conn, error),
 	wsDialContext func(ctx context.Context, network, addr string) (net.Conn, error),
 	sortMeasuredNodes func(types.Nodes),
+	selector Selector,
 	reverseMetadata *pb.ServiceMetadata,
 	minBalance string,
+	logger *slog.Logger,
+	events *Events,
 ) (*Common, error) {
 	encryptionAlgo := defaultEncryptionAlgo
 	var err error
@@ -182,6 +217,14 @@ func NewCommon(
 		}
 	}
 
+	switch bandwidthDirection {
+	case "":
+		bandwidthDirection = BandwidthDownlink
+	case BandwidthDownlink, BandwidthUplink, BandwidthBoth:
+	default:
+		return nil, fmt.Errorf("unknown bandwidth direction %q", bandwidthDirection)
+	}
+
 	if client == nil {
 		clientConfig := &nkn.ClientConfig{
 			HttpDialContext: httpDialContext,
@@ -210,6 +253,14 @@ func NewCommon(
 		measureBandwidthConcurrentWorkers = int(maxPoolSize)
 	}
 
+	geoProviderOptions := &geo.ProviderOptions{
+		Path:      geoDBPath,
+		Download:  downloadGeoDB,
+		Offline:   geoOffline,
+		CacheSize: int(geoCacheSize),
+		Providers: geoProviders,
+	}
+
 	var wg sync.WaitGroup
 	c := &Common{
 		Service:                        service,
@@ -224,11 +275,17 @@ func NewCommon(
 		IsServer:                       isServer,
 		GeoDBPath:                      geoDBPath,
 		DownloadGeoDB:                  downloadGeoDB,
+		GeoProviderOptions:             geoProviderOptions,
 		GetSubscribersBatchSize:        int(getSubscribersBatchSize),
 		MeasureBandwidth:               measureBandwidth,
 		MeasureBandwidthTimeout:        time.Duration(measureBandwidthTimeout) * time.Second,
 		MeasureBandwidthWorkersTimeout: time.Duration(measureBandwidthWorkersTimeout) * time.Second,
 		MeasurementBytesDownLink:       measurementBytes,
+		MeasurementBytesUpLink:         measurementBytesUpLink,
+		BandwidthDirection:             bandwidthDirection,
+		MeasurePing:                    measurePing,
+		MeasurePingCount:               measurePingCount,
+		MeasurementCacheTTL:            time.Duration(measurementCacheTTL) * time.Second,
 		MeasureStoragePath:             measureStoragePath,
 		MaxPoolSize:                    maxPoolSize,
 		TcpDialContext:                 tcpDialContext,
@@ -243,6 +300,7 @@ func NewCommon(
 		measureDelayConcurrentWorkers:     measureDelayConcurrentWorkers,
 		measureBandwidthConcurrentWorkers: measureBandwidthConcurrentWorkers,
 		sortMeasuredNodes:                 sortMeasuredNodes,
+		selector:                          selector,
 		sessionsWaitGroup:                 &wg,
 
 		reverseBytesEntryToExit: make(map[string][]uint64),
@@ -251,17 +309,37 @@ func NewCommon(
 		udpReadChan:  make(chan []byte, 64),
 		udpWriteChan: make(chan []byte, 64),
 	}
+	c.logger = loggerOrDefault(logger)
+	if service != nil && len(service.Name) > 0 {
+		c.logger = c.logger.With("service", service.Name)
+	}
+	c.Subscriptions = NewSubscriptionManager(client, c.logger)
+	c.GeoProviderOptions.Logger = c.logger
+	if c.ServiceInfo != nil && c.ServiceInfo.NknFilter != nil {
+		c.ServiceInfo.NknFilter.Logger = c.logger
+	}
+	c.Events = events
+	if c.Events == nil {
+		c.Events = NewEvents()
+		c.ownEvents = true
+	}
+	c.Discovery = &NknDiscovery{Client: client, Subscriptions: c.Subscriptions, Logger: c.logger}
+
 	c.minBalance, err = common.StringToFixed64(minBalance)
 	if err != nil {
 		return nil, err
 	}
 
 	if !c.IsServer && c.ServiceInfo.IPFilter.NeedGeoInfo() {
-		c.ServiceInfo.IPFilter.AddProvider(c.DownloadGeoDB, c.GeoDBPath)
+		err = c.ServiceInfo.IPFilter.AddProviders(c.GeoProviderOptions)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if !c.IsServer && c.MeasureStoragePath != "" {
 		c.measureStorage = storage.NewMeasureStorage(c.MeasureStoragePath, c.SubscriptionPrefix+c.Service.Name)
+		c.measureStorage.Logger = c.logger
 	}
 
 	return c, nil
@@ -414,7 +492,7 @@ func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr,
 			}
 			n, from, encrypted, err = conn.ReadFromUDPEncrypted(buffer)
 			if err != nil {
-				log.Println("Couldn't receive data:", err)
+				c.logger.Warn("Couldn't receive udp data", "error", err)
 				if errors.Is(err, io.ErrClosedPipe) {
 					return
 				}
@@ -422,7 +500,13 @@ func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr,
 			if bytes.Equal(buffer[:PrefixLen], []byte{PrefixLen - 1: 0}) && c.IsServer && n > PrefixLen {
 				connMetadata, err := parseUDPConnMetadata(buffer[PrefixLen:n])
 				if err != nil {
-					log.Println("Couldn't read udp metadata from client:", err)
+					c.logger.Debug("Couldn't read udp metadata from client", "remoteAddr", from, "error", err)
+					continue
+				}
+				if c.allowUDPSource != nil && !c.allowUDPSource(from.IP, -1) {
+					continue
+				}
+				if udpPings.handle(conn, buffer[:n], connMetadata, encrypted, from, c.logger) {
 					continue
 				}
 				if connMetadata.IsPing || encrypted {
@@ -435,13 +519,13 @@ func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr,
 
 				encryptKey, ok := c.encryptKeys.Load(connKey)
 				if !ok {
-					log.Println("no encrypt key found")
+					c.logger.Debug("No encrypt key found", "remoteAddr", from, "session", sessionKey(connKey))
 					continue
 				}
 				k := encryptKey.(*[encryptKeySize]byte)
 				err = conn.AddCodec(from, k, connMetadata.EncryptionAlgo, false)
 				if err != nil {
-					log.Println(err)
+					c.logger.Warn("Add udp codec error", "remoteAddr", from, "session", sessionKey(connKey), "error", err)
 					continue
 				}
 
@@ -453,7 +537,11 @@ func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr,
 			}
 
 			if !encrypted {
-				log.Println("Unencrypted udp packet received")
+				c.logger.Debug("Unencrypted udp packet received", "remoteAddr", from)
+				continue
+			}
+
+			if n >= PrefixLen && c.allowUDPSource != nil && !c.allowUDPSource(from.IP, int(buffer[2])) {
 				continue
 			}
 
@@ -487,7 +575,7 @@ func (c *Common) startUDPReaderWriter(conn *EncryptUDPConn, toAddr *net.UDPAddr,
 				}
 				n, _, err := conn.WriteMsgUDP(data, nil, to)
 				if err != nil {
-					log.Println("Couldn't send data to server:", err)
+					c.logger.Warn("Couldn't send udp data", "remoteAddr", to, "error", err)
 					continue
 				}
 				if out != nil {
@@ -531,14 +619,21 @@ func (c *Common) getOrComputeSharedKey(remotePublicKey []byte) (*[sharedKeySize]
 }
 
 func (c *Common) wrapConn(conn net.Conn, remotePublicKey []byte, localConnMetadata *pb.ConnectionMetadata) (net.Conn, *pb.ConnectionMetadata, error) {
+	encryptedConn, remoteConnMetadata, err := c.handshake(conn, remotePublicKey, localConnMetadata)
+	if err != nil {
+		DefaultMetrics.Add("tuna_handshake_failures_total", 1, "role", c.metricsRole)
+	}
+	return encryptedConn, remoteConnMetadata, err
+}
+
+func (c *Common) handshake(conn net.Conn, remotePublicKey []byte, localConnMetadata *pb.ConnectionMetadata) (net.Conn, *pb.ConnectionMetadata, error) {
 	var connNonce []byte
 	var encryptionAlgo pb.EncryptionAlgo
 	var remoteConnMetadata *pb.ConnectionMetadata
 	if localConnMetadata == nil {
 		localConnMetadata = &pb.ConnectionMetadata{}
 	} else {
-		connMetadataCopy := *localConnMetadata
-		localConnMetadata = &connMetadataCopy
+		localConnMetadata = proto.Clone(localConnMetadata).(*pb.ConnectionMetadata)
 	}
 
 	err := conn.SetDeadline(time.Now().Add(10 * time.Second))
@@ -664,38 +759,26 @@ func (c *Common) wrapUDPConn(conn UDPConn, addr *net.UDPAddr, remotePublicKey []
 }
 
 func (c *Common) UpdateServerConn(remotePublicKey []byte) error {
+	return c.UpdateServerConnContext(context.Background(), remotePublicKey)
+}
+
+// UpdateServerConnContext connects to the remote node in metadata. Dialing
+// stops when ctx is done.
+func (c *Common) UpdateServerConnContext(ctx context.Context, remotePublicKey []byte) error {
 	hasUDP := len(c.Service.UDP) > 0 || (c.ReverseMetadata != nil && len(c.ReverseMetadata.ServiceUdp) > 0)
 	metadata := c.GetMetadata()
 
 	Close(c.GetTCPConn())
 
 	addr := metadata.Ip + ":" + strconv.Itoa(int(metadata.TcpPort))
-	var tcpConn net.Conn
-	var err error
-	if c.TcpDialContext != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.DialTimeout)*time.Second)
-		defer cancel()
-		tcpConn, err = c.TcpDialContext(ctx, tcp4, addr)
-	} else {
-		tcpConn, err = net.DialTimeout(
-			tcp4,
-			addr,
-			time.Duration(c.DialTimeout)*time.Second,
-		)
-	}
+	encryptedConn, remoteMetadata, err := c.dialServerTCP(ctx, addr, remotePublicKey)
 	if err != nil {
 		return err
 	}
 
-	encryptedConn, remoteMetadata, err := c.wrapConn(tcpConn, remotePublicKey, nil)
-	if err != nil {
-		Close(tcpConn)
-		return err
-	}
-
 	c.SetServerTCPConn(encryptedConn)
 
-	log.Println("Connected to TCP at", addr)
+	c.logger.Info("Connected to TCP", "remoteAddr", addr)
 
 	if hasUDP {
 		oldConn := c.GetUDPConn()
@@ -715,22 +798,60 @@ func (c *Common) UpdateServerConn(remotePublicKey []byte) error {
 			return err
 		}
 		c.SetServerUDPConn(uConn)
-		log.Println("Connected to UDP at", addr.String())
+		c.logger.Info("Connected to UDP", "remoteAddr", addr.String())
 	}
 
 	c.SetConnected(true)
 
-	c.OnConnect.receive()
+	// reverse exits notify after the reverse entry accepts the session
+	if !c.Reverse {
+		c.OnConnect.receive()
+		c.emitEvent(&Event{Type: EventConnected, RemoteNknAddress: c.GetRemoteNknAddress(), RemoteNetAddr: addr})
+	}
 
 	return nil
 }
 
+// dialServerTCP dials and encrypts a TCP connection to the exit at addr.
+func (c *Common) dialServerTCP(ctx context.Context, addr string, remotePublicKey []byte) (net.Conn, *pb.ConnectionMetadata, error) {
+	var tcpConn net.Conn
+	var err error
+	if c.TcpDialContext != nil {
+		dialCtx, cancel := context.WithTimeout(ctx, time.Duration(c.DialTimeout)*time.Second)
+		defer cancel()
+		tcpConn, err = c.TcpDialContext(dialCtx, tcp4, addr)
+	} else {
+		// like net.DialTimeout, zero DialTimeout means no timeout
+		tcpConn, err = (&net.Dialer{Timeout: time.Duration(c.DialTimeout) * time.Second}).DialContext(ctx, tcp4, addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedConn, remoteMetadata, err := c.wrapConn(tcpConn, remotePublicKey, nil)
+	if err != nil {
+		Close(tcpConn)
+		return nil, nil, err
+	}
+
+	return encryptedConn, remoteMetadata, nil
+}
+
 func (c *Common) CreateServerConn(force bool) error {
+	return c.CreateServerConnContext(context.Background(), force)
+}
+
+// CreateServerConnContext selects a remote node and connects to it, retrying
+// until it succeeds, c is closed or ctx is done.
+func (c *Common) CreateServerConnContext(ctx context.Context, force bool) error {
 	if !c.IsServer && (!c.GetConnected() || force) {
 		for {
 			if c.isClosed {
 				return ErrClosed
 			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 
 			err := c.SetPaymentReceiver("")
 			if err != nil {
@@ -743,91 +864,34 @@ func (c *Common) CreateServerConn(force bool) error {
 					return err
 				}
 				if entryToExitMaxPrice > 0 || exitToEntryMaxPrice > 0 {
-					balance, err := c.Client.BalanceByAddress(c.Wallet.Address())
+					balance, err := c.Client.BalanceByAddressContext(ctx, c.Wallet.Address())
 					if err != nil {
-						log.Println("tuna.CreateServerConn BalanceByAddress error:", err)
+						c.logger.Warn("Get balance error", "error", err)
 					} else {
 						if balance.ToFixed64() < c.minBalance {
+							c.emitEvent(&Event{Type: EventBalanceLow, Balance: balance.String(), MinBalance: c.minBalance.String()})
 							return nkn.ErrInsufficientBalance
 						}
 					}
 				}
 			}
 
-			candidateSubs, err := c.GetTopPerformanceNodes(c.MeasureBandwidth, measureBandwidthTopCount)
+			candidateSubs, err := c.GetTopPerformanceNodesContext(ctx, c.MeasureBandwidth, measureBandwidthTopCount)
 			if err != nil {
-				log.Println(err)
-				time.Sleep(time.Second)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				c.logger.Warn("Get top performance nodes error", "error", err)
+				sleepContext(ctx, time.Second)
 				continue
 			}
 
 			for _, subscriber := range candidateSubs {
-				metadata := subscriber.Metadata
-				if c.presetNode == nil {
-					subscription, err := c.Client.GetSubscription(c.SubscriptionPrefix+c.Service.Name, subscriber.Address)
-					if err == nil {
-						latestMeta, err := ReadMetadata(subscription.Meta)
-						if err == nil {
-							metadata = latestMeta
-						} else {
-							log.Println(err)
-						}
-					} else {
-						log.Println(err)
-					}
-				}
-
-				c.SetMetadata(metadata)
-
-				log.Printf("IP: %s, address: %s, delay: %.3f ms, bandwidth: %f KB/s", metadata.Ip, subscriber.Address, subscriber.Delay, subscriber.Bandwidth/1024)
-
-				entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
+				err = c.connectToNode(ctx, subscriber)
 				if err != nil {
-					log.Println(err)
+					c.logger.Warn("Connect to node error", "address", subscriber.Address, "error", err)
 					continue
 				}
-
-				if len(metadata.BeneficiaryAddr) > 0 {
-					err = c.SetPaymentReceiver(metadata.BeneficiaryAddr)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-				} else {
-					addr, err := nkn.ClientAddrToWalletAddr(subscriber.Address)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-
-					err = c.SetPaymentReceiver(addr)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-				}
-				c.Lock()
-				c.remoteNknAddress = subscriber.Address
-				c.entryToExitPrice = entryToExitPrice
-				c.exitToEntryPrice = exitToEntryPrice
-				if c.ReverseMetadata != nil {
-					c.metadata.ServiceTcp = c.ReverseMetadata.ServiceTcp
-					c.metadata.ServiceUdp = c.ReverseMetadata.ServiceUdp
-				}
-				c.Unlock()
-				remotePublicKey, err := nkn.ClientAddrToPubKey(subscriber.Address)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				err = c.UpdateServerConn(remotePublicKey)
-				if err != nil {
-					log.Println(err)
-					time.Sleep(time.Second)
-					continue
-				}
-
 				return nil
 			}
 		}
@@ -836,52 +900,108 @@ func (c *Common) CreateServerConn(force bool) error {
 	return nil
 }
 
-func (c *Common) GetTopPerformanceNodes(measureBandwidth bool, n int) (types.Nodes, error) {
+// connectToNode connects to subscriber and sets it as the current remote node.
+// latestMetadata returns the metadata subscriber currently advertises, or
+// the one it was selected with if that fails.
+func (c *Common) latestMetadata(ctx context.Context, subscriber *types.Node) *pb.ServiceMetadata {
 	if c.presetNode != nil {
-		return types.Nodes{c.presetNode}, nil
+		return subscriber.Metadata
 	}
-	return c.GetTopPerformanceNodesContext(context.Background(), measureBandwidth, n)
+	meta, err := c.Discovery.GetContext(ctx, c.SubscriptionPrefix+c.Service.Name, subscriber.Address)
+	if err != nil {
+		c.logger.Warn("Get latest metadata error", "address", subscriber.Address, "error", err)
+		return subscriber.Metadata
+	}
+	latestMeta, err := ReadMetadata(meta)
+	if err != nil {
+		c.logger.Warn("Read latest metadata error", "address", subscriber.Address, "error", err)
+		return subscriber.Metadata
+	}
+	return latestMeta
 }
 
-func (c *Common) GetTopPerformanceNodesContext(ctx context.Context, measureBandwidth bool, n int) (types.Nodes, error) {
-	if len(c.ServiceInfo.IPFilter.GetProviders()) > 0 {
-		c.ServiceInfo.IPFilter.UpdateDataFileContext(ctx)
+// paymentReceiverOf returns the wallet address that an exit with metadata
+// and NKN address should be paid to.
+func paymentReceiverOf(metadata *pb.ServiceMetadata, address string) (string, error) {
+	if len(metadata.BeneficiaryAddr) > 0 {
+		if err := nkn.VerifyWalletAddress(metadata.BeneficiaryAddr); err != nil {
+			return "", err
+		}
+		return metadata.BeneficiaryAddr, nil
 	}
+	return nkn.ClientAddrToWalletAddr(address)
+}
 
-	if c.measureStorage != nil {
-		measureStorageMutex.Lock()
-		defer measureStorageMutex.Unlock()
+func (c *Common) connectToNode(ctx context.Context, subscriber *types.Node) error {
+	metadata := c.latestMetadata(ctx, subscriber)
 
-		err := c.measureStorage.Load()
-		if err != nil {
-			return nil, err
+	c.SetMetadata(metadata)
+
+	c.logger.Info("Selected node", "ip", metadata.Ip, "address", subscriber.Address, "delayMs", subscriber.Delay, "bandwidthKBps", subscriber.Bandwidth/1024)
+
+	entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
+	if err != nil {
+		return err
+	}
+
+	paymentReceiver, err := paymentReceiverOf(metadata, subscriber.Address)
+	if err != nil {
+		return err
+	}
+	err = c.SetPaymentReceiver(paymentReceiver)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.remoteNknAddress = subscriber.Address
+	c.entryToExitPrice = entryToExitPrice
+	c.exitToEntryPrice = exitToEntryPrice
+	if c.ReverseMetadata != nil {
+		c.metadata.ServiceTcp = c.ReverseMetadata.ServiceTcp
+		c.metadata.ServiceUdp = c.ReverseMetadata.ServiceUdp
+	}
+	c.Unlock()
+	remotePublicKey, err := nkn.ClientAddrToPubKey(subscriber.Address)
+	if err != nil {
+		return err
+	}
+
+	err = c.UpdateServerConnContext(ctx, remotePublicKey)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		c.recordReputation(metadata.Ip, subscriber.Address, &storage.ReputationEvent{Reason: "connect error: " + err.Error()})
+		sleepContext(ctx, time.Second)
+		return err
 	}
 
-	var filterSubs types.Nodes
-	allSubscribers, subscriberRaw, err := c.nknFilterContext(ctx)
+	c.Lock()
+	c.connectedAt = time.Now()
+	c.Unlock()
+
+	return nil
+}
+
+func (c *Common) GetTopPerformanceNodes(measureBandwidth bool, n int) (types.Nodes, error) {
+	return c.GetTopPerformanceNodesContext(context.Background(), measureBandwidth, n)
+}
+
+func (c *Common) GetTopPerformanceNodesContext(ctx context.Context, measureBandwidth bool, n int) (types.Nodes, error) {
+	if c.presetNode != nil {
+		return types.Nodes{c.presetNode}, nil
+	}
+	round, err := c.measureNodes(ctx, measureBandwidth, n, false)
 	if err != nil {
 		return nil, err
 	}
+	candidateSubs := round.nodes
+	if c.selector != nil && round.measured > 0 && len(candidateSubs) == 0 {
+		return nil, fmt.Errorf("%w: no node meets the selector requirements", ErrNoProviders)
+	}
 
-	filterSubs = c.filterSubscribers(allSubscribers, subscriberRaw)
-
-	var candidateSubs types.Nodes
-	if len(filterSubs) == 0 {
-		return nil, nil
-	} else if len(filterSubs) == 1 {
-		candidateSubs = filterSubs
-	} else {
-		delayMeasuredSubs := measureDelay(ctx, filterSubs, c.measureDelayConcurrentWorkers, measureDelayTopDelayCount, defaultMeasureDelayTimeout, c.TcpDialContext)
-		if measureBandwidth {
-			candidateSubs = c.measureBandwidth(ctx, delayMeasuredSubs, n, c.MeasureBandwidthWorkersTimeout)
-		} else {
-			length := n
-			if length > len(delayMeasuredSubs) {
-				length = len(delayMeasuredSubs)
-			}
-			candidateSubs = delayMeasuredSubs[:length]
-		}
+	if len(candidateSubs) > n {
+		candidateSubs = candidateSubs[:n]
 	}
 
 	if c.sortMeasuredNodes != nil {
@@ -908,75 +1028,26 @@ func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]str
 			if len(f.Metadata) > 0 {
 				subscriberRaw[f.Address] = f.Metadata
 			} else {
-				subscription, err := c.Client.GetSubscriptionContext(ctx, topic, f.Address)
+				meta, err := c.Discovery.GetContext(ctx, topic, f.Address)
 				if err != nil {
-					log.Println(err)
+					c.logger.Warn("Get metadata of allowed node error", "address", f.Address, "error", err)
 					continue
 				}
-				subscriberRaw[f.Address] = subscription.Meta
+				subscriberRaw[f.Address] = meta
 			}
 			allSubscribers = append(allSubscribers, f.Address)
 		}
 		if len(allSubscribers) == 0 {
-			return nil, nil, errors.New("none of the NKN address whitelist can provide service")
+			return nil, nil, fmt.Errorf("%w: none of the NKN address whitelist can provide service", ErrNoProviders)
 		}
 	} else {
-		// check if there is at least one service provider with low cost
-		subscribers, err := c.Client.GetSubscribersContext(ctx, topic, 0, c.GetSubscribersBatchSize, false, false, nil)
+		var err error
+		subscriberRaw, err = c.Discovery.ListContext(ctx, topic, c.GetSubscribersBatchSize)
 		if err != nil {
 			return nil, nil, err
 		}
-		if subscribers.Subscribers.Len() == 0 {
-			return nil, nil, errors.New("there is no service providers for " + c.Service.Name)
-		}
-
-		var allPrefix [][]byte
-		if subscribers.Subscribers.Len() < c.GetSubscribersBatchSize {
-			allPrefix = make([][]byte, 1)
-		} else {
-			allPrefix = make([][]byte, 256)
-			for i := 0; i < 256; i++ {
-				allPrefix[i] = []byte{byte(i)}
-			}
-		}
-
-		rand.Shuffle(len(allPrefix), func(i, j int) {
-			allPrefix[i], allPrefix[j] = allPrefix[j], allPrefix[i]
-		})
-
-		subscriberRaw = make(map[string]string)
-		subscriberCount := 0
-		for i := 0; i < len(allPrefix); i++ {
-			count, err := c.Client.GetSubscribersCountContext(ctx, topic, allPrefix[i])
-			if err != nil {
-				return nil, nil, err
-			}
-
-			if count > 0 {
-				offset := rand.Intn((count-1)/c.GetSubscribersBatchSize + 1)
-				subscribers, err := c.Client.GetSubscribersContext(ctx, topic, offset*c.GetSubscribersBatchSize, c.GetSubscribersBatchSize, true, false, allPrefix[i])
-				if err != nil {
-					return nil, nil, err
-				}
-
-				for subscriber, meta := range subscribers.Subscribers.Map() {
-					if _, ok := subscriberRaw[subscriber]; !ok {
-						subscriberRaw[subscriber] = meta
-						subscriberCount++
-					}
-				}
-				if subscriberCount >= c.GetSubscribersBatchSize {
-					break
-				}
-			}
-
-			if i+maxRPCRequests < len(allPrefix) {
-				estimatedRemainingRequests := float64(c.GetSubscribersBatchSize-subscriberCount) / (float64(subscriberCount+1) / float64(i+1))
-				if estimatedRemainingRequests > maxRPCRequests {
-					i = len(allPrefix) - 1
-					allPrefix = append(allPrefix, nil)
-				}
-			}
+		if len(subscriberRaw) == 0 {
+			return nil, nil, fmt.Errorf("%w for %s", ErrNoProviders, c.Service.Name)
 		}
 
 		if c.measureStorage != nil {
@@ -984,7 +1055,7 @@ func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]str
 			for _, v := range nodes {
 				item := v.(*storage.FavoriteNode)
 				subscriberRaw[item.Address] = item.Metadata
-				log.Printf("Use favorite node: %s", item.IP)
+				c.logger.Debug("Use favorite node", "ip", item.IP)
 			}
 		}
 
@@ -997,12 +1068,16 @@ func (c *Common) nknFilterContext(ctx context.Context) ([]string, map[string]str
 	return allSubscribers, subscriberRaw, nil
 }
 
-func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[string]string) types.Nodes {
+// filterSubscribersWithReasons returns subscribers that pass price, NKN and
+// IP filters and avoid nodes, together with the reason each rejected
+// subscriber was filtered out.
+func (c *Common) filterSubscribersWithReasons(allSubscribers []string, subscriberRaw map[string]string) (types.Nodes, []*NodeReport, error) {
 	entryToExitMaxPrice, exitToEntryMaxPrice, err := ParsePrice(c.ServiceInfo.MaxPrice)
 	if err != nil {
-		log.Fatalf("Parse price of service error: %v", err)
+		return nil, nil, fmt.Errorf("parse max price of service: %w", err)
 	}
 	filterSubs := make(types.Nodes, 0, len(allSubscribers))
+	rejected := make([]*NodeReport, 0)
 
 	var nodes []*net.IPNet
 	if c.measureStorage != nil {
@@ -1013,38 +1088,56 @@ func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[st
 		metadataString := subscriberRaw[subscriber]
 		metadata, err := ReadMetadata(metadataString)
 		if err != nil {
-			log.Println("Couldn't unmarshal metadata:", err)
+			c.logger.Debug("Couldn't unmarshal metadata", "address", subscriber, "error", err)
+			rejected = append(rejected, &NodeReport{Address: subscriber, Rejected: "invalid metadata"})
 			continue
 		}
+		reject := func(reason string) {
+			rejected = append(rejected, &NodeReport{Address: subscriber, IP: metadata.Ip, Price: metadata.Price, Rejected: reason})
+		}
+
 		entryToExitPrice, exitToEntryPrice, err := ParsePrice(metadata.Price)
 		if err != nil {
-			log.Println(err)
+			c.logger.Debug("Invalid price", "address", subscriber, "error", err)
+			reject("invalid price")
 			continue
 		}
 		if entryToExitPrice > entryToExitMaxPrice || exitToEntryPrice > exitToEntryMaxPrice {
+			reject("price higher than max price " + c.ServiceInfo.MaxPrice)
+			continue
+		}
+
+		if reason := c.advertisementRejection(metadata); len(reason) > 0 {
+			reject(reason)
 			continue
 		}
 
 		if !c.ServiceInfo.NknFilter.IsAllow(&filter.NknClient{Address: subscriber}) {
+			reject("disallowed by NKN filter")
 			continue
 		}
 
 		res, err := c.ServiceInfo.IPFilter.AllowIP(metadata.Ip)
 		if err != nil {
-			log.Println(err)
+			c.logger.Warn("IP filter error", "ip", metadata.Ip, "error", err)
 		}
 		if !res {
+			reject("disallowed by IP filter")
 			continue
 		}
 
-		if c.measureStorage != nil { // disallow avoid nodes
-			for _, ip := range nodes {
-				if ip.Contains(net.ParseIP(metadata.Ip)) {
-					log.Printf("disallow avoid subnet: %s, ip: %s", ip.String(), metadata.Ip)
-					continue
-				}
+		avoided := false
+		for _, ip := range nodes { // disallow avoid nodes
+			if ip.Contains(net.ParseIP(metadata.Ip)) {
+				c.logger.Debug("Disallow avoid subnet", "subnet", ip.String(), "ip", metadata.Ip)
+				reject("in avoid subnet " + ip.String())
+				avoided = true
+				break
 			}
 		}
+		if avoided {
+			continue
+		}
 
 		filterSubs = append(filterSubs, &types.Node{
 			Address:     subscriber,
@@ -1053,10 +1146,10 @@ func (c *Common) filterSubscribers(allSubscribers []string, subscriberRaw map[st
 		})
 	}
 
-	return filterSubs
+	return filterSubs, rejected, nil
 }
 
-func measureDelay(ctx context.Context, nodes types.Nodes, concurrentWorkers, numResults int, timeout time.Duration, dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) types.Nodes {
+func (c *Common) measureDelay(ctx context.Context, nodes types.Nodes, concurrentWorkers, numResults int, timeout time.Duration) types.Nodes {
 	timeStart := time.Now()
 	var lock sync.Mutex
 	delayMeasuredSubs := make(types.Nodes, 0, len(nodes))
@@ -1068,15 +1161,17 @@ func measureDelay(ctx context.Context, nodes types.Nodes, concurrentWorkers, num
 			wg.Add(1)
 			tunaUtil.Enqueue(measurementDelayJobChan, func() {
 				addr := node.Metadata.Ip + ":" + strconv.Itoa(int(node.Metadata.TcpPort))
-				delay, err := tunaUtil.DelayMeasurementContext(ctx, tcp4, addr, timeout, dialContext)
+				delay, err := measurementCache.do(ctx, "delay "+addr, c.MeasurementCacheTTL, func() (interface{}, error) {
+					return tunaUtil.DelayMeasurementContext(ctx, tcp4, addr, timeout, c.TcpDialContext)
+				})
 				if err != nil {
 					var e net.Error
 					if !errors.As(err, &e) {
-						log.Println(err)
+						c.logger.Warn("Measure delay error", "remoteAddr", addr, "error", err)
 					}
 					return
 				}
-				node.Delay = float32(delay) / float32(time.Millisecond)
+				node.Delay = float32(delay.(time.Duration)) / float32(time.Millisecond)
 				lock.Lock()
 				delayMeasuredSubs = append(delayMeasuredSubs, node)
 				lock.Unlock()
@@ -1085,7 +1180,8 @@ func measureDelay(ctx context.Context, nodes types.Nodes, concurrentWorkers, num
 	}
 	wg.Wait()
 	measureDelayTime := time.Since(timeStart)
-	log.Printf("Measure delay: total use %s\n", measureDelayTime)
+	observeMeasurement("delay", measureDelayTime)
+	c.logger.Info("Measured delay", "nodes", len(nodes), "duration", measureDelayTime)
 
 	close(measurementDelayJobChan)
 
@@ -1098,7 +1194,104 @@ func measureDelay(ctx context.Context, nodes types.Nodes, concurrentWorkers, num
 	return delayMeasuredSubs
 }
 
-func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int, timeout time.Duration) types.Nodes {
+// bandwidthMeasurement is the bandwidth of a node in bytes/s.
+type bandwidthMeasurement struct {
+	min, max             float32
+	minUplink, maxUplink float32
+}
+
+// bandwidthMeasurementError is a failed downlink measurement of a node that
+// did accept the measurement connection.
+type bandwidthMeasurementError struct {
+	err error
+}
+
+func (e *bandwidthMeasurementError) Error() string {
+	return e.err.Error()
+}
+
+// measureNodeBandwidth measures the bandwidth of node in the configured
+// direction.
+func (c *Common) measureNodeBandwidth(ctx context.Context, sub *types.Node) (*bandwidthMeasurement, error) {
+	remotePublicKey, err := nkn.ClientAddrToPubKey(sub.Address)
+	if err != nil {
+		c.logger.Warn("Invalid node address", "address", sub.Address, "error", err)
+		return nil, err
+	}
+
+	d := net.Dialer{Timeout: defaultMeasureDelayTimeout}
+	addr := sub.Metadata.Ip + ":" + strconv.Itoa(int(sub.Metadata.TcpPort))
+	var dialContext = d.DialContext
+	if c.TcpDialContext != nil {
+		dialContext = c.TcpDialContext
+	}
+	conn, err := dialContext(ctx, tcp4, addr)
+	if err != nil {
+		var e net.Error
+		if !errors.As(err, &e) {
+			c.logger.Warn("Dial node error", "remoteAddr", addr, "error", err)
+		}
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+
+	connMetadata := &pb.ConnectionMetadata{
+		IsMeasurement:            true,
+		MeasurementBytesDownlink: uint32(c.MeasurementBytesDownLink),
+	}
+	if c.BandwidthDirection != BandwidthDownlink {
+		connMetadata.MeasurementBytesUplink = uint32(c.MeasurementBytesUpLink)
+	}
+	encryptedConn, _, err := c.wrapConn(conn, remotePublicKey, connMetadata)
+	if err != nil {
+		select {
+		case <-ctx.Done():
+		default:
+			c.logger.Warn("Bandwidth measurement handshake error", "remoteAddr", addr, "error", err)
+		}
+		conn.Close()
+		return nil, err
+	}
+	defer encryptedConn.Close()
+
+	res := &bandwidthMeasurement{}
+	timeStart := time.Now()
+	res.min, res.max, err = tunaUtil.BandwidthMeasurementClientContext(ctx, encryptedConn, int(c.MeasurementBytesDownLink), c.MeasureBandwidthTimeout)
+	dur := time.Since(timeStart)
+	if err != nil {
+		return nil, &bandwidthMeasurementError{err: err}
+	}
+
+	c.logger.Debug("Measured bandwidth", "remoteAddr", addr, "minKBps", res.min/1024, "maxKBps", res.max/1024, "duration", dur)
+
+	if connMetadata.MeasurementBytesUplink > 0 {
+		timeStart = time.Now()
+		res.minUplink, res.maxUplink, err = tunaUtil.BandwidthUplinkClientContext(ctx, encryptedConn, int(connMetadata.MeasurementBytesUplink), c.MeasureBandwidthTimeout)
+		dur = time.Since(timeStart)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil, err
+			default:
+			}
+			if err != tunaUtil.ErrUplinkNotSupported {
+				c.logger.Warn("Uplink bandwidth measurement error", "remoteAddr", addr, "error", err)
+				return nil, err
+			}
+			c.logger.Debug("Uplink bandwidth measurement not supported, using downlink", "remoteAddr", addr)
+		} else {
+			c.logger.Debug("Measured uplink bandwidth", "remoteAddr", addr, "minKBps", res.minUplink/1024, "maxKBps", res.maxUplink/1024, "duration", dur)
+		}
+	}
+
+	return res, nil
+}
+
+func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int, timeout, cacheTTL time.Duration) types.Nodes {
 	timeStart := time.Now()
 
 	var resLock sync.Mutex
@@ -1116,100 +1309,29 @@ func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int,
 		wg.Add(1)
 		sub := nodes[i]
 		tunaUtil.Enqueue(measurementBandwidthJobChan, func() {
-			remotePublicKey, err := nkn.ClientAddrToPubKey(sub.Address)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			d := net.Dialer{Timeout: defaultMeasureDelayTimeout}
 			addr := sub.Metadata.Ip + ":" + strconv.Itoa(int(sub.Metadata.TcpPort))
-			var dialContext = d.DialContext
-			if c.TcpDialContext != nil {
-				dialContext = c.TcpDialContext
+			key := fmt.Sprintf("bandwidth %s %d", addr, c.MeasurementBytesDownLink)
+			if c.BandwidthDirection != BandwidthDownlink {
+				key += fmt.Sprintf(" %d", c.MeasurementBytesUpLink)
 			}
-			conn, err := dialContext(ctx, tcp4, addr)
-			if err != nil {
-				var e net.Error
-				if !errors.As(err, &e) {
-					log.Println(err)
-				}
-				return
-			}
-
-			go func() {
-				<-ctx.Done()
-				conn.SetDeadline(time.Now())
-			}()
-
-			encryptedConn, _, err := c.wrapConn(conn, remotePublicKey, &pb.ConnectionMetadata{
-				IsMeasurement:            true,
-				MeasurementBytesDownlink: uint32(c.MeasurementBytesDownLink),
+			// results reused from the cache were recorded when measured
+			v, err := measurementCache.do(ctx, key, cacheTTL, func() (interface{}, error) {
+				res, err := c.measureNodeBandwidth(ctx, sub)
+				c.recordBandwidthMeasurement(ctx, sub, res, err)
+				return res, err
 			})
 			if err != nil {
-				select {
-				case <-ctx.Done():
-				default:
-					log.Println(err)
-				}
-				conn.Close()
-				return
-			}
-			defer encryptedConn.Close()
-
-			timeStart := time.Now()
-			min, max, err := tunaUtil.BandwidthMeasurementClientContext(ctx, encryptedConn, int(c.MeasurementBytesDownLink), c.MeasureBandwidthTimeout)
-			dur := time.Since(timeStart)
-			if err != nil {
-				select {
-				case <-ctx.Done():
-				default:
-					if c.measureStorage != nil {
-						c.measureStorage.AddAvoidNode(sub.Metadata.Ip, &storage.AvoidNode{
-							IP:      sub.Metadata.Ip,
-							Address: sub.Address,
-						})
-						err = c.measureStorage.SaveAvoidNodes()
-						if err != nil {
-							log.Println(err)
-						}
-						log.Printf("Add avoid node: %s", sub.Metadata.Ip)
-					}
-				}
 				return
 			}
+			res := v.(*bandwidthMeasurement)
 
-			log.Printf("Address: %s, bandwidth: %f - %f KB/s, time: %s", addr, min/1024, max/1024, dur)
-
-			if c.measureStorage != nil {
-				metadata, err := proto.Marshal(sub.Metadata)
-				if err != nil {
-					log.Println(err)
-				} else {
-					metadataString := base64.StdEncoding.EncodeToString(metadata)
-					updated := c.measureStorage.AddFavoriteNode(sub.Metadata.Ip, &storage.FavoriteNode{
-						IP:           sub.Metadata.Ip,
-						Address:      sub.Address,
-						Metadata:     metadataString,
-						Delay:        sub.Delay,
-						MinBandwidth: min / 1024,
-						MaxBandwidth: max / 1024,
-					})
-					if updated {
-						err = c.measureStorage.SaveFavoriteNodes()
-						if err != nil {
-							log.Println(err)
-						}
-						log.Printf("Add favorite node: %s", sub.Metadata.Ip)
-					}
-				}
-			}
-
-			sub.Bandwidth = min
+			sub.DownlinkBandwidth = res.min
+			sub.UplinkBandwidth = res.minUplink
+			sub.Bandwidth = directionBandwidth(c.BandwidthDirection, res.min, res.minUplink)
 			resLock.Lock()
 			bandwidthMeasuredSubs = append(bandwidthMeasuredSubs, sub)
 			if len(bandwidthMeasuredSubs) >= n {
-				log.Println("Collected enough results, cancel bandwidth measurement.")
+				c.logger.Debug("Collected enough results, cancel bandwidth measurement")
 				cancel()
 			}
 			resLock.Unlock()
@@ -1218,7 +1340,8 @@ func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int,
 	wg.Wait()
 
 	measureBandwidthTime := time.Since(timeStart)
-	log.Printf("Measure bandwidth: total use %s\n", measureBandwidthTime)
+	observeMeasurement("bandwidth", measureBandwidthTime)
+	c.logger.Info("Measured bandwidth", "nodes", len(nodes), "duration", measureBandwidthTime)
 
 	close(measurementBandwidthJobChan)
 
@@ -1227,6 +1350,91 @@ func (c *Common) measureBandwidth(ctx context.Context, nodes types.Nodes, n int,
 	return bandwidthMeasuredSubs
 }
 
+// recordBandwidthMeasurement records the bandwidth measurement result of node
+// in its reputation and the favorite or avoid nodes of the measure storage.
+// Measurements canceled by ctx are not recorded.
+func (c *Common) recordBandwidthMeasurement(ctx context.Context, node *types.Node, res *bandwidthMeasurement, err error) {
+	if err != nil {
+		var e *bandwidthMeasurementError
+		if !errors.As(err, &e) || ctx.Err() != nil {
+			return
+		}
+		c.recordReputation(node.Metadata.Ip, node.Address, &storage.ReputationEvent{Reason: "bandwidth measurement error: " + err.Error()})
+		if c.measureStorage != nil {
+			c.measureStorage.AddAvoidNode(node.Metadata.Ip, &storage.AvoidNode{
+				IP:      node.Metadata.Ip,
+				Address: node.Address,
+			})
+			err = c.measureStorage.SaveAvoidNodes()
+			if err != nil {
+				c.logger.Warn("Save avoid nodes error", "error", err)
+			}
+			c.logger.Info("Add avoid node", "ip", node.Metadata.Ip)
+		}
+		return
+	}
+
+	if c.measureStorage != nil {
+		metadata, err := proto.Marshal(node.Metadata)
+		if err != nil {
+			c.logger.Warn("Marshal metadata error", "error", err)
+		} else {
+			metadataString := base64.StdEncoding.EncodeToString(metadata)
+			updated := c.measureStorage.AddFavoriteNode(node.Metadata.Ip, &storage.FavoriteNode{
+				IP:                 node.Metadata.Ip,
+				Address:            node.Address,
+				Metadata:           metadataString,
+				Delay:              node.Delay,
+				MinBandwidth:       res.min / 1024,
+				MaxBandwidth:       res.max / 1024,
+				MinUplinkBandwidth: res.minUplink / 1024,
+				MaxUplinkBandwidth: res.maxUplink / 1024,
+			})
+			if updated {
+				err = c.measureStorage.SaveFavoriteNodes()
+				if err != nil {
+					c.logger.Warn("Save favorite nodes error", "error", err)
+				}
+				c.logger.Info("Add favorite node", "ip", node.Metadata.Ip)
+			}
+		}
+	}
+
+	c.recordReputation(node.Metadata.Ip, node.Address, &storage.ReputationEvent{
+		Success:    true,
+		Throughput: directionBandwidth(c.BandwidthDirection, res.min, res.minUplink) / 1024,
+	})
+}
+
+// directionBandwidth returns the bandwidth used to rank a node in direction.
+// Downlink is used if uplink is not measured.
+func directionBandwidth(direction string, downlink, uplink float32) float32 {
+	if uplink == 0 {
+		return downlink
+	}
+	switch direction {
+	case BandwidthUplink:
+		return uplink
+	case BandwidthBoth:
+		if uplink < downlink {
+			return uplink
+		}
+	}
+	return downlink
+}
+
+// serveMeasurement serves a bandwidth measurement requested by connMetadata.
+func serveMeasurement(conn net.Conn, connMetadata *pb.ConnectionMetadata) error {
+	err := tunaUtil.BandwidthMeasurementServer(conn, int(connMetadata.MeasurementBytesDownlink), maxMeasureBandwidthTimeout)
+	if err != nil {
+		return err
+	}
+	if connMetadata.MeasurementBytesUplink > 0 {
+		return tunaUtil.BandwidthUplinkServerContext(context.Background(), conn, int(connMetadata.MeasurementBytesUplink), maxMeasureBandwidthTimeout)
+	}
+	return nil
+}
+
 func (c *Common) startPayment(
 	bytesEntryToExitUsed, bytesExitToEntryUsed *uint64,
 	bytesEntryToExitPaid, bytesExitToEntryPaid *uint64,
@@ -1234,19 +1442,30 @@ func (c *Common) startPayment(
 	minNanoPayFee string,
 	nanoPayFeePercentage float64,
 	getPaymentStreamRecipient func() (*smux.Stream, string, error),
+	closeChan <-chan struct{},
 ) {
 	var np *nkn.NanoPay
 	var bytesEntryToExit, bytesExitToEntry uint64
 	var cost, lastCost common.Fixed64
 	entryToExitPrice, exitToEntryPrice := c.GetPrice()
 	lastPaymentTime := time.Now()
+	stopping := false
 
-	for {
+	// after closeChan is closed, unpaid traffic is paid once more
+	for !stopping {
 		for {
 			time.Sleep(100 * time.Millisecond)
 			if c.isClosed {
 				return
 			}
+			select {
+			case <-closeChan:
+				stopping = true
+			default:
+			}
+			if stopping {
+				break
+			}
 			bytesEntryToExit = atomic.LoadUint64(bytesEntryToExitUsed)
 			bytesExitToEntry = atomic.LoadUint64(bytesExitToEntryUsed)
 			if (bytesEntryToExit+bytesExitToEntry)-(*bytesEntryToExitPaid+*bytesExitToEntryPaid) > trafficPaymentThreshold*TrafficUnit {
@@ -1267,7 +1486,7 @@ func (c *Common) startPayment(
 
 		paymentStream, paymentReceiver, err := getPaymentStreamRecipient()
 		if err != nil {
-			log.Printf("Get payment stream err: %v", err)
+			c.logger.Warn("Get payment stream error", "error", err)
 			continue
 		}
 
@@ -1278,7 +1497,7 @@ func (c *Common) startPayment(
 		if np == nil || np.Recipient() != paymentReceiver {
 			np, err = c.Client.NewNanoPay(paymentReceiver, nanoPayFee, defaultNanoPayDuration)
 			if err != nil {
-				log.Printf("Create nanopay err: %v", err)
+				c.logger.Warn("Create nanopay error", "error", err)
 				continue
 			}
 		}
@@ -1288,7 +1507,7 @@ func (c *Common) startPayment(
 
 			minTxFee, err := common.StringToFixed64(minNanoPayFee)
 			if err != nil {
-				log.Printf("minNanoPayFee to Fixed64 err: %v", err)
+				c.logger.Error("Parse min nanopay fee error", "error", err)
 				return
 			}
 			if fee < minTxFee {
@@ -1299,10 +1518,19 @@ func (c *Common) startPayment(
 
 		err = sendNanoPay(np, paymentStream, cost, nanoPayFee)
 		if err != nil {
-			log.Printf("Send nanopay err: %v", err)
+			c.logger.Error("Send nanopay error", "error", err)
+			if errors.Is(err, nkn.ErrInsufficientBalance) {
+				c.emitEvent(&Event{Type: EventBalanceLow, RemoteNknAddress: paymentReceiver, Error: err.Error()})
+			}
+			if metadata := c.GetMetadata(); metadata != nil {
+				c.recordReputation(metadata.Ip, c.GetRemoteNknAddress(), &storage.ReputationEvent{Reason: "payment error: " + err.Error()})
+			}
 			return
 		}
-		log.Printf("send nanopay success: %s", cost.String())
+		c.logger.Info("Sent nanopay", "amount", cost.String())
+		atomic.AddInt64(&c.nanoPaySent, int64(cost))
+		c.emitEvent(&Event{Type: EventPaymentSent, RemoteNknAddress: paymentReceiver, Amount: cost.String()})
+		DefaultMetrics.Add("tuna_nanopay_sent_total", float64(cost)/common.StorageFactor, "role", c.metricsRole)
 
 		*bytesEntryToExitPaid = bytesEntryToExit
 		*bytesExitToEntryPaid = bytesExitToEntry
@@ -1332,6 +1560,31 @@ func (c *Common) pipe(dest io.WriteCloser, src io.ReadCloser, written *uint64) {
 	copyBuffer(dest, src, written)
 }
 
+// pipeStream copies between a service stream and conn until both directions
+// are closed, counting bytes written to each of them.
+func (c *Common) pipeStream(stream *smux.Stream, conn net.Conn, service string, streamWritten, connWritten *uint64) {
+	event := &Event{Service: service, StreamID: stream.ID(), RemoteNetAddr: conn.RemoteAddr().String()}
+	opened := *event
+	opened.Type = EventStreamOpened
+	c.emitEvent(&opened)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.pipe(stream, conn, streamWritten)
+	}()
+	go func() {
+		defer wg.Done()
+		c.pipe(conn, stream, connWritten)
+	}()
+	go func() {
+		wg.Wait()
+		event.Type = EventStreamClosed
+		c.emitEvent(event)
+	}()
+}
+
 func (c *Common) GetNumActiveSessions() int {
 	c.RLock()
 	defer c.RUnlock()
@@ -1362,23 +1615,45 @@ func (c *Common) WaitSessions() {
 		return
 	}
 
+	ctx := context.Background()
+	if linger > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, linger)
+		defer cancel()
+	}
+	c.WaitSessionsContext(ctx)
+}
+
+// WaitSessionsContext waits for sessions wait group, or until ctx is done in
+// which case ctx.Err() is returned.
+func (c *Common) WaitSessionsContext(ctx context.Context) error {
 	waitChan := make(chan struct{})
 	go func() {
 		c.sessionsWaitGroup.Wait()
 		close(waitChan)
 	}()
 
-	var timeoutChan <-chan time.Time
-	if linger > 0 {
-		timeoutChan = time.After(linger)
-	}
-
 	select {
 	case <-waitChan:
-	case <-timeoutChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// stopAccepting marks c as shutting down so that new streams are rejected.
+func (c *Common) stopAccepting() {
+	c.Lock()
+	c.isShuttingDown = true
+	c.Unlock()
+}
+
+func (c *Common) IsShuttingDown() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.isShuttingDown
+}
+
 func (c *Common) SetRemoteNode(node *types.Node) {
 	c.presetNode = node
 }
@@ -1405,7 +1680,7 @@ func CreateRawMetadata(
 	udpPort uint32,
 	price string,
 	beneficiaryAddr string,
-) []byte {
+) ([]byte, error) {
 	metadata := &pb.ServiceMetadata{
 		Ip:              ip,
 		TcpPort:         tcpPort,
@@ -1418,9 +1693,9 @@ func CreateRawMetadata(
 	}
 	metadataRaw, err := proto.Marshal(metadata)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMetadata, err)
 	}
-	return []byte(base64.StdEncoding.EncodeToString(metadataRaw))
+	return []byte(base64.StdEncoding.EncodeToString(metadataRaw)), nil
 }
 
 func UpdateMetadata(
@@ -1439,87 +1714,19 @@ func UpdateMetadata(
 	subscriptionReplaceTxPool bool,
 	client *nkn.MultiClient,
 	closeChan chan struct{},
-) {
-	metadataRaw := CreateRawMetadata(serviceID, serviceTCP, serviceUDP, ip, tcpPort, udpPort, price, beneficiaryAddr)
-	topic := subscriptionPrefix + serviceName
-	identifier := ""
-	subInterval := config.ConsensusDuration
-	if subscriptionDuration > 3 {
-		subInterval = time.Duration(subscriptionDuration-3) * config.ConsensusDuration
+) error {
+	metadataRaw, err := CreateRawMetadata(serviceID, serviceTCP, serviceUDP, ip, tcpPort, udpPort, price, beneficiaryAddr)
+	if err != nil {
+		return err
 	}
-	var nextSub <-chan time.Time
-
-	go func() {
-		for {
-			nextSub = time.After(0)
-
-			func() {
-				sub, err := client.GetSubscription(topic, address.MakeAddressString(client.PubKey(), identifier))
-				if err != nil {
-					log.Println("Get existing subscription error:", err)
-					return
-				}
-
-				if len(sub.Meta) == 0 && sub.ExpiresAt == 0 {
-					return
-				}
-
-				if sub.Meta != string(metadataRaw) {
-					log.Println("Existing subscription meta need update.")
-					return
-				}
-
-				height, err := client.GetHeight()
-				if err != nil {
-					log.Println("Get current height error:", err)
-					return
-				}
-
-				if sub.ExpiresAt-height < 3 {
-					log.Println("Existing subscription is expiring")
-					return
-				}
-
-				log.Println("Existing subscription expires after", sub.ExpiresAt-height, "blocks")
-
-				maxSubDuration := float64(sub.ExpiresAt-height) * float64(config.ConsensusDuration)
-				nextSub = time.After(time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * maxSubDuration))
-			}()
-
-			select {
-			case <-nextSub:
-			case <-closeChan:
-				return
-			}
-
-			subFee, err := common.StringToFixed64(subscriptionFee)
-			if err != nil {
-				log.Println("Parse subscription fee error:", err)
-			}
-
-			if subFee > 0 {
-				balance, err := client.Balance()
-				if err != nil {
-					log.Println("Get balance error:", err)
-				} else {
-					if subFee > balance.ToFixed64() {
-						subFee = balance.ToFixed64()
-					}
-				}
-			}
-
-			addToSubscribeQueue(client, identifier, topic, int(subscriptionDuration), string(metadataRaw), &nkn.TransactionConfig{Fee: subFee.String()}, subscriptionReplaceTxPool)
-
-			nextSub = time.After(time.Duration((1 - rand.Float64()*subscribeDurationRandomFactor) * float64(subInterval)))
-
-			select {
-			case <-nextSub:
-			case <-time.After(maxCheckSubscribeInterval):
-			case <-closeChan:
-				return
-			}
-		}
-	}()
+	d := &NknDiscovery{
+		Client:                    client,
+		SubscriptionDuration:      subscriptionDuration,
+		SubscriptionFee:           subscriptionFee,
+		SubscriptionReplaceTxPool: subscriptionReplaceTxPool,
+	}
+	d.Publish(subscriptionPrefix+serviceName, client.Address(), func() string { return string(metadataRaw) }, nil, closeChan)
+	return nil
 }
 
 func copyBuffer(dest io.Writer, src io.Reader, written *uint64) error {
@@ -1555,7 +1762,7 @@ func Close(conn io.Closer) {
 	}
 	err := conn.Close()
 	if err != nil {
-		log.Println("Error while closing:", err)
+		slog.Debug("Error while closing", "error", err)
 	}
 }
 
@@ -1585,13 +1792,13 @@ func LoadOrCreateAccount(walletFile, passwordFile string) (*vault.Account, error
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		if _, err = os.Stat(passwordFile); os.IsNotExist(err) {
 			pswd = base64.StdEncoding.EncodeToString(util.RandomBytes(24))
-			log.Println("Creating wallet.pswd")
+			slog.Info("Creating password file", "path", passwordFile)
 			err = os.WriteFile(passwordFile, []byte(pswd), 0644)
 			if err != nil {
 				return nil, fmt.Errorf("save password to file error: %v", err)
 			}
 		}
-		log.Println("Creating wallet.json")
+		slog.Info("Creating wallet file", "path", walletFile)
 		wallet, err = vault.NewWallet(walletFile, []byte(pswd))
 		if err != nil {
 			return nil, fmt.Errorf("create wallet error: %v", err)
@@ -1641,7 +1848,10 @@ func sendNanoPay(np *nkn.NanoPay, paymentStream *smux.Stream, cost common.Fixed6
 		}
 	}
 	if err != nil || tx == nil || tx.GetSize() == 0 {
-		return fmt.Errorf("send nanopay tx failed: %v", err)
+		if err == nil {
+			err = errors.New("empty nanopay tx")
+		}
+		return fmt.Errorf("%w: send nanopay tx: %w", ErrPaymentFailed, err)
 	}
 
 	txBytes, err := tx.Marshal()
@@ -1674,14 +1884,14 @@ func nanoPayClaim(txBytes []byte, npc *nkn.NanoPayClaimer) (*nkn.Amount, error)
 	return npc.Claim(tx)
 }
 
-func checkNanoPayClaim(session *smux.Session, npc *nkn.NanoPayClaimer, onErr *nkn.OnError, isClosed *bool) {
+func (c *Common) checkNanoPayClaim(session *smux.Session, npc *nkn.NanoPayClaimer, onErr *nkn.OnError, isClosed *bool) {
 	for {
 		err, ok := <-onErr.C
 		if !ok {
 			break
 		}
 		if err != nil {
-			log.Println("Couldn't claim nano pay:", err)
+			c.logger.Warn("Couldn't claim nanopay", "error", err)
 			if npc.IsClosed() {
 				Close(session)
 				*isClosed = true
@@ -1691,7 +1901,7 @@ func checkNanoPayClaim(session *smux.Session, npc *nkn.NanoPayClaimer, onErr *nk
 	}
 }
 
-func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, isClosed *bool, getTotalCost func() (common.Fixed64, common.Fixed64)) {
+func (c *Common) checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, isClosed *bool, getTotalCost func() (common.Fixed64, common.Fixed64)) {
 	var totalCost, totalBytes, totalCostDelayed, totalBytesDelayed common.Fixed64
 
 	go func() {
@@ -1734,13 +1944,14 @@ func checkPayment(session *smux.Session, lastPaymentTime *time.Time, lastPayment
 		if *lastPaymentAmount < common.Fixed64(minTrafficCoverage*float64(totalCost)) && totalCost-*lastPaymentAmount > common.Fixed64(maxTrafficUnpaid*TrafficUnit*float64(totalCost)/float64(totalBytes)) {
 			Close(session)
 			*isClosed = true
-			log.Printf("Not enough payment. Since last payment: %s. Last claimed: %v, expected: %v", time.Since(*lastPaymentTime).String(), *lastPaymentAmount, totalCost)
+			c.logger.Warn("Not enough payment", "remoteAddr", session.RemoteAddr(), "sinceLastPayment", time.Since(*lastPaymentTime), "lastClaimed", lastPaymentAmount.String(), "expected", totalCost.String())
+			c.emitEvent(&Event{Type: EventInsufficientPayment, RemoteNetAddr: session.RemoteAddr().String(), Amount: lastPaymentAmount.String(), Expected: totalCost.String()})
 			return
 		}
 	}
 }
 
-func handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, getTotalCost func() (common.Fixed64, common.Fixed64)) error {
+func (c *Common) handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPaymentTime *time.Time, lastPaymentAmount, bytesPaid *common.Fixed64, getTotalCost func() (common.Fixed64, common.Fixed64)) error {
 	for {
 		tx, err := ReadVarBytes(stream, maxNanoPayTxnSize)
 		if err != nil {
@@ -1761,17 +1972,22 @@ func handlePaymentStream(stream *smux.Stream, npc *nkn.NanoPayClaimer, lastPayme
 			if err == nil {
 				break
 			} else {
-				log.Printf("could't claim nanoPay: %v", err)
+				c.logger.Warn("Couldn't claim nanopay", "error", err)
 			}
 		}
 		if err != nil || amount == nil {
 			if npc.IsClosed() {
-				log.Printf("nanopayclaimer closed: %v", err)
+				c.logger.Info("Nanopay claimer closed", "error", err)
 				return nil
 			}
 			continue
 		}
 
+		if claimed := amount.ToFixed64() - *lastPaymentAmount; claimed > 0 {
+			atomic.AddInt64(&c.nanoPayClaimed, int64(claimed))
+			c.emitEvent(&Event{Type: EventPaymentClaimed, RemoteNetAddr: stream.RemoteAddr().String(), Amount: claimed.String()})
+			DefaultMetrics.Add("tuna_nanopay_claimed_total", float64(claimed)/common.StorageFactor, "role", c.metricsRole)
+		}
 		*lastPaymentAmount = amount.ToFixed64()
 		*lastPaymentTime = time.Now()
 		*bytesPaid = totalBytes * (npc.Amount().Fixed64 / totalCost)
@@ -1,15 +1,97 @@
 package types
 
 import (
+	"sort"
+	"time"
+
 	"github.com/nknorg/tuna/pb"
 )
 
 type Node struct {
-	Delay       float32 // ms
-	Bandwidth   float32 // byte/s
-	Metadata    *pb.ServiceMetadata
-	Address     string
-	MetadataRaw string
+	Delay             float32 // ms
+	Bandwidth         float32 // byte/s, in the direction used to rank nodes
+	DownlinkBandwidth float32 // byte/s, 0 if not measured
+	UplinkBandwidth   float32 // byte/s, 0 if not measured
+	Metadata          *pb.ServiceMetadata
+	Address           string
+	MetadataRaw       string
+	TCPPing           *PingStats // nil if not measured
+	UDPPing           *PingStats // nil if not measured
+}
+
+// Ping returns UDP ping stats if measured, otherwise TCP ping stats.
+func (n *Node) Ping() *PingStats {
+	if n.UDPPing != nil {
+		return n.UDPPing
+	}
+	return n.TCPPing
+}
+
+// PingStats is the result of an application level ping/echo measurement.
+// All durations are in ms.
+type PingStats struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Min      float32 `json:"min"`
+	Max      float32 `json:"max"`
+	Mean     float32 `json:"mean"`
+	Median   float32 `json:"median"`
+	P90      float32 `json:"p90"`
+	Jitter   float32 `json:"jitter"` // mean difference between consecutive RTTs
+}
+
+// NewPingStats computes stats of rtts, which are the round trip times of
+// received replies in the order they were sent.
+func NewPingStats(sent int, rtts []time.Duration) *PingStats {
+	s := &PingStats{Sent: sent, Received: len(rtts)}
+	if len(rtts) == 0 {
+		return s
+	}
+
+	ms := make([]float32, len(rtts))
+	var sum, jitter float32
+	for i, rtt := range rtts {
+		ms[i] = float32(rtt) / float32(time.Millisecond)
+		sum += ms[i]
+		if i > 0 {
+			d := ms[i] - ms[i-1]
+			if d < 0 {
+				d = -d
+			}
+			jitter += d
+		}
+	}
+	s.Mean = sum / float32(len(ms))
+	if len(ms) > 1 {
+		s.Jitter = jitter / float32(len(ms)-1)
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i] < ms[j] })
+	s.Min = ms[0]
+	s.Max = ms[len(ms)-1]
+	s.Median = percentile(ms, 0.5)
+	s.P90 = percentile(ms, 0.9)
+
+	return s
+}
+
+// Loss returns the ratio of pings without reply.
+func (s *PingStats) Loss() float32 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float32(s.Sent-s.Received) / float32(s.Sent)
+}
+
+func percentile(sorted []float32, p float32) float32 {
+	i := int(p*float32(len(sorted)) + 0.5)
+	if i > 0 {
+		i--
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
 }
 
 type Nodes []*Node
@@ -33,3 +115,21 @@ type SortByBandwidth struct{ Nodes }
 func (s SortByBandwidth) Less(i, j int) bool {
 	return s.Nodes[i].Bandwidth > s.Nodes[j].Bandwidth
 }
+
+// SortByPing sorts nodes by ping loss, then by median RTT plus jitter. Nodes
+// without ping stats are sorted by delay after nodes with ping stats.
+type SortByPing struct{ Nodes }
+
+func (s SortByPing) Less(i, j int) bool {
+	pi, pj := s.Nodes[i].Ping(), s.Nodes[j].Ping()
+	if pi == nil || pj == nil {
+		if pi != nil || pj != nil {
+			return pi != nil
+		}
+		return s.Nodes[i].Delay < s.Nodes[j].Delay
+	}
+	if pi.Loss() != pj.Loss() {
+		return pi.Loss() < pj.Loss()
+	}
+	return pi.Median+pi.Jitter < pj.Median+pj.Jitter
+}
@@ -5,7 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"strings"
@@ -17,6 +17,7 @@ import (
 	nknPb "github.com/nknorg/nkn/v2/pb"
 	"github.com/nknorg/tuna/pb"
 	"github.com/nknorg/tuna/storage"
+	"github.com/rdegges/go-ipify"
 	"github.com/xtaci/smux"
 	"google.golang.org/protobuf/proto"
 )
@@ -87,6 +88,35 @@ func (c *OnConnect) close() {
 	c.closeLock.Unlock()
 }
 
+// sleepContext sleeps for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// getIPContext is ipify.GetIp that returns when ctx is done.
+func getIPContext(ctx context.Context) (string, error) {
+	type result struct {
+		ip  string
+		err error
+	}
+	resChan := make(chan result, 1)
+	go func() {
+		ip, err := ipify.GetIp()
+		resChan <- result{ip, err}
+	}()
+	select {
+	case res := <-resChan:
+		return res.ip, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
 func ParseEncryptionAlgo(encryptionAlgoStr string) (pb.EncryptionAlgo, error) {
 	if encryptionAlgo, ok := encryptionAlgoMap[strings.ToLower(strings.TrimSpace(encryptionAlgoStr))]; ok {
 		return encryptionAlgo, nil
@@ -98,13 +128,13 @@ func ParsePrice(priceStr string) (common.Fixed64, common.Fixed64, error) {
 	price := strings.Split(priceStr, ",")
 	entryToExitPrice, err := common.StringToFixed64(strings.Trim(price[0], " "))
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, fmt.Errorf("%w %q: %v", ErrInvalidPrice, priceStr, err)
 	}
 	var exitToEntryPrice common.Fixed64
 	if len(price) > 1 {
 		exitToEntryPrice, err = common.StringToFixed64(strings.Trim(price[1], " "))
 		if err != nil {
-			return 0, 0, err
+			return 0, 0, fmt.Errorf("%w %q: %v", ErrInvalidPrice, priceStr, err)
 		}
 	} else {
 		exitToEntryPrice = entryToExitPrice
@@ -193,7 +223,7 @@ func writeUDPConnMetadata(conn UDPConn, addr *net.UDPAddr, connMetadata *pb.Conn
 	return err
 }
 
-func sendPingMsg(conn UDPConn, closeChan chan struct{}) {
+func (c *Common) sendPingMsg(conn UDPConn, closeChan chan struct{}) {
 	pingMsg := new(pb.ConnectionMetadata)
 	pingMsg.IsPing = true
 
@@ -205,7 +235,7 @@ func sendPingMsg(conn UDPConn, closeChan chan struct{}) {
 		}
 		err := writeUDPConnMetadata(conn, nil, pingMsg)
 		if err != nil {
-			log.Println("write udp ping msg error:", err)
+			c.logger.Warn("Write udp ping message error", "error", err)
 			break
 		}
 		time.Sleep(heartbeatInterval)
@@ -278,7 +308,7 @@ func GetFavoriteSeedRPCServerContext(ctx context.Context, path, filenamePrefix s
 				return
 			}
 			if nodeState.SyncState != nknPb.SyncState_name[int32(nknPb.SyncState_PERSIST_FINISHED)] {
-				log.Printf("Skip rpc node %s in state %s\n", addr, nodeState.SyncState)
+				slog.Debug("Skip rpc node", "address", addr, "state", nodeState.SyncState)
 				return
 			}
 			lock.Lock()
@@ -302,6 +332,18 @@ func GetFavoriteSeedRPCServerContext(ctx context.Context, path, filenamePrefix s
 	return rpcAddrs, nil
 }
 
+// addrIP returns the IP of a network address, or nil if addr has no IP.
+func addrIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
 func randomIdentifier() string {
 	b := make([]byte, randomIdentifierLength)
 	for i := range b {
@@ -0,0 +1,294 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadConfig reads a JSON, YAML (.yaml or .yml) or TOML (.toml) file into
+// value depending on its extension. YAML and TOML use the same field names as
+// the json tags of value, and unquoted numbers and bools are read into string
+// fields as text, e.g. price: 0.001.
+func ReadConfig(fileName string, value interface{}) error {
+	var unmarshal func([]byte, interface{}) error
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	case ".toml":
+		unmarshal = toml.Unmarshal
+	default:
+		return ReadJSON(fileName, value)
+	}
+
+	file, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("read file error: %v", err)
+	}
+
+	var data interface{}
+	err = unmarshal(file, &data)
+	if err != nil {
+		return fmt.Errorf("parse %s error: %v", filepath.Ext(fileName)[1:], err)
+	}
+
+	// convert to JSON so that json tags and unmarshalers of value apply
+	b, err := json.Marshal(stringifyScalars(data, reflect.TypeOf(value)))
+	if err != nil {
+		return fmt.Errorf("parse %s error: %v", filepath.Ext(fileName)[1:], err)
+	}
+	err = json.Unmarshal(b, value)
+	if err != nil {
+		return fmt.Errorf("parse %s error: %v", filepath.Ext(fileName)[1:], err)
+	}
+
+	return nil
+}
+
+// stringifyScalars converts numbers and bools in data to strings where the
+// corresponding field of t is a string.
+func stringifyScalars(data interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch d := data.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			for k, v := range d {
+				if field, ok := jsonField(t, k); ok {
+					d[k] = stringifyScalars(v, field.Type)
+				}
+			}
+		case reflect.Map:
+			for k, v := range d {
+				d[k] = stringifyScalars(v, t.Elem())
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, v := range d {
+				d[i] = stringifyScalars(v, t.Elem())
+			}
+		}
+	case []map[string]interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, v := range d {
+				stringifyScalars(v, t.Elem())
+			}
+		}
+	case float64:
+		if t.Kind() == reflect.String {
+			return strconv.FormatFloat(d, 'f', -1, 64)
+		}
+	case int, int64, uint64, bool:
+		if t.Kind() == reflect.String {
+			return fmt.Sprint(d)
+		}
+	}
+	return data
+}
+
+// jsonField returns the field of struct t that encoding/json decodes name
+// into, including fields of embedded structs.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	var folded reflect.StructField
+	foundFolded := false
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && len(tag) == 0 {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if f, ok := jsonField(embedded, name); ok {
+					return f, true
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if len(tag) == 0 {
+			tag = field.Name
+		}
+		if tag == name {
+			return field, true
+		}
+		if !foundFolded && strings.EqualFold(tag, name) {
+			folded, foundFolded = field, true
+		}
+	}
+	return folded, foundFolded
+}
+
+// EnvName returns the environment variable name of a json field name under
+// prefix, e.g. TUNA_SEED_RPC_SERVER_ADDR for seedRPCServerAddr.
+func EnvName(prefix, name string) string {
+	runes := []rune(name)
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	sb.WriteByte('_')
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			sb.WriteByte('_')
+			continue
+		}
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				sb.WriteByte('_')
+			}
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+// ApplyEnv sets fields of the struct value points to from environment
+// variables named by EnvName of their json tags. Strings, numbers and bools
+// are parsed from text, string slices are comma separated, and other types
+// are JSON. Fields of nested structs and existing map entries can also be set
+// by appending their names, e.g. TUNA_SERVICES_HTTPPROXY_PRICE for
+// services.httpproxy.price. Nil struct pointers are allocated if any of their
+// fields is set.
+func ApplyEnv(prefix string, value interface{}) error {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("apply env to %T: not a struct pointer", value)
+	}
+	return applyEnvStruct(prefix, v.Elem())
+}
+
+func applyEnvStruct(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		err := applyEnvValue(EnvName(prefix, name), v.Field(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyEnvValue(name string, v reflect.Value) error {
+	if s, ok := os.LookupEnv(name); ok {
+		err := setFromEnv(v, s)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return applyEnvStruct(name, v)
+	case reflect.Ptr:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		if v.IsNil() {
+			if !hasEnvPrefix(name + "_") {
+				return nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return applyEnvStruct(name, v.Elem())
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			// map entries are not addressable, so set a copy back
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			err := applyEnvValue(EnvName(name, key.String()), elem)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setFromEnv(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			var elems []string
+			for _, elem := range strings.Split(s, ",") {
+				if elem = strings.TrimSpace(elem); len(elem) > 0 {
+					elems = append(elems, elem)
+				}
+			}
+			v.Set(reflect.ValueOf(elems).Convert(v.Type()))
+			return nil
+		}
+		return json.Unmarshal([]byte(s), v.Addr().Interface())
+	case reflect.Func, reflect.Chan, reflect.Interface:
+		return fmt.Errorf("can't be set by environment variable")
+	default:
+		return json.Unmarshal([]byte(s), v.Addr().Interface())
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"os"
+)
+
+// LockSuffix is appended to a file name to get the name of its lock file.
+const LockSuffix = ".lock"
+
+// FileLock is an advisory lock shared by all processes that lock the same
+// file. The lock is held on a separate lock file so the locked file itself
+// can be replaced by rename.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile blocks until it gets an exclusive lock of fileName.
+func LockFile(fileName string) (*FileLock, error) {
+	f, err := os.OpenFile(fileName+LockSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{file: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -1,17 +1,31 @@
 package util
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 const (
 	readBufferSize  = 1024
 	writeBufferSize = 1024
+
+	PingFrameSize = 16 // sequence number and send time
+	MaxPingCount  = 100
+
+	uplinkReady = 1
 )
 
+// ErrUplinkNotSupported is returned by BandwidthUplinkClientContext if the
+// server closes the connection instead of starting an uplink measurement.
+var ErrUplinkNotSupported = errors.New("uplink measurement not supported")
+
 func DelayMeasurement(network, address string, timeout time.Duration, dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) (time.Duration, error) {
 	return DelayMeasurementContext(context.Background(), network, address, timeout, dialContext)
 }
@@ -134,3 +148,274 @@ func BandwidthMeasurementServerContext(ctx context.Context, conn net.Conn, bytes
 
 	return nil
 }
+
+// BandwidthUplinkClientContext sends bytesUplink random bytes over conn and
+// returns the uplink bandwidth in byte/s measured by the client, including
+// the time for the server to report, and by the server between the first
+// and last byte it read.
+func BandwidthUplinkClientContext(ctx context.Context, conn net.Conn, bytesUplink int, timeout time.Duration) (float32, float32, error) {
+	if timeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	ready := make([]byte, 1)
+	_, err := io.ReadFull(conn, ready)
+	if err != nil {
+		if err == io.EOF {
+			return 0, 0, ErrUplinkNotSupported
+		}
+		return 0, 0, err
+	}
+	if ready[0] != uplinkReady {
+		return 0, 0, ErrUplinkNotSupported
+	}
+
+	timeStart := time.Now()
+	b := make([]byte, writeBufferSize)
+	for bytesWritten := 0; bytesWritten < bytesUplink; {
+		n := bytesUplink - bytesWritten
+		if n > len(b) {
+			n = len(b)
+		}
+		_, err = rand.Read(b[:n])
+		if err != nil {
+			return 0, 0, err
+		}
+		m, err := conn.Write(b[:n])
+		if err != nil {
+			return 0, 0, err
+		}
+		bytesWritten += m
+	}
+
+	report := make([]byte, 8)
+	_, err = io.ReadFull(conn, report)
+	if err != nil {
+		return 0, 0, err
+	}
+	timeToReport := time.Since(timeStart)
+
+	bps := float32(bytesUplink) / float32(timeToReport) * float32(time.Second)
+	bpsRead := bps
+	if serverDuration := time.Duration(binary.LittleEndian.Uint64(report)); serverDuration > 0 {
+		bpsRead = float32(bytesUplink) / float32(serverDuration) * float32(time.Second)
+		if bpsRead < bps {
+			bpsRead = bps
+		}
+	}
+
+	return bps, bpsRead, nil
+}
+
+// BandwidthUplinkServerContext reads bytesUplink bytes from conn and reports
+// the time between the first and last byte back to the client.
+func BandwidthUplinkServerContext(ctx context.Context, conn net.Conn, bytesUplink int, timeout time.Duration) error {
+	if timeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	_, err := conn.Write([]byte{uplinkReady})
+	if err != nil {
+		return err
+	}
+
+	var timeFirstByte time.Time
+	var m int
+	b := make([]byte, readBufferSize)
+	for bytesRead := 0; bytesRead < bytesUplink; {
+		n := bytesUplink - bytesRead
+		if n > len(b) {
+			n = len(b)
+		}
+		m, err = conn.Read(b[:n])
+		if err != nil {
+			return err
+		}
+		if bytesRead == 0 {
+			timeFirstByte = time.Now()
+		}
+		bytesRead += m
+	}
+
+	var duration time.Duration
+	if bytesUplink > m {
+		duration = time.Since(timeFirstByte)
+	}
+
+	report := make([]byte, 8)
+	binary.LittleEndian.PutUint64(report, uint64(duration))
+	_, err = conn.Write(report)
+	return err
+}
+
+// NewPingFrame returns a ping frame with sequence number seq.
+func NewPingFrame(seq uint64) []byte {
+	b := make([]byte, PingFrameSize)
+	binary.LittleEndian.PutUint64(b, seq)
+	binary.LittleEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	return b
+}
+
+// PingFrameSeq returns the sequence number of a ping frame.
+func PingFrameSeq(b []byte) (uint64, error) {
+	if len(b) != PingFrameSize {
+		return 0, errors.New("invalid ping frame size")
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// PingClientContext sends count ping frames over conn every interval without
+// waiting for replies, and returns the round trip times of replies received
+// within timeout in the order pings were sent. Pings without reply within
+// timeout are lost, so that len(rtts) < sent measures loss.
+func PingClientContext(ctx context.Context, conn net.Conn, count int, interval, timeout time.Duration) ([]time.Duration, int, error) {
+	frames := make([][]byte, count)
+	sendTime := make([]time.Time, count)
+	rtts := make([]time.Duration, count)
+	var lock sync.Mutex
+	received := 0
+	allReceived := make(chan struct{})
+
+	var readErr error
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		reply := make([]byte, PingFrameSize)
+		for {
+			_, err := io.ReadFull(conn, reply)
+			if err != nil {
+				readErr = err
+				return
+			}
+			seq, err := PingFrameSeq(reply)
+			if err != nil || seq >= uint64(count) {
+				readErr = errors.New("ping reply mismatch")
+				return
+			}
+			lock.Lock()
+			if frames[seq] == nil || !bytes.Equal(reply, frames[seq]) {
+				lock.Unlock()
+				readErr = errors.New("ping reply mismatch")
+				return
+			}
+			if rtt := time.Since(sendTime[seq]); rtts[seq] == 0 && rtt <= timeout {
+				rtts[seq] = rtt
+				received++
+				if received == count {
+					close(allReceived)
+				}
+			}
+			lock.Unlock()
+		}
+	}()
+
+	var err error
+	sent := 0
+	for seq := 0; seq < count && err == nil; seq++ {
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				continue
+			case <-readDone:
+				err = readErr
+				continue
+			case <-time.After(interval):
+			}
+		}
+
+		frame := NewPingFrame(uint64(seq))
+		lock.Lock()
+		frames[seq], sendTime[seq] = frame, time.Now()
+		lock.Unlock()
+		err = conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err != nil {
+			break
+		}
+		_, err = conn.Write(frame)
+		if err != nil {
+			break
+		}
+		sent++
+	}
+
+	if err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-readDone:
+			err = readErr
+		case <-allReceived:
+		case <-time.After(timeout):
+		}
+	}
+	conn.SetReadDeadline(time.Now())
+	<-readDone
+
+	res := make([]time.Duration, 0, sent)
+	for _, rtt := range rtts[:sent] {
+		if rtt > 0 {
+			res = append(res, rtt)
+		}
+	}
+	// the server may close conn right after the last reply
+	if errors.Is(err, io.EOF) && len(res) == sent {
+		err = nil
+	}
+
+	return res, sent, err
+}
+
+// PingServer echoes up to MaxPingCount ping frames until conn is closed or
+// timeout is reached.
+func PingServer(conn net.Conn, timeout time.Duration) error {
+	if timeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	b := make([]byte, PingFrameSize)
+	for i := 0; i < MaxPingCount; i++ {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		_, err = conn.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -25,22 +26,14 @@ func ReadJSON(fileName string, value interface{}) error {
 	return nil
 }
 
+// WriteJSON writes data to a temp file and renames it to path, so path
+// always has either the old or the new content.
 func WriteJSON(path string, data interface{}) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
 	b, err := json.MarshalIndent(data, "", "    ")
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(b)
-	if err != nil {
-		return err
-	}
-	return nil
+	return WriteFileAtomic(path, b, 0644)
 }
 
 func Exists(path string) bool {
@@ -55,36 +48,76 @@ func Exists(path string) bool {
 }
 
 func DownloadJsonFile(ctx context.Context, url, filename string) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	return downloadFile(ctx, url, filename, func(b []byte) error {
+		if !json.Valid(b) {
+			return errors.New("invalid json")
+		}
+		return nil
+	})
+}
+
+func downloadFile(ctx context.Context, url, filename string, validate func([]byte) error) error {
+	b, err := Download(ctx, url, 60*time.Second)
 	if err != nil {
 		return err
 	}
+	if validate != nil {
+		err = validate(b)
+		if err != nil {
+			return err
+		}
+	}
+	return WriteFileAtomic(filename, b, 0644)
+}
+
+// Download returns the body of url, or an error if the response status is
+// not 200.
+func Download(ctx context.Context, url string, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 	client := http.Client{
-		Timeout: 60 * time.Second,
+		Timeout: timeout,
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	b, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s error: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// WriteFileAtomic writes data to a temp file in the same directory and
+// renames it to filename, so readers never see a partially written file.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
 	if err != nil {
 		return err
 	}
-	if !json.Valid(b) {
-		return errors.New("invalid json")
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = f.Write(b)
+
+	err = os.Chmod(tmpName, perm)
 	if err != nil {
-		os.Remove(filename)
 		return err
 	}
-	return nil
+
+	return os.Rename(tmpName, filename)
 }
 
 func DeepCopyMap(value map[string]interface{}) map[string]interface{} {
@@ -0,0 +1,374 @@
+package tuna
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn/v2/common"
+	"github.com/nknorg/tuna/geo"
+)
+
+// ConfigError is a problem of the configuration field at Path, e.g.
+// services.httpproxy.maxPrice. Fields of a service in the services file are
+// under the service name as well, e.g. services.httpproxy.tcp.
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all problems found by Validate. It matches
+// ErrInvalidConfig as well as the error of each problem with errors.Is.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return ErrInvalidConfig.Error() + ": " + strings.Join(s, "; ")
+}
+
+func (e ConfigErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e)+1)
+	errs = append(errs, ErrInvalidConfig)
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// configValidator collects problems of a configuration.
+type configValidator struct {
+	errs  ConfigErrors
+	ports map[string]string // network and port to path using it
+}
+
+func newConfigValidator() *configValidator {
+	return &configValidator{ports: make(map[string]string)}
+}
+
+func (v *configValidator) add(path string, err error) {
+	v.errs = append(v.errs, &ConfigError{Path: path, Err: err})
+}
+
+func (v *configValidator) addf(path string, format string, a ...interface{}) {
+	v.add(path, fmt.Errorf(format, a...))
+}
+
+func (v *configValidator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+func (v *configValidator) price(path, price string) {
+	_, _, err := ParsePrice(price)
+	if err != nil {
+		v.add(path, err)
+	}
+}
+
+func (v *configValidator) fee(path, fee string) {
+	_, err := common.StringToFixed64(fee)
+	if err != nil {
+		v.add(path, fmt.Errorf("%w %q: %v", ErrInvalidFee, fee, err))
+	}
+}
+
+func (v *configValidator) amount(path, amount string) {
+	_, err := common.StringToFixed64(amount)
+	if err != nil {
+		v.addf(path, "invalid amount %q: %v", amount, err)
+	}
+}
+
+func (v *configValidator) walletAddress(path, addr string) {
+	if len(addr) == 0 {
+		return
+	}
+	err := nkn.VerifyWalletAddress(addr)
+	if err != nil {
+		v.addf(path, "invalid wallet address %q: %v", addr, err)
+	}
+}
+
+func (v *configValidator) ip(path, ip string) {
+	if len(ip) > 0 && net.ParseIP(ip) == nil {
+		v.addf(path, "invalid IP %q", ip)
+	}
+}
+
+func (v *configValidator) nonNegative(path string, value float64) {
+	if value < 0 {
+		v.addf(path, "should not be negative")
+	}
+}
+
+// port checks that port is valid and not used by another path. Port 0 means
+// a random port.
+func (v *configValidator) port(path, network string, port int64) {
+	if port < 0 || port > 65535 {
+		v.addf(path, "invalid port %d", port)
+		return
+	}
+	if port == 0 {
+		return
+	}
+	key := network + "/" + strconv.FormatInt(port, 10)
+	if other, ok := v.ports[key]; ok {
+		v.addf(path, "%s port %d is also used by %s", network, port, other)
+		return
+	}
+	v.ports[key] = path
+}
+
+// listenAddr checks an HTTP listen address, which can also be a Unix socket.
+func (v *configValidator) listenAddr(path, addr string) {
+	if len(addr) == 0 || strings.HasPrefix(addr, "unix:") {
+		return
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.add(path, err)
+		return
+	}
+	port, err := strconv.ParseInt(portStr, 10, 64)
+	if err != nil {
+		v.addf(path, "invalid port %q", portStr)
+		return
+	}
+	v.port(path, tcp4, port)
+}
+
+// adminAddr checks that the admin API listens on localhost or a Unix socket.
+func (v *configValidator) adminAddr(path, addr string) {
+	if len(addr) == 0 {
+		return
+	}
+	// invalid addresses are reported by listenAddr
+	if _, _, err := net.SplitHostPort(addr); err != nil && !strings.HasPrefix(addr, adminUnixPrefix) {
+		return
+	}
+	if err := checkAdminAddr(addr); err != nil {
+		v.add(path, err)
+	}
+}
+
+func (v *configValidator) encryption(path, encryption string) {
+	if len(encryption) == 0 {
+		return
+	}
+	_, err := ParseEncryptionAlgo(encryption)
+	if err != nil {
+		v.add(path, err)
+	}
+}
+
+func (v *configValidator) bandwidthDirection(path, direction string) {
+	switch direction {
+	case "", BandwidthDownlink, BandwidthUplink, BandwidthBoth:
+	default:
+		v.addf(path, "unknown bandwidth direction %q", direction)
+	}
+}
+
+func (v *configValidator) selector(path string, conf *SelectorConfig) {
+	if conf == nil || len(conf.Strategy) == 0 {
+		return
+	}
+	_, err := NewSelector(conf)
+	if err != nil {
+		v.add(path+".strategy", err)
+	}
+}
+
+func (v *configValidator) discovery(path string, conf *DiscoveryConfig) {
+	if conf == nil {
+		return
+	}
+	// only creates the backend without using it
+	_, err := NewDiscovery(conf, nil, nil, 0, "", false, nil)
+	if err != nil {
+		v.add(path, err)
+	}
+}
+
+func (v *configValidator) geoProviders(path string, confs []geo.ProviderConfig) {
+	for i, conf := range confs {
+		if !geo.IsProviderRegistered(conf.Type) {
+			v.addf(fmt.Sprintf("%s[%d].type", path, i), "unknown geo provider type %q", conf.Type)
+		}
+	}
+}
+
+// service checks ports and encryption of a service from the services file.
+func (v *configValidator) service(path string, service *Service, checkPorts bool) {
+	v.encryption(path+".encryption", service.Encryption)
+	if !checkPorts {
+		return
+	}
+	for _, port := range service.TCP {
+		v.port(path+".tcp", tcp4, int64(port))
+	}
+	for _, port := range service.UDP {
+		v.port(path+".udp", udp4, int64(port))
+	}
+}
+
+func findService(services []Service, name string) *Service {
+	for i := range services {
+		if services[i].Name == name {
+			return &services[i]
+		}
+	}
+	return nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate checks c and services of the services file used with it, and
+// returns all problems found as ConfigErrors, or nil if there is none.
+func (c *EntryConfiguration) Validate(services []Service) error {
+	conf, err := MergedEntryConfig(c)
+	if err != nil {
+		return err
+	}
+	v := newConfigValidator()
+
+	if conf.Reverse {
+		v.walletAddress("reverseBeneficiaryAddr", conf.ReverseBeneficiaryAddr)
+		v.price("reversePrice", conf.ReversePrice)
+		v.ip("reverseServiceListenIP", conf.ReverseServiceListenIP)
+		v.port("reverseTCP", tcp4, int64(conf.ReverseTCP))
+		v.port("reverseUDP", udp4, int64(conf.ReverseUDP))
+		v.amount("reverseMinFlushAmount", conf.ReverseMinFlushAmount)
+		v.amount("reverseSubscriptionFee", conf.ReverseSubscriptionFee)
+		v.nonNegative("reverseClaimInterval", float64(conf.ReverseClaimInterval))
+		v.nonNegative("reverseSubscriptionDuration", float64(conf.ReverseSubscriptionDuration))
+	} else {
+		if len(conf.Services) == 0 {
+			v.addf("services", "no service configured")
+		}
+		for _, name := range sortedKeys(conf.Services) {
+			path := "services." + name
+			serviceInfo := conf.Services[name]
+			service := findService(services, name)
+			if service == nil {
+				v.addf(path, "service %s not found in services file", name)
+			} else {
+				v.service(path, service, true)
+			}
+			if len(serviceInfo.MaxPrice) > 0 {
+				v.price(path+".maxPrice", serviceInfo.MaxPrice)
+			}
+			v.ip(path+".listenIP", serviceInfo.ListenIP)
+			v.selector(path+".selector", serviceInfo.Selector)
+		}
+		v.fee("nanoPayFee", conf.NanoPayFee)
+		v.fee("minNanoPayFee", conf.MinNanoPayFee)
+		v.nonNegative("nanoPayFeeRatio", conf.NanoPayFeeRatio)
+	}
+
+	v.amount("minBalance", conf.MinBalance)
+	v.bandwidthDirection("bandwidthDirection", conf.BandwidthDirection)
+	v.selector("selector", conf.Selector)
+	v.discovery("discovery", conf.Discovery)
+	v.geoProviders("geoProviders", conf.GeoProviders)
+	v.listenAddr("metricsListenAddr", conf.MetricsListenAddr)
+	v.listenAddr("adminListenAddr", conf.AdminListenAddr)
+	v.adminAddr("adminListenAddr", conf.AdminListenAddr)
+
+	v.nonNegative("dialTimeout", float64(conf.DialTimeout))
+	v.nonNegative("udpTimeout", float64(conf.UDPTimeout))
+	v.nonNegative("measureBandwidthTimeout", float64(conf.MeasureBandwidthTimeout))
+	v.nonNegative("measureBandwidthWorkersTimeout", float64(conf.MeasureBandwidthWorkersTimeout))
+	v.nonNegative("measurePingCount", float64(conf.MeasurePingCount))
+	v.nonNegative("qualityCheckInterval", float64(conf.QualityCheckInterval))
+	v.nonNegative("qualityMinBandwidth", float64(conf.QualityMinBandwidth))
+	v.nonNegative("qualityAlternateInterval", float64(conf.QualityAlternateInterval))
+	v.nonNegative("migrationDrainTimeout", float64(conf.MigrationDrainTimeout))
+
+	return v.err()
+}
+
+// Validate checks c and services of the services file used with it, and
+// returns all problems found as ConfigErrors, or nil if there is none.
+func (c *ExitConfiguration) Validate(services []Service) error {
+	conf, err := MergedExitConfig(c)
+	if err != nil {
+		return err
+	}
+	v := newConfigValidator()
+
+	v.walletAddress("beneficiaryAddr", conf.BeneficiaryAddr)
+
+	if len(conf.Services) == 0 {
+		v.addf("services", "no service configured")
+	}
+	if !conf.Reverse && len(services) > 256 {
+		v.addf("services", "too many services in services file")
+	}
+	for _, name := range sortedKeys(conf.Services) {
+		path := "services." + name
+		service := findService(services, name)
+		if service == nil {
+			v.addf(path, "service %s not found in services file", name)
+		} else {
+			// exits connect to services instead of listening on their ports
+			v.service(path, service, false)
+		}
+		v.price(path+".price", conf.Services[name].Price)
+	}
+
+	if conf.Reverse {
+		if len(conf.ReverseMaxPrice) > 0 {
+			v.price("reverseMaxPrice", conf.ReverseMaxPrice)
+		}
+		v.fee("reverseNanopayfee", conf.ReverseNanoPayFee)
+		v.fee("minReverseNanoPayFee", conf.MinReverseNanoPayFee)
+		v.nonNegative("reverseNanopayfeeRatio", conf.ReverseNanoPayFeeRatio)
+		v.encryption("reverseEncryption", conf.ReverseEncryption)
+		v.amount("reverseMinBalance", conf.ReverseMinBalance)
+	} else {
+		v.port("listenTCP", tcp4, int64(conf.ListenTCP))
+		v.port("listenUDP", udp4, int64(conf.ListenUDP))
+		v.amount("subscriptionFee", conf.SubscriptionFee)
+		v.amount("minFlushAmount", conf.MinFlushAmount)
+		v.nonNegative("subscriptionDuration", float64(conf.SubscriptionDuration))
+		v.nonNegative("claimInterval", float64(conf.ClaimInterval))
+	}
+
+	v.bandwidthDirection("bandwidthDirection", conf.BandwidthDirection)
+	v.discovery("discovery", conf.Discovery)
+	v.geoProviders("geoProviders", conf.GeoProviders)
+	v.listenAddr("metricsListenAddr", conf.MetricsListenAddr)
+	v.listenAddr("adminListenAddr", conf.AdminListenAddr)
+	v.adminAddr("adminListenAddr", conf.AdminListenAddr)
+
+	v.nonNegative("dialTimeout", float64(conf.DialTimeout))
+	v.nonNegative("udpTimeout", float64(conf.UDPTimeout))
+	v.nonNegative("maxBandwidth", float64(conf.MaxBandwidth))
+	v.nonNegative("maxSessions", float64(conf.MaxSessions))
+
+	return v.err()
+}